@@ -0,0 +1,78 @@
+package compiler
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// findLongLiterals returns where the string literals of code longer than
+// threshold bytes are, in order, except in constant and import
+// declarations, where they have to stay literals. Raw strings are left
+// alone, generated code quotes everything.
+func findLongLiterals(code []byte, threshold int) []literalSite {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(code))
+	var s scanner.Scanner
+	s.Init(file, code, nil, 0)
+
+	var sites []literalSite
+	// inside a constant or import declaration, and how many parentheses
+	// deep in it
+	declaring := false
+	depth := 0
+	for {
+		pos, tok, lit := s.Scan()
+		switch tok {
+		case token.EOF:
+			return sites
+		case token.CONST, token.IMPORT:
+			declaring = true
+			depth = 0
+		case token.LPAREN:
+			depth++
+		case token.RPAREN:
+			depth--
+		case token.SEMICOLON:
+			if declaring && depth == 0 {
+				declaring = false
+			}
+		case token.STRING:
+			if declaring || lit[0] != '"' {
+				continue
+			}
+			value, err := strconv.Unquote(lit)
+			if err != nil || len(value) <= threshold {
+				continue
+			}
+			start := file.Offset(pos)
+			sites = append(sites, literalSite{start: start, end: start + len(lit), literal: lit})
+		}
+	}
+}
+
+// externalizeStrings moves the string literals of parts longer than
+// threshold bytes into one string, and replaces them with slices of blob.
+// Each string is in there once, however many times it appears. It returns
+// blob, empty if no literal was long enough, and how many literals were
+// replaced.
+func externalizeStrings(parts []*codePart, threshold int) (string, int) {
+	var blob strings.Builder
+	offsets := make(map[string]int)
+	replaced := 0
+	for _, cp := range parts {
+		replaced += cp.replaceLiterals(findLongLiterals(cp.code, threshold), func(literal string) string {
+			value, _ := strconv.Unquote(literal)
+			offset, ok := offsets[value]
+			if !ok {
+				offset = blob.Len()
+				offsets[value] = offset
+				blob.WriteString(value)
+			}
+			return fmt.Sprintf("blob[%d:%d]", offset, offset+len(value))
+		})
+	}
+	return blob.String(), replaced
+}
@@ -0,0 +1,117 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FindLongLiterals(t *testing.T) {
+	code := []byte(`import (
+	"a/long/import/path"
+)
+
+const GeneratorVersion = "a long constant"
+
+const (
+	a = "another long constant"
+)
+
+var b = "a long variable"
+
+func f() {
+	out = append(out, "short")
+	out = append(out, "\x00 long\tone")
+	rA = gt(r, 0, ` + "`a raw string`" + `, 0)
+	switch string(rs(r, 0, 2)) {
+	case "a long case":
+	}
+}
+`)
+
+	var literals []string
+	for _, site := range findLongLiterals(code, 8) {
+		assert.EqualValues(t, site.literal, string(code[site.start:site.end]))
+		literals = append(literals, site.literal)
+	}
+	assert.EqualValues(t, []string{`"a long variable"`, `"\x00 long\tone"`, `"a long case"`}, literals)
+}
+
+func Test_CompileStringBlob(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "blob")
+	assert.Zero(t, stats.StringsExternalized)
+	plain := buf.String()
+
+	buf.Reset()
+	stats, err = CompileTo(&buf, book, Options{Package: "generated", StringBlobThreshold: 16})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.NotZero(t, stats.StringsExternalized)
+	assert.Contains(t, code, "\nconst blob = \"")
+	assert.Contains(t, code, "var re0 = regexp.MustCompile(blob[")
+	// short strings and constants stay where they are
+	assert.Contains(t, code, `out = append(out, "ELF")`)
+	assert.Contains(t, code, "const GeneratedBookHash = "+strconv.Quote(BookHash(book)))
+	assert.NotContains(t, code, `out = append(out, "Composite Document File V2 Document")`)
+	assert.Contains(t, code, "Composite Document File V2 Document")
+
+	// every string is in there once
+	match := regexp.MustCompile(`(?m)^const blob = (".*")$`).FindStringSubmatch(code)
+	if !assert.NotNil(t, match) {
+		return
+	}
+	blob, err := strconv.Unquote(match[1])
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(blob), stats.BlobSize)
+	assert.EqualValues(t, 1, strings.Count(blob, "Composite Document File V2 Document"))
+	assert.EqualValues(t, 1, strings.Count(blob, "HTML document text"))
+	assert.Less(t, strings.Count(code, "\""), strings.Count(plain, "\""))
+}
+
+func Test_GeneratedStringBlob(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	for _, opts := range []Options{
+		{StringBlobThreshold: 16},
+		{StringBlobThreshold: 1, SelfContained: true, Structured: true},
+		{StringBlobThreshold: 4, PagesPerFile: 2, EmitMatchers: true},
+	} {
+		testGeneratedSamples(t, book, opts, generatedSamples)
+	}
+}
+
+// Test_StringBlobBuildTime reports how long building code with many long
+// strings takes, with and without a blob. It doesn't compare them, that
+// depends on the machine.
+func Test_StringBlobBuildTime(t *testing.T) {
+	var magic strings.Builder
+	for i := 0; i < 300; i++ {
+		long := strings.Repeat(fmt.Sprintf("long description %d, ", i), 12)
+		fmt.Fprintf(&magic, "0\tstring\tLONG%04d\t%s\n", i, long)
+		fmt.Fprintf(&magic, ">8\tsearch/4096\t%s\t\\b, %s\n", strings.Repeat(fmt.Sprintf("pattern%d", i), 16), long)
+	}
+	book := parseBook(t, magic.String())
+
+	var durations []time.Duration
+	for _, threshold := range []int{0, 16} {
+		dir := scratchModule(t, book, Options{StringBlobThreshold: threshold})
+		// only the generated package is timed
+		runGo(t, dir, "build", "github.com/9uanhuo/wizardry/utils")
+		start := time.Now()
+		runGo(t, dir, "build", ".")
+		durations = append(durations, time.Since(start))
+	}
+	t.Logf("go build took %s with literals, %s with a blob", durations[0], durations[1])
+}
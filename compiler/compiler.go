@@ -1,132 +1,622 @@
 package compiler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
 	"github.com/pkg/errors"
 )
 
+// LogFunc receives progress messages from the compiler
+type LogFunc func(format string, args ...interface{})
+
 type indentCallback func()
 
 type ruleNode struct {
+	// id is the index of the rule in its page, labels are named after it
 	id       int64
 	rule     parser.Rule
 	children []*ruleNode
+	// matched is set for string rules merged into a string switch, which
+	// already compared their bytes
+	matched bool
 }
 
-type nodeEmitter func(node *ruleNode, defaultMarker string, prevSibling *ruleNode)
-
 type PageUsage struct {
 	EmitNormal  bool
 	EmitSwapped bool
 }
 
-// Compile generates go code from a spellbook
-func Compile(book parser.Spellbook, output string, chatty bool, emitComments bool, pkg string) error {
-	startTime := time.Now()
+// DefaultRuntimeImportPath is where generated code imports SliceReader,
+// StringTest and SearchTest from, unless told otherwise
+const DefaultRuntimeImportPath = "github.com/9uanhuo/wizardry/utils"
+
+// Options controls what Compile generates
+type Options struct {
+	// Package is the name of the generated package
+	Package string
+
+	// EmitComments adds the source of each rule as a comment above its code,
+	// along with the file and line it comes from, if known
+	EmitComments bool
+
+	// LineDirectives adds a //line directive before the code of each rule
+	// read from a file, so that stack traces and coverage reports point at
+	// the magic instead of the generated code. The code after a rule's, up
+	// to the next directive, is attributed to the rule too.
+	LineDirectives bool
+
+	// SourceRoot is what magic file paths are relative to in comments and
+	// line directives. If it's empty, or doesn't contain a file, only the
+	// name of the file is kept.
+	SourceRoot string
+
+	// Trace makes the generated code declare a Trace hook which, when set,
+	// receives the source of every rule that matches, in the order they're
+	// evaluated in. It's nil by default, so it costs a check per matching
+	// rule until someone sets it.
+	Trace bool
+
+	// HelpersImportPath is the package StringTest, MakeFinder, ReadUint and
+	// StringTestFlags are imported from. Defaults to DefaultRuntimeImportPath.
+	// If it's ReaderImportPath, the package is only imported once.
+	HelpersImportPath string
+
+	// ReaderImportPath is the package SliceReader is imported from, it must
+	// be the one the helpers take, and have a TextHint method. Defaults to
+	// DefaultRuntimeImportPath.
+	ReaderImportPath string
+
+	// SliceReaderAPI makes the exported functions of generated code take a
+	// *SliceReader, as they used to, instead of a Reader: an io.ReaderAt
+	// with a Size method, declared in the generated code, which
+	// *bytes.Reader, *strings.Reader and *io.SectionReader are.
+	SliceReaderAPI bool
+
+	// SelfContained inlines SliceReader and the helpers in the generated
+	// code, which then only imports the standard library. The import paths
+	// are ignored.
+	SelfContained bool
+
+	// InlineReaders emits integer readers that read into a scratch buffer,
+	// one per identification passed along to every page function, instead
+	// of calling ReadUint of the helpers.
+	InlineReaders bool
+
+	// SkipFormat writes the generated code as-is, without running it
+	// through go/format, which also checks that it parses. It's faster.
+	SkipFormat bool
+
+	// EmitMatchers also emits, for every page, an IsXxx function next to
+	// IdentifyXxx, reporting whether one of the top-level rules of the page
+	// matches (for pages, one of the rules right under the name rule). They
+	// return at the first match and build no descriptions, which makes them
+	// cheap format checks. They're listed in Matchers, like pages in Pages.
+	EmitMatchers bool
+
+	// EmitFilter also emits GuessCandidates, which tells which top-level
+	// trees may match a target from its first bytes, and IdentifyFiltered,
+	// which is IdentifyStrings, only running those. Trees are ruled out by
+	// a string or byte test at offset 0, the others always run. See
+	// filterKey.
+	EmitFilter bool
+
+	// SortByStrength emits the top-level trees of the empty page strongest
+	// first, as given by Rule.Strength, which is the order file(1) tries
+	// them in. Trees of the same strength keep the order of the book.
+	SortByStrength bool
+
+	// Structured emits the code of rules as nested if blocks, instead of
+	// jumping to a label when they fail. It's the same code otherwise, and
+	// it identifies the same things, but it's easier to step through, and
+	// to read coverage reports of.
+	Structured bool
+
+	// NoSwitches compiles sibling tests one after the other, instead of
+	// merging them into switches. It's slower, and mostly useful to check
+	// switches against.
+	NoSwitches bool
+
+	// NoOffsetGuards calls string and search tests whatever their offset,
+	// instead of checking first that it's inside the target, which fails
+	// faster. It's slower on targets they don't match, pointers to nowhere
+	// among them, and mostly useful to check guards against.
+	NoOffsetGuards bool
+
+	// ParityMagdir and ParityCorpus make CompileWithOptions and CompileToDir
+	// also emit a test, next to the generated code, which checks that every
+	// file under ParityCorpus is identified the same way by the generated
+	// code and by the interpreter, with the magic files at ParityMagdir.
+	// They should be the ones the book was parsed from. Relative paths are
+	// resolved from the directory of the generated package. See
+	// WriteParityTest.
+	ParityMagdir string
+	ParityCorpus string
+
+	// EmitFuzzTest makes CompileWithOptions and CompileToDir also emit a fuzz
+	// test, next to the generated code, which identifies arbitrary data and
+	// fails if that panics. See WriteFuzzTest.
+	EmitFuzzTest bool
+
+	// OnlyPages restricts the generated code to some of the book: the
+	// top-level trees whose description starts with an entry, the pages
+	// named by one, and every page they use. Compiling fails if an entry
+	// matches nothing. All of the book is compiled when it's empty.
+	OnlyPages []string
+
+	// MaxInputSize, when it's not zero, leaves out the rules that can't
+	// match inputs of at most that many bytes, because they read that far
+	// at a fixed offset, along with the rules under them, and the pages only
+	// they use. Rules at indirect offsets are always kept.
+	MaxInputSize int64
+
+	// SkipUnsupported compiles books with rules the compiler doesn't
+	// support, instead of failing with an *UnsupportedError. Those rules,
+	// and the ones under them, never match in generated code, Stats lists
+	// them.
+	SkipUnsupported bool
+
+	// AllowCycles compiles books whose pages use each other in a loop,
+	// instead of failing with a *UseCycleError. Page functions then take
+	// how deep in uses they are, and give up past maxUseDepth, like file(1)
+	// does, so that the generated code doesn't overflow the stack.
+	AllowCycles bool
+
+	// StringBlobThreshold, when it's not zero, moves the string literals
+	// of the generated code longer than that many bytes, descriptions,
+	// string test values and search patterns among them, into a single
+	// string constant, blob, which the code slices, so that go only has
+	// one big literal to deal with instead of thousands of small ones.
+	// Whether that builds faster depends on the book, the size of page
+	// functions usually matters more. Constants stay as they are.
+	StringBlobThreshold int
+
+	// SingleDispatch emits the code identifying pages as the cases of a
+	// single function, identifyPage, which takes the ID of the page to run
+	// and whether it's swapped, instead of a function per page and
+	// endianness. Uses call it again with the ID of the page they use. The
+	// exported functions stay the same, matchers are still one function per
+	// page. It saves what every function costs, symbols and prologues among
+	// them, for a switch, so whether the binary gets smaller depends on the
+	// book: with a few small pages, it doesn't. CompileToDir puts it all in
+	// one file.
+	SingleDispatch bool
+
+	// MinimalImports makes the generated code import nothing but the
+	// runtime, encoding/binary, and strconv if descriptions are formatted,
+	// so that it builds small with TinyGo, for WebAssembly among others.
+	// Descriptions are formatted by code emitted next to the rules instead
+	// of fmt, scratch buffers aren't pooled, and the runtime compiles
+	// patterns and turns bits into floats, so it must have MustCompileRegex,
+	// Float32FromBits and Float64FromBits. It can't be used with Trace or
+	// SelfContained.
+	MinimalImports bool
+
+	// RuntimeSwap emits the pages used in both byte orders, through \^
+	// uses, once instead of twice: their functions take whether they're
+	// swapped, and pick the byte order of what they read as they run.
+	// Pages used in one byte order keep a function without the branches.
+	// The exported functions stay the same.
+	RuntimeSwap bool
+
+	// PagesPerFile is how many pages CompileToDir puts in each file, it
+	// defaults to one. CompileTo ignores it.
+	PagesPerFile int
+
+	// Incremental makes CompileToDir leave the files whose code would be
+	// the same as it was alone, instead of formatting and writing them
+	// again, so that they keep their modification time. What each file is
+	// generated from is recorded in a manifest next to them, every time,
+	// files that don't match it anymore are written again. CompileTo
+	// ignores it.
+	Incremental bool
+
+	// Logf receives progress messages from the compiler. The compiler
+	// doesn't print anything when it's nil, Stats has what it would say.
+	Logf LogFunc
+}
+
+func (opts Options) logf(format string, args ...interface{}) {
+	if opts.Logf != nil {
+		opts.Logf(format, args...)
+	}
+}
+
+// Stats describes what CompileTo generated
+type Stats struct {
+	// BytesWritten is the size of the generated code
+	BytesWritten int64
+
+	// PagesEmitted counts page functions, pages used with swapped endianness
+	// have a second one, unless RuntimeSwap takes care of both
+	PagesEmitted int
+
+	// RulesCompiled counts rules turned into code, once per page function
+	// they're part of
+	RulesCompiled int
+
+	// RulesSkipped counts rules that were left out because the compiler
+	// doesn't support them, they never match in generated code
+	RulesSkipped int
+
+	// Unsupported are the rules left out with SkipUnsupported, once each,
+	// however many page functions they're part of
+	Unsupported []*RuleError
+
+	// RulesPruned counts rules that were left out because of MaxInputSize
+	RulesPruned int
+
+	// SwitchCases counts rules merged into switches, once per page function
+	// they're part of
+	SwitchCases int
+
+	// DescriptionsDeduplicated counts description literals replaced with
+	// an entry of descs, because they appeared more than once
+	DescriptionsDeduplicated int
+
+	// StringsExternalized counts string literals replaced with a slice of
+	// blob, because of StringBlobThreshold, and BlobSize is its length
+	StringsExternalized int
+	BlobSize            int
+
+	// Pages tells what was generated for each page, in the order they were
+	// emitted, see WriteReport
+	Pages []PageStats
+
+	// FilesKept counts the files CompileToDir left as they were, with
+	// Incremental
+	FilesKept int
+
+	// Duration is how long generating the code took
+	Duration time.Duration
+}
+
+// Compile generates go code from a spellbook, quietly
+func Compile(book parser.Spellbook, output string, trace bool, emitComments bool, pkg string) error {
+	return CompileWithOptions(book, output, Options{
+		Package:      pkg,
+		EmitComments: emitComments,
+		Trace:        trace,
+	})
+}
+
+// CompileWithOptions generates go code from a spellbook into the output file
+func CompileWithOptions(book parser.Spellbook, output string, opts Options) error {
+	_, err := CompileToFile(book, output, opts)
+	return err
+}
 
+// CompileToFile is CompileWithOptions, also returning stats about the
+// generated code
+func CompileToFile(book parser.Spellbook, output string, opts Options) (Stats, error) {
 	f, err := os.Create(output)
 	if err != nil {
-		return errors.WithStack(err)
+		return Stats{}, errors.WithStack(err)
 	}
+	defer f.Close()
 
-	fmt.Println("Generating into:", output)
+	opts.logf("Generating into: %s", output)
 
-	defer f.Close()
+	stats, err := CompileTo(f, book, opts)
+	if err != nil {
+		return stats, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return stats, errors.WithStack(err)
+	}
 
-	lf := []byte("\n")
-	oneIndent := []byte("  ")
-	indentLevel := 0
+	logStats(opts, stats)
 
-	indent := func() {
-		indentLevel++
+	if opts.ParityCorpus != "" {
+		err = writeParityTestFile(parityTestPath(output), opts)
+		if err != nil {
+			return stats, err
+		}
+	}
+	if opts.EmitFuzzTest {
+		err = writeFuzzTestFile(fuzzTestPath(output), book, opts)
 	}
+	return stats, err
+}
+
+// logStats tells how much code was generated. How long it took is only in
+// the stats, so that logs are the same from one run to the next.
+func logStats(opts Options, stats Stats) {
+	opts.logf("Generated code is %.2f KiB", float64(stats.BytesWritten)/1024.0)
+}
 
-	outdent := func() {
-		indentLevel--
+// CompileToDir generates go code from a spellbook into several files in
+// dir, which is created if needed. Code shared by all pages goes to
+// sharedFileName, pages go to files named after pageFilePattern, with
+// opts.PagesPerFile pages in each, and what they're generated from to
+// manifestFileName. Page files left over from a previous run are removed.
+// Splitting the code lets go build compile it in parallel.
+func CompileToDir(dir string, book parser.Spellbook, opts Options) (Stats, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return Stats{}, errors.WithStack(err)
 	}
 
-	emit := func(format string, args ...interface{}) {
-		if format != "" {
-			for i := 0; i < indentLevel; i++ {
-				f.Write(oneIndent)
-			}
-			fmt.Fprintf(f, format, args...)
+	manifestPath := filepath.Join(dir, manifestFileName)
+	previous := make(map[string]manifestEntry)
+	if opts.Incremental {
+		previous, err = readManifest(manifestPath)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	opts.logf("Generating into: %s", dir)
+
+	pagesPerFile := opts.PagesPerFile
+	if pagesPerFile <= 0 {
+		pagesPerFile = 1
+	}
+
+	partName := func(part int) string {
+		if part == 0 {
+			return sharedFileName
+		}
+		return fmt.Sprintf(pageFilePattern, fmt.Sprintf("%03d", part))
+	}
+	hashes := pageHashes(book)
+	manifest := make(map[string]manifestEntry)
+
+	// the file being written, and the hash of what was written to it
+	var f *os.File
+	var written hash.Hash
+	closeFile := func() error {
+		if f == nil {
+			return nil
+		}
+		name := filepath.Base(f.Name())
+		entry := manifest[name]
+		entry.content = hex.EncodeToString(written.Sum(nil))
+		manifest[name] = entry
+		err := f.Close()
+		f = nil
+		return errors.WithStack(err)
+	}
+
+	kept := 0
+	unchanged := func(part int, cp *codePart) bool {
+		name := partName(part)
+		key := partKey(cp, hashes, opts)
+		manifest[name] = manifestEntry{key: key}
+		entry, ok := previous[name]
+		if !ok || entry.key != key || fileHash(filepath.Join(dir, name)) != entry.content {
+			return false
+		}
+		manifest[name] = entry
+		kept++
+		return true
+	}
+	stats, err := compile(book, opts, pagesPerFile, unchanged, func(part int) (io.Writer, error) {
+		err := closeFile()
+		if err != nil {
+			return nil, err
+		}
+
+		f, err = os.Create(filepath.Join(dir, partName(part)))
+		if err != nil {
+			return nil, errors.WithStack(err)
 		}
-		f.Write(lf)
+		written = sha256.New()
+		return io.MultiWriter(f, written), nil
+	})
+	closeErr := closeFile()
+	if err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		return stats, err
+	}
+	stats.FilesKept = kept
 
-	emitLabel := func(label string) {
-		// labels have one less indent than usual
-		for i := 1; i < indentLevel; i++ {
-			f.Write(oneIndent)
+	stale, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf(pageFilePattern, "*")))
+	if err != nil {
+		return stats, errors.WithStack(err)
+	}
+	for _, name := range stale {
+		if _, ok := manifest[filepath.Base(name)]; ok {
+			continue
 		}
-		f.Write([]byte(label))
-		f.WriteString(":")
-		f.Write(lf)
+		err = os.Remove(name)
+		if err != nil {
+			return stats, errors.WithStack(err)
+		}
+	}
+	err = writeManifest(manifestPath, manifest)
+	if err != nil {
+		return stats, err
+	}
+
+	logStats(opts, stats)
+	if opts.Incremental {
+		opts.logf("Kept %d of %d files, they didn't change", kept, len(manifest))
 	}
 
-	withIndent := func(f indentCallback) {
-		indent()
-		f()
-		outdent()
+	if opts.ParityCorpus != "" {
+		err = writeParityTestFile(filepath.Join(dir, parityFileName), opts)
+		if err != nil {
+			return stats, err
+		}
 	}
+	if opts.EmitFuzzTest {
+		err = writeFuzzTestFile(filepath.Join(dir, fuzzFileName), book, opts)
+	}
+	return stats, err
+}
 
-	emit("// this file has been generated by github.com/itchio/wizardry")
-	emit("// from a set of magic rules. you probably don't want to edit it by hand")
-	emit("")
+const (
+	// sharedFileName is where CompileToDir puts code shared by all pages
+	sharedFileName = "wizardry_shared.go"
 
-	emit("package %s", pkg)
-	emit("")
-	emit("import (")
-	withIndent(func() {
-		emit(strconv.Quote("fmt"))
-		emit(strconv.Quote("encoding/binary"))
-		emit(strconv.Quote("github.com/itchio/wizardry/wizardry"))
-		emit(strconv.Quote("github.com/itchio/wizardry/wizardry/utils"))
+	// pageFilePattern is the name of the files CompileToDir puts pages in
+	pageFilePattern = "wizardry_pages_%s.go"
+)
+
+// CompileTo generates go code from a spellbook into w
+func CompileTo(w io.Writer, book parser.Spellbook, opts Options) (Stats, error) {
+	return compile(book, opts, 0, nil, func(part int) (io.Writer, error) {
+		return w, nil
 	})
-	emit(")")
-	emit("")
-
-	emit("// silence import errors, if we don't use string/search etc.")
-	emit("var _ wizardry.StringTestFlags")
-	emit("var _ fmt.State")
-
-	emit("var l binary.ByteOrder=binary.LittleEndian")
-	emit("var b binary.ByteOrder=binary.BigEndian")
-	emit("var gt=wizardry.StringTest")
-	emit("var ht=wizardry.SearchTest")
-	emit("var t=true")
-	emit("var f=false")
-	emit("var tb=make([]byte, 8)")
-	emit("")
-
-	for _, byteWidth := range []byte{1, 2, 4, 8} {
-		for _, endianness := range []parser.Endianness{parser.LittleEndian, parser.BigEndian} {
-			retType := "uint64"
-
-			emit("// reads an unsigned %d-bit %s integer", byteWidth*8, endianness)
-			emit("func f%d%s(r *utils.SliceReader, off int64) (%s, bool) {", byteWidth, endiannessString(endianness, false), retType)
-			withIndent(func() {
-				emit("n,err:=r.ReadAt(tb,int64(off))")
-				emit("if n<%d||err!=nil {return 0,f}", byteWidth)
-				if byteWidth == 1 {
-					emit("return %s(tb[0]),t", retType)
-				} else {
-					emit("return %s(%s.Uint%d(tb)),t", retType, endiannessString(endianness, false), byteWidth*8)
-				}
-			})
-			emit("}")
-			emit("")
+}
+
+// compile generates go code from a spellbook. The code shared by all pages
+// goes to part 0, and so do pages, unless pagesPerFile is set: then they're
+// grouped in parts 1 and up, each with its own package clause and imports.
+// open is called once per part, in order, unless unchanged is set and
+// returns true for the part, given its code before formatting: then it's
+// left as it is.
+func compile(book parser.Spellbook, opts Options, pagesPerFile int, unchanged func(part int, cp *codePart) bool, open func(part int) (io.Writer, error)) (Stats, error) {
+	var stats Stats
+	start := time.Now()
+
+	if opts.MinimalImports {
+		// tracing is for debugging, the inlined runtime imports more
+		if opts.Trace {
+			return stats, errors.New("MinimalImports can't be used with Trace")
+		}
+		if opts.SelfContained {
+			return stats, errors.New("MinimalImports can't be used with SelfContained")
+		}
+	}
+
+	helpersPath := opts.HelpersImportPath
+	if helpersPath == "" {
+		helpersPath = DefaultRuntimeImportPath
+	}
+	readerPath := opts.ReaderImportPath
+	if readerPath == "" {
+		readerPath = DefaultRuntimeImportPath
+	}
+
+	var roots []string
+	if len(opts.OnlyPages) > 0 {
+		total := len(book)
+		var err error
+		book, roots, err = pruneBook(book, opts.OnlyPages)
+		if err != nil {
+			return stats, err
+		}
+		opts.logf("Compiling %d of %d pages", len(book), total)
+	}
+
+	if opts.MaxInputSize > 0 {
+		book, stats.RulesPruned = pruneFarRules(book, opts.MaxInputSize, roots)
+		opts.logf("Pruned %d rules that read past %d bytes", stats.RulesPruned, opts.MaxInputSize)
+	}
+
+	err := checkDivisors(book)
+	if err != nil {
+		return stats, err
+	}
+
+	if unsupported := unsupportedRules(book); len(unsupported) > 0 {
+		if !opts.SkipUnsupported {
+			return stats, &UnsupportedError{Rules: unsupported}
+		}
+		for _, re := range unsupported {
+			opts.logf("Skipping %s", re)
+		}
+		stats.Unsupported = unsupported
+	}
+
+	if !opts.AllowCycles {
+		err = checkUseCycles(book, opts.SourceRoot)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	regexNames, regexPatterns, err := regexVars(book)
+	if err != nil {
+		return stats, err
+	}
+	finderNames, finderKeys := finderVars(book)
+
+	usages := computePagesUsage(book, roots...)
+	readers := usedReaders(book, usages)
+	imports := []string{"fmt"}
+	if opts.InlineReaders {
+		// for the pool of scratch buffers
+		imports = append(imports, "sync")
+	}
+	// with MinimalImports, sf formats descriptions if any has a conversion
+	conversions := false
+	if opts.MinimalImports {
+		imports = nil
+		conversions = hasConversions(book)
+		if conversions {
+			imports = append(imports, "strconv")
+		}
+	}
+	for _, reader := range readers {
+		if reader.byteWidth > 1 {
+			imports = append(imports, "encoding/binary")
+			break
 		}
 	}
+	if len(regexPatterns) > 0 && !opts.MinimalImports {
+		imports = append(imports, "regexp")
+	}
+	floats := usesFamily(book, parser.KindFamilyFloat)
+	if floats && !opts.MinimalImports {
+		imports = append(imports, "math")
+	}
+	guids := usesFamily(book, parser.KindFamilyGuid)
+	if !opts.SliceReaderAPI && !opts.MinimalImports {
+		imports = append(imports, "io")
+	}
+	// qualifiers for the helpers and the reader in generated code, a
+	// single package is imported once
+	hq := "wizardry."
+	rq := "utils."
+	if helpersPath == readerPath {
+		hq = rq
+	}
+	if opts.SelfContained {
+		imports = append(imports, selfContainedImports...)
+		hq = ""
+		rq = ""
+	}
+	// what exported functions take, and how they pass it on to page
+	// functions, which read from a SliceReader
+	api := "Reader"
+	inner := "sl(r)"
+	if opts.SliceReaderAPI {
+		api = "*" + rq + "SliceReader"
+		inner = "r"
+	}
+	// page functions take how deep in uses they are when cycles are
+	// allowed, as dp: this is its declaration, what exported functions
+	// pass, and what uses pass
+	depthParam, depthTop, depthUse := "", "", ""
+	if opts.AllowCycles {
+		depthParam, depthTop, depthUse = ", dp int", ",0", ",dp+1"
+	}
+
+	// tbParam and tbArg declare and pass tb, the scratch buffer inlined
+	// readers read into, there's none otherwise
+	tbParam, tbArg := "", ""
+	if opts.InlineReaders {
+		tbParam, tbArg = ", tb *[8]byte", ",tb"
+	}
 
 	// sort pages
 	var pages []string
@@ -135,404 +625,2027 @@ func Compile(book parser.Spellbook, output string, chatty bool, emitComments boo
 	}
 	sort.Strings(pages)
 
-	usages := computePagesUsage(book)
-
+	// with SingleDispatch, pages are numbered in name order, their cases in
+	// identifyPage are twice that, plus one when swapped
+	pageIDs := make(map[string]int)
 	for _, page := range pages {
-		nodes := treeify(book[page])
-		usage := usages[page]
+		if usage := usages[page]; usage != nil && (usage.EmitNormal || usage.EmitSwapped) {
+			pageIDs[page] = len(pageIDs)
+		}
+	}
 
-		for _, swapEndian := range []bool{false, true} {
-			defaultSeed := 0
+	// page functions are emitted for both endiannesses, as needed, and
+	// once more as matchers, if asked
+	variants := []pageVariant{{swapEndian: false}, {swapEndian: true}}
+	if opts.EmitMatchers {
+		variants = append(variants, pageVariant{swapEndian: false, matcher: true}, pageVariant{swapEndian: true, matcher: true})
+	}
 
-			if swapEndian {
-				if !usage.EmitSwapped {
-					continue
-				}
-			} else {
-				if !usage.EmitNormal {
-					continue
-				}
+	c := &compilation{
+		book:          book,
+		opts:          opts,
+		stats:         stats,
+		helpersPath:   helpersPath,
+		readerPath:    readerPath,
+		hq:            hq,
+		rq:            rq,
+		api:           api,
+		inner:         inner,
+		depthParam:    depthParam,
+		depthTop:      depthTop,
+		depthUse:      depthUse,
+		tbParam:       tbParam,
+		tbArg:         tbArg,
+		usages:        usages,
+		readers:       readers,
+		imports:       imports,
+		regexNames:    regexNames,
+		regexPatterns: regexPatterns,
+		finderNames:   finderNames,
+		finderKeys:    finderKeys,
+		conversions:   conversions,
+		floats:        floats,
+		guids:         guids,
+		pages:         pages,
+		symbols:       pageSymbols(pages),
+		pageIDs:       pageIDs,
+		variants:      variants,
+		render:        renderGoto,
+	}
+	if opts.Structured {
+		c.render = renderStructured
+	}
+	c.cw = &codeWriter{
+		emit:          c.emit,
+		emitLabel:     c.emitLabel,
+		emitDirective: c.emitDirective,
+		withIndent:    c.withIndent,
+		markSource:    c.markSource,
+	}
+
+	c.openPart(0)
+	c.emitShared()
+	c.emitRegistry()
+	c.emitPages(pagesPerFile)
+	c.endPart()
+
+	// descriptions used more than once are emitted once, at the end of
+	// the first part
+	descs, replaced := dedupeDescriptions(c.parts)
+	if len(descs) > 0 {
+		var entries strings.Builder
+		for _, desc := range descs {
+			fmt.Fprintf(&entries, "%s,\n", desc)
+		}
+		decl := strings.Replace(descsDecl, "{\n", "{\n"+entries.String(), 1)
+		c.parts[0].code = append(c.parts[0].code, decl...)
+	}
+	c.stats.DescriptionsDeduplicated = replaced
+
+	if opts.StringBlobThreshold > 0 {
+		blob, replaced := externalizeStrings(c.parts, opts.StringBlobThreshold)
+		if blob != "" {
+			decl := fmt.Sprintf("// blob has the strings longer than %d bytes, the code slices it\nconst blob=%s\n", opts.StringBlobThreshold, strconv.Quote(blob))
+			c.parts[0].code = append(c.parts[0].code, decl...)
+		}
+		c.stats.StringsExternalized = replaced
+		c.stats.BlobSize = len(blob)
+	}
+
+	err = c.writeParts(unchanged, open)
+	if err != nil {
+		return c.stats, err
+	}
+	c.stats.Duration = time.Since(start)
+	return c.stats, nil
+}
+
+// compilation is the state of compile: what it worked out from the book and
+// the options, and the code emitted so far
+type compilation struct {
+	book  parser.Spellbook
+	opts  Options
+	stats Stats
+
+	helpersPath string
+	readerPath  string
+	// qualifiers for the helpers and the reader in generated code, a
+	// single package is imported once
+	hq string
+	rq string
+	// what exported functions take, and how they pass it on to page
+	// functions, which read from a SliceReader
+	api   string
+	inner string
+	// page functions take how deep in uses they are when cycles are
+	// allowed, as dp: this is its declaration, what exported functions
+	// pass, and what uses pass
+	depthParam string
+	depthTop   string
+	depthUse   string
+	// tbParam and tbArg declare and pass tb, the scratch buffer inlined
+	// readers read into, there's none otherwise
+	tbParam string
+	tbArg   string
+
+	usages        map[string]*PageUsage
+	readers       []reader
+	imports       []string
+	regexNames    map[string]string
+	regexPatterns []string
+	finderNames   map[finderKey]string
+	finderKeys    []finderKey
+	// with MinimalImports, sf formats descriptions if any has a conversion
+	conversions bool
+	floats      bool
+	guids       bool
+
+	// pages are the names of the pages of the book, sorted
+	pages   []string
+	symbols map[string]string
+	// with SingleDispatch, pages are numbered in name order, their cases in
+	// identifyPage are twice that, plus one when swapped
+	pageIDs  map[string]int
+	variants []pageVariant
+	render   renderer
+	cw       *codeWriter
+
+	// code is emitted into out one part at a time, parts are kept until
+	// they're all there, so that descriptions can be deduplicated across
+	// them, then formatted and written in order
+	parts       []*codePart
+	out         bytes.Buffer
+	marks       []sourceMark
+	partPages   []string
+	indentLevel int
+	// with SingleDispatch, everything emitted for pages but the code
+	// identifying them is set aside, and comes after identifyPage
+	aside bytes.Buffer
+}
+
+// pageVariant is one of the functions emitted for a page: page functions
+// are emitted for both endiannesses, as needed, and once more as matchers,
+// if asked
+type pageVariant struct {
+	swapEndian bool
+	matcher    bool
+}
+
+// markSource records what the code emitted next is generated from
+func (c *compilation) markSource(format string, args ...interface{}) {
+	c.marks = append(c.marks, sourceMark{
+		offset: c.out.Len(),
+		source: fmt.Sprintf(format, args...),
+	})
+}
+
+// endPart keeps the part emitted so far
+func (c *compilation) endPart() {
+	c.parts = append(c.parts, &codePart{code: append([]byte(nil), c.out.Bytes()...), marks: c.marks, pages: c.partPages})
+	c.out.Reset()
+	c.marks = nil
+	c.partPages = nil
+}
+
+// openPart starts emitting another part, they're numbered in order
+func (c *compilation) openPart(part int) {
+	if part > 0 {
+		c.endPart()
+	}
+}
+
+// writeParts formats the parts and writes them
+func (c *compilation) writeParts(unchanged func(part int, cp *codePart) bool, open func(part int) (io.Writer, error)) error {
+	for part, cp := range c.parts {
+		if unchanged != nil && unchanged(part, cp) {
+			continue
+		}
+
+		code := cp.code
+		if !c.opts.SkipFormat {
+			var err error
+			code, err = formatCode(code, cp.marks)
+			if err != nil {
+				return err
 			}
+		}
 
-			emit("func Identify%s(r *utils.SliceReader, po int64) []string {", pageSymbol(page, swapEndian))
-			withIndent(func() {
-				emit("var out []string")
-				emit("var ss []string; ss=ss[0:]")
-				emit("var gf int64; gf&=gf") // globalOffset
-				emit("var ra uint64; ra&=ra")
-				emit("var rb uint64; rb&=rb")
-				emit("var rc uint64; rc&=rc")
-				emit("var rA int64; rA&=rA")
-				emit("var k bool; k=!!k")
-				emit("var l bool; l=!!l")
-				emit("var m bool; m=!!m")
-				emit("var d=make([]bool, 32); d[0]=!!d[0]")
-				emit("")
-
-				emit("a:=func (args... string) {")
-				withIndent(func() {
-					emit("out=append(out, args...)")
-				})
-				emit("}")
-
-				var emitNode nodeEmitter
-
-				emitNode = func(node *ruleNode, defaultMarker string, prevSiblingNode *ruleNode) {
-					rule := node.rule
-
-					canFail := false
-
-					if emitComments {
-						emit("// %s", rule.Line)
-					}
+		w, err := open(part)
+		if err != nil {
+			return err
+		}
+		n, err := w.Write(code)
+		c.stats.BytesWritten += int64(n)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
 
-					// don't bother emitting global offset if no direct children
-					// have relative offsets. if grandchildren have relative offsets,
-					// they'll be relative to their own parent
-					emitGlobalOffset := false
-					for _, child := range node.children {
-						cof := child.rule.Offset
-						if cof.IsRelative || (cof.OffsetType == parser.OffsetTypeIndirect && cof.Indirect.IsRelative) {
-							emitGlobalOffset = true
-							break
-						}
-					}
+// oneIndent is how much generated code is indented per level, before
+// formatting
+const oneIndent = "  "
 
-					var off Expression
+func (c *compilation) indent() {
+	c.indentLevel++
+}
 
-					// if the previous node has exactly the same offset,
-					// then we can reuse their offset without having to
-					// recomput it (especially if it's indirect)
-					reuseOffset := false
-					if prevSiblingNode != nil {
-						pr := prevSiblingNode.rule
-						reuseOffset = pr.Offset.Equals(rule.Offset)
-					}
+func (c *compilation) outdent() {
+	c.indentLevel--
+}
 
-					switch rule.Offset.OffsetType {
-					case parser.OffsetTypeDirect:
-						off = &BinaryOp{
-							LHS:      &VariableAccess{"po"},
-							Operator: OperatorAdd,
-							RHS:      &NumberLiteral{rule.Offset.Direct},
-						}
-						if rule.Offset.IsRelative {
-							off = &BinaryOp{
-								LHS:      off,
-								Operator: OperatorAdd,
-								RHS:      &VariableAccess{"gf"},
-							}
-						}
-					case parser.OffsetTypeIndirect:
-						indirect := rule.Offset.Indirect
-
-						var offsetAddress Expression = &NumberLiteral{indirect.OffsetAddress}
-						if indirect.IsRelative {
-							offsetAddress = &BinaryOp{
-								LHS:      offsetAddress,
-								Operator: OperatorAdd,
-								RHS:      &VariableAccess{"gf"},
-							}
-						}
-
-						if !reuseOffset {
-							emit("ra,k=f%d%s(r,%s)",
-								indirect.ByteWidth,
-								endiannessString(indirect.Endianness, swapEndian),
-								offsetAddress)
-						}
-						canFail = true
-						emit("if !k {goto %s}", failLabel(node))
-						var offsetAdjustValue Expression = &NumberLiteral{indirect.OffsetAdjustmentValue}
-
-						if indirect.OffsetAdjustmentIsRelative {
-							offsetAdjustAddress := fmt.Sprintf("%s + %s", offsetAddress, quoteNumber(indirect.OffsetAdjustmentValue))
-							emit("rb,l=f%d%s(r,%s)",
-								indirect.ByteWidth,
-								endiannessString(indirect.Endianness, swapEndian),
-								offsetAdjustAddress)
-							emit("if !l {goto %s}", failLabel(node))
-							offsetAdjustValue = &VariableAccess{"int64(rb)"}
-						}
-
-						off = &VariableAccess{"int64(ra)"}
-
-						switch indirect.OffsetAdjustmentType {
-						case parser.AdjustmentAdd:
-							off = &BinaryOp{
-								LHS:      off,
-								Operator: OperatorAdd,
-								RHS:      offsetAdjustValue,
-							}
-						case parser.AdjustmentSub:
-							off = &BinaryOp{
-								LHS:      off,
-								Operator: OperatorSub,
-								RHS:      offsetAdjustValue,
-							}
-						case parser.AdjustmentMul:
-							off = &BinaryOp{
-								LHS:      off,
-								Operator: OperatorMul,
-								RHS:      offsetAdjustValue,
-							}
-						case parser.AdjustmentDiv:
-							off = &BinaryOp{
-								LHS:      off,
-								Operator: OperatorDiv,
-								RHS:      offsetAdjustValue,
-							}
-						}
-
-						if rule.Offset.IsRelative {
-							off = &BinaryOp{
-								LHS:      off,
-								Operator: OperatorAdd,
-								RHS:      &VariableAccess{"gf"},
-							}
-						}
-					}
+func (c *compilation) emit(format string, args ...interface{}) {
+	if format != "" {
+		for i := 0; i < c.indentLevel; i++ {
+			c.out.WriteString(oneIndent)
+		}
+		fmt.Fprintf(&c.out, format, args...)
+	}
+	c.out.WriteByte('\n')
+}
 
-					off = off.Fold()
-
-					switch rule.Kind.Family {
-					case parser.KindFamilySwitch:
-						sk, _ := rule.Kind.Data.(*parser.SwitchKind)
-
-						emit("rc,m=f%d%s(r,%s)",
-							sk.ByteWidth,
-							endiannessString(sk.Endianness, swapEndian),
-							off,
-						)
-
-						canFail = true
-						emit("switch rc {")
-						withIndent(func() {
-							for _, c := range sk.Cases {
-								emit("case %d: a(%s)", c.Value, strconv.Quote(string(c.Description)))
-							}
-							emit("default: {goto %s}", failLabel(node))
-						})
-						emit("}")
-
-					case parser.KindFamilyInteger:
-						ik, _ := rule.Kind.Data.(*parser.IntegerKind)
-
-						if !ik.MatchAny {
-							reuseSibling := false
-							if prevSiblingNode != nil {
-								pr := prevSiblingNode.rule
-								if pr.Offset.Equals(rule.Offset) && pr.Kind.Family == parser.KindFamilyInteger {
-									pik, _ := pr.Kind.Data.(*parser.IntegerKind)
-									if pik.ByteWidth == ik.ByteWidth {
-										reuseSibling = true
-									}
-								}
-							}
-
-							if !reuseSibling {
-								emit("rc,m=f%d%s(r,%s)",
-									ik.ByteWidth,
-									endiannessString(ik.Endianness, swapEndian),
-									off,
-								)
-							}
-
-							lhs := "rc"
-
-							operator := "=="
-							switch ik.IntegerTest {
-							case parser.IntegerTestEqual:
-								operator = "=="
-							case parser.IntegerTestNotEqual:
-								operator = "!="
-							case parser.IntegerTestLessThan:
-								operator = "< "
-							case parser.IntegerTestGreaterThan:
-								operator = ">"
-							}
-
-							if ik.Signed && (ik.IntegerTest == parser.IntegerTestGreaterThan || ik.IntegerTest == parser.IntegerTestLessThan) {
-								lhs = fmt.Sprintf("int64(int%d(%s))", ik.ByteWidth*8, lhs)
-							}
-
-							if ik.DoAnd {
-								lhs = fmt.Sprintf("%s&%s", lhs, quoteNumber(int64(ik.AndValue)))
-							}
-
-							switch ik.AdjustmentType {
-							case parser.AdjustmentAdd:
-								lhs = fmt.Sprintf("(%s+%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							case parser.AdjustmentSub:
-								lhs = fmt.Sprintf("(%s-%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							case parser.AdjustmentMul:
-								lhs = fmt.Sprintf("(%s*%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							case parser.AdjustmentDiv:
-								lhs = fmt.Sprintf("(%s/%s)", lhs, quoteNumber(ik.AdjustmentValue))
-							}
-
-							rhs := quoteNumber(ik.Value)
-
-							ruleTest := fmt.Sprintf("m&&%s%s%s", lhs, operator, rhs)
-							canFail = true
-							emit("if !(%s) {goto %s}", ruleTest, failLabel(node))
-						}
-						if emitGlobalOffset {
-							gfValue := &BinaryOp{
-								LHS:      off,
-								Operator: OperatorAdd,
-								RHS:      &NumberLiteral{int64(ik.ByteWidth)},
-							}
-							emit("gf=%s", gfValue.Fold())
-						}
-					case parser.KindFamilyString:
-						sk, _ := rule.Kind.Data.(*parser.StringKind)
-						emit("rA = gt(r,%s,%s,%d)", off, strconv.Quote(string(sk.Value)), sk.Flags)
-						canFail = true
-						if sk.Negate {
-							emit("if rA>=0 {goto %s}", failLabel(node))
-						} else {
-							emit("if rA<0 {goto %s}", failLabel(node))
-						}
-						if emitGlobalOffset {
-							gfValue := &BinaryOp{
-								LHS:      off,
-								Operator: OperatorAdd,
-								RHS:      &VariableAccess{"rA"},
-							}
-							emit("gf=%s", gfValue.Fold())
-						}
-
-					case parser.KindFamilySearch:
-						sk, _ := rule.Kind.Data.(*parser.SearchKind)
-						emit("rA=ht(r,%s,%s,%s)", off, quoteNumber(int64(sk.MaxLen)), strconv.Quote(string(sk.Value)))
-						canFail = true
-						emit("if rA<0 {goto %s}", failLabel(node))
-						if emitGlobalOffset {
-							gfValue := &BinaryOp{
-								LHS:      off,
-								Operator: OperatorAdd,
-								RHS: &BinaryOp{
-									LHS:      &VariableAccess{"rA"},
-									Operator: OperatorAdd,
-									RHS:      &NumberLiteral{int64(len(sk.Value))},
-								},
-							}
-							emit("gf=%s", gfValue.Fold())
-						}
-
-					case parser.KindFamilyUse:
-						uk, _ := rule.Kind.Data.(*parser.UseKind)
-						emit("a(Identify%s(r,%s)...)", pageSymbol(uk.Page, uk.SwapEndian), off)
-
-					case parser.KindFamilyName:
-						// do nothing, pretty much
-
-					case parser.KindFamilyClear:
-						// reset defaultMarker for this level
-						if defaultMarker == "" {
-							panic("compiler error: nil defaultMarker for clear rule")
-						}
-						emit("%s=f", defaultMarker)
-
-					case parser.KindFamilyDefault:
-						// only succeed if defaultMarker is unset
-						// (so, fail if it's set)
-						if defaultMarker == "" {
-							panic("compiler error: nil defaultMarker for default rule")
-						}
-						canFail = true
-						emit("if %s {goto %s}", defaultMarker, failLabel(node))
-						if emitGlobalOffset {
-							emit("gf=%s", off)
-						}
-
-					default:
-						emit("// fixme: unhandled %s", rule.Kind)
-						canFail = true
-						emit("goto %s", failLabel(node))
-					}
+func (c *compilation) emitLabel(label string) {
+	// labels have one less indent than usual
+	for i := 1; i < c.indentLevel; i++ {
+		c.out.WriteString(oneIndent)
+	}
+	c.out.WriteString(label)
+	c.out.WriteString(":")
+	c.out.WriteByte('\n')
+}
 
-					if chatty {
-						emit("fmt.Printf(\"%%s\\n\", %s)", strconv.Quote(rule.Line))
-					}
-					if len(rule.Description) > 0 {
-						emit("a(%s)", strconv.Quote(string(rule.Description)))
-					}
+func (c *compilation) emitDirective(directive string) {
+	c.out.WriteString(directive)
+	c.out.WriteByte('\n')
+}
 
-					numChildren := len(node.children)
-					childDefaultMarker := ""
-
-					if numChildren > 0 {
-						for _, child := range node.children {
-							if child.rule.Kind.Family == parser.KindFamilyDefault {
-								childDefaultMarker = fmt.Sprintf("d[%d]", rule.Level)
-								defaultSeed++
-								emit("%s=f", childDefaultMarker)
-								break
-							}
-						}
-
-						var prevSibling = node
-						for _, child := range node.children {
-							emitNode(child, childDefaultMarker, prevSibling)
-							prevSibling = child
-						}
-					}
+func (c *compilation) withIndent(f indentCallback) {
+	c.indent()
+	f()
+	c.outdent()
+}
 
-					if defaultMarker != "" {
-						emit("%s=t", defaultMarker)
-					}
+// emitHeader emits the package clause and imports of a part
+func (c *compilation) emitHeader(imports []string, helpers bool, reader bool) {
+	c.emit("// this file has been generated by github.com/9uanhuo/wizardry")
+	c.emit("// from a set of magic rules. you probably don't want to edit it by hand")
+	c.emit("")
 
-					if canFail {
-						emitLabel(failLabel(node))
-					}
-				}
+	c.emit("package %s", c.opts.Package)
+	c.emit("")
+	if len(imports) == 0 && (c.opts.SelfContained || !(helpers || reader)) {
+		return
+	}
+	c.emit("import (")
+	c.withIndent(func() {
+		sort.Strings(imports)
+		for i, imp := range imports {
+			if i > 0 && imports[i-1] == imp {
+				continue
+			}
+			c.emit(strconv.Quote(imp))
+		}
+		if !c.opts.SelfContained && (helpers || reader) {
+			c.emit("")
+			if helpers && c.helpersPath != c.readerPath {
+				c.emit("wizardry %s", strconv.Quote(c.helpersPath))
+			}
+			if reader || (helpers && c.helpersPath == c.readerPath) {
+				c.emit("utils %s", strconv.Quote(c.readerPath))
+			}
+		}
+	})
+	c.emit(")")
+	c.emit("")
+}
 
-				for _, node := range nodes {
-					switchify(node)
+// emitShared emits what every page function uses: the constants, the
+// helpers and readers, and the types of the API
+func (c *compilation) emitShared() {
+	c.emitHeader(c.imports, true, true)
+
+	c.emit("// GeneratedFromRuleCount is how many rules the code was generated from")
+	c.emit("const GeneratedFromRuleCount=%d", countBookRules(c.book))
+	c.emit("")
+	c.emit("// GeneratedBookHash identifies the rules the code was generated from, it's")
+	c.emit("// what compiler.BookHash returns for them")
+	c.emit("const GeneratedBookHash=%s", strconv.Quote(BookHash(c.book)))
+	c.emit("")
+	c.emit("// GeneratorVersion is the version of wizardry the code was generated with")
+	c.emit("const GeneratorVersion=%s", strconv.Quote(GeneratorVersion()))
+	c.emit("")
+	if files := sourceFiles(c.book, c.opts.SourceRoot); len(files) > 0 {
+		c.emit("// GeneratedFromFiles are the magic files the rules were read from")
+		c.emit("var GeneratedFromFiles=[]string{")
+		c.withIndent(func() {
+			for _, file := range files {
+				c.emit("%s,", strconv.Quote(file))
+			}
+		})
+		c.emit("}")
+		c.emit("")
+	}
 
-					emitNode(node, "", nil)
-				}
+	if !c.opts.MinimalImports {
+		c.emit("var sf=fmt.Sprintf")
+	}
+	c.emit("var gt=%sStringTest", c.hq)
+	c.emit("var xt=%sRegexTest", c.hq)
+	c.emit("var dt=%sFormatDate", c.hq)
+	c.emit("var ut=%sString16Test", c.hq)
+	c.emit("var uu=%sString16End", c.hq)
+	c.emit("var ud=%sDecodeString16", c.hq)
+	c.emit("const (du=%sDateFormatUnix; dd=%sDateFormatDOSDate; dm=%sDateFormatDOSTime)", c.hq, c.hq, c.hq)
+	c.emit("var t=true")
+	c.emit("var f=false")
+	c.emit("")
+	if c.opts.InlineReaders && !c.opts.MinimalImports {
+		c.emit("// scratch buffers for reading integers, one per identification so that")
+		c.emit("// identifying from several goroutines at once is safe")
+		c.emit("var tbPool=sync.Pool{New: func() interface{} {return new([8]byte)}}")
+		c.emit("")
+	}
+	if c.opts.AllowCycles {
+		c.emit("// pages used deeper than that find nothing, pages using each other")
+		c.emit("// in a loop would overflow the stack otherwise")
+		c.emit("const maxUseDepth=%d", maxUseDepth)
+		c.emit("")
+	}
+	c.emit("// Result is what identification found: description fragments, and the")
+	c.emit("// MIME type of the matching rules, if any")
+	c.emit("type Result struct {")
+	c.withIndent(func() {
+		c.emit("Descriptions []string")
+		c.emit("MIME string")
+	})
+	c.emit("}")
+	c.emit("")
+
+	if !c.opts.SliceReaderAPI {
+		c.emit("// Reader is what identification reads from, e.g. a *bytes.Reader, or a")
+		c.emit("// file in an *io.SectionReader")
+		c.emit("type Reader interface {")
+		c.withIndent(func() {
+			if c.opts.MinimalImports {
+				c.emit("ReadAt(p []byte, off int64) (n int, err error)")
+			} else {
+				c.emit("io.ReaderAt")
+			}
+			c.emit("Size() int64")
+		})
+		c.emit("}")
+		c.emit("")
+		c.emit("// sl returns r as a SliceReader, which page functions read through")
+		c.emit("func sl(r Reader) *%sSliceReader {", c.rq)
+		c.withIndent(func() {
+			c.emit("if sr,ok:=r.(*%sSliceReader); ok {return sr}", c.rq)
+			c.emit("return %sNewSliceReader(r,0,r.Size())", c.rq)
+		})
+		c.emit("}")
+		c.emit("")
+	}
 
-				emit("return out")
-			})
-			emit("}")
-			emit("")
+	if c.opts.Trace {
+		c.emit("// Trace, when set, receives the source of every rule that matches, as")
+		c.emit("// identification goes. Set it before identifying anything.")
+		c.emit("var Trace func(line string)")
+		c.emit("")
+	}
+
+	if len(c.regexPatterns) > 0 {
+		c.emit("// compiled patterns of regex rules")
+		for _, pattern := range c.regexPatterns {
+			if c.opts.MinimalImports {
+				c.emit("var %s=%sMustCompileRegex(%s)", c.regexNames[pattern], c.hq, strconv.Quote(pattern))
+			} else {
+				c.emit("var %s=regexp.MustCompile(%s)", c.regexNames[pattern], strconv.Quote(pattern))
+			}
 		}
+		c.emit("")
+	}
+
+	if len(c.finderKeys) > 0 {
+		c.emit("// finders of search rules, prepared once")
+		for _, key := range c.finderKeys {
+			c.emit("var %s=%sMakeFinder(%s,%d)", c.finderNames[key], c.hq, strconv.Quote(key.pattern), key.flags)
+		}
+		c.emit("// ht is SearchTest, through the finder of the rule")
+		c.emit("func ht(r *%sSliceReader, off int64, maxLen int64, hf *%sFinder, flags %sStringTestFlags) (int64, int64) {", c.rq, c.hq, c.hq)
+		c.withIndent(func() {
+			c.emit("if %sTargetExcluded(flags) {return -1,0}", c.hq)
+			c.emit("return hf.Find(r,off,maxLen)")
+		})
+		c.emit("}")
+		c.emit("")
+	}
 
+	if c.floats {
+		c.emit("// reinterpret the bits read by float and double tests")
+		if c.opts.MinimalImports {
+			c.emit("var g4=%sFloat32FromBits", c.hq)
+			c.emit("var g8=%sFloat64FromBits", c.hq)
+		} else {
+			c.emit("func g4(v uint64) float64 {return float64(math.Float32frombits(uint32(v)))}")
+			c.emit("func g8(v uint64) float64 {return math.Float64frombits(v)}")
+		}
+		c.emit("")
 	}
 
-	fmt.Printf("Compiled in %s\n", time.Since(startTime))
+	if c.guids {
+		c.emit("// tells whether the %d bytes at off are the GUID g, any GUID if g is empty", utils.GUIDSize)
+		c.emit("func gq(r *%sSliceReader, off int64, g string) bool {", c.rq)
+		c.withIndent(func() {
+			c.emit("if off<0||off+%d>r.Size() {return f}", utils.GUIDSize)
+			c.emit("var b [%d]byte", utils.GUIDSize)
+			c.emit("n,_:=r.ReadAt(b[:],off)")
+			c.emit("return n==%d&&(g==\"\"||string(b[:])==g)", utils.GUIDSize)
+		})
+		c.emit("}")
+		c.emit("var gs=%sFormatGUID", c.hq)
+		c.emit("")
+	}
 
-	fSize, _ := f.Seek(0, io.SeekCurrent)
-	fmt.Printf("Generated code is %.2f KiB\n", float64(fSize)/1024.0)
+	if c.opts.SelfContained {
+		c.out.WriteString(selfContainedRuntime)
+		c.emit("")
+	}
+	if c.conversions {
+		c.out.WriteString(sprintfRuntime)
+		c.emit("")
+	}
 
-	return nil
+	c.emit("// reads the bytes a string test matched, to format them")
+	c.emit("func rs(r *%sSliceReader, off int64, end int64) []byte {", c.rq)
+	c.withIndent(func() {
+		c.emit("if end-off>%d {end=off+%d}", utils.MaxFormattedString, utils.MaxFormattedString)
+		c.emit("b:=make([]byte, end-off)")
+		c.emit("n,_:=r.ReadAt(b,off)")
+		c.emit("return b[:n]")
+	})
+	c.emit("}")
+	c.emit("")
+
+	for _, rd := range c.readers {
+		c.emit("// reads an unsigned %d-bit %s integer", rd.byteWidth*8, rd.endianness)
+		c.emit("func %s(r *%sSliceReader%s, off int64) (uint64, bool) {", rd.name(), c.rq, c.tbParam)
+		c.withIndent(func() {
+			order := "nil"
+			if rd.byteWidth > 1 {
+				order = "binary.LittleEndian"
+				if rd.endianness == parser.BigEndian {
+					order = "binary.BigEndian"
+				}
+			}
+			if !c.opts.InlineReaders {
+				c.emit("return %sReadUint(r,off,%d,%s)", c.hq, rd.byteWidth, order)
+				return
+			}
+			c.emit("n,_:=r.ReadAt(tb[:%d],int64(off))", rd.byteWidth)
+			c.emit("if n<%d {return 0,f}", rd.byteWidth)
+			if rd.byteWidth == 1 {
+				c.emit("return uint64(tb[0]),t")
+			} else {
+				c.emit("return uint64(%s.Uint%d(tb[:%d])),t", order, rd.byteWidth*8, rd.byteWidth)
+			}
+		})
+		c.emit("}")
+		c.emit("")
+	}
+	if c.opts.RuntimeSwap {
+		for _, rd := range swapReaders(c.book, c.usages) {
+			swapped := reader{byteWidth: rd.byteWidth, endianness: rd.endianness.MaybeSwapped(true)}
+			c.emit("// reads an unsigned %d-bit %s integer, %s if swap is set", rd.byteWidth*8, rd.endianness, swapped.endianness)
+			c.emit("func %s(r *%sSliceReader%s, off int64, swap bool) (uint64, bool) {", rd.swapName(), c.rq, c.tbParam)
+			c.withIndent(func() {
+				c.emit("if swap {return %s(r%s,off)}", swapped.name(), c.tbArg)
+				c.emit("return %s(r%s,off)", rd.name(), c.tbArg)
+			})
+			c.emit("}")
+			c.emit("")
+		}
+	}
 }
 
-func pageSymbol(page string, swapEndian bool) string {
-	result := ""
-	for _, token := range strings.Split(page, "-") {
-		result += strings.Title(token)
+// emitScratch declares tb, the scratch buffer of an identification
+func (c *compilation) emitScratch() {
+	if !c.opts.InlineReaders {
+		return
+	}
+	if c.opts.MinimalImports {
+		c.emit("tb:=new([8]byte)")
+		return
 	}
+	c.emit("tb:=tbPool.Get().(*[8]byte)")
+	c.emit("defer tbPool.Put(tb)")
+}
 
+// pageSymbol returns what the functions of page are named after
+func (c *compilation) pageSymbol(page string, swapEndian bool) string {
+	symbol, ok := c.symbols[page]
+	if !ok {
+		// used, but not in the book
+		symbol = manglePageName(page)
+	}
 	if swapEndian {
-		result += "__Swapped"
+		symbol += "__Swapped"
 	}
+	return symbol
+}
 
-	return result
+// swapsAtRuntime tells whether page has one function for both byte
+// orders, which takes whether it's swapped first: with RuntimeSwap, pages
+// used in both byte orders do
+func (c *compilation) swapsAtRuntime(page string) bool {
+	usage := c.usages[page]
+	return c.opts.RuntimeSwap && usage != nil && usage.EmitNormal && usage.EmitSwapped
 }
 
-func endiannessString(en parser.Endianness, swapEndian bool) string {
-	if en.MaybeSwapped(swapEndian) == parser.BigEndian {
-		return "b"
+// pageCall returns the call to the function of page starting with
+// prefix, swapped as swap says, t, f, or an expression when the caller
+// swaps at run time, with args
+func (c *compilation) pageCall(prefix string, page string, swap string, args string) string {
+	if c.swapsAtRuntime(page) {
+		return fmt.Sprintf("%s%s(%s,%s)", prefix, c.pageSymbol(page, false), swap, args)
 	}
-	return "l"
+	return fmt.Sprintf("%s%s(%s)", prefix, c.pageSymbol(page, swap == "t"), args)
 }
 
-func quoteNumber(number int64) string {
-	return fmt.Sprintf("%d", number)
+// identifyCall returns the call identifying page with args, the reader
+// to the maximum, then cd, which only the top-level page takes, and
+// depth. identifyPage takes cd for every page when filtering.
+func (c *compilation) identifyCall(page string, swap string, args string, cd string, depth string) string {
+	if !c.opts.SingleDispatch {
+		return c.pageCall("identify", page, swap, args+cd+depth)
+	}
+	if cd == "" && c.opts.EmitFilter {
+		cd = ",nil"
+	}
+	id, ok := c.pageIDs[page]
+	if !ok {
+		// used, but not in the book: no case runs
+		id = -1
+	}
+	return fmt.Sprintf("identifyPage(%d,%s,%s%s%s)", id, swap, args, cd, depth)
+}
+
+// emitRegistry emits the list of pages, the maps of the functions
+// identifying them, and the functions identifying with the whole book
+func (c *compilation) emitRegistry() {
+	c.emit("// pages and the functions identifying them:")
+	for _, page := range c.pages {
+		usage := c.usages[page]
+		if usage == nil {
+			continue
+		}
+		if usage.EmitNormal {
+			c.emit("//   %s: Identify%s", strconv.Quote(page), c.pageSymbol(page, false))
+		}
+		if usage.EmitSwapped {
+			c.emit("//   %s, swapped: Identify%s", strconv.Quote(page), c.pageSymbol(page, true))
+		}
+	}
+	c.emit("")
+
+	c.emit("// Pages maps the names of pages to the functions identifying them,")
+	c.emit("// swapped variants have a \"^\" appended")
+	c.emit("var Pages = map[string]func(r %s, po int64) []string{", c.api)
+	c.withIndent(func() {
+		for _, page := range c.pages {
+			usage := c.usages[page]
+			if usage == nil {
+				continue
+			}
+			if usage.EmitNormal {
+				c.emit("%s: Identify%s,", strconv.Quote(page), c.pageSymbol(page, false))
+			}
+			if usage.EmitSwapped {
+				c.emit("%s: Identify%s,", strconv.Quote(page+"^"), c.pageSymbol(page, true))
+			}
+		}
+	})
+	c.emit("}")
+	c.emit("")
+
+	if c.opts.EmitMatchers {
+		c.emit("// Matchers maps the names of pages to the functions telling whether")
+		c.emit("// they match, keyed like Pages")
+		c.emit("var Matchers = map[string]func(r %s, po int64) bool{", c.api)
+		c.withIndent(func() {
+			for _, page := range c.pages {
+				usage := c.usages[page]
+				if usage == nil {
+					continue
+				}
+				if usage.EmitNormal {
+					c.emit("%s: Is%s,", strconv.Quote(page), c.pageSymbol(page, false))
+				}
+				if usage.EmitSwapped {
+					c.emit("%s: Is%s,", strconv.Quote(page+"^"), c.pageSymbol(page, true))
+				}
+			}
+		})
+		c.emit("}")
+		c.emit("")
+	}
+
+	if usage := c.usages[""]; usage != nil && usage.EmitNormal {
+		c.emit("// IdentifyStrings identifies r with the whole book, and returns the")
+		c.emit("// descriptions found, like the interpreter does")
+		c.emit("func IdentifyStrings(r %s) []string {", c.api)
+		c.withIndent(func() {
+			c.emit("return Identify%s(r,0)", c.pageSymbol("", false))
+		})
+		c.emit("}")
+		c.emit("")
+		c.emit("// IdentifyStringsMax is IdentifyStrings, stopping once it found max")
+		c.emit("// descriptions, or not at all if max is 0 or less")
+		c.emit("func IdentifyStringsMax(r %s, max int) []string {", c.api)
+		c.withIndent(func() {
+			c.emit("return Identify%s__Max(r,0,max).Descriptions", c.pageSymbol("", false))
+		})
+		c.emit("}")
+		c.emit("")
+		c.emit("// IdentifyString is IdentifyStrings, with the descriptions merged into")
+		c.emit("// one, e.g. \"ELF 64-bit LSB executable\"")
+		c.emit("func IdentifyString(r %s) string {", c.api)
+		c.withIndent(func() {
+			c.emit("return %sMergeStrings(IdentifyStrings(r))", c.hq)
+		})
+		c.emit("}")
+		c.emit("")
+	}
+}
+
+// emitFilter emits what IdentifyFiltered needs to pick the top-level
+// trees, nodes, to run
+func (c *compilation) emitFilter(filter *treeFilter, nodes []*ruleNode) {
+	c.emit("// treeLines are the first lines of the top-level trees, in the order")
+	c.emit("// they run, treeSlots where they are in what gc fills, -1 if they")
+	c.emit("// always run")
+	c.emit("var treeLines=[...]string{")
+	c.withIndent(func() {
+		for _, node := range nodes {
+			c.emit("%s,", strconv.Quote(node.rule.Line))
+		}
+	})
+	c.emit("}")
+	c.emit("var treeSlots=[...]int{")
+	c.withIndent(func() {
+		for _, slot := range filter.slots {
+			c.emit("%d,", slot)
+		}
+	})
+	c.emit("}")
+	c.emit("")
+
+	c.emit("// gc tells which top-level trees may match a target starting with p")
+	c.emit("func gc(p []byte, cd *[%d]bool) {", len(filter.keys))
+	c.withIndent(func() {
+		for i, key := range filter.keys {
+			c.emit("cd[%d]=%s", i, filterCheck(key))
+		}
+	})
+	c.emit("}")
+	c.emit("")
+
+	c.emit("// GuessCandidates returns the first lines of the top-level trees that")
+	c.emit("// may match a target starting with prefix, in the order they run:")
+	c.emit("// those it doesn't rule out, and those it can't tell about. prefix")
+	c.emit("// should have the first %d bytes of the target, or all of it.", filter.prefixSize)
+	c.emit("func GuessCandidates(prefix []byte) []string {")
+	c.withIndent(func() {
+		c.emit("var cd [%d]bool", len(filter.keys))
+		c.emit("gc(prefix,&cd)")
+		c.emit("var c []string")
+		c.emit("for i, line := range treeLines {")
+		c.withIndent(func() {
+			c.emit("if s:=treeSlots[i]; s<0||cd[s] {c=append(c,line)}")
+		})
+		c.emit("}")
+		c.emit("return c")
+	})
+	c.emit("}")
+	c.emit("")
+
+	c.emit("// IdentifyFiltered is IdentifyStrings, only running the top-level trees")
+	c.emit("// GuessCandidates returns for the first bytes of r")
+	c.emit("func IdentifyFiltered(r %s) []string {", c.api)
+	c.withIndent(func() {
+		c.emit("var p [%d]byte", filter.prefixSize)
+		c.emit("n,_:=r.ReadAt(p[:],0)")
+		c.emit("var cd [%d]bool", len(filter.keys))
+		c.emit("gc(p[:n],&cd)")
+		c.emitScratch()
+		c.emit("o,_:=%s", c.identifyCall("", "f", c.inner+c.tbArg+",0,0", ",&cd", c.depthTop))
+		c.emit("return o")
+	})
+	c.emit("}")
+	c.emit("")
+}
+
+// setAside moves what was emitted since from aside
+func (c *compilation) setAside(from int) {
+	c.aside.Write(c.out.Bytes()[from:])
+	c.out.Truncate(from)
+	for len(c.marks) > 0 && c.marks[len(c.marks)-1].offset > from {
+		c.marks = c.marks[:len(c.marks)-1]
+	}
+}
+
+// emitPages emits the functions of the pages used, with SingleDispatch as
+// cases of identifyPage
+func (c *compilation) emitPages(pagesPerFile int) {
+	if c.opts.SingleDispatch {
+		filterParam := ""
+		if c.opts.EmitFilter {
+			filterParam = fmt.Sprintf(", cd *[%d]bool", len(newTreeFilter(treeify(c.book[""])).keys))
+		}
+		c.emit("// identifyPage runs the page whose ID is id, swapped if swap is set,")
+		c.emit("// every page is one of its cases")
+		c.emit("func identifyPage(id int, swap bool, r *%sSliceReader%s, po int64, mx int%s%s) ([]string, string) {", c.rq, c.tbParam, filterParam, c.depthParam)
+		c.indent()
+		c.emit("sv:=id*2")
+		c.emit("if swap {sv++}")
+		c.emit("switch sv {")
+	}
+
+	pageIndex := 0
+	for _, page := range c.pages {
+		usage := c.usages[page]
+		if usage == nil || (!usage.EmitNormal && !usage.EmitSwapped) {
+			// nothing uses that page
+			continue
+		}
+		if pagesPerFile > 0 && pageIndex%pagesPerFile == 0 && !c.opts.SingleDispatch {
+			c.openPart(pageIndex/pagesPerFile + 1)
+			// pages in split parts only need the reader
+			c.emitHeader(nil, false, true)
+		}
+		pageIndex++
+		c.emitPage(page)
+	}
+
+	if c.opts.SingleDispatch {
+		c.emit("}")
+		c.emit("return nil, \"\"")
+		c.outdent()
+		c.emit("}")
+		c.emit("")
+		c.out.Write(c.aside.Bytes())
+	}
+}
+
+// emitPage emits the variants of the functions of page, and its filter
+// if it's the top-level page
+func (c *compilation) emitPage(page string) {
+	nodes := treeify(c.book[page])
+	usage := c.usages[page]
+	if page == "" && c.opts.SortByStrength {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].rule.Strength() > nodes[j].rule.Strength()
+		})
+	}
+
+	// the top-level page takes the trees the filter kept
+	var filter *treeFilter
+	if page == "" && c.opts.EmitFilter {
+		filter = newTreeFilter(nodes)
+	}
+
+	c.partPages = append(c.partPages, page)
+
+	ps := PageStats{
+		Page:        page,
+		EmitNormal:  usage.EmitNormal,
+		EmitSwapped: usage.EmitSwapped,
+	}
+	pageStart := c.out.Len() + c.aside.Len()
+
+	for _, variant := range c.variants {
+		if variant.swapEndian {
+			if !usage.EmitSwapped {
+				continue
+			}
+		} else {
+			if !usage.EmitNormal {
+				continue
+			}
+		}
+		ruleStats := c.emitVariant(page, nodes, filter, variant)
+		// matchers don't count, they're the same rules again
+		if !variant.matcher {
+			ps.RulesCompiled += ruleStats.RulesCompiled
+			ps.RulesSkipped += ruleStats.RulesSkipped
+			ps.SwitchCases += ruleStats.SwitchCases
+		}
+	}
+
+	if filter != nil {
+		filterStart := c.out.Len()
+		c.emitFilter(filter, nodes)
+		if c.opts.SingleDispatch {
+			c.setAside(filterStart)
+		}
+	}
+
+	ps.BytesEmitted = int64(c.out.Len() + c.aside.Len() - pageStart)
+	c.stats.RulesCompiled += ps.RulesCompiled
+	c.stats.RulesSkipped += ps.RulesSkipped
+	c.stats.SwitchCases += ps.SwitchCases
+	c.stats.Pages = append(c.stats.Pages, ps)
+}
+
+// emitVariant emits a function of page, for variant, and returns what it
+// made of the rules
+func (c *compilation) emitVariant(page string, nodes []*ruleNode, filter *treeFilter, variant pageVariant) *Stats {
+	pe := &pageEmitter{
+		compilation: c,
+		page:        page,
+		swapEndian:  variant.swapEndian,
+		matcher:     variant.matcher,
+		runtimeSwap: c.swapsAtRuntime(page),
+		ruleStats:   &Stats{},
+	}
+	filterParam, filterTop := "", ""
+	if filter != nil {
+		filterParam, filterTop = fmt.Sprintf(", cd *[%d]bool", len(filter.keys)), ",nil"
+	}
+
+	variantStart := c.out.Len()
+	swap := swapLiteral(pe.swapEndian)
+	c.markSource("page %q", page)
+	if pe.matcher {
+
+		c.emit("func Is%s(r %s, po int64) bool {", c.pageSymbol(page, pe.swapEndian), c.api)
+		c.withIndent(func() {
+			c.emitScratch()
+			c.emit("return %s", c.pageCall("is", page, swap, c.inner+c.tbArg+",po"+c.depthTop))
+		})
+		c.emit("}")
+		c.emit("")
+
+		if pe.runtimeSwap {
+			if pe.swapEndian {
+				// the function is the one of the normal variant
+				if c.opts.SingleDispatch {
+					c.setAside(variantStart)
+				}
+				return pe.ruleStats
+			}
+			c.emit("func is%s(swap bool, r *%sSliceReader%s, po int64%s) bool {", c.pageSymbol(page, false), c.rq, c.tbParam, c.depthParam)
+		} else {
+			c.emit("func is%s(r *%sSliceReader%s, po int64%s) bool {", c.pageSymbol(page, pe.swapEndian), c.rq, c.tbParam, c.depthParam)
+		}
+	} else {
+		c.emit("func Identify%s__Result(r %s, po int64) Result {", c.pageSymbol(page, pe.swapEndian), c.api)
+		c.withIndent(func() {
+			c.emitScratch()
+			c.emit("o,u:=%s", c.identifyCall(page, swap, c.inner+c.tbArg+",po,0", filterTop, c.depthTop))
+			c.emit("return Result{Descriptions: o, MIME: u}")
+		})
+		c.emit("}")
+		c.emit("")
+
+		c.emit("// Identify%s__Max is Identify%s__Result, stopping once it found max", c.pageSymbol(page, pe.swapEndian), c.pageSymbol(page, pe.swapEndian))
+		c.emit("// descriptions, or not at all if max is 0 or less")
+		c.emit("func Identify%s__Max(r %s, po int64, max int) Result {", c.pageSymbol(page, pe.swapEndian), c.api)
+		c.withIndent(func() {
+			c.emitScratch()
+			c.emit("o,u:=%s", c.identifyCall(page, swap, c.inner+c.tbArg+",po,max", filterTop, c.depthTop))
+			c.emit("return Result{Descriptions: o, MIME: u}")
+		})
+		c.emit("}")
+		c.emit("")
+
+		c.emit("func Identify%s(r %s, po int64) []string {", c.pageSymbol(page, pe.swapEndian), c.api)
+		c.withIndent(func() {
+			c.emit("return Identify%s__Result(r,po).Descriptions", c.pageSymbol(page, pe.swapEndian))
+		})
+		c.emit("}")
+		c.emit("")
+
+		if pe.runtimeSwap && pe.swapEndian {
+			// the function is the one of the normal variant
+			if c.opts.SingleDispatch {
+				c.setAside(variantStart)
+			}
+			return pe.ruleStats
+		}
+		c.stats.PagesEmitted++
+		if c.opts.SingleDispatch {
+			c.setAside(variantStart)
+			caseID := c.pageIDs[page] * 2
+			if pe.swapEndian {
+				caseID++
+			}
+			pe.labelPrefix = fmt.Sprintf("c%d", caseID)
+			switch {
+			case pe.runtimeSwap:
+				c.emit("case %d, %d: // %s, swapped or not", caseID, caseID+1, strconv.Quote(page))
+			case pe.swapEndian:
+				c.emit("case %d: // %s, swapped", caseID, strconv.Quote(page))
+			default:
+				c.emit("case %d: // %s", caseID, strconv.Quote(page))
+			}
+		} else if pe.runtimeSwap {
+			c.emit("func identify%s(swap bool, r *%sSliceReader%s, po int64, mx int%s%s) ([]string, string) {", c.pageSymbol(page, false), c.rq, c.tbParam, filterParam, c.depthParam)
+		} else {
+			c.emit("func identify%s(r *%sSliceReader%s, po int64, mx int%s%s) ([]string, string) {", c.pageSymbol(page, pe.swapEndian), c.rq, c.tbParam, filterParam, c.depthParam)
+		}
+	}
+	c.withIndent(func() {
+		pe.emitBody(nodes, filter)
+	})
+	if !c.opts.SingleDispatch || pe.matcher {
+		c.emit("}")
+		c.emit("")
+	}
+	if c.opts.SingleDispatch && pe.matcher {
+		c.setAside(variantStart)
+	}
+	return pe.ruleStats
+}
+
+// pageEmitter turns the rules of a page into the body of one of its
+// functions
+type pageEmitter struct {
+	*compilation
+	page        string
+	swapEndian  bool
+	matcher     bool
+	runtimeSwap bool
+	// labels are per function, pages share identifyPage
+	labelPrefix string
+	ruleStats   *Stats
+
+	markers map[*ruleNode]int
+	// where matchers return, they don't look any further
+	topNodes map[*ruleNode]bool
+	// stop returns what was found once there's enough of it.
+	// uses make sure they never go over, so there's exactly mx
+	stop string
+	// siblings reading the same integer keep it in locals of their own,
+	// rd and ok, numbered in the function: shared has the number of each
+	// of them, sharedDone those already read
+	shared      map[*ruleNode]int
+	sharedDone  map[int]bool
+	sharedCount int
+}
+
+// readCall returns the call reading an unsigned integer of byteWidth
+// bytes, written in the byte order en, at off
+func (pe *pageEmitter) readCall(byteWidth int, en parser.Endianness, off Expression) string {
+	if pe.runtimeSwap && byteWidth > 1 {
+		return fmt.Sprintf("%s(r%s,%s,swap)", reader{byteWidth: byteWidth, endianness: en}.swapName(), pe.tbArg, off)
+	}
+	return fmt.Sprintf("%s(r%s,%s)", readerName(byteWidth, en, pe.swapEndian), pe.tbArg, off)
+}
+
+// readVars returns where the value an integer rule read is, and whether
+// reading it worked
+func (pe *pageEmitter) readVars(node *ruleNode) (string, string) {
+	if index, ok := pe.shared[node]; ok {
+		return fmt.Sprintf("rd%d", index), fmt.Sprintf("ok%d", index)
+	}
+	return "rc", "m"
+}
+
+// needsOffsetGuard tells whether a string or search test for pattern at o
+// checks its offset first. Tests can't match an empty pattern past the
+// end, which they would. With MaxInputSize, offsets that don't depend on
+// the target are below it, or the rule was pruned, so they only fail on
+// smaller targets, in the first byte the test reads.
+func (pe *pageEmitter) needsOffsetGuard(o parser.Offset, pattern string) bool {
+	if pe.opts.NoOffsetGuards || pattern == "" {
+		return false
+	}
+	return pe.opts.MaxInputSize == 0 || o.IsRelative || o.OffsetType == parser.OffsetTypeIndirect
+}
+
+// emitBody emits the body of the function of the trees nodes
+func (pe *pageEmitter) emitBody(nodes []*ruleNode, filter *treeFilter) {
+	if !pe.opts.NoSwitches {
+		for _, node := range nodes {
+			switchify(node)
+		}
+	}
+	pe.markers = defaultMarkers(nodes)
+	pageMarker := ""
+	if index, ok := pe.markers[nil]; ok {
+		pageMarker = fmt.Sprintf("d[%d]", index)
+	}
+	pe.topNodes = make(map[*ruleNode]bool)
+	if pe.matcher {
+		pe.topNodes = matcherTopNodes(nodes)
+	}
+	pe.stop = "if mx>0&&len(out)>=mx {return out, mt}"
+	if pe.page == "" {
+		pe.stop = "if mx>0&&len(out)>=mx {if !fd {fm=mt}; return out, fm}"
+	}
+	pe.shared = make(map[*ruleNode]int)
+	pe.sharedDone = make(map[int]bool)
+
+	// rules are turned into statements first, so that only the
+	// locals they use are declared
+	trees := make([]*nodeStmt, len(nodes))
+	uses := newIdentUses()
+	for i, node := range nodes {
+		trees[i] = pe.emitNode(node, pageMarker, nil)
+		uses.addStatements(trees[i].body)
+	}
+
+	if pe.opts.AllowCycles {
+		if pe.matcher {
+			pe.emit("if dp>maxUseDepth {return f}")
+		} else {
+			pe.emit("if dp>maxUseDepth {return nil, \"\"}")
+		}
+	}
+	if !pe.matcher {
+		pe.emit("var out []string")
+	}
+	for _, local := range pageLocals {
+		if !uses.referenced(local.name) {
+			continue
+		}
+		pe.emit("%s", local.decl)
+		if uses.onlyWritten(local.name) {
+			// only assigned to, go wants it used anyway
+			pe.emit("_=%s", local.name)
+		}
+	}
+	for i := 0; i < pe.sharedCount; i++ {
+		pe.emit("var rd%d uint64; var ok%d bool", i, i)
+	}
+	if uses.referenced("d") {
+		pe.emit("var d [%d]bool", len(pe.markers))
+		if pageMarker != "" && pe.page != "" {
+			// like in the interpreter, rules at the top of a used
+			// page count as matched
+			pe.emit("%s=t", pageMarker)
+		}
+	}
+	if !pe.matcher {
+		pe.emit("var mt string") // MIME type of the current tree
+		if pe.page == "" {
+			pe.emit("var fm string; var fd bool")
+		}
+	}
+
+	for i, tree := range trees {
+		if filter != nil && !pe.matcher && filter.slots[i] >= 0 {
+			// skipped when the target can't start like the tree
+			pe.emit("if cd==nil||cd[%d] {", filter.slots[i])
+			pe.withIndent(func() {
+				pe.render(pe.cw, tree)
+			})
+			pe.emit("}")
+		} else {
+			pe.render(pe.cw, tree)
+		}
+		if pe.page == "" && !pe.matcher {
+			// the first tree that produces output gives the MIME type
+			pe.emit("if !fd && len(out)>0 {fm=mt; fd=t}")
+			pe.emit("mt=\"\"")
+		}
+	}
+
+	switch {
+	case pe.matcher:
+		pe.emit("return f")
+	case pe.page == "":
+		pe.emit("return out, fm")
+	default:
+		pe.emit("return out, mt")
+	}
+}
+
+// emitNode turns node into a statement, defaultMarker is the marker of its
+// group for default and clear
+func (pe *pageEmitter) emitNode(node *ruleNode, defaultMarker string, prevSiblingNode *ruleNode) *nodeStmt {
+	rule := node.rule
+	ns := &nodeStmt{label: pe.labelPrefix + failLabel(node)}
+	// line adds a line of code to the rule
+	line := func(format string, args ...interface{}) {
+		ns.body = append(ns.body, lineStmt{fmt.Sprintf(format, args...)})
+	}
+	// guard ends the rule when failIf holds, okIf is its opposite
+	guard := func(failIf string, okIf string) {
+		ns.body = append(ns.body, guardStmt{failIf: failIf, okIf: okIf})
+	}
+	ns.body = append(ns.body, markStmt{fmt.Sprintf("rule %q", rule.Line)})
+
+	supported := true
+	// string switches emit their children in their cases
+	childrenEmitted := false
+	// switches stand for several integer rules
+	ruleCount := 1
+	// appends the description, if the rule has one
+	describe := ""
+
+	if pe.opts.EmitComments {
+		line("// %s", ruleProvenance(rule, pe.opts.SourceRoot))
+	}
+	if pe.opts.LineDirectives {
+		if directive := lineDirective(rule, pe.opts.SourceRoot); directive != "" {
+			ns.body = append(ns.body, directiveStmt{directive})
+		}
+	}
+
+	if rule.Offset.OffsetType == parser.OffsetTypeIndirect && rule.Offset.Indirect.IsNested() {
+		// only the interpreter knows how to follow nested indirect offsets,
+		// the rule and its children never match
+		pe.ruleStats.RulesSkipped += countRules(node)
+		line("// fixme: unhandled nested indirect offset %s", rule.Offset)
+		ns.body = append(ns.body, failStmt{})
+		return ns
+	}
+
+	if rule.Offset.OffsetType == parser.OffsetTypeIndirect && dividesByNonPositive(rule.Offset.Indirect) {
+		// the interpreter gives up on those, zero was
+		// reported by checkDivisors
+		pe.ruleStats.RulesCompiled += countRules(node)
+		line("// pointer divided by %d, never matches", rule.Offset.Indirect.OffsetAdjustmentValue)
+		ns.body = append(ns.body, failStmt{})
+		return ns
+	}
+
+	// don't bother emitting global offset if no direct children
+	// have relative offsets. if grandchildren have relative offsets,
+	// they'll be relative to their own parent
+	emitGlobalOffset := false
+	for _, child := range node.children {
+		cof := child.rule.Offset
+		if cof.IsRelative || (cof.OffsetType == parser.OffsetTypeIndirect && cof.Indirect.IsRelative) {
+			emitGlobalOffset = true
+			break
+		}
+	}
+
+	var off Expression
+
+	// if the previous node read its offset from the same
+	// place, then we can reuse it without having to read it
+	// again, as long as nothing else was read since
+	reuseOffset := false
+	if prevSiblingNode != nil && unchangedSince(prevSiblingNode, rule) {
+		reuseOffset = sameAddress(prevSiblingNode.rule.Offset, rule.Offset)
+	}
+
+	switch rule.Offset.OffsetType {
+	case parser.OffsetTypeDirect:
+		off = &BinaryOp{
+			LHS:      offsetBase(rule.Offset.IsRelative),
+			Operator: OperatorAdd,
+			RHS:      &NumberLiteral{Value: rule.Offset.Direct, Hex: rule.Offset.DirectIsHex},
+		}
+	case parser.OffsetTypeIndirect:
+		indirect := rule.Offset.Indirect
+
+		var offsetAddress Expression = &BinaryOp{
+			LHS:      offsetBase(indirect.IsRelative),
+			Operator: OperatorAdd,
+			RHS:      &NumberLiteral{Value: indirect.OffsetAddress, Hex: indirect.OffsetAddressIsHex},
+		}
+		offsetAddress = offsetAddress.Fold()
+
+		if !reuseOffset {
+			line("ra,k=%s", pe.readCall(indirect.ByteWidth, indirect.Endianness, offsetAddress))
+		}
+		guard("!k", "k")
+		var offsetAdjustValue Expression = &NumberLiteral{Value: indirect.OffsetAdjustmentValue, Hex: indirect.OffsetAdjustmentIsHex}
+
+		if indirect.OffsetAdjustmentIsRelative {
+			offsetAdjustAddress := (&BinaryOp{
+				LHS:      offsetAddress,
+				Operator: OperatorAdd,
+				RHS:      &NumberLiteral{Value: indirect.OffsetAdjustmentValue, Hex: indirect.OffsetAdjustmentIsHex},
+			}).Fold()
+			line("rb,l=%s", pe.readCall(indirect.ByteWidth, indirect.Endianness, offsetAdjustAddress))
+			guard("!l", "l")
+			offsetAdjustValue = &VariableAccess{"int64(rb)"}
+		}
+
+		// like the interpreter, give up on pointers that would go
+		// below zero
+		if failIf, okIf := adjustmentGuard(indirect); failIf != "" {
+			guard(failIf, okIf)
+		}
+
+		off = &VariableAccess{"int64(ra)"}
+
+		switch indirect.OffsetAdjustmentType {
+		case parser.AdjustmentAdd:
+			off = &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      offsetAdjustValue,
+			}
+		case parser.AdjustmentSub:
+			off = &BinaryOp{
+				LHS:      off,
+				Operator: OperatorSub,
+				RHS:      offsetAdjustValue,
+			}
+		case parser.AdjustmentMul:
+			off = &BinaryOp{
+				LHS:      off,
+				Operator: OperatorMul,
+				RHS:      offsetAdjustValue,
+			}
+		case parser.AdjustmentDiv:
+			off = &BinaryOp{
+				LHS:      off,
+				Operator: OperatorDiv,
+				RHS:      offsetAdjustValue,
+			}
+		}
+
+		// pointers are relative to the page too
+		off = &BinaryOp{
+			LHS:      off,
+			Operator: OperatorAdd,
+			RHS:      offsetBase(rule.Offset.IsRelative),
+		}
+	}
+
+	off = off.Fold()
+
+	if !compiledFamilies[rule.Kind.Family] {
+		supported = false
+		line("// fixme: unhandled %s", rule.Kind)
+		ns.body = append(ns.body, failStmt{})
+	}
+
+	switch rule.Kind.Family {
+	case parser.KindFamilySwitch:
+		sk, _ := rule.Kind.Data.(*parser.SwitchKind)
+		ruleCount = len(sk.Cases)
+		pe.ruleStats.SwitchCases += len(sk.Cases)
+
+		line("rc,m=%s", pe.readCall(sk.ByteWidth, sk.Endianness, off))
+
+		ss := switchStmt{subject: "rc"}
+		for _, c := range sk.Cases {
+			value := quoteUnsigned(utils.TruncateUint(uint64(c.Value), sk.ByteWidth))
+			if pe.topNodes[node] {
+				ss.cases = append(ss.cases, switchCase{value: value, body: []stmt{lineStmt{"return t"}}})
+				continue
+			}
+			var body []stmt
+			if pe.opts.Trace && !pe.matcher {
+				body = append(body, lineStmt{fmt.Sprintf("if Trace!=nil {Trace(%s)}", strconv.Quote(c.Line))})
+			}
+			mime := ""
+			if c.MIME != "" {
+				mime = fmt.Sprintf("; mt=%s", strconv.Quote(c.MIME))
+			}
+			body = append(body, lineStmt{describeSwitchCase(sk, c) + mime})
+			ss.cases = append(ss.cases, switchCase{value: value, body: body})
+		}
+		ns.body = append(ns.body, ss)
+		if !pe.matcher {
+			// what follows the switch runs after every case
+			line("%s", pe.stop)
+		}
+
+	case parser.KindFamilyStringSwitch:
+		sk, _ := rule.Kind.Data.(*parser.StringSwitchKind)
+		// the merged rules count themselves
+		ruleCount = 0
+		pe.ruleStats.SwitchCases += len(node.children)
+
+		end := &BinaryOp{
+			LHS:      off,
+			Operator: OperatorAdd,
+			RHS:      &NumberLiteral{Value: int64(sk.Length)},
+		}
+		ss := switchStmt{subject: fmt.Sprintf("string(rs(r,%s,%s))", off, end.Fold())}
+		// siblings testing the same string all match, in order
+		var values []string
+		byValue := make(map[string][]*ruleNode)
+		for _, child := range node.children {
+			value := child.rule.Kind.Data.(*parser.StringKind).Value
+			if _, ok := byValue[value]; !ok {
+				values = append(values, value)
+			}
+			byValue[value] = append(byValue[value], child)
+		}
+
+		for _, value := range values {
+			var body []stmt
+			prevSibling := node
+			for _, child := range byValue[value] {
+				body = append(body, pe.emitNode(child, defaultMarker, prevSibling))
+				prevSibling = child
+			}
+			ss.cases = append(ss.cases, switchCase{value: strconv.Quote(value), body: body})
+		}
+		ns.body = append(ns.body, ss)
+		childrenEmitted = true
+
+	case parser.KindFamilyInteger:
+		ik, _ := rule.Kind.Data.(*parser.IntegerKind)
+
+		value, ok := "rc", "m"
+		if readsValue(rule) {
+			// the parent, or a previous sibling without children
+			// (that could read something else) may have read the
+			// same thing already
+			reuseSibling := false
+			if prevSiblingNode != nil && unchangedSince(prevSiblingNode, rule) {
+				pr := prevSiblingNode.rule
+				if canonicalOffset(pr.Offset).Equals(canonicalOffset(rule.Offset)) && readsValue(pr) {
+					pik, _ := pr.Kind.Data.(*parser.IntegerKind)
+					if pik.ByteWidth == ik.ByteWidth && pik.Endianness == ik.Endianness {
+						reuseSibling = true
+					}
+				}
+			}
+			prevValue, prevOk := "", ""
+			if reuseSibling {
+				prevValue, prevOk = pe.readVars(prevSiblingNode)
+			}
+
+			index, isShared := pe.shared[node]
+			switch {
+			case isShared:
+				// the first sibling of the group reads for all of them
+				value, ok = pe.readVars(node)
+				if !pe.sharedDone[index] {
+					pe.sharedDone[index] = true
+					if reuseSibling {
+						line("%s,%s=%s,%s", value, ok, prevValue, prevOk)
+					} else {
+						line("%s,%s=%s", value, ok, pe.readCall(ik.ByteWidth, ik.Endianness, off))
+					}
+				}
+			case reuseSibling:
+				value, ok = prevValue, prevOk
+			default:
+				line("rc,m=%s", pe.readCall(ik.ByteWidth, ik.Endianness, off))
+			}
+		}
+		describe = describeInteger(rule, ik, value, ok)
+
+		if !ik.MatchAny {
+			ruleTest := fmt.Sprintf("%s&&%s", ok, integerTestExpression(ik, value))
+			guard("!("+ruleTest+")", ruleTest)
+		}
+		if emitGlobalOffset {
+			gfValue := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      &NumberLiteral{Value: int64(ik.ByteWidth)},
+			}
+			line("gf=%s", gfValue.Fold())
+		}
+	case parser.KindFamilyDate:
+		dk, _ := rule.Kind.Data.(*parser.DateKind)
+
+		// always read, "x" tests print the value too
+		line("rc,m=%s", pe.readCall(dk.ByteWidth, dk.Endianness, off))
+		describe = describeDate(rule, dk, "rc", "m")
+
+		if !dk.MatchAny {
+			ruleTest := fmt.Sprintf("m&&%s", integerTestExpression(&dk.IntegerKind, "rc"))
+			guard("!("+ruleTest+")", ruleTest)
+		}
+		if emitGlobalOffset {
+			gfValue := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      &NumberLiteral{Value: int64(dk.ByteWidth)},
+			}
+			line("gf=%s", gfValue.Fold())
+		}
+
+	case parser.KindFamilyFloat:
+		fk, _ := rule.Kind.Data.(*parser.FloatKind)
+
+		line("rc,m=%s", pe.readCall(fk.ByteWidth, fk.Endianness, off))
+		describe = describeFloat(rule, fk, "rc", "m")
+
+		if !fk.MatchAny {
+			ruleTest := fmt.Sprintf("m&&%s", floatTestExpression(fk, "rc"))
+			guard("!("+ruleTest+")", ruleTest)
+		}
+		if emitGlobalOffset {
+			gfValue := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      &NumberLiteral{Value: int64(fk.ByteWidth)},
+			}
+			line("gf=%s", gfValue.Fold())
+		}
+
+	case parser.KindFamilyString:
+		sk, _ := rule.Kind.Data.(*parser.StringKind)
+		if node.matched {
+			// where gt would have stopped
+			matchEnd := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      &NumberLiteral{Value: int64(len(sk.Value))},
+			}
+			line("rA=%s", matchEnd.Fold())
+		} else {
+			if !sk.Negate && pe.needsOffsetGuard(rule.Offset, sk.Value) {
+				failIf, okIf := offsetGuard(off)
+				guard(failIf, okIf)
+			}
+			line("rA = gt(r,%s,%s,%s)", off, strconv.Quote(sk.Value), stringFlags(sk.Flags))
+			if sk.Negate {
+				guard("rA>=0", "rA<0")
+			} else {
+				guard("rA<0", "rA>=0")
+			}
+		}
+		describe = describeString(rule, sk, off)
+		if emitGlobalOffset {
+			if sk.Negate {
+				gfValue := &BinaryOp{
+					LHS:      off,
+					Operator: OperatorAdd,
+					RHS:      &VariableAccess{"rA"},
+				}
+				line("gf=%s", gfValue.Fold())
+			} else {
+				// rA is where the match ends, not its length
+				line("gf=rA")
+			}
+		}
+
+	case parser.KindFamilyGuid:
+		gk, _ := rule.Kind.Data.(*parser.GuidKind)
+		gq := fmt.Sprintf("gq(r,%s,%s)", off, strconv.Quote(string(gk.Value)))
+		guard("!"+gq, gq)
+		describe = describeGuid(rule, gk, off)
+		if emitGlobalOffset {
+			gfValue := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      &NumberLiteral{Value: utils.GUIDSize},
+			}
+			line("gf=%s", gfValue.Fold())
+		}
+
+	case parser.KindFamilyString16:
+		sk, _ := rule.Kind.Data.(*parser.String16Kind)
+		bigEndian := strconv.FormatBool(sk.Endianness.MaybeSwapped(pe.swapEndian) == parser.BigEndian)
+		if pe.runtimeSwap {
+			bigEndian = "swap"
+			if sk.Endianness == parser.BigEndian {
+				bigEndian = "!swap"
+			}
+		}
+		if sk.MatchAny {
+			line("rA=uu(r,%s,%s)", off, bigEndian)
+		} else {
+			line("rA=ut(r,%s,%s,%s,0)", off, strconv.Quote(sk.Value), bigEndian)
+		}
+		if sk.Negate {
+			guard("rA>=0", "rA<0")
+		} else {
+			guard("rA<0", "rA>=0")
+			if emitGlobalOffset {
+				line("gf=rA")
+			}
+		}
+		describe = describeString16(rule, sk, off, bigEndian)
+
+	case parser.KindFamilyPString:
+		pk, _ := rule.Kind.Data.(*parser.PStringKind)
+		width := int64(pk.LengthWidth)
+
+		// read the length with the reader for its width and
+		// byte order, then look for the pattern after it
+		line("rc,m=%s", pe.readCall(pk.LengthWidth, pk.LengthEndianness, off))
+		if pk.LengthIncludesItself {
+			guard(fmt.Sprintf("!m||rc<%d", width), fmt.Sprintf("m&&rc>=%d", width))
+			line("rc-=%d", width)
+		} else {
+			guard("!m", "m")
+		}
+
+		start := (&BinaryOp{
+			LHS:      off,
+			Operator: OperatorAdd,
+			RHS:      &NumberLiteral{Value: width},
+		}).Fold()
+		guard(fmt.Sprintf("rc>uint64(r.Size()-(%s))", start), fmt.Sprintf("rc<=uint64(r.Size()-(%s))", start))
+		line("rA=gt(r,%s,%s,%s)", start, strconv.Quote(pk.Value), stringFlags(pk.Flags))
+		inside := fmt.Sprintf("rA>=0&&rA<=%s+int64(rc)", start)
+		outside := fmt.Sprintf("rA<0||rA>%s+int64(rc)", start)
+		if pk.Negate {
+			guard(inside, outside)
+		} else {
+			guard(outside, inside)
+		}
+		describe = describePString(rule, pk, start)
+		if emitGlobalOffset {
+			line("gf=%s+int64(rc)", start)
+		}
+
+	case parser.KindFamilySearch:
+		sk, _ := rule.Kind.Data.(*parser.SearchKind)
+		if pe.needsOffsetGuard(rule.Offset, sk.Value) {
+			failIf, okIf := offsetGuard(off)
+			guard(failIf, okIf)
+		}
+		variableBlanks := sk.Flags&(utils.CompactWhitespace|utils.OptionalBlanks) > 0
+		search := fmt.Sprintf("ht(r,%s,%s,%s,%s)", off, quoteNumber(int64(sk.MaxLen)), pe.finderNames[searchFinderKey(sk)], stringFlags(sk.Flags))
+		if variableBlanks && emitGlobalOffset {
+			line("rA,rB=%s", search)
+		} else {
+			line("rA,_=%s", search)
+		}
+		guard("rA<0", "rA>=0")
+		describe = describeSearch(rule, sk)
+		if emitGlobalOffset {
+			// with variable blanks, the match isn't as long as the pattern
+			var matchLen Expression = &NumberLiteral{Value: int64(len(sk.Value))}
+			if variableBlanks {
+				matchLen = &VariableAccess{"rB"}
+			}
+			gfValue := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS: &BinaryOp{
+					LHS:      &VariableAccess{"rA"},
+					Operator: OperatorAdd,
+					RHS:      matchLen,
+				},
+			}
+			line("gf=%s", gfValue.Fold())
+		}
+
+	case parser.KindFamilyRegex:
+		rk, _ := rule.Kind.Data.(*parser.RegexKind)
+		line("rA,rB=xt(r,%s,%s,%v,%s)", off, quoteNumber(rk.MaxLen), rk.Lines, pe.regexNames[rk.Pattern()])
+		guard("rA<0", "rA>=0")
+		if emitGlobalOffset {
+			end := "rB"
+			if rk.MatchStart {
+				end = "rA"
+			}
+			gfValue := &BinaryOp{
+				LHS:      off,
+				Operator: OperatorAdd,
+				RHS:      &VariableAccess{end},
+			}
+			line("gf=%s", gfValue.Fold())
+		}
+		describe = describeRegex(rule, off)
+
+	case parser.KindFamilyUse:
+		uk, _ := rule.Kind.Data.(*parser.UseKind)
+		// in a swapped page, \^ swaps back
+		useSwap := swapLiteral(pe.swapEndian != uk.SwapEndian)
+		if pe.runtimeSwap {
+			useSwap = "swap"
+			if uk.SwapEndian {
+				useSwap = "!swap"
+			}
+		}
+		if pe.matcher {
+			is := pe.pageCall("is", uk.Page, useSwap, fmt.Sprintf("r%s,%s%s", pe.tbArg, off, pe.depthUse))
+			guard("!"+is, is)
+		} else {
+			// used pages find at most what's left to find
+			call := pe.identifyCall(uk.Page, useSwap, fmt.Sprintf("r%s,%s,mx-len(out)", pe.tbArg, off), "", pe.depthUse)
+			line("{o,u:=%s; out=append(out,o...); if u!=\"\" {mt=u}}", call)
+			line("%s", pe.stop)
+		}
+
+	case parser.KindFamilyName:
+		// do nothing, pretty much
+
+	case parser.KindFamilyClear:
+		// reset defaultMarker for this level. clear rules
+		// never match, their children never run
+		line("%s=f", defaultMarker)
+		pe.ruleStats.RulesCompiled++
+		return ns
+
+	case parser.KindFamilyDefault:
+		// only succeed if defaultMarker is unset
+		// (so, fail if it's set)
+		guard(defaultMarker, "!"+defaultMarker)
+		if emitGlobalOffset {
+			line("gf=%s", off)
+		}
+
+	default:
+		if supported {
+			panic(fmt.Sprintf("compiledFamilies has %s rules, emitNode doesn't", rule.Kind))
+		}
+	}
+
+	if supported {
+		pe.ruleStats.RulesCompiled += ruleCount
+	} else {
+		pe.ruleStats.RulesSkipped++
+	}
+
+	if pe.topNodes[node] {
+		if node.rule.Kind.Family != parser.KindFamilySwitch {
+			line("return t")
+		}
+		return ns
+	}
+
+	if pe.opts.Trace && !pe.matcher && !generatedSwitch(rule) {
+		line("if Trace!=nil {Trace(%s)}", strconv.Quote(rule.Line))
+	}
+	if len(rule.Description) > 0 {
+		if describe == "" {
+			describe = describeConstant(rule.Description)
+		}
+		line("%s", describe)
+		if rule.MIME != "" {
+			line("mt=%s", strconv.Quote(rule.MIME))
+		}
+		line("%s", pe.stop)
+	}
+
+	numChildren := len(node.children)
+	childDefaultMarker := ""
+
+	if numChildren > 0 && !childrenEmitted {
+		// children start a new group for default and clear
+		if index, ok := pe.markers[node]; ok {
+			childDefaultMarker = fmt.Sprintf("d[%d]", index)
+			line("%s=f", childDefaultMarker)
+		}
+
+		groups, count := sharedReads(node.children)
+		for child, group := range groups {
+			pe.shared[child] = pe.sharedCount + group
+		}
+		pe.sharedCount += count
+
+		var prevSibling = node
+		for _, child := range node.children {
+			ns.body = append(ns.body, pe.emitNode(child, childDefaultMarker, prevSibling))
+			prevSibling = child
+		}
+	}
+
+	if defaultMarker != "" {
+		line("%s=t", defaultMarker)
+	}
+	return ns
+}
+
+// maxUseDepth is how deep in uses generated code goes when cycles are
+// allowed, it's file(1)'s default limit on name recursion
+const maxUseDepth = 50
+
+// offsetGuard returns the conditions a test at off fails and goes on on,
+// because off is outside the target
+func offsetGuard(off Expression) (string, string) {
+	return fmt.Sprintf("%s<0||%s>=sz", off, off), fmt.Sprintf("%s>=0&&%s<sz", off, off)
+}
+
+// pageLocals are the variables page functions may need, they're only
+// declared where used
+var pageLocals = []struct {
+	name string
+	decl string
+}{
+	// the end of the previous match, absolute
+	{"gf", "var gf=po"},
+	// the size of the target, offsets are checked against it
+	{"sz", "var sz=r.Size()"},
+	// values read by indirect offsets
+	{"ra", "var ra uint64"},
+	{"rb", "var rb uint64"},
+	// the value read by the current rule
+	{"rc", "var rc uint64"},
+	// where string-like tests matched
+	{"rA", "var rA int64"},
+	{"rB", "var rB int64"},
+	// whether the reads above succeeded
+	{"k", "var k bool"},
+	{"l", "var l bool"},
+	{"m", "var m bool"},
+}
+
+// offsetBase returns what offsets are relative to: the end of the previous
+// match (gf) for relative offsets, the offset the page is used at (po) otherwise
+func offsetBase(relative bool) Expression {
+	if relative {
+		return &VariableAccess{"gf"}
+	}
+	return &VariableAccess{"po"}
+}
+
+// errDivisionByZero is the error of rules dividing by a constant zero
+var errDivisionByZero = errors.New("division by zero")
+
+// checkDivisors reports the first rule dividing by a constant zero, either
+// its pointer or the value it read, as a *RuleError. The interpreter never
+// matches them, but they're mistakes, and go doesn't compile them. Divisors
+// read from the target are checked by generated code.
+func checkDivisors(book parser.Spellbook) error {
+	var pages []string
+	for page := range book {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	for _, page := range pages {
+		for _, rule := range book[page] {
+			if rule.Offset.OffsetType == parser.OffsetTypeIndirect {
+				indirect := rule.Offset.Indirect
+				if dividesByNonPositive(indirect) && indirect.OffsetAdjustmentValue == 0 {
+					return ruleError(page, rule, errDivisionByZero)
+				}
+			}
+
+			var ik *parser.IntegerKind
+			switch data := rule.Kind.Data.(type) {
+			case *parser.IntegerKind:
+				ik = data
+			case *parser.DateKind:
+				ik = &data.IntegerKind
+			}
+			if ik != nil && ik.AdjustmentType == parser.AdjustmentDiv && utils.TruncateUint(uint64(ik.AdjustmentValue), ik.ByteWidth) == 0 {
+				return ruleError(page, rule, errDivisionByZero)
+			}
+		}
+	}
+	return nil
+}
+
+// dividesByNonPositive returns whether indirect divides the pointer by a
+// constant zero or negative value
+func dividesByNonPositive(indirect *parser.IndirectOffset) bool {
+	return indirect.OffsetAdjustmentType == parser.AdjustmentDiv &&
+		!indirect.OffsetAdjustmentIsRelative && indirect.OffsetAdjustmentIndirect == nil &&
+		indirect.OffsetAdjustmentValue <= 0
+}
+
+// adjustmentGuard returns a test failing when the adjustment of indirect
+// takes ra below zero, multiplies it by a negative value, or divides it by
+// zero, which the interpreter rejects, and its opposite. failIf is empty if
+// the adjustment always works.
+func adjustmentGuard(indirect *parser.IndirectOffset) (failIf string, okIf string) {
+	if indirect.OffsetAdjustmentIsRelative {
+		switch indirect.OffsetAdjustmentType {
+		case parser.AdjustmentSub:
+			return "ra<rb", "ra>=rb"
+		case parser.AdjustmentDiv:
+			return "rb==0", "rb!=0"
+		}
+		return "", ""
+	}
+
+	value := indirect.OffsetAdjustmentValue
+	switch indirect.OffsetAdjustmentType {
+	case parser.AdjustmentAdd, parser.AdjustmentSub:
+		subtracts := (indirect.OffsetAdjustmentType == parser.AdjustmentSub) != (value < 0)
+		if subtracts && value != 0 {
+			magnitude := quoteUnsigned(uint64(value))
+			if value < 0 {
+				magnitude = quoteUnsigned(uint64(-value))
+			}
+			return "ra<" + magnitude, "ra>=" + magnitude
+		}
+	case parser.AdjustmentMul:
+		if value < 0 {
+			return "ra!=0", "ra==0"
+		}
+	}
+	return "", ""
+}
+
+// unchangedSince returns whether the locals generated code reads offsets
+// and values into still hold what prev read when rule runs: prev is its
+// parent, and rule isn't relative to where prev ended, or prev is a
+// previous sibling without children, that could have read something else
+func unchangedSince(prev *ruleNode, rule parser.Rule) bool {
+	if prev.rule.Level < rule.Level {
+		o := rule.Offset
+		return !o.IsRelative && !(o.OffsetType == parser.OffsetTypeIndirect && o.Indirect.IsRelative)
+	}
+	return len(prev.children) == 0
+}
+
+// canonicalOffset returns o with its adjustment simplified like Fold would:
+// adding 0, or multiplying or dividing by 1, is no adjustment at all, and
+// subtracting a constant is adding its opposite. Offsets that only differ
+// in that way are Equals once canonical.
+func canonicalOffset(o parser.Offset) parser.Offset {
+	if o.OffsetType != parser.OffsetTypeIndirect || o.Indirect == nil {
+		return o
+	}
+	indirect := *o.Indirect
+	if !indirect.OffsetAdjustmentIsRelative && indirect.OffsetAdjustmentIndirect == nil {
+		if indirect.OffsetAdjustmentType == parser.AdjustmentSub {
+			indirect.OffsetAdjustmentType = parser.AdjustmentAdd
+			indirect.OffsetAdjustmentValue = -indirect.OffsetAdjustmentValue
+		}
+		switch indirect.OffsetAdjustmentType {
+		case parser.AdjustmentAdd:
+			if indirect.OffsetAdjustmentValue == 0 {
+				indirect.OffsetAdjustmentType = parser.AdjustmentNone
+			}
+		case parser.AdjustmentMul, parser.AdjustmentDiv:
+			if indirect.OffsetAdjustmentValue == 1 {
+				indirect.OffsetAdjustmentType = parser.AdjustmentNone
+				indirect.OffsetAdjustmentValue = 0
+			}
+		}
+	}
+	o.Indirect = &indirect
+	return o
+}
+
+// sameAddress returns whether a and b are indirect offsets read from the
+// same place in the same format, whatever their adjustments. Rules with a
+// that never match don't read anything.
+func sameAddress(a parser.Offset, b parser.Offset) bool {
+	if a.OffsetType != parser.OffsetTypeIndirect || b.OffsetType != parser.OffsetTypeIndirect {
+		return false
+	}
+	if a.Indirect.IsNested() || dividesByNonPositive(a.Indirect) {
+		return false
+	}
+	withoutAdjustment := func(indirect parser.IndirectOffset) *parser.IndirectOffset {
+		indirect.OffsetAdjustmentType = parser.AdjustmentNone
+		indirect.OffsetAdjustmentIsRelative = false
+		indirect.OffsetAdjustmentValue = 0
+		indirect.OffsetAdjustmentIndirect = nil
+		return &indirect
+	}
+	return withoutAdjustment(*a.Indirect).Equals(withoutAdjustment(*b.Indirect))
+}
+
+// swapLiteral returns swapEndian in generated code, where t and f are true
+// and false
+func swapLiteral(swapEndian bool) string {
+	if swapEndian {
+		return "t"
+	}
+	return "f"
+}
+
+func endiannessString(en parser.Endianness, swapEndian bool) string {
+	if en.MaybeSwapped(swapEndian) == parser.BigEndian {
+		return "b"
+	}
+	return "l"
+}
+
+// quoteNumber returns number as a go literal, in parentheses if negative so
+// that it can go anywhere in an expression
+func quoteNumber(number int64) string {
+	return (&NumberLiteral{Value: number}).String()
+}
+
+// stringFlags returns the flags of a string test as passed to gt, along
+// with what the target looks like if they're for text or binary targets
+func stringFlags(flags utils.StringTestFlags) string {
+	if flags&(utils.ForceText|utils.ForceBinary) > 0 {
+		return fmt.Sprintf("%d|r.TextHint()", flags)
+	}
+	return strconv.FormatInt(int64(flags), 10)
+}
+
+func quoteUnsigned(number uint64) string {
+	return fmt.Sprintf("0x%x", number)
+}
+
+// integerTestExpression returns a go expression performing the test
+// described by ik on value, an uint64 read from the target. It must agree
+// with the interpreter: mask first, then adjustment, both truncated to the
+// width of the test, then sign extension and comparison.
+func integerTestExpression(ik *parser.IntegerKind, value string) string {
+	bits := ik.ByteWidth * 8
+
+	expr := value
+	if ik.DoAnd {
+		expr = fmt.Sprintf("%s&%s", expr, quoteUnsigned(ik.AndValue))
+	}
+	expr = fmt.Sprintf("uint%d(%s)", bits, expr)
+
+	adjustment := utils.TruncateUint(uint64(ik.AdjustmentValue), ik.ByteWidth)
+	switch ik.AdjustmentType {
+	case parser.AdjustmentAdd:
+		expr = fmt.Sprintf("(%s+%s)", expr, quoteUnsigned(adjustment))
+	case parser.AdjustmentSub:
+		expr = fmt.Sprintf("(%s-%s)", expr, quoteUnsigned(adjustment))
+	case parser.AdjustmentMul:
+		expr = fmt.Sprintf("(%s*%s)", expr, quoteUnsigned(adjustment))
+	case parser.AdjustmentDiv:
+		if adjustment == 0 {
+			// file(1) never matches when dividing by zero
+			return "false"
+		}
+		expr = fmt.Sprintf("(%s/%s)", expr, quoteUnsigned(adjustment))
+	}
+
+	value64 := utils.TruncateUint(uint64(ik.Value), ik.ByteWidth)
+	rhs := quoteUnsigned(value64)
+	if ik.Signed {
+		expr = fmt.Sprintf("int%d(%s)", bits, expr)
+		rhs = quoteNumber(int64(utils.SignExtend(value64, ik.ByteWidth)))
+	}
+
+	switch ik.IntegerTest {
+	case parser.IntegerTestNotEqual:
+		return fmt.Sprintf("%s!=%s", expr, rhs)
+	case parser.IntegerTestLessThan:
+		return fmt.Sprintf("%s<%s", expr, rhs)
+	case parser.IntegerTestGreaterThan:
+		return fmt.Sprintf("%s>%s", expr, rhs)
+	case parser.IntegerTestAnd:
+		return fmt.Sprintf("%s&%s==%s", expr, rhs, rhs)
+	default:
+		return fmt.Sprintf("%s==%s", expr, rhs)
+	}
+}
+
+// usesFamily tells whether any rule of the book is of the given family,
+// helpers only some kinds of tests need aren't emitted otherwise
+func usesFamily(book parser.Spellbook, family parser.KindFamily) bool {
+	for _, rules := range book {
+		for _, rule := range rules {
+			if rule.Kind.Family == family {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matcherTopNodes returns the nodes whose match makes a matcher return: the
+// top-level rules, or for pages, the rules right under the name rule
+func matcherTopNodes(nodes []*ruleNode) map[*ruleNode]bool {
+	top := make(map[*ruleNode]bool)
+	var add func(nodes []*ruleNode)
+	add = func(nodes []*ruleNode) {
+		for _, node := range nodes {
+			if node.rule.Kind.Family == parser.KindFamilyStringSwitch {
+				// the merged rules report their own matches
+				add(node.children)
+				continue
+			}
+			top[node] = true
+		}
+	}
+
+	for _, node := range nodes {
+		if node.rule.Kind.Family == parser.KindFamilyName {
+			add(node.children)
+		} else {
+			add([]*ruleNode{node})
+		}
+	}
+	return top
+}
+
+// defaultMarkers numbers the flags telling whether a rule matched among
+// siblings that include default or clear rules, one per parent. The flag
+// for the top-level rules is stored under the nil node.
+func defaultMarkers(nodes []*ruleNode) map[*ruleNode]int {
+	markers := make(map[*ruleNode]int)
+
+	var walk func(parent *ruleNode, children []*ruleNode)
+	walk = func(parent *ruleNode, children []*ruleNode) {
+		for _, child := range children {
+			family := child.rule.Kind.Family
+			if family == parser.KindFamilyDefault || family == parser.KindFamilyClear {
+				markers[parent] = len(markers)
+				break
+			}
+		}
+		for _, child := range children {
+			walk(child, child.children)
+		}
+	}
+	walk(nil, nodes)
+
+	return markers
+}
+
+// countRules returns how many rules are in the tree rooted at node
+func countRules(node *ruleNode) int {
+	count := 1
+	switch kind := node.rule.Kind.Data.(type) {
+	case *parser.SwitchKind:
+		count = len(kind.Cases)
+	case *parser.StringSwitchKind:
+		// the merged rules are its children
+		count = 0
+	}
+	for _, child := range node.children {
+		count += countRules(child)
+	}
+	return count
 }
 
 func failLabel(node *ruleNode) string {
@@ -0,0 +1,482 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseBook(t testing.TB, magic string) parser.Spellbook {
+	pctx := &parser.ParseContext{
+		Logf: func(format string, args ...interface{}) {},
+	}
+
+	book := make(parser.Spellbook)
+	err := pctx.Parse(strings.NewReader(magic), book)
+	assert.NoError(t, err)
+	return book
+}
+
+func Test_IntegerTestExpression(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"0\tbyte&0xf0\t<0x20", "int8(uint8(rc&0xf0))<32"},
+		{"0\tubyte+16\t0x05", "(uint8(rc)+0x10)==0x5"},
+		{"0\tubyte-16\t0x05", "(uint8(rc)-0x10)==0x5"},
+		{"0\tubyte/4&0xf0\t0x0c", "(uint8(rc&0xf0)/0x4)==0xc"},
+		{"0\tubyte/0\t0", "false"},
+		{"0\tbyte\t-1", "int8(uint8(rc))==(-1)"},
+		{"0\tbelong\t<0", "int32(uint32(rc))<0"},
+		{"0\tubelong\t<0", "uint32(rc)<0x0"},
+		{"0\tleshort&0xff00\t0x3e00", "int16(uint16(rc&0xff00))==15872"},
+		{"0\tulelong\t&0x01000000", "uint32(rc)&0x1000000==0x1000000"},
+		{"0\tlequad\t!-1", "int64(uint64(rc))!=(-1)"},
+	}
+
+	for _, c := range cases {
+		book := parseBook(t, c.line)
+		ik, _ := book[""][0].Kind.Data.(*parser.IntegerKind)
+		assert.EqualValues(t, c.expected, integerTestExpression(ik, "rc"), "for %q", c.line)
+	}
+}
+
+func Test_ScratchBufferPerCall(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	ulelong	0x2a	answer
+0	string	RIFF	RIFF
+>(4.l)	use	chunk
+>8	ubeshort	1	version 1
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated", InlineReaders: true})
+	assert.NoError(t, err)
+	code := buf.String()
+
+	// no shared scratch buffer at package level
+	assert.NotContains(t, code, "var tb=")
+	assert.Contains(t, code, "func f4l(r *utils.SliceReader, tb *[8]byte, off int64) (uint64, bool) {")
+	assert.Contains(t, code, "n, _ := r.ReadAt(tb[:4], int64(off))")
+
+	// exported entry points get a buffer from the pool, pages pass it along
+	assert.Contains(t, code, "func IdentifyChunk__Result(r Reader, po int64) Result {\n\ttb := tbPool.Get().(*[8]byte)")
+	assert.Contains(t, code, "o, u := identifyChunk(sl(r), tb, ")
+
+	// readers calling ReadUint need no buffer
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.Contains(t, code, "func f4l(r *utils.SliceReader, off int64) (uint64, bool) {\n\treturn utils.ReadUint(r, off, 4, binary.LittleEndian)\n}")
+	assert.NotContains(t, code, "tb")
+	assert.NotContains(t, code, `"sync"`)
+
+	// the old signature wraps the one returning a Result
+	assert.Contains(t, code, "func IdentifyChunk(r Reader, po int64) []string {\n\treturn IdentifyChunk__Result(r, po).Descriptions")
+}
+
+func Test_CompileSliceReaderAPI(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	ulelong	0x2a	answer
+0	string	RIFF	RIFF
+>(4.l)	use	chunk
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated", EmitMatchers: true})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, "type Reader interface {\n\tio.ReaderAt\n\tSize() int64\n}")
+	assert.Contains(t, code, "func IsChunk(r Reader, po int64) bool {")
+	assert.Contains(t, code, "var Pages = map[string]func(r Reader, po int64) []string{")
+	// page functions still read from a SliceReader
+	assert.Contains(t, code, "func identifyChunk(r *utils.SliceReader, po int64, mx int) ([]string, string) {")
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", EmitMatchers: true, SliceReaderAPI: true})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.NotContains(t, code, "Reader interface")
+	assert.NotContains(t, code, "sl(r)")
+	assert.NotContains(t, code, "\"io\"")
+	assert.Contains(t, code, "func IdentifyChunk__Result(r *utils.SliceReader, po int64) Result {")
+	assert.Contains(t, code, "func IsChunk(r *utils.SliceReader, po int64) bool {")
+	assert.Contains(t, code, "o, u := identifyChunk(r, ")
+}
+
+func Test_CompileTo(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	ulelong	0x2a	answer
+>4	ubyte	1	one
+>4	ubyte	2	two
+>4	ubyte	3	three
+0	string	RIFF	RIFF
+>(4.l)	use	chunk
+>12	use	\^chunk
+>((8.l).b)	ubyte	1	nested
+>>0	ubyte	1	under nested
+>8	der	seq	der
+`)
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "riff", EmitComments: true, SkipUnsupported: true})
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, buf.Len(), stats.BytesWritten)
+	// the chunk page is used with both endiannesses
+	assert.EqualValues(t, 3, stats.PagesEmitted)
+	// chunk has 5 rules (three of them switched), emitted twice, the
+	// top-level tree has 3 more
+	assert.EqualValues(t, 13, stats.RulesCompiled)
+	// nested indirect offsets and der aren't supported
+	assert.EqualValues(t, 3, stats.RulesSkipped)
+	if assert.Len(t, stats.Unsupported, 2) {
+		assert.EqualValues(t, ">((8.l).b)\tubyte\t1\tnested", stats.Unsupported[0].Line)
+		assert.EqualValues(t, ">8\tder\tseq\tder", stats.Unsupported[1].Line)
+	}
+
+	code := buf.String()
+	assert.Contains(t, code, "package riff\n")
+	assert.Contains(t, code, "func IdentifyChunk(")
+	assert.Contains(t, code, "func IdentifyChunk__Swapped(")
+	assert.Contains(t, code, "// >8\tder\tseq\tder")
+}
+
+func Test_CompileTrace(t *testing.T) {
+	book := parseBook(t, `
+0	string	RIFF	RIFF
+>4	ubyte	1	one
+>4	ubyte	2	two
+>4	ubyte	3	three
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "riff"})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "Trace")
+	assert.NotContains(t, buf.String(), "Printf")
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "riff", Trace: true})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, "var Trace func(line string)\n")
+	assert.Contains(t, code, `Trace("0\tstring\tRIFF\tRIFF")`)
+	// switched rules are traced one by one, the switch itself isn't
+	assert.Contains(t, code, `Trace(">4\tubyte\t2\ttwo")`)
+	assert.NotContains(t, code, `Trace("(switch`)
+}
+
+func Test_CompileRegex(t *testing.T) {
+	book := parseBook(t, `
+0	name	shebang
+>0	regex/1l	^#!.*python	Python script
+0	regex/1l	^#!.*python	Python script
+>&0	regex/c	^[0-9.]+	\b, version %s
+0	use	shebang
+`)
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "regex"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, stats.RulesSkipped)
+
+	code := buf.String()
+	assert.Contains(t, code, "\t\"regexp\"\n")
+	// patterns are only compiled once, flags tell them apart
+	assert.EqualValues(t, 1, strings.Count(code, `regexp.MustCompile("(?m)^#!.*python")`))
+	assert.EqualValues(t, 1, strings.Count(code, `regexp.MustCompile("(?mi)^[0-9.]+")`))
+	assert.EqualValues(t, 2, strings.Count(code, "rA, rB = xt(r, po, 1, true, re0)"))
+}
+
+func Test_CompileRegexError(t *testing.T) {
+	book := parseBook(t, `
+0	name	broken
+>0	regex	b	never
+0	use	broken
+`)
+	// the parser leaves out rules whose pattern doesn't compile, kinds
+	// made by hand can still have one
+	book["broken"][1].Kind.Data = &parser.RegexKind{Value: "a(?<b"}
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "regex"})
+	assert.Error(t, err)
+
+	var re *RuleError
+	assert.True(t, errors.As(err, &re), "expected a *RuleError, got %v", err)
+	if re != nil {
+		assert.EqualValues(t, "broken", re.Page)
+		assert.EqualValues(t, ">0\tregex\tb\tnever", re.Line)
+	}
+	assert.Contains(t, err.Error(), "invalid named capture")
+}
+
+func Test_CompileDivisionByZero(t *testing.T) {
+	magdir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(magdir, "pointers"), []byte("0\tstring\tAB\tab\n>(2.l/0)\tubyte\tx\t%d\n"), 0644))
+	book := parseTestMagic(t, magdir)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.Error(t, err)
+	var re *RuleError
+	assert.True(t, errors.As(err, &re), "expected a *RuleError, got %v", err)
+	if re != nil {
+		assert.EqualValues(t, filepath.Join(magdir, "pointers"), re.File)
+		assert.EqualValues(t, 2, re.LineNumber)
+		assert.EqualValues(t, ">(2.l/0)\tubyte\tx\t%d", re.Line)
+	}
+	assert.Contains(t, err.Error(), "pointers:2: ")
+	assert.Contains(t, err.Error(), "division by zero")
+
+	// values divided by zero too, truncated to the width of the test
+	for _, magic := range []string{"0\tubyte/0\t1\tone", "0\tuleshort/0x10000\t1\tone"} {
+		_, err = CompileTo(&buf, parseBook(t, magic), Options{Package: "generated"})
+		assert.True(t, errors.As(err, &re), "for %q", magic)
+	}
+
+	// negative divisors never match, like in the interpreter
+	_, err = CompileTo(&buf, parseBook(t, "0\tstring\tAB\tab\n>(2.l/-1)\tubyte\tx\t%d\n"), Options{Package: "generated"})
+	assert.NoError(t, err)
+}
+
+type failingWriter struct {
+	remaining int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.remaining {
+		n := fw.remaining
+		fw.remaining = 0
+		return n, errWriteFailed
+	}
+	fw.remaining -= len(p)
+	return len(p), nil
+}
+
+func Test_CompileToWriteError(t *testing.T) {
+	book := parseBook(t, "0\tstring\tRIFF\tRIFF")
+
+	stats, err := CompileTo(&failingWriter{remaining: 100}, book, Options{Package: "riff"})
+	assert.True(t, errors.Is(err, errWriteFailed))
+	assert.EqualValues(t, 100, stats.BytesWritten)
+}
+
+func Test_CompileLogf(t *testing.T) {
+	book := parseBook(t, "0\tstring\tRIFF\tRIFF")
+
+	var messages []string
+	output := filepath.Join(t.TempDir(), "generated.go")
+	stats, err := CompileToFile(book, output, Options{
+		Package: "riff",
+		Logf: func(format string, args ...interface{}) {
+			messages = append(messages, fmt.Sprintf(format, args...))
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, messages, 2)
+	assert.EqualValues(t, "Generating into: "+output, messages[0])
+	// timing would make logs differ from run to run, it's only in stats
+	assert.EqualValues(t, fmt.Sprintf("Generated code is %.2f KiB", float64(stats.BytesWritten)/1024.0), messages[1])
+	assert.NotZero(t, stats.Duration)
+}
+
+func Test_CompileQuiet(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "generated", OnlyPages: []string{"PNG", "riff-chunk"}})
+	assert.NoError(t, err)
+	_, err = CompileToDir(t.TempDir(), book, Options{Package: "generated", PagesPerFile: 2})
+	assert.NoError(t, err)
+	err = CompileWithOptions(book, filepath.Join(t.TempDir(), "generated.go"), Options{Package: "generated"})
+	assert.NoError(t, err)
+
+	os.Stdout = stdout
+	assert.NoError(t, w.Close())
+	printed, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, string(printed))
+
+	// what would have been printed is in the stats
+	assert.EqualValues(t, buf.Len(), stats.BytesWritten)
+	assert.NotZero(t, stats.Duration)
+}
+
+func Test_CompileToDir(t *testing.T) {
+	book := parseBook(t, `
+0	name	alpha
+>0	ubyte	1	alpha
+0	name	beta
+>0	ubyte	2	beta
+0	name	gamma
+>0	ubyte	3	gamma
+0	string	ABC	letters
+>3	use	alpha
+>3	use	beta
+>3	use	\^gamma
+`)
+
+	dir := t.TempDir()
+	// left over from a run that emitted more files
+	err := ioutil.WriteFile(filepath.Join(dir, "wizardry_pages_009.go"), []byte("package stale"), 0644)
+	assert.NoError(t, err)
+
+	stats, err := CompileToDir(dir, book, Options{Package: "split", PagesPerFile: 3})
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	assert.NoError(t, err)
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	assert.EqualValues(t, []string{"wizardry_pages_001.go", "wizardry_pages_002.go", "wizardry_shared.go"}, files)
+
+	var total int64
+	var code strings.Builder
+	for _, name := range files {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		total += int64(len(contents))
+		code.Write(contents)
+
+		assert.True(t, strings.Contains(string(contents), "package split\n"), name)
+	}
+	assert.EqualValues(t, total, stats.BytesWritten)
+
+	// shared helpers are only emitted once
+	assert.EqualValues(t, 1, strings.Count(code.String(), "func f1("))
+	assert.EqualValues(t, 1, strings.Count(code.String(), "func rs("))
+
+	// same pages and rules as when compiling into a single file
+	var buf bytes.Buffer
+	single, err := CompileTo(&buf, book, Options{Package: "split"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, single.PagesEmitted, stats.PagesEmitted)
+	assert.EqualValues(t, single.RulesCompiled, stats.RulesCompiled)
+	for _, page := range []string{"Alpha", "Beta", "Gamma__Swapped", ""} {
+		assert.EqualValues(t, 1, strings.Count(code.String(), "func identify"+page+"("), page)
+	}
+}
+
+func Test_SortByStrength(t *testing.T) {
+	weakFirst := `
+0	byte	0x41	one byte
+0	string	ABCDEFGH	eight bytes
+`
+	strongFirst := `
+0	string	ABCDEFGH	eight bytes
+0	byte	0x41	one byte
+`
+
+	for _, magic := range []string{weakFirst, strongFirst} {
+		book := parseBook(t, magic)
+
+		var buf bytes.Buffer
+		_, err := CompileTo(&buf, book, Options{Package: "sorted", SortByStrength: true})
+		assert.NoError(t, err)
+		code := buf.String()
+		assert.Less(t, strings.Index(code, `append(out, "eight bytes")`), strings.Index(code, `append(out, "one byte")`))
+
+		samples := []generatedSample{
+			{name: "both", data: "ABCDEFGH", expected: "eight bytes|one byte"},
+		}
+		testGeneratedSamples(t, book, Options{SortByStrength: true}, samples)
+	}
+
+	// the book's order is kept by default
+	book := parseBook(t, weakFirst)
+	assert.EqualValues(t, 40, book[""][0].Strength())
+	assert.EqualValues(t, 110, book[""][1].Strength())
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "sorted"})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Less(t, strings.Index(code, `append(out, "one byte")`), strings.Index(code, `append(out, "eight bytes")`))
+}
+
+func Test_CompileDeterministic(t *testing.T) {
+	// parsed twice, so that map iteration orders differ
+	compileOnce := func(opts Options) []byte {
+		book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+		var buf bytes.Buffer
+		_, err := CompileTo(&buf, book, opts)
+		assert.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	for _, opts := range []Options{
+		{Package: "generated"},
+		{Package: "generated", EmitComments: true, SelfContained: true},
+	} {
+		first := compileOnce(opts)
+		for i := 0; i < 4; i++ {
+			assert.True(t, bytes.Equal(first, compileOnce(opts)), "compiling the same book should give the same code")
+		}
+	}
+}
+
+func Test_PrunedOutput(t *testing.T) {
+	book := parseBook(t, `
+0	ubyte	0x47	image
+>1	string	IF87a	\b, gif 87a
+>1	string	IF89a	\b, gif 89a
+>1	string	IF88a	\b, gif 88a
+>1	string	IF86a	\b, gif 86a
+0	ubyte	0x42	B
+`)
+
+	for _, opts := range []Options{{}, {SelfContained: true}, {Structured: true}} {
+		opts.Package = "pruned"
+		var buf bytes.Buffer
+		_, err := CompileTo(&buf, book, opts)
+		assert.NoError(t, err)
+		code := buf.String()
+
+		// only the reader for single bytes, which doesn't need binary
+		assert.Contains(t, code, "func f1(")
+		assert.NotContains(t, code, "func f2l(")
+		assert.NotContains(t, code, "func f1l(")
+		if !opts.SelfContained {
+			assert.NotContains(t, code, `"encoding/binary"`)
+		}
+
+		// only the locals that are used, the string switch only sets rA
+		start := strings.Index(code, "func identify(")
+		assert.Contains(t, code[start:], "\tvar out []string\n\tvar rc uint64\n\tvar rA int64\n\t_ = rA\n\tvar m bool\n\tvar mt string\n")
+		for _, unused := range []string{"var gf", "var ra", "var k ", "&=", "!!", "fmt.State"} {
+			assert.NotContains(t, code, unused)
+		}
+	}
+
+	samples := []generatedSample{
+		{name: "gif", data: "GIF89a", expected: `image|\b, gif 89a`},
+		{name: "b", data: "B", expected: "B"},
+	}
+	for _, opts := range []Options{{}, {SelfContained: true}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
@@ -0,0 +1,159 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// codePart is the code of one part, as emitted, before formatting
+type codePart struct {
+	code  []byte
+	marks []sourceMark
+	// pages are the pages identified in the part
+	pages []string
+}
+
+// descriptionAppend is what description literals follow in emitted code,
+// see description.constant and description.formatted
+var descriptionAppend = []byte("out=append(out,")
+
+// descsDecl is the declaration of descs, without its entries
+const descsDecl = "// descs are the descriptions found in more than one place\nvar descs = [...]string{\n}\n"
+
+// literalSite is where a description literal is in the code of a part
+type literalSite struct {
+	start, end int
+	literal    string
+}
+
+// findDescriptionLiterals returns where the description literals of code
+// are, in order. They're the first argument of the append, or of the sf
+// call in it.
+func findDescriptionLiterals(code []byte) []literalSite {
+	var sites []literalSite
+	pos := 0
+	for {
+		i := bytes.Index(code[pos:], descriptionAppend)
+		if i < 0 {
+			return sites
+		}
+		start := pos + i + len(descriptionAppend)
+		if bytes.HasPrefix(code[start:], []byte("sf(")) {
+			start += len("sf(")
+		}
+		pos = start
+		if start >= len(code) || code[start] != '"' {
+			// used pages append what they found
+			continue
+		}
+
+		literal, err := strconv.QuotedPrefix(string(code[start:]))
+		if err != nil {
+			continue
+		}
+		sites = append(sites, literalSite{start: start, end: start + len(literal), literal: literal})
+		pos = start + len(literal)
+	}
+}
+
+// dedupeDescriptions replaces the description literals that appear more
+// than once in parts with entries of descs, when that makes the code
+// shorter, moving source marks along. It returns the entries, as go
+// literals, in the order they first appear, and how many literals were
+// replaced.
+func dedupeDescriptions(parts []*codePart) ([]string, int) {
+	sites := make([][]literalSite, len(parts))
+	counts := make(map[string]int)
+	for i, cp := range parts {
+		sites[i] = findDescriptionLiterals(cp.code)
+		for _, site := range sites[i] {
+			counts[site.literal]++
+		}
+	}
+
+	// references are at most that long
+	repeated := 0
+	for _, count := range counts {
+		if count > 1 {
+			repeated++
+		}
+	}
+	refSize := len(fmt.Sprintf("descs[%d]", repeated))
+	// saving returns how many bytes sharing literal saves, its entry in
+	// descs is indented, and followed by a comma
+	saving := func(literal string) int {
+		count := counts[literal]
+		return count*(len(literal)-refSize) - (len(literal) + 3)
+	}
+	shared := func(literal string) bool {
+		return counts[literal] > 1 && saving(literal) > 0
+	}
+
+	// then descs has to be worth declaring
+	total := 0
+	for literal := range counts {
+		if shared(literal) {
+			total += saving(literal)
+		}
+	}
+	if total <= len(descsDecl) {
+		return nil, 0
+	}
+
+	var descs []string
+	indices := make(map[string]int)
+	replaced := 0
+	for i, cp := range parts {
+		replaced += cp.replaceLiterals(sites[i], func(literal string) string {
+			if !shared(literal) {
+				return ""
+			}
+			index, ok := indices[literal]
+			if !ok {
+				index = len(descs)
+				indices[literal] = index
+				descs = append(descs, literal)
+			}
+			return fmt.Sprintf("descs[%d]", index)
+		})
+	}
+	return descs, replaced
+}
+
+// replaceLiterals replaces the literals at sites, in order, with what ref
+// returns for them, unless it's empty, moving source marks along. It
+// returns how many were replaced.
+func (cp *codePart) replaceLiterals(sites []literalSite, ref func(literal string) string) int {
+	var code bytes.Buffer
+	last := 0
+	shift := 0
+	m := 0
+	replaced := 0
+	for _, site := range sites {
+		r := ref(site.literal)
+		if r == "" {
+			continue
+		}
+
+		// marks before the literal move by what was replaced so far
+		for m < len(cp.marks) && cp.marks[m].offset <= site.start {
+			cp.marks[m].offset += shift
+			m++
+		}
+		code.Write(cp.code[last:site.start])
+		code.WriteString(r)
+		last = site.end
+		shift += len(r) - (site.end - site.start)
+		replaced++
+	}
+	if replaced == 0 {
+		return 0
+	}
+	for ; m < len(cp.marks); m++ {
+		cp.marks[m].offset += shift
+	}
+	code.Write(cp.code[last:])
+	cp.code = code.Bytes()
+	return replaced
+}
@@ -0,0 +1,103 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FindDescriptionLiterals(t *testing.T) {
+	code := []byte(`out=append(out,"a \"quoted\" one")
+out=append(out,sf("\\b, %d",int64(rc)))
+{o,u:=identifyChunk(r,tb,4,mx-len(out)); out=append(out,o...); if u!="" {mt=u}}
+Trace("out=append(out,\"not one\")")
+out=append(out,"last")`)
+
+	var literals []string
+	for _, site := range findDescriptionLiterals(code) {
+		assert.EqualValues(t, site.literal, string(code[site.start:site.end]))
+		literals = append(literals, site.literal)
+	}
+	assert.EqualValues(t, []string{`"a \"quoted\" one"`, `"\\b, %d"`, `"last"`}, literals)
+}
+
+func Test_DedupeDescriptions(t *testing.T) {
+	long := `"a description long enough to be worth sharing, even between two parts"`
+	line := "out=append(out," + long + ")\n"
+	first := &codePart{
+		code:  []byte(line + "out=append(out,\"short\")\nout=append(out,\"short\")\n"),
+		marks: []sourceMark{{offset: 0, source: "one"}, {offset: len(line), source: "two"}},
+	}
+	formatted := "out=append(out,sf(" + long + ",rc))\n"
+	second := &codePart{
+		code:  []byte(formatted + line + "out=append(out,\"once\")\n"),
+		marks: []sourceMark{{offset: len(formatted), source: "three"}},
+	}
+
+	// not worth it
+	descs, replaced := dedupeDescriptions([]*codePart{first})
+	assert.Empty(t, descs)
+	assert.EqualValues(t, 0, replaced)
+
+	descs, replaced = dedupeDescriptions([]*codePart{first, second})
+	assert.EqualValues(t, []string{long}, descs)
+	assert.EqualValues(t, 3, replaced)
+	assert.EqualValues(t, "out=append(out,descs[0])\nout=append(out,\"short\")\nout=append(out,\"short\")\n", string(first.code))
+	assert.EqualValues(t, "out=append(out,sf(descs[0],rc))\nout=append(out,descs[0])\nout=append(out,\"once\")\n", string(second.code))
+
+	// marks still point at the same lines
+	assert.EqualValues(t, 0, first.marks[0].offset)
+	assert.EqualValues(t, len("out=append(out,descs[0])\n"), first.marks[1].offset)
+	assert.EqualValues(t, len("out=append(out,sf(descs[0],rc))\n"), second.marks[0].offset)
+}
+
+// repeatedMagic repeats descriptions across trees and pages
+func repeatedMagic(trees int) string {
+	var sb strings.Builder
+	sb.WriteString("0\tname\tversioned\n>4\tubyte\tx\t\\b, with a version number that is %d\n")
+	for i := 0; i < trees; i++ {
+		fmt.Fprintf(&sb, "0\tstring\tR%02d\trepeated format %d\n", i, i)
+		sb.WriteString(">3\tubyte\t1\t\\b, with some compressed data in it\n")
+		sb.WriteString(">3\tubyte\t2\t\\b, with a version number that is %d\n")
+		sb.WriteString(">3\tuse\t\\^versioned\n")
+	}
+	return sb.String()
+}
+
+func Test_CompileDedupe(t *testing.T) {
+	book := parseBook(t, repeatedMagic(20))
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	// 20 of each in the trees, where the version is known, and the one in
+	// each variant of the used page
+	assert.EqualValues(t, 20+20+2, stats.DescriptionsDeduplicated)
+	assert.Contains(t, code, "var descs = [...]string{\n\t\"\\\\b, with some compressed data in it\",\n\t\"\\\\b, with a version number that is 2\",\n\t\"\\\\b, with a version number that is %d\",\n}\n")
+	assert.EqualValues(t, 1, strings.Count(code, "with some compressed data in it"))
+	assert.EqualValues(t, 2, strings.Count(code, "with a version number"))
+	assert.Contains(t, code, "out = append(out, sf(descs[2], int64(rc)))")
+	// descriptions that appear once stay where they are
+	assert.Contains(t, code, "out = append(out, \"repeated format 7\")")
+
+	// split, descs is in the first part
+	dir := t.TempDir()
+	stats, err = CompileToDir(dir, book, Options{Package: "generated", PagesPerFile: 1})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 20+20+2, stats.DescriptionsDeduplicated)
+}
+
+func Test_GeneratedDedupe(t *testing.T) {
+	book := parseBook(t, repeatedMagic(20))
+	samples := []generatedSample{
+		{name: "compressed", data: "R07\x01\x00\x00\x00\x09", expected: `repeated format 7|\b, with some compressed data in it|\b, with a version number that is 9`},
+		{name: "version", data: "R13\x02\x00\x00\x00\x05", expected: `repeated format 13|\b, with a version number that is 2|\b, with a version number that is 5`},
+	}
+	for _, opts := range []Options{{}, {PagesPerFile: 1, Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
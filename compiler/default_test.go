@@ -0,0 +1,116 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GeneratedDefault(t *testing.T) {
+	book := parseBook(t, `
+0	name	tail
+>0	byte	9	\b, nine
+>0	clear	x
+>0	default	x	\b, cleared
+0	string	AB	ab
+>2	byte	1	\b, one
+>>3	byte	1	\b, sub one
+>>3	default	x	\b, sub default
+>2	byte	2	\b, two
+>>3	byte	2	\b, sub two
+>>3	default	x	\b, sub default
+>>>4	byte	7	\b, seven
+>>>4	default	x	\b, not seven
+>2	default	x	\b, neither
+>>3	use	tail
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "defaults"})
+	assert.NoError(t, err)
+	code := buf.String()
+	// one flag for each parent of default or clear rules
+	assert.Contains(t, code, "var d [4]bool")
+
+	inputs := []struct {
+		name string
+		data string
+	}{
+		{"one, sub one", "AB\x01\x01"},
+		{"one, sub default", "AB\x01\x05"},
+		{"two, sub two", "AB\x02\x02"},
+		{"two, sub default", "AB\x02\x01\x07"},
+		{"two, sub default, not seven", "AB\x02\x01\x08"},
+		{"neither, nine", "AB\x03\x09"},
+		{"neither, cleared", "AB\x03\x05"},
+	}
+
+	// the generated code must find what the interpreter does
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, in := range inputs {
+		sr := utils.NewSliceReader(strings.NewReader(in.data), 0, int64(len(in.data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     in.name,
+			data:     in.data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+
+	// defaults of a subtree don't depend on what matched in its siblings
+	assert.EqualValues(t, `ab|\b, two|\b, sub default|\b, seven`, samples[3].expected)
+	assert.EqualValues(t, `ab|\b, neither|\b, nine|\b, cleared`, samples[5].expected)
+	assert.EqualValues(t, `ab|\b, neither|\b, cleared`, samples[6].expected)
+
+	for _, opts := range []Options{{}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+func Test_GeneratedDeepLevels(t *testing.T) {
+	const levels = 40
+
+	var magic strings.Builder
+	magic.WriteString("0\tubyte\t0\tlevel 0\n")
+	for i := 1; i < levels; i++ {
+		fmt.Fprintf(&magic, "%s%d\tubyte\t%d\t%d\n", strings.Repeat(">", i), i, i, i)
+	}
+	// every level has a default rule, so every level needs a flag
+	for i := levels - 1; i > 0; i-- {
+		fmt.Fprintf(&magic, "%s%d\tdefault\tx\t\\b, no %d\n", strings.Repeat(">", i), i, i)
+	}
+	book := parseBook(t, magic.String())
+
+	var all, cut []byte
+	for i := 0; i < levels; i++ {
+		all = append(all, byte(i))
+		cut = append(cut, byte(i))
+	}
+	cut[35] = 0xff
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range [][]byte{all, cut} {
+		sr := utils.NewSliceReader(bytes.NewReader(data), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     string(data),
+			expected: strings.Join(result, "|"),
+		})
+	}
+	assert.True(t, strings.HasSuffix(samples[0].expected, "|38|39"))
+	assert.True(t, strings.HasSuffix(samples[1].expected, `|34|\b, no 35`))
+
+	for _, opts := range []Options{{}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
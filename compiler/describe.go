@@ -0,0 +1,262 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// Descriptions are formatted like the interpreter does it: the first
+// printf-style conversion gets the value the rule read. Whatever can be
+// formatted at compile time is, so most rules keep appending a constant.
+
+// description is the description of a rule, with its escapes decoded, and
+// its first conversion parsed
+type description struct {
+	utils.Conversion
+	// join is what the fragment starts with in generated code: a leading
+	// \b, like in the interpreter, for fragments joined to the previous one
+	join string
+}
+
+// parseDescription decodes desc, and finds its first conversion
+func parseDescription(desc []byte) (description, bool) {
+	text, join := utils.DecodeDescription(string(desc))
+	c, found := utils.ParseConversion(text)
+	d := description{Conversion: c}
+	if join {
+		d.join = utils.DescriptionJoin
+	}
+	return d, found
+}
+
+// hasConversions tells whether a rule of book has a conversion in its
+// description, that generated code may format at run time
+func hasConversions(book parser.Spellbook) bool {
+	for _, rules := range book {
+		for _, rule := range rules {
+			if _, found := parseDescription(rule.Description); found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// constant returns a statement appending s, which doesn't depend on what
+// was read
+func (d description) constant(s string) string {
+	return fmt.Sprintf("out=append(out,%s)", strconv.Quote(d.join+s))
+}
+
+// formatted returns a statement appending arg formatted with format, at
+// run time. The join prefix has no verbs, it goes in the format as-is.
+func (d description) formatted(format string, arg string) string {
+	return fmt.Sprintf("out=append(out,sf(%s,%s))", strconv.Quote(d.join+format), arg)
+}
+
+// describeConstant returns a statement appending a description that doesn't
+// depend on what was read
+func describeConstant(desc []byte) string {
+	c, _ := parseDescription(desc)
+	return c.constant(c.Unformatted())
+}
+
+// describeInteger returns a statement appending the description of an
+// integer rule. value is the uint64 it read, ok tells whether the read
+// succeeded, which "x" tests don't need to match.
+func describeInteger(rule parser.Rule, ik *parser.IntegerKind, value string, ok string) string {
+	c, found := parseDescription(rule.Description)
+	if !found {
+		return c.constant(c.Prefix)
+	}
+	if c.IsFloat() {
+		return c.constant(c.Unformatted())
+	}
+
+	format, arg := c.IntegerFormat()
+	var expr string
+	switch arg {
+	case utils.IntegerArgSigned:
+		if ik.Signed {
+			expr = fmt.Sprintf("int%d(%s)", ik.ByteWidth*8, value)
+		} else {
+			expr = fmt.Sprintf("int64(%s)", value)
+		}
+	case utils.IntegerArgChar:
+		expr = fmt.Sprintf("rune(byte(%s))", value)
+	default:
+		expr = value
+	}
+
+	formatted := c.formatted(c.GoFormat(format), expr)
+	if !ik.MatchAny {
+		return formatted
+	}
+	return fmt.Sprintf("if %s {%s} else {%s}", ok, formatted, c.constant(c.Unformatted()))
+}
+
+// describeDate returns a statement appending the description of a date
+// rule. Dates printed with "%s" go through the runtime's FormatDate, other
+// conversions print the number like integer rules do.
+func describeDate(rule parser.Rule, dk *parser.DateKind, value string, ok string) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' {
+		return describeInteger(rule, &dk.IntegerKind, value, ok)
+	}
+
+	if dk.DoAnd {
+		value = fmt.Sprintf("%s&%s", value, quoteUnsigned(dk.AndValue))
+	}
+	formatted := c.formatted(c.GoFormat(c.Spec+"s"),
+		fmt.Sprintf("dt(%s,%d,%v,%s)", value, dk.ByteWidth, dk.Local, dateFormatName(dk.Format)))
+	if !dk.MatchAny {
+		return formatted
+	}
+	return fmt.Sprintf("if %s {%s} else {%s}", ok, formatted, c.constant(c.Unformatted()))
+}
+
+// dateFormatName returns the name of the constant generated code uses for
+// a utils.DateFormat
+func dateFormatName(format utils.DateFormat) string {
+	switch format {
+	case utils.DateFormatDOSDate:
+		return "dd"
+	case utils.DateFormatDOSTime:
+		return "dm"
+	default:
+		return "du"
+	}
+}
+
+// describeFloat returns a statement appending the description of a float
+// rule, value holds the bits it read
+func describeFloat(rule parser.Rule, fk *parser.FloatKind, value string, ok string) string {
+	c, found := parseDescription(rule.Description)
+	if !found {
+		return c.constant(c.Prefix)
+	}
+	if !c.IsFloat() {
+		return c.constant(c.Unformatted())
+	}
+
+	formatted := c.formatted(c.GoFormat(c.FloatFormat()), floatExpression(fk, value))
+	if !fk.MatchAny {
+		return formatted
+	}
+	return fmt.Sprintf("if %s {%s} else {%s}", ok, formatted, c.constant(c.Unformatted()))
+}
+
+// describeSwitchCase returns the description of a switch case, which only
+// matches a single value, so it's always formatted at compile time
+func describeSwitchCase(sk *parser.SwitchKind, sc *parser.SwitchCase) string {
+	c, found := parseDescription(sc.Description)
+	if !found {
+		return c.constant(c.Prefix)
+	}
+
+	value := utils.TruncateUint(uint64(sc.Value), sk.ByteWidth)
+	signed := int64(value)
+	if sk.Signed {
+		signed = int64(utils.SignExtend(value, sk.ByteWidth))
+	}
+	return c.constant(c.FormatInteger(value, signed))
+}
+
+// describeString returns a statement appending the description of a string
+// rule, which matched from off to rA
+func describeString(rule parser.Rule, sk *parser.StringKind, off Expression) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' || sk.Negate || sk.Value == "" {
+		// negated tests don't match anything to show
+		return c.constant(c.Unformatted())
+	}
+
+	if sk.Flags == 0 {
+		// exact matches are the pattern itself
+		return c.constant(c.FormatBytes([]byte(sk.Value)))
+	}
+	return c.formatted(c.GoFormat(c.Spec+"s"), fmt.Sprintf("rs(r,%s,rA)", off))
+}
+
+// describePString returns a statement appending the description of a
+// pstring rule, whose string starts at start and is rc bytes long
+func describePString(rule parser.Rule, pk *parser.PStringKind, start Expression) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' || pk.Negate {
+		return c.constant(c.Unformatted())
+	}
+	return c.formatted(c.GoFormat(c.Spec+"s"), fmt.Sprintf("rs(r,%s,%s+int64(rc))", start, start))
+}
+
+// describeGuid returns a statement appending the description of a guid
+// rule, which matched the 16 bytes at off
+func describeGuid(rule parser.Rule, gk *parser.GuidKind, off Expression) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' {
+		return c.constant(c.Unformatted())
+	}
+
+	if !gk.MatchAny {
+		return c.constant(c.FormatString(utils.FormatGUID(gk.Value)))
+	}
+	end := &BinaryOp{LHS: off, Operator: OperatorAdd, RHS: &NumberLiteral{Value: utils.GUIDSize}}
+	return c.formatted(c.GoFormat(c.Spec+"s"), fmt.Sprintf("gs(rs(r,%s,%s))", off, end.Fold()))
+}
+
+// describeString16 returns a statement appending the description of a
+// string16 rule, which matched from off to rA. "x" tests show the string
+// they found, others their pattern. bigEndian is an expression telling
+// whether it's big-endian.
+func describeString16(rule parser.Rule, sk *parser.String16Kind, off Expression, bigEndian string) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' || sk.Negate {
+		return c.constant(c.Unformatted())
+	}
+
+	if !sk.MatchAny {
+		return c.constant(c.FormatBytes([]byte(sk.Value)))
+	}
+	return c.formatted(c.GoFormat(c.Spec+"s"), fmt.Sprintf("ud(r,%s,rA,%s)", off, bigEndian))
+}
+
+// describeSearch returns a statement appending the description of a search
+// rule, which matches its pattern exactly
+func describeSearch(rule parser.Rule, sk *parser.SearchKind) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' {
+		return c.constant(c.Unformatted())
+	}
+	return c.constant(c.FormatBytes([]byte(sk.Value)))
+}
+
+// describeRegex returns a statement appending the description of a regex
+// rule, which matched from off+rA to off+rB. Empty matches have nothing to
+// show.
+func describeRegex(rule parser.Rule, off Expression) string {
+	c, found := parseDescription(rule.Description)
+	if !found || c.Verb != 's' {
+		return c.constant(c.Unformatted())
+	}
+
+	start := &BinaryOp{LHS: off, Operator: OperatorAdd, RHS: &VariableAccess{"rA"}}
+	end := &BinaryOp{LHS: off, Operator: OperatorAdd, RHS: &VariableAccess{"rB"}}
+	formatted := c.formatted(c.GoFormat(c.Spec+"s"), fmt.Sprintf("rs(r,%s,%s)", start.Fold(), end.Fold()))
+	return fmt.Sprintf("if rB>rA {%s} else {%s}", formatted, c.constant(c.Unformatted()))
+}
+
+// readsValue tells whether the code emitted for rule leaves the value it
+// read in rc: "x" tests only read if their description shows the value
+func readsValue(rule parser.Rule) bool {
+	ik, ok := rule.Kind.Data.(*parser.IntegerKind)
+	if !ok || rule.Kind.Family != parser.KindFamilyInteger {
+		return false
+	}
+	if !ik.MatchAny {
+		return true
+	}
+	_, found := parseDescription(rule.Description)
+	return found
+}
@@ -0,0 +1,148 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Describe(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"0\tubyte\t1\tno value", `out=append(out,"no value")`},
+		{"0\tubyte\t1\t100%%", `out=append(out,"100%")`},
+		{"0\tbyte\t>0\tversion %d", `out=append(out,sf("version %d",int8(rc)))`},
+		{"0\tbelong\t<0\tnegative %i", `out=append(out,sf("negative %d",int32(rc)))`},
+		{"0\tulequad\t>0\thuge %lld", `out=append(out,sf("huge %d",int64(rc)))`},
+		{"0\tuleshort\t>0\t%u%% done", `out=append(out,sf("%d%% done",rc))`},
+		{"0\tubyte\t>0\tflags %#02x %d", `out=append(out,sf("flags %#02x %%d",rc))`},
+		{"0\tubyte\t>0x20\tletter %c", `out=append(out,sf("letter %c",rune(byte(rc))))`},
+		{"0\tbeshort\t>0\tas string %5s", `out=append(out,sf("as string %5d",int16(rc)))`},
+		{"0\tuleshort\tx\tsize %llu", `if m {out=append(out,sf("size %d",rc))} else {out=append(out,"size %llu")}`},
+		{"0\tstring\tv1.\tversion %s", `out=append(out,"version v1.")`},
+		{"0\tstring\tv1.\tversion %.2s", `out=append(out,"version v1")`},
+		{"0\tstring\tv1.\tversion %d", `out=append(out,"version %d")`},
+		{"0\tstring\t!v1.\tnot %s", `out=append(out,"not %s")`},
+		{"0\tstring/c\tabc\tletters %-5.5s", `out=append(out,sf("letters %-5.5s",rs(r,po,rA)))`},
+		{"0\tsearch/64\tWAVE\tfound %s", `out=append(out,"found WAVE")`},
+		{"0\tledate\t>0\tmodified %s", `out=append(out,sf("modified %s",dt(rc,4,false,du)))`},
+		{"0\tbeqldate\tx\tmodified %s", `if m {out=append(out,sf("modified %s",dt(rc,8,true,du)))} else {out=append(out,"modified %s")}`},
+		{"0\tlemsdosdate&0xffff\tx\ton %s", `if m {out=append(out,sf("on %s",dt(rc&0xffff,2,false,dd)))} else {out=append(out,"on %s")}`},
+		{"0\tlemsdostime\tx\tat %s", `if m {out=append(out,sf("at %s",dt(rc,2,false,dm)))} else {out=append(out,"at %s")}`},
+		{"0\tledate\t>0\ttimestamp %d", `out=append(out,sf("timestamp %d",int64(rc)))`},
+		{"0\tguid\tx\tclass %s", `out=append(out,sf("class %s",gs(rs(r,po,po+16))))`},
+		{"0\tguid\t00020906-0000-0000-C000-000000000046\tclass %s", `out=append(out,"class 00020906-0000-0000-C000-000000000046")`},
+		{"0\tguid\tx\tclass %d", `out=append(out,"class %d")`},
+		{"0\tlestring16\tx\tname %s", `out=append(out,sf("name %s",ud(r,po,rA,false)))`},
+		{"0\tbestring16\tx\tname %-10s", `out=append(out,sf("name %-10s",ud(r,po,rA,true)))`},
+		{"0\tlestring16\tMZ\tfound %s", `out=append(out,"found MZ")`},
+		{"0\tlestring16\t!MZ\tnot %s", `out=append(out,"not %s")`},
+		{"0\tlefloat\tx\tfloat %g", `if m {out=append(out,sf("float %.6g",g4(rc)))} else {out=append(out,"float %g")}`},
+		{"0\tbedouble\t>1\tdouble %5.2f%%", `out=append(out,sf("double %5.2f%%",g8(rc)))`},
+		{"0\tbedouble\t>1\tdouble %d", `out=append(out,"double %d")`},
+		{"0\tubyte\t>1\tnot a float %f", `out=append(out,"not a float %f")`},
+		// escapes are decoded, a leading \b joins to the previous fragment
+		{"0\tubyte\t>0\t\\bversion %d", `out=append(out,sf("\\bversion %d",int64(rc)))`},
+		{"0\tulelong\tx\t\\b, %u bytes", `if m {out=append(out,sf("\\b, %d bytes",rc))} else {out=append(out,"\\b, %u bytes")}`},
+		{"0\tubyte\t1\tA\\x20B\\041\\\\\\t\\q", `out=append(out,"A B!\\\t\\q")`},
+		{"0\tubyte\t1\tnot\\bjoined", `out=append(out,"not\\bjoined")`},
+		{"0\tstring\tv1.\t\\b%s\\056", `out=append(out,"\\bv1..")`},
+	}
+
+	for _, c := range cases {
+		book := parseBook(t, c.line)
+		rule := book[""][0]
+
+		var actual string
+		switch rule.Kind.Family {
+		case parser.KindFamilyInteger:
+			actual = describeInteger(rule, rule.Kind.Data.(*parser.IntegerKind), "rc", "m")
+		case parser.KindFamilyString:
+			actual = describeString(rule, rule.Kind.Data.(*parser.StringKind), &VariableAccess{"po"})
+		case parser.KindFamilySearch:
+			actual = describeSearch(rule, rule.Kind.Data.(*parser.SearchKind))
+		case parser.KindFamilyGuid:
+			actual = describeGuid(rule, rule.Kind.Data.(*parser.GuidKind), &VariableAccess{"po"})
+		case parser.KindFamilyString16:
+			sk := rule.Kind.Data.(*parser.String16Kind)
+			actual = describeString16(rule, sk, &VariableAccess{"po"}, strconv.FormatBool(sk.Endianness == parser.BigEndian))
+		case parser.KindFamilyFloat:
+			actual = describeFloat(rule, rule.Kind.Data.(*parser.FloatKind), "rc", "m")
+		case parser.KindFamilyDate:
+			actual = describeDate(rule, rule.Kind.Data.(*parser.DateKind), "rc", "m")
+		}
+		assert.EqualValues(t, c.expected, actual, "for %q", c.line)
+	}
+}
+
+func Test_DescribeSwitchCase(t *testing.T) {
+	sk := &parser.SwitchKind{ByteWidth: 1, Signed: true}
+
+	assert.EqualValues(t, `out=append(out,"minus one (-1)")`, describeSwitchCase(sk, &parser.SwitchCase{Value: -1, Description: []byte("minus one (%d)")}))
+	assert.EqualValues(t, `out=append(out,"unsigned 255")`, describeSwitchCase(sk, &parser.SwitchCase{Value: -1, Description: []byte("unsigned %u")}))
+	assert.EqualValues(t, `out=append(out,"plain")`, describeSwitchCase(sk, &parser.SwitchCase{Value: 1, Description: []byte("plain")}))
+	assert.EqualValues(t, `out=append(out,"\\b, 1\t")`, describeSwitchCase(sk, &parser.SwitchCase{Value: 1, Description: []byte(`\b, %d\t`)}))
+}
+
+func Test_CompileDirectAppends(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+
+	// descriptions are appended where they're found, without a closure
+	assert.NotContains(t, code, ":= func(")
+	assert.NotContains(t, code, "a(o...)")
+	assert.Contains(t, code, "out = append(out, o...)")
+	assert.Contains(t, code, "out = append(out, \"Zip archive data\")")
+}
+
+// escapesMagic has descriptions joined to the previous one, and escapes
+const escapesMagic = `
+0	string	AB	ab
+>2	ubyte	x	\bversion %d
+>3	ubyte	1	\b,\x20one\041
+>3	ubyte	2	\b,\040two\\
+>3	ubyte	3	three
+>3	ubyte	4	\bfour
+>3	ubyte	5	\b, five
+>3	ubyte	6	\bsix
+>4	string	C	\b\tC%s
+`
+
+func Test_GeneratedDescriptionEscapes(t *testing.T) {
+	book := parseBook(t, escapesMagic)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	var merged []string
+	for _, data := range []string{"AB\x03\x01C", "AB\x04\x02", "AB\x05\x03", "AB\x06\x04", "AB\x07\x05C", "AB\x08\x06"} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+		merged = append(merged, utils.MergeStrings(result))
+	}
+	assert.EqualValues(t, []string{"abversion 3, one!\tCC", "abversion 4, two\\", "abversion 5 three", "abversion 6four", "abversion 7, five\tCC", "abversion 8six"}, merged)
+
+	// the test checks IdentifyString against the merged descriptions too
+	for _, opts := range []Options{{}, {SelfContained: true, Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
@@ -0,0 +1,126 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CompileSingleDispatch(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "generated", SingleDispatch: true})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, "func identifyPage(id int, swap bool, r *utils.SliceReader, po int64, mx int) ([]string, string) {")
+	assert.NotContains(t, code, "func identify(")
+	assert.Contains(t, code, "\tcase 0: // \"\"\n")
+	assert.Contains(t, code, "o, u := identifyPage(0, f, sl(r), po, 0)")
+	// the exported functions are still there
+	assert.Contains(t, code, "func IdentifyStrings(r Reader) []string {")
+	assert.Contains(t, code, "func Identify__Result(r Reader, po int64) Result {")
+	assert.NotZero(t, stats.PagesEmitted)
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", SingleDispatch: true, EmitFilter: true, EmitMatchers: true, AllowCycles: true})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.Contains(t, code, "func identifyPage(id int, swap bool, r *utils.SliceReader, po int64, mx int, cd *[7]bool, dp int) ([]string, string) {")
+	assert.Contains(t, code, "o, _ := identifyPage(0, f, sl(r), 0, 0, &cd, 0)")
+	// matchers aren't dispatched
+	assert.Contains(t, code, "func is(r *utils.SliceReader, po int64, dp int) bool {")
+
+	// it's one function, so it's one file
+	dir := t.TempDir()
+	_, err = CompileToDir(dir, book, Options{Package: "generated", SingleDispatch: true, PagesPerFile: 1})
+	assert.NoError(t, err)
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func Test_GeneratedSingleDispatch(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	for _, opts := range []Options{
+		{},
+		{Structured: true, SelfContained: true},
+		{EmitMatchers: true, AllowCycles: true, PagesPerFile: 2},
+		{EmitFilter: true, SortByStrength: true},
+	} {
+		opts.SingleDispatch = true
+		testGenerated(t, book, opts)
+	}
+}
+
+const sizeMainSource = `package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"generated"
+)
+
+func main() {
+	f, err := os.Open(os.Args[1])
+	if err != nil {
+		panic(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(generated.IdentifyStrings(io.NewSectionReader(f, 0, fi.Size())))
+}
+`
+
+// generatedTextSize builds a program identifying files with the code
+// generated from book with opts, and returns the size of the code of the
+// generated package in it
+func generatedTextSize(t *testing.T, book parser.Spellbook, opts Options) int64 {
+	dir := scratchModule(t, book, opts)
+	main := filepath.Join(dir, "cmd", "identify")
+	assert.NoError(t, os.MkdirAll(main, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(main, "main.go"), []byte(sizeMainSource), 0644))
+	binary := filepath.Join(dir, "identify")
+	runGo(t, dir, "build", "-o", binary, "./cmd/identify")
+
+	var size int64
+	scanner := bufio.NewScanner(strings.NewReader(runGo(t, dir, "tool", "nm", "-size", binary)))
+	for scanner.Scan() {
+		// address, size, type, name
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || (fields[2] != "T" && fields[2] != "t") || !strings.HasPrefix(fields[3], "generated.") {
+			continue
+		}
+		symbolSize, err := strconv.ParseInt(fields[1], 10, 64)
+		assert.NoError(t, err)
+		size += symbolSize
+	}
+	return size
+}
+
+// Test_SingleDispatchTextSize compares the size of the code generated with
+// and without SingleDispatch, once built. It only logs it, it depends on the
+// book and on go.
+func Test_SingleDispatchTextSize(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	perPage := generatedTextSize(t, book, Options{})
+	single := generatedTextSize(t, book, Options{SingleDispatch: true})
+	assert.NotZero(t, perPage)
+	assert.NotZero(t, single)
+	t.Logf("text of the generated package: %d bytes with a function per page, %d with SingleDispatch (%.1f%%)",
+		perPage, single, 100*float64(single)/float64(perPage))
+}
@@ -0,0 +1,82 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// RuleError is returned when a rule can't be compiled
+type RuleError struct {
+	// Page is the page the rule is on, "" for the top-level page
+	Page string
+
+	// Line is the magic source line of the rule
+	Line string
+
+	// File and LineNumber tell where the rule was read from, File is empty
+	// if it wasn't read from a file
+	File       string
+	LineNumber int
+
+	Err error
+}
+
+// ruleError returns a *RuleError about rule, of page
+func ruleError(page string, rule parser.Rule, err error) *RuleError {
+	return &RuleError{
+		Page:       page,
+		Line:       rule.Line,
+		File:       rule.SourceFile,
+		LineNumber: rule.SourceLine,
+		Err:        err,
+	}
+}
+
+func (re *RuleError) Error() string {
+	msg := fmt.Sprintf("can't compile rule %q of page %q: %v", re.Line, re.Page, re.Err)
+	if re.File != "" {
+		return fmt.Sprintf("%s:%d: %s", re.File, re.LineNumber, msg)
+	}
+	return msg
+}
+
+func (re *RuleError) Unwrap() error {
+	return re.Err
+}
+
+// UseCycleError is returned when pages use each other in a loop, which
+// generated code would follow until the stack overflows
+type UseCycleError struct {
+	// Pages is the loop, starting and ending with the same page
+	Pages []string
+
+	// Uses are the provenance of the use rules going from each page of the
+	// loop to the next, see ruleProvenance
+	Uses []string
+}
+
+func (uce *UseCycleError) Error() string {
+	names := make([]string, len(uce.Pages))
+	for i, page := range uce.Pages {
+		names[i] = strconv.Quote(page)
+	}
+	return fmt.Sprintf("pages use each other in a loop: %s (%s)", strings.Join(names, " -> "), strings.Join(uce.Uses, "; "))
+}
+
+// UnsupportedError is returned when rules of the book need something the
+// compiler doesn't support, unless Options.SkipUnsupported is set
+type UnsupportedError struct {
+	// Rules are the unsupported rules, each Err says what isn't supported
+	Rules []*RuleError
+}
+
+func (ue *UnsupportedError) Error() string {
+	lines := make([]string, len(ue.Rules))
+	for i, re := range ue.Rules {
+		lines[i] = re.Error()
+	}
+	return fmt.Sprintf("%d rules can't be compiled, leave them out with SkipUnsupported:\n%s", len(ue.Rules), strings.Join(lines, "\n"))
+}
@@ -0,0 +1,91 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// maxFilterKey is how many bytes of a string test at offset 0 the filter
+// checks, IdentifyFiltered reads at most that many
+const maxFilterKey = 8
+
+// treeFilter tells which top-level trees the filter can rule out, from the
+// first bytes of the target
+type treeFilter struct {
+	// keys are what the indexed trees need the target to start with, in
+	// the order of their trees
+	keys []string
+
+	// slots has, for every tree, its index in keys, or -1 if it always
+	// runs
+	slots []int
+
+	// prefixSize is how many bytes the filter needs, the length of the
+	// longest key
+	prefixSize int
+}
+
+// newTreeFilter returns the filter of the top-level trees whose first rule
+// is nodes
+func newTreeFilter(nodes []*ruleNode) *treeFilter {
+	tf := &treeFilter{}
+	for _, node := range nodes {
+		key, ok := filterKey(node.rule)
+		if !ok {
+			tf.slots = append(tf.slots, -1)
+			continue
+		}
+		tf.slots = append(tf.slots, len(tf.keys))
+		tf.keys = append(tf.keys, key)
+		if len(key) > tf.prefixSize {
+			tf.prefixSize = len(key)
+		}
+	}
+	return tf
+}
+
+// filterCheck returns the go expression telling whether a target starting
+// with p may match a tree of key
+func filterCheck(key string) string {
+	if len(key) == 1 {
+		return fmt.Sprintf("len(p)>0&&p[0]==%s", quoteUnsigned(uint64(key[0])))
+	}
+	return fmt.Sprintf("len(p)>=%d&&string(p[:%d])==%s", len(key), len(key), strconv.Quote(key))
+}
+
+// filterKey returns the bytes a target has to start with for rule, a
+// top-level one, to match, up to maxFilterKey of them. Only string tests
+// at offset 0, and byte equality tests there, have one: anything else may
+// match whatever the target starts with, as far as the filter knows.
+func filterKey(rule parser.Rule) (string, bool) {
+	of := rule.Offset
+	if of.OffsetType != parser.OffsetTypeDirect || of.IsRelative || of.Direct != 0 {
+		return "", false
+	}
+
+	switch rule.Kind.Family {
+	case parser.KindFamilyString:
+		sk, _ := rule.Kind.Data.(*parser.StringKind)
+		// text and binary only say what the target is, full words only
+		// look around the match
+		if sk.Negate || sk.Value == "" || sk.Flags&^(utils.ForceText|utils.ForceBinary|utils.FullWord) != 0 {
+			return "", false
+		}
+		if len(sk.Value) > maxFilterKey {
+			return sk.Value[:maxFilterKey], true
+		}
+		return sk.Value, true
+
+	case parser.KindFamilyInteger:
+		ik, _ := rule.Kind.Data.(*parser.IntegerKind)
+		if ik.ByteWidth != 1 || ik.MatchAny || ik.DoAnd || ik.AdjustmentType != parser.AdjustmentNone ||
+			ik.IntegerTest != parser.IntegerTestEqual {
+			return "", false
+		}
+		return string([]byte{byte(utils.TruncateUint(uint64(ik.Value), 1))}), true
+	}
+	return "", false
+}
@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FilterKey(t *testing.T) {
+	book := parseBook(t, `
+0	string	GIF8	gif
+0	string	\x89PNG\r\n\x1a\nmore	png
+0	ubyte	0x7f	byte
+0	byte	-1	signed byte
+0	string/b	BIN	binary
+0	string/c	gif8	any case
+0	string	!NOT	negated
+0	string	\0	nul
+4	string	FAR	not at 0
+&0	string	REL	relative
+(4.l)	string	IND	indirect
+0	ubyte	>1	greater
+0	ubyte&0xf0	0x10	masked
+0	ubeshort	0x1f8b	short
+0	search/16	FIND	search
+0	default	x	default
+`)
+
+	var keys []string
+	var ok []bool
+	for _, rule := range book[""] {
+		key, indexed := filterKey(rule)
+		keys = append(keys, key)
+		ok = append(ok, indexed)
+	}
+	assert.EqualValues(t, []string{"GIF8", "\x89PNG\r\n\x1a\n", "\x7f", "\xff", "BIN", "", "", "\x00", "", "", "", "", "", "", "", ""}, keys)
+	assert.EqualValues(t, []bool{true, true, true, true, true, false, false, true, false, false, false, false, false, false, false, false}, ok)
+
+	filter := newTreeFilter(treeify(book[""]))
+	assert.EqualValues(t, []int{0, 1, 2, 3, 4, -1, -1, 5, -1, -1, -1, -1, -1, -1, -1, -1}, filter.slots)
+	assert.EqualValues(t, 8, filter.prefixSize)
+
+	assert.EqualValues(t, "len(p)>0&&p[0]==0x7f", filterCheck("\x7f"))
+	assert.EqualValues(t, `len(p)>=4&&string(p[:4])=="GIF8"`, filterCheck("GIF8"))
+}
+
+func Test_CompileFilter(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "IdentifyFiltered")
+	assert.Contains(t, buf.String(), "func identify(r *utils.SliceReader, po int64, mx int) ([]string, string) {")
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", EmitFilter: true})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, "func identify(r *utils.SliceReader, po int64, mx int, cd *[7]bool) ([]string, string) {")
+	assert.Contains(t, code, "func GuessCandidates(prefix []byte) []string {")
+	assert.Contains(t, code, "func IdentifyFiltered(r Reader) []string {")
+	assert.Contains(t, code, "\tcd[2] = len(p) >= 4 && string(p[:4]) == \"\\x7fELF\"\n")
+	assert.Contains(t, code, "o, u := identify(sl(r), po, 0, nil)")
+	// matchers don't filter
+	assert.NotContains(t, code, "func is(r *utils.SliceReader, po int64, cd")
+}
+
+const filterTestSource = `package generated
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var corpus = []string{
+%s}
+
+func sectionReader(data string) *io.SectionReader {
+	return io.NewSectionReader(strings.NewReader(data), 0, int64(len(data)))
+}
+
+func TestFiltered(t *testing.T) {
+	for _, data := range corpus {
+		expected := IdentifyStrings(sectionReader(data))
+		if actual := IdentifyFiltered(sectionReader(data)); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%%q: expected %%q, got %%q", data, expected, actual)
+		}
+	}
+
+	all := GuessCandidates(nil)
+	if len(all) == 0 || len(all) >= len(treeLines) {
+		t.Errorf("expected some trees to be ruled out for empty targets, got %%q", all)
+	}
+	png := strings.Join(GuessCandidates([]byte("\x89PNG\r\n\x1a\n")), "\n")
+	if !strings.Contains(png, "PNG image data") || strings.Contains(png, "Zip archive data") {
+		t.Errorf("expected PNG images, and not zip archives, got %%q", png)
+	}
+}
+
+func BenchmarkUnfiltered(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, data := range corpus {
+			IdentifyStrings(sectionReader(data))
+		}
+	}
+}
+
+func BenchmarkFiltered(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, data := range corpus {
+			IdentifyFiltered(sectionReader(data))
+		}
+	}
+}
+`
+
+func Test_GeneratedFilter(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	// the samples, and how they start, down to nothing
+	var corpus strings.Builder
+	for _, s := range generatedSamples {
+		for _, size := range []int{len(s.data), 8, 4, 1, 0} {
+			if size <= len(s.data) {
+				fmt.Fprintf(&corpus, "\t%s,\n", strconv.Quote(s.data[:size]))
+			}
+		}
+	}
+
+	for _, opts := range []Options{{}, {Structured: true, SortByStrength: true}, {PagesPerFile: 2, AllowCycles: true}} {
+		opts.EmitFilter = true
+		dir := scratchModule(t, book, opts)
+		err := ioutil.WriteFile(filepath.Join(dir, "filter_test.go"), []byte(fmt.Sprintf(filterTestSource, corpus.String())), 0644)
+		assert.NoError(t, err)
+		runGo(t, dir, "test", "-bench", ".", "-benchtime", "100x", "./...")
+	}
+}
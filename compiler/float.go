@@ -0,0 +1,44 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// floatExpression returns a go expression reinterpreting value, the bits
+// read by a float test, as a float64. g4 and g8 are emitted in the shared
+// part when the book has float tests.
+func floatExpression(fk *parser.FloatKind, value string) string {
+	return fmt.Sprintf("g%d(%s)", fk.ByteWidth, value)
+}
+
+// floatTestExpression returns a go expression performing the test
+// described by fk on value, the bits read from the target. Go's comparisons
+// already behave like file(1)'s: NaN is only different, and -0 equals 0.
+func floatTestExpression(fk *parser.FloatKind, value string) string {
+	l := fk.Value
+	if fk.ByteWidth == 4 {
+		l = float64(float32(l))
+	}
+
+	// go constants have no infinities or NaN, those are spelled as bits
+	rhs := strconv.FormatFloat(l, 'g', -1, 64)
+	if math.IsInf(l, 0) || math.IsNaN(l) {
+		rhs = fmt.Sprintf("g8(%s)", quoteUnsigned(math.Float64bits(l)))
+	}
+
+	expr := floatExpression(fk, value)
+	switch fk.FloatTest {
+	case parser.IntegerTestNotEqual:
+		return fmt.Sprintf("%s!=%s", expr, rhs)
+	case parser.IntegerTestLessThan:
+		return fmt.Sprintf("%s<%s", expr, rhs)
+	case parser.IntegerTestGreaterThan:
+		return fmt.Sprintf("%s>%s", expr, rhs)
+	default:
+		return fmt.Sprintf("%s==%s", expr, rhs)
+	}
+}
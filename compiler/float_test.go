@@ -0,0 +1,101 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const floatMagic = `
+0	string	FL	floats
+>2	lefloat	x	\b, float %g
+>2	lefloat	0	\b, zero
+>2	lefloat	!0	\b, not zero
+>2	lefloat	<0	\b, negative
+>2	lefloat	>1e30	\b, huge
+>6	bedouble	>1.5	\b, double over 1.5 (%.2f)
+>6	bedouble	x	\b, double %e
+>6	bedouble	=inf	\b, infinite
+`
+
+func Test_FloatTestExpression(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"0\tlefloat\t0\tzero", "g4(rc)==0"},
+		{"0\tlefloat\t!-0\tnot zero", "g4(rc)!=-0"},
+		{"0\tbefloat\t<0.1\tsmall", "g4(rc)<0.10000000149011612"},
+		{"0\tledouble\t>0.1\tbig", "g8(rc)>0.1"},
+		{"0\tdouble\t=-inf\tinfinite", "g8(rc)==g8(0xfff0000000000000)"},
+	}
+
+	for _, c := range cases {
+		book := parseBook(t, c.line)
+		fk, ok := book[""][0].Kind.Data.(*parser.FloatKind)
+		assert.True(t, ok, "for %q", c.line)
+		if ok {
+			assert.EqualValues(t, c.expected, floatTestExpression(fk, "rc"), "for %q", c.line)
+		}
+	}
+}
+
+func Test_CompileFloatImports(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, parseBook(t, floatMagic), Options{Package: "floats"})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "\t\"math\"\n")
+
+	// no float rules, no math
+	buf.Reset()
+	_, err = CompileTo(&buf, parseBook(t, "0\tulelong\t1\tone"), Options{Package: "integers"})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "\"math\"")
+}
+
+func Test_GeneratedFloat(t *testing.T) {
+	book := parseBook(t, floatMagic)
+
+	inputs := []struct {
+		name string
+		data string
+	}{
+		{"zero", "FL\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{"negative zero", "FL\x00\x00\x00\x80\x80\x00\x00\x00\x00\x00\x00\x00"},
+		{"NaN", "FL\x00\x00\xc0\x7f\x7f\xf8\x00\x00\x00\x00\x00\x01"},
+		{"negative", "FL\x00\x00\xc0\xbf\x40\x02\x00\x00\x00\x00\x00\x00"},
+		{"huge", "FL\xff\xff\x7f\x7f\x7f\xf0\x00\x00\x00\x00\x00\x00"},
+		{"short", "FL\x00\x00\x80\x3f\x40"},
+	}
+
+	// the generated code must find what the interpreter does
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, in := range inputs {
+		sr := utils.NewSliceReader(strings.NewReader(in.data), 0, int64(len(in.data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     in.name,
+			data:     in.data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+
+	assert.EqualValues(t, `floats|\b, float -0|\b, zero|\b, double -0.000000e+00`, samples[1].expected)
+	assert.EqualValues(t, `floats|\b, float NaN|\b, not zero|\b, double NaN`, samples[2].expected)
+	assert.EqualValues(t, `floats|\b, float 3.40282e+38|\b, not zero|\b, huge|\b, double over 1.5 (+Inf)|\b, double +Inf|\b, infinite`, samples[4].expected)
+
+	testGeneratedSamples(t, book, Options{}, samples)
+	t.Run("self-contained", func(t *testing.T) {
+		testGeneratedSamples(t, book, Options{SelfContained: true}, samples)
+	})
+	t.Run("minimal imports", func(t *testing.T) {
+		testGeneratedSamples(t, book, Options{MinimalImports: true}, samples)
+	})
+}
@@ -2,6 +2,7 @@ package compiler
 
 import (
 	"fmt"
+	"math"
 )
 
 // This package implements constant folding
@@ -77,12 +78,29 @@ type Expression interface {
 
 type NumberLiteral struct {
 	Value int64
+	// Hex writes the number in hexadecimal, like the magic it comes from
+	Hex bool
 }
 
 var _ Expression = (*NumberLiteral)(nil)
 
+// String writes negative numbers in parentheses, so that x-(-4) doesn't
+// become a decrement
 func (nl *NumberLiteral) String() string {
-	return fmt.Sprintf("%d", nl.Value)
+	var s string
+	if nl.Hex {
+		if nl.Value < 0 {
+			s = fmt.Sprintf("-0x%x", uint64(-nl.Value))
+		} else {
+			s = fmt.Sprintf("0x%x", nl.Value)
+		}
+	} else {
+		s = fmt.Sprintf("%d", nl.Value)
+	}
+	if nl.Value < 0 {
+		s = "(" + s + ")"
+	}
+	return s
 }
 
 func (nl *NumberLiteral) Fold() Expression {
@@ -112,91 +130,180 @@ type BinaryOp struct {
 var _ Expression = (*BinaryOp)(nil)
 
 func (bo *BinaryOp) String() string {
-	if rhs, ok := bo.RHS.(*BinaryOp); ok && rhs.Operator.Precedence() < bo.Operator.Precedence() {
-		return fmt.Sprintf("%s%s(%s)", bo.LHS, bo.Operator, bo.RHS)
+	lhs := bo.LHS.String()
+	if lop, ok := bo.LHS.(*BinaryOp); ok && lop.Operator.Precedence() < bo.Operator.Precedence() {
+		lhs = "(" + lhs + ")"
 	}
-	if lhs, ok := bo.LHS.(*BinaryOp); ok && lhs.Operator.Precedence() < bo.Operator.Precedence() {
-		return fmt.Sprintf("(%s)%s%s", bo.LHS, bo.Operator, bo.RHS)
+	rhs := bo.RHS.String()
+	// a-(b-c) isn't a-b-c, and a*(b/c) isn't a*b/c either
+	if rop, ok := bo.RHS.(*BinaryOp); ok {
+		if rop.Operator.Precedence() < bo.Operator.Precedence() ||
+			(rop.Operator.Precedence() == bo.Operator.Precedence() && !(rop.Operator == bo.Operator && bo.Operator.IsAssociative())) {
+			rhs = "(" + rhs + ")"
+		}
 	}
-	return fmt.Sprintf("%s%s%s", bo.LHS, bo.Operator, bo.RHS)
+	return lhs + bo.Operator.String() + rhs
 }
 
+// Fold returns a simpler expression computing the same thing. Children are
+// folded first, then sums and products are flattened into their terms:
+// constants are combined, terms that cancel out are dropped, and what's
+// left is written in a canonical order, constant last, e.g. 2+(x-3)+gf-gf
+// becomes x-1. Divisions by zero are left as they are.
 func (bo *BinaryOp) Fold() Expression {
 	lhs := bo.LHS.Fold()
 	rhs := bo.RHS.Fold()
 
-	if bo.Operator == OperatorAdd {
-		if ln, ok := lhs.(*NumberLiteral); ok && ln.Value == 0 {
-			return rhs
+	switch bo.Operator {
+	case OperatorAdd, OperatorSub:
+		return foldSum(&BinaryOp{LHS: lhs, Operator: bo.Operator, RHS: rhs})
+	case OperatorMul:
+		return foldProduct(&BinaryOp{LHS: lhs, Operator: bo.Operator, RHS: rhs})
+	case OperatorDiv:
+		if rn, ok := rhs.(*NumberLiteral); ok {
+			if rn.Value == 1 {
+				return lhs
+			}
+			if ln, ok := lhs.(*NumberLiteral); ok && rn.Value != 0 {
+				return &NumberLiteral{Value: bo.Operator.Evaluate(ln.Value, rn.Value), Hex: ln.Hex || rn.Hex}
+			}
 		}
-		if rn, ok := rhs.(*NumberLiteral); ok && rn.Value == 0 {
-			return lhs
+	default:
+		ln, lok := lhs.(*NumberLiteral)
+		rn, rok := rhs.(*NumberLiteral)
+		if lok && rok {
+			return &NumberLiteral{Value: bo.Operator.Evaluate(ln.Value, rn.Value), Hex: ln.Hex || rn.Hex}
 		}
 	}
 
-	if bo.Operator == OperatorSub {
-		if ln, ok := lhs.(*NumberLiteral); ok && ln.Value == 0 {
-			if rn, ok := rhs.(*NumberLiteral); ok {
-				return &NumberLiteral{-rn.Value}
+	return &BinaryOp{
+		LHS:      lhs,
+		Operator: bo.Operator,
+		RHS:      rhs,
+	}
+}
+
+// sumTerm is a term of a sum, added or subtracted
+type sumTerm struct {
+	expr     Expression
+	negative bool
+}
+
+// foldSum folds a sum whose children are folded already
+func foldSum(sum Expression) Expression {
+	var terms []sumTerm
+	var constant int64
+	// the constant is written in hex if any of its parts was
+	hex := false
+
+	var flatten func(e Expression, negative bool)
+	flatten = func(e Expression, negative bool) {
+		switch e := e.(type) {
+		case *NumberLiteral:
+			hex = hex || e.Hex
+			if negative {
+				constant -= e.Value
+			} else {
+				constant += e.Value
 			}
-		}
-		if rn, ok := rhs.(*NumberLiteral); ok && rn.Value == 0 {
-			return rhs
+		case *BinaryOp:
+			if e.Operator == OperatorAdd || e.Operator == OperatorSub {
+				flatten(e.LHS, negative)
+				flatten(e.RHS, negative != (e.Operator == OperatorSub))
+				return
+			}
+			terms = append(terms, sumTerm{expr: e, negative: negative})
+		default:
+			terms = append(terms, sumTerm{expr: e, negative: negative})
 		}
 	}
+	flatten(sum, false)
 
-	if bo.Operator == OperatorMul {
-		if ln, ok := lhs.(*NumberLiteral); ok && ln.Value == 0 {
-			return &NumberLiteral{0}
+	// x-x is 0, whatever x is
+	var kept []sumTerm
+	for _, term := range terms {
+		cancelled := false
+		for i, other := range kept {
+			if other.negative != term.negative && other.expr.String() == term.expr.String() {
+				kept = append(kept[:i], kept[i+1:]...)
+				cancelled = true
+				break
+			}
 		}
-		if rn, ok := rhs.(*NumberLiteral); ok && rn.Value == 0 {
-			return &NumberLiteral{0}
+		if !cancelled {
+			kept = append(kept, term)
 		}
 	}
 
-	if ln, ok := lhs.(*NumberLiteral); ok {
-		if rn, ok := rhs.(*NumberLiteral); ok {
-			return &NumberLiteral{
-				Value: bo.Operator.Evaluate(ln.Value, rn.Value),
-			}
+	// start from the first added term, so there's something to subtract from
+	var result Expression
+	for i, term := range kept {
+		if !term.negative {
+			result = term.expr
+			kept = append(kept[:i:i], kept[i+1:]...)
+			break
+		}
+	}
+	if result == nil {
+		if len(kept) == 0 {
+			return &NumberLiteral{Value: constant, Hex: hex}
 		}
+		result = &NumberLiteral{Value: constant, Hex: hex}
+		constant = 0
+	}
 
-		if rop, ok := rhs.(*BinaryOp); ok && rop.Operator == bo.Operator && bo.Operator.IsAssociative() {
-			if cln, ok := rop.LHS.(*NumberLiteral); ok {
-				return &BinaryOp{
-					LHS:      &NumberLiteral{bo.Operator.Evaluate(ln.Value, cln.Value)},
-					RHS:      rop.RHS.Fold(),
-					Operator: bo.Operator,
-				}
-			} else if crn, ok := rop.RHS.(*NumberLiteral); ok {
-				return &BinaryOp{
-					LHS:      rop.LHS.Fold(),
-					RHS:      &NumberLiteral{bo.Operator.Evaluate(ln.Value, crn.Value)},
-					Operator: bo.Operator,
-				}
-			}
+	for _, term := range kept {
+		op := OperatorAdd
+		if term.negative {
+			op = OperatorSub
 		}
-	} else if rn, ok := rhs.(*NumberLiteral); ok {
-		if lop, ok := lhs.(*BinaryOp); ok && lop.Operator == bo.Operator && bo.Operator.IsAssociative() {
-			if cln, ok := lop.LHS.(*NumberLiteral); ok {
-				return &BinaryOp{
-					LHS:      &NumberLiteral{bo.Operator.Evaluate(rn.Value, cln.Value)},
-					RHS:      lop.RHS.Fold(),
-					Operator: bo.Operator,
-				}
-			} else if crn, ok := lop.RHS.(*NumberLiteral); ok {
-				return &BinaryOp{
-					LHS:      lop.LHS.Fold(),
-					RHS:      &NumberLiteral{bo.Operator.Evaluate(rn.Value, crn.Value)},
-					Operator: bo.Operator,
-				}
+		result = &BinaryOp{LHS: result, Operator: op, RHS: term.expr}
+	}
+
+	switch {
+	case constant > 0 || constant == math.MinInt64:
+		result = &BinaryOp{LHS: result, Operator: OperatorAdd, RHS: &NumberLiteral{Value: constant, Hex: hex}}
+	case constant < 0:
+		result = &BinaryOp{LHS: result, Operator: OperatorSub, RHS: &NumberLiteral{Value: -constant, Hex: hex}}
+	}
+	return result
+}
+
+// foldProduct folds a product whose children are folded already
+func foldProduct(product Expression) Expression {
+	var factors []Expression
+	constant := int64(1)
+	hex := false
+
+	var flatten func(e Expression)
+	flatten = func(e Expression) {
+		switch e := e.(type) {
+		case *NumberLiteral:
+			hex = hex || e.Hex
+			constant *= e.Value
+		case *BinaryOp:
+			if e.Operator == OperatorMul {
+				flatten(e.LHS)
+				flatten(e.RHS)
+				return
 			}
+			factors = append(factors, e)
+		default:
+			factors = append(factors, e)
 		}
 	}
+	flatten(product)
 
-	return &BinaryOp{
-		LHS:      lhs,
-		Operator: bo.Operator,
-		RHS:      rhs,
+	if constant == 0 || len(factors) == 0 {
+		return &NumberLiteral{Value: constant, Hex: hex}
+	}
+
+	result := factors[0]
+	for _, factor := range factors[1:] {
+		result = &BinaryOp{LHS: result, Operator: OperatorMul, RHS: factor}
+	}
+	if constant != 1 {
+		result = &BinaryOp{LHS: result, Operator: OperatorMul, RHS: &NumberLiteral{Value: constant, Hex: hex}}
 	}
+	return result
 }
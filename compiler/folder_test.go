@@ -1,17 +1,22 @@
 package compiler
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_Fold(t *testing.T) {
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{1},
+			LHS:      &NumberLiteral{Value: 1},
 			Operator: OperatorAdd,
-			RHS:      &NumberLiteral{3},
+			RHS:      &NumberLiteral{Value: 3},
 		}
 
 		assert.EqualValues(t, "1+3", node.String())
@@ -19,9 +24,9 @@ func Test_Fold(t *testing.T) {
 	}
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{3},
+			LHS:      &NumberLiteral{Value: 3},
 			Operator: OperatorSub,
-			RHS:      &NumberLiteral{1},
+			RHS:      &NumberLiteral{Value: 1},
 		}
 
 		assert.EqualValues(t, "3-1", node.String())
@@ -29,12 +34,12 @@ func Test_Fold(t *testing.T) {
 	}
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{1},
+			LHS:      &NumberLiteral{Value: 1},
 			Operator: OperatorAdd,
 			RHS: &BinaryOp{
-				LHS:      &NumberLiteral{2},
+				LHS:      &NumberLiteral{Value: 2},
 				Operator: OperatorAdd,
-				RHS:      &NumberLiteral{3},
+				RHS:      &NumberLiteral{Value: 3},
 			},
 		}
 		assert.EqualValues(t, "1+2+3", node.String())
@@ -42,12 +47,12 @@ func Test_Fold(t *testing.T) {
 	}
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{2},
+			LHS:      &NumberLiteral{Value: 2},
 			Operator: OperatorMul,
 			RHS: &BinaryOp{
-				LHS:      &NumberLiteral{3},
+				LHS:      &NumberLiteral{Value: 3},
 				Operator: OperatorAdd,
-				RHS:      &NumberLiteral{4},
+				RHS:      &NumberLiteral{Value: 4},
 			},
 		}
 		assert.EqualValues(t, "2*(3+4)", node.String())
@@ -56,12 +61,12 @@ func Test_Fold(t *testing.T) {
 	{
 		node := &BinaryOp{
 			LHS: &BinaryOp{
-				LHS:      &NumberLiteral{3},
+				LHS:      &NumberLiteral{Value: 3},
 				Operator: OperatorAdd,
-				RHS:      &NumberLiteral{4},
+				RHS:      &NumberLiteral{Value: 4},
 			},
 			Operator: OperatorMul,
-			RHS:      &NumberLiteral{2},
+			RHS:      &NumberLiteral{Value: 2},
 		}
 		assert.EqualValues(t, "(3+4)*2", node.String())
 		assert.EqualValues(t, "14", node.Fold().String())
@@ -71,9 +76,9 @@ func Test_Fold(t *testing.T) {
 			LHS:      &VariableAccess{"x"},
 			Operator: OperatorAdd,
 			RHS: &BinaryOp{
-				LHS:      &NumberLiteral{3},
+				LHS:      &NumberLiteral{Value: 3},
 				Operator: OperatorAdd,
-				RHS:      &NumberLiteral{2},
+				RHS:      &NumberLiteral{Value: 2},
 			},
 		}
 		assert.EqualValues(t, "x+3+2", node.String())
@@ -81,25 +86,25 @@ func Test_Fold(t *testing.T) {
 	}
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{2},
+			LHS:      &NumberLiteral{Value: 2},
 			Operator: OperatorAdd,
 			RHS: &BinaryOp{
-				LHS:      &NumberLiteral{3},
+				LHS:      &NumberLiteral{Value: 3},
 				Operator: OperatorAdd,
 				RHS:      &VariableAccess{"x"},
 			},
 		}
 		assert.EqualValues(t, "2+3+x", node.String())
-		assert.EqualValues(t, "5+x", node.Fold().String())
+		assert.EqualValues(t, "x+5", node.Fold().String())
 	}
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{2},
+			LHS:      &NumberLiteral{Value: 2},
 			Operator: OperatorAdd,
 			RHS: &BinaryOp{
 				LHS:      &VariableAccess{"x"},
 				Operator: OperatorAdd,
-				RHS:      &NumberLiteral{3},
+				RHS:      &NumberLiteral{Value: 3},
 			},
 		}
 		assert.EqualValues(t, "2+x+3", node.String())
@@ -108,34 +113,34 @@ func Test_Fold(t *testing.T) {
 	{
 		node := &BinaryOp{
 			LHS: &BinaryOp{
-				LHS:      &NumberLiteral{3},
+				LHS:      &NumberLiteral{Value: 3},
 				Operator: OperatorAdd,
 				RHS:      &VariableAccess{"x"},
 			},
 			Operator: OperatorAdd,
-			RHS:      &NumberLiteral{2},
+			RHS:      &NumberLiteral{Value: 2},
 		}
 		assert.EqualValues(t, "3+x+2", node.String())
-		assert.EqualValues(t, "5+x", node.Fold().String())
+		assert.EqualValues(t, "x+5", node.Fold().String())
 	}
 	{
 		node := &BinaryOp{
 			LHS: &BinaryOp{
 				LHS:      &VariableAccess{"x"},
 				Operator: OperatorAdd,
-				RHS:      &NumberLiteral{3},
+				RHS:      &NumberLiteral{Value: 3},
 			},
 			Operator: OperatorAdd,
-			RHS:      &NumberLiteral{2},
+			RHS:      &NumberLiteral{Value: 2},
 		}
 		assert.EqualValues(t, "x+3+2", node.String())
 		assert.EqualValues(t, "x+5", node.Fold().String())
 	}
 	{
 		node := &BinaryOp{
-			LHS:      &NumberLiteral{3},
+			LHS:      &NumberLiteral{Value: 3},
 			Operator: OperatorAdd,
-			RHS:      &NumberLiteral{0},
+			RHS:      &NumberLiteral{Value: 0},
 		}
 		assert.EqualValues(t, "3+0", node.String())
 		assert.EqualValues(t, "3", node.Fold().String())
@@ -144,7 +149,7 @@ func Test_Fold(t *testing.T) {
 		node := &BinaryOp{
 			LHS:      &VariableAccess{"x"},
 			Operator: OperatorAdd,
-			RHS:      &NumberLiteral{0},
+			RHS:      &NumberLiteral{Value: 0},
 		}
 		assert.EqualValues(t, "x+0", node.String())
 		assert.EqualValues(t, "x", node.Fold().String())
@@ -153,18 +158,224 @@ func Test_Fold(t *testing.T) {
 		node := &BinaryOp{
 			LHS:      &VariableAccess{"x"},
 			Operator: OperatorSub,
-			RHS:      &NumberLiteral{0},
+			RHS:      &NumberLiteral{Value: 0},
 		}
 		assert.EqualValues(t, "x-0", node.String())
-		assert.EqualValues(t, "0", node.Fold().String())
+		assert.EqualValues(t, "x", node.Fold().String())
 	}
 	{
 		node := &BinaryOp{
 			LHS:      &VariableAccess{"x"},
 			Operator: OperatorMul,
-			RHS:      &NumberLiteral{0},
+			RHS:      &NumberLiteral{Value: 0},
 		}
 		assert.EqualValues(t, "x*0", node.String())
 		assert.EqualValues(t, "0", node.Fold().String())
 	}
 }
+
+func Test_FoldRules(t *testing.T) {
+	x := &VariableAccess{"x"}
+	y := &VariableAccess{"y"}
+	gf := &VariableAccess{"gf"}
+	n := func(value int64) Expression { return &NumberLiteral{Value: value} }
+	hex := func(value int64) Expression { return &NumberLiteral{Value: value, Hex: true} }
+	op := func(lhs Expression, operator Operator, rhs Expression) Expression {
+		return &BinaryOp{LHS: lhs, Operator: operator, RHS: rhs}
+	}
+
+	cases := []struct {
+		expr     Expression
+		folded   string
+		unfolded string
+	}{
+		// identities
+		{op(n(0), OperatorAdd, x), "x", "0+x"},
+		{op(x, OperatorMul, n(1)), "x", "x*1"},
+		{op(n(1), OperatorMul, x), "x", "1*x"},
+		{op(x, OperatorDiv, n(1)), "x", "x/1"},
+		{op(n(0), OperatorMul, x), "0", "0*x"},
+		// constants, even under other operations
+		{op(n(7), OperatorDiv, n(2)), "3", "7/2"},
+		{op(n(-7), OperatorDiv, n(2)), "(-3)", "(-7)/2"},
+		{op(n(0xf0), OperatorBinaryAnd, n(0x3c)), "48", "240&60"},
+		{op(op(n(1), OperatorAdd, n(2)), OperatorMul, x), "x*3", "(1+2)*x"},
+		{op(op(x, OperatorAdd, n(3)), OperatorSub, n(1)), "x+2", "x+3-1"},
+		{op(op(x, OperatorSub, n(3)), OperatorAdd, n(1)), "x-2", "x-3+1"},
+		{op(n(2), OperatorSub, op(n(5), OperatorAdd, x)), "(-3)-x", "2-(5+x)"},
+		{op(n(2), OperatorMul, op(x, OperatorMul, n(3))), "x*6", "2*x*3"},
+		{op(op(x, OperatorMul, y), OperatorMul, n(2)), "x*y*2", "x*y*2"},
+		// terms that cancel out
+		{op(op(gf, OperatorAdd, n(4)), OperatorSub, gf), "4", "gf+4-gf"},
+		{op(op(x, OperatorSub, gf), OperatorAdd, op(gf, OperatorAdd, y)), "x+y", "x-gf+gf+y"},
+		{op(op(x, OperatorMul, n(2)), OperatorSub, op(x, OperatorMul, n(2))), "0", "x*2-x*2"},
+		// canonical order, constants last
+		{op(n(4), OperatorAdd, op(y, OperatorSub, x)), "y-x+4", "4+(y-x)"},
+		{op(n(4), OperatorSub, x), "4-x", "4-x"},
+		// division by zero stays, for go to complain about
+		{op(n(4), OperatorDiv, n(0)), "4/0", "4/0"},
+		{op(op(n(2), OperatorAdd, n(2)), OperatorDiv, op(x, OperatorSub, x)), "4/0", "(2+2)/(x-x)"},
+		// integer division doesn't distribute
+		{op(x, OperatorMul, op(y, OperatorDiv, n(2))), "x*(y/2)", "x*(y/2)"},
+		{op(op(x, OperatorAdd, n(8)), OperatorDiv, n(2)), "(x+8)/2", "(x+8)/2"},
+		// negative constants don't make decrements
+		{op(x, OperatorSub, n(-1)), "x+1", "x-(-1)"},
+		{op(x, OperatorMul, n(-2)), "x*(-2)", "x*(-2)"},
+		// numbers written in hex stay in hex
+		{op(op(x, OperatorAdd, hex(0x3c)), OperatorAdd, n(4)), "x+0x40", "x+0x3c+4"},
+		{op(x, OperatorAdd, hex(-0x10)), "x-0x10", "x+(-0x10)"},
+		{op(hex(0x10), OperatorMul, n(2)), "0x20", "0x10*2"},
+	}
+
+	for _, c := range cases {
+		assert.EqualValues(t, c.unfolded, c.expr.String())
+		assert.EqualValues(t, c.folded, c.expr.Fold().String(), "folding %s", c.unfolded)
+	}
+}
+
+// foldedOffsetsMagic reads the same indirect offsets in different ways
+const foldedOffsetsMagic = `
+0	string	IND
+>3	ubyte	x	\b, a=%d
+>(3.b)	ubyte	x	\b, at a %d
+>(3.b+0)	ubyte	x	\b, at a+0 %d
+>(3.b-1)	ubyte	x	\b, at a-1 %d
+>(3.b*1)	ubyte	x	\b, at a*1 %d
+>(3.b/1)	ubyte	x	\b, at a/1 %d
+>(3.b+2)	ubyte	x	\b, at a+2 %d
+>>(4.b)	ubyte	x	\b, at b %d
+>(3.b+2)	ubyte	x	\b, at a+2 again %d
+>(3.b+1)	ubyte	x	\b, at a+1 %d
+>(3.b+1)	ubyte	x	\b, there again %d
+`
+
+func Test_GeneratedFoldedOffsets(t *testing.T) {
+	book := parseBook(t, foldedOffsetsMagic)
+
+	var out bytes.Buffer
+	_, err := CompileTo(&out, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := out.String()
+	assert.NotContains(t, code, "+0)")
+	assert.NotContains(t, code, "*1)")
+	assert.NotContains(t, code, "/1)")
+	// the pointer is read again after a sibling's children read another
+	assert.EqualValues(t, 3, strings.Count(code, "ra, k = "))
+	// a, a+0, a*1 and a/1 read once, a+2 again reads what a+2 did
+	assert.EqualValues(t, 4, strings.Count(code, "rc, m = "))
+	assert.EqualValues(t, 1, strings.Count(code, "rd0, ok0 = f1(r, int64(ra)+po)"))
+	assert.EqualValues(t, 1, strings.Count(code, "rd1, ok1 = f1(r, int64(ra)+po+2)"))
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{"IND\x05\x06\x07\x08\x09\x0a\x0b\x0c", "IND\x06\x09\x00\x01\x02\x03\x04\x05"} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+
+	for _, opts := range []Options{{}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// negativeAdjustmentsMagic adjusts pointers by negative values, in a page
+// used at 8 so that the offsets stay positive
+const negativeAdjustmentsMagic = `
+0	name	neg
+>(0.b+-2)	ubyte	x	\b, add %d
+>(0.b--2)	ubyte	x	\b, sub %d
+>(0.b*-1)	ubyte	x	\b, mul %d
+>(0.b/-2)	ubyte	x	\b, div %d
+>(0.b+-0x2)	ubyte	x	\b, hex %d
+>(1.b*(-1))	ubyte	x	\b, mul pair %d
+>(1.b+(-1))	ubyte	x	\b, add pair %d
+0	string	NEG
+>8	use	neg
+`
+
+func Test_GeneratedNegativeAdjustments(t *testing.T) {
+	book := parseBook(t, negativeAdjustmentsMagic)
+
+	var out bytes.Buffer
+	_, err := CompileTo(&out, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := out.String()
+	assert.Contains(t, code, "int64(ra)+po-2)")
+	assert.Contains(t, code, "int64(ra)+po+2)")
+	assert.Contains(t, code, "int64(ra)*(-1)+po)")
+	assert.Contains(t, code, "// pointer divided by -2, never matches")
+	assert.Contains(t, code, "if ra < 0x2 {")
+	// +-0x2 is the same offset as +-2, it shares its read
+	assert.Contains(t, code, "rd0, ok0 = f1(r, int64(ra)+po-2)")
+	assert.NotContains(t, code, "int64(ra)+po-0x2)")
+	assert.Contains(t, code, "rb, l = f1(r, po)")
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{"NEG\x0a\x0b\x0c\x0d\x0e\x02\x01\x14\x15\x16", "NEG\x0a\x0b\x0c\x0d\x0e\x01\x00\x14\x15\x16\x17\x18", "NEG\x0a\x0b\x0c\x0d\x0e\x00\x02\x14\x15\x16\x17\x18"} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	// multiplying or dividing by a negative value only works out for 0
+	assert.EqualValues(t, `\b, add 2|\b, sub 22|\b, hex 2|\b, mul pair 20|\b, add pair 21`, samples[0].expected)
+	assert.Contains(t, samples[2].expected, `\b, mul 0`)
+
+	for _, opts := range []Options{{}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// runtimeDivisorMagic divides pointers by values read from the target,
+// which may be zero
+const runtimeDivisorMagic = `
+0	string	DV
+>(2.l/(4))	ubyte	x	\b, divided %d
+>(2.s/(6))	ubyte	x	\b, short %d
+>2	ulelong	x	\b, pointer %d
+`
+
+func Test_GeneratedRuntimeDivisor(t *testing.T) {
+	book := parseBook(t, runtimeDivisorMagic)
+
+	var out bytes.Buffer
+	_, err := CompileTo(&out, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "if rb == 0 {")
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{
+		"DV\x14\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x2a",
+		"DV\x14\x00\x00\x00\x02\x00\x00\x00\x2a",
+		"DV\x14\x00\x00\x00\x00\x00\x02\x00\x2a",
+	} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	// dividing by zero doesn't match, and doesn't stop the siblings
+	assert.EqualValues(t, `\b, pointer 20`, samples[0].expected)
+	assert.EqualValues(t, `\b, divided 42|\b, pointer 20`, samples[1].expected)
+	assert.EqualValues(t, `\b, divided 68|\b, short 42|\b, pointer 20`, samples[2].expected)
+
+	for _, opts := range []Options{{}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
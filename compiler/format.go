@@ -0,0 +1,101 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/scanner"
+	"strings"
+)
+
+// snippetContext is how many lines are shown around errors in FormatError
+const snippetContext = 3
+
+// FormatError is returned when the generated code can't be formatted, which
+// means the compiler emitted something that doesn't parse
+type FormatError struct {
+	// Source is the magic rule the offending code was generated from, or the
+	// page for code outside of rules
+	Source string
+
+	// Line is where the error is in the unformatted code, 0 if unknown
+	Line int
+
+	// Snippet is the unformatted code around Line
+	Snippet string
+
+	Err error
+}
+
+func (fe *FormatError) Error() string {
+	msg := fmt.Sprintf("generated code doesn't parse: %v", fe.Err)
+	if fe.Source != "" {
+		msg += fmt.Sprintf("\nwhile compiling %s", fe.Source)
+	}
+	if fe.Snippet != "" {
+		msg += "\n" + fe.Snippet
+	}
+	return msg
+}
+
+func (fe *FormatError) Unwrap() error {
+	return fe.Err
+}
+
+// sourceMark records that the code from offset on was generated from source
+type sourceMark struct {
+	offset int
+	source string
+}
+
+// formatCode runs go/format on generated code. marks, sorted by offset, tell
+// which rule generated what, so errors can point at it.
+func formatCode(code []byte, marks []sourceMark) ([]byte, error) {
+	formatted, err := format.Source(code)
+	if err == nil {
+		return formatted, nil
+	}
+
+	fe := &FormatError{Err: err}
+	if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+		// line directives change the line positions report, not the offset
+		fe.Line = bytes.Count(code[:clampOffset(list[0].Pos.Offset, len(code))], []byte("\n")) + 1
+
+		lines := bytes.Split(code, []byte("\n"))
+		lineStart := 0
+		for i := 0; i < fe.Line-1 && i < len(lines); i++ {
+			lineStart += len(lines[i]) + 1
+		}
+		for _, mark := range marks {
+			if mark.offset > lineStart {
+				break
+			}
+			fe.Source = mark.source
+		}
+
+		var sb strings.Builder
+		for i := fe.Line - snippetContext; i <= fe.Line+snippetContext; i++ {
+			if i < 1 || i > len(lines) {
+				continue
+			}
+			marker := " "
+			if i == fe.Line {
+				marker = ">"
+			}
+			fmt.Fprintf(&sb, "%s%5d | %s\n", marker, i, lines[i-1])
+		}
+		fe.Snippet = strings.TrimSuffix(sb.String(), "\n")
+	}
+	return nil, fe
+}
+
+// clampOffset keeps offset within code of length n
+func clampOffset(offset int, n int) int {
+	if offset < 0 {
+		return 0
+	}
+	if offset > n {
+		return n
+	}
+	return offset
+}
@@ -0,0 +1,71 @@
+package compiler
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func Test_FormattedGolden(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	ulelong	0x2a	answer
+>4	ubyte	1	one
+>4	ubyte	2	two
+0	string	RIFF	RIFF
+>4	ulelong	x	\b, %u bytes
+>(4.l)	use	chunk
+>8	search/16	WAVE	\b, WAVE
+>>&0	ubeshort	1	version 1
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "golden", EmitComments: true})
+	assert.NoError(t, err)
+
+	golden := filepath.Join("testdata", "riff.go.golden")
+	if *update {
+		err = ioutil.WriteFile(golden, buf.Bytes(), 0644)
+		assert.NoError(t, err)
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.EqualValues(t, string(expected), buf.String())
+}
+
+func Test_FormatError(t *testing.T) {
+	book := parseBook(t, `
+0	string	RIFF	RIFF
+>8	ubyte	<2	small
+>8	ubyte	>2	big
+`)
+	// a comment that spans several lines breaks the generated code
+	book[""][1].Line = ">8\tubyte\t<2\n}) not go"
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "broken", EmitComments: true})
+	assert.Error(t, err)
+
+	fe, ok := err.(*FormatError)
+	assert.True(t, ok, "expected a *FormatError, got %v", err)
+	if ok {
+		assert.EqualValues(t, `rule ">8\tubyte\t<2\n}) not go"`, fe.Source)
+		assert.True(t, fe.Line > 0)
+		assert.Contains(t, fe.Snippet, "}) not go")
+		assert.Contains(t, err.Error(), "while compiling rule")
+	}
+	assert.EqualValues(t, 0, buf.Len())
+
+	// without formatting, nothing checks the code
+	_, err = CompileTo(&buf, book, Options{Package: "broken", EmitComments: true, SkipFormat: true})
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(buf.String(), "}) not go"))
+}
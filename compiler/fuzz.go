@@ -0,0 +1,189 @@
+package compiler
+
+import (
+	"fmt"
+	"go/format"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/pkg/errors"
+)
+
+// fuzzFileName is where CompileToDir puts the fuzz test
+const fuzzFileName = "wizardry_fuzz_test.go"
+
+// maxFuzzSeeds is how many string rules the fuzz test is seeded with
+const maxFuzzSeeds = 16
+
+// maxFuzzSeedOffset is how far from the start the strings seeding the fuzz
+// test may be
+const maxFuzzSeedOffset = 4096
+
+// fuzzTestSource feeds arbitrary bytes to the top-level page of the
+// generated code, which mustn't panic, and can't find more descriptions
+// than the book has
+const fuzzTestSource = `// this file has been generated by github.com/9uanhuo/wizardry
+// from a set of magic rules. you probably don't want to edit it by hand
+
+package %s
+
+import (
+	"bytes"
+	"testing"
+	%s
+)
+
+// fuzzMaxDescriptions is how many descriptions the rules can find at most,
+// 0 if they use pages in a loop, which is only bounded by their depth
+const fuzzMaxDescriptions = %d
+
+// fuzzSeeds are an empty file, and the strings some top-level rules look
+// for, where they look for them
+var fuzzSeeds = []string{
+%s}
+
+func FuzzIdentify(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		result := Identify__Result(%s, 0)
+		if fuzzMaxDescriptions > 0 && len(result.Descriptions) > fuzzMaxDescriptions {
+			t.Errorf("found %%d descriptions, the rules have at most %%d", len(result.Descriptions), fuzzMaxDescriptions)
+		}
+	})
+}
+`
+
+// WriteFuzzTest writes a fuzz test for the code generated from book with
+// opts, which identifies arbitrary data with the top-level page, and fails
+// if that panics, or finds more descriptions than the rules can. It's seeded
+// with an empty file, and some of the strings top-level rules look for. Run
+// it with go test -fuzz FuzzIdentify, plain go test only tries the seeds.
+func WriteFuzzTest(w io.Writer, book parser.Spellbook, opts Options) error {
+	// same as in the parity test, minus the interpreter
+	readerImport := ""
+	reader := "bytes.NewReader(data)"
+	if opts.SliceReaderAPI {
+		rq := "utils."
+		switch {
+		case opts.SelfContained:
+			rq = ""
+		case opts.ReaderImportPath != "" && opts.ReaderImportPath != DefaultRuntimeImportPath:
+			readerImport = "utils " + strconv.Quote(opts.ReaderImportPath)
+		default:
+			readerImport = "utils " + strconv.Quote(DefaultRuntimeImportPath)
+		}
+		reader = fmt.Sprintf("%sNewSliceReader(bytes.NewReader(data), 0, int64(len(data)))", rq)
+	}
+
+	var seeds strings.Builder
+	for _, seed := range fuzzSeeds(book) {
+		fmt.Fprintf(&seeds, "\t%s,\n", strconv.Quote(seed))
+	}
+
+	source := fmt.Sprintf(fuzzTestSource, opts.Package, readerImport, maxDescriptions(book), seeds.String(), reader)
+	code, err := format.Source([]byte(source))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = w.Write(code)
+	return errors.WithStack(err)
+}
+
+// fuzzSeeds returns an empty string, and the strings the first top-level
+// string rules look for, at the offset they look for them
+func fuzzSeeds(book parser.Spellbook) []string {
+	seeds := []string{""}
+	for _, rule := range book[""] {
+		if len(seeds) > maxFuzzSeeds {
+			break
+		}
+		if rule.Level != 0 || rule.Kind.Family != parser.KindFamilyString {
+			continue
+		}
+		sk, _ := rule.Kind.Data.(*parser.StringKind)
+		of := rule.Offset
+		if sk.Negate || sk.Value == "" || of.OffsetType != parser.OffsetTypeDirect || of.IsRelative ||
+			of.Direct < 0 || of.Direct > maxFuzzSeedOffset {
+			continue
+		}
+		seeds = append(seeds, strings.Repeat("\x00", int(of.Direct))+sk.Value)
+	}
+	return seeds
+}
+
+// maxDescriptions returns how many descriptions identifying something with
+// the top-level page of book can find at most: one per rule, plus what
+// used pages find, every time they're used. It's 0 when pages use each
+// other in a loop, and capped at maxDescriptionsBound.
+func maxDescriptions(book parser.Spellbook) int {
+	counts := make(map[string]int)
+	following := make(map[string]bool)
+	looped := false
+
+	var count func(page string) int
+	count = func(page string) int {
+		if n, ok := counts[page]; ok {
+			return n
+		}
+		if following[page] {
+			looped = true
+			return 0
+		}
+		following[page] = true
+
+		n := 0
+		for _, rule := range book[page] {
+			if len(rule.Description) > 0 {
+				n++
+			}
+			if rule.Kind.Family == parser.KindFamilyUse {
+				uk, _ := rule.Kind.Data.(*parser.UseKind)
+				n += count(uk.Page)
+			}
+			if n > maxDescriptionsBound {
+				n = maxDescriptionsBound
+			}
+		}
+
+		following[page] = false
+		counts[page] = n
+		return n
+	}
+
+	n := count("")
+	if looped {
+		return 0
+	}
+	return n
+}
+
+// maxDescriptionsBound caps maxDescriptions, so that it fits an int32
+const maxDescriptionsBound = 1 << 30
+
+// fuzzTestPath is where CompileWithOptions puts the fuzz test of the code
+// generated into output
+func fuzzTestPath(output string) string {
+	return strings.TrimSuffix(output, ".go") + "_fuzz_test.go"
+}
+
+// writeFuzzTestFile writes the fuzz test of the code generated from book
+// with opts to path
+func writeFuzzTestFile(path string, book parser.Spellbook, opts Options) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	opts.logf("Generating fuzz test into: %s", path)
+	err = WriteFuzzTest(f, book, opts)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(f.Close())
+}
@@ -0,0 +1,63 @@
+package compiler
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FuzzSeeds(t *testing.T) {
+	book := parseBook(t, `
+0	string	AB	ab
+>2	string	CD	cd
+0	belong	1	one
+4	string/c	efg	efg
+0	string	!HI	not hi
+&2	string	JK	relative
+8192	string	FAR	too far
+`)
+	assert.EqualValues(t, []string{"", "AB", "\x00\x00\x00\x00efg"}, fuzzSeeds(book))
+}
+
+func Test_MaxDescriptions(t *testing.T) {
+	book := parseBook(t, `
+0	name	inner
+>0	ubyte	1	one
+>0	ubyte	2
+>>1	ubyte	3	three
+0	string	AB	ab
+>2	use	inner
+>2	use	\^inner
+>3	string	C
+`)
+	assert.EqualValues(t, 5, maxDescriptions(book))
+
+	book = parseBook(t, cycleMagic)
+	assert.EqualValues(t, 0, maxDescriptions(book))
+}
+
+func Test_GeneratedFuzz(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	t.Run("fuzzing", func(t *testing.T) {
+		dir := scratchModule(t, book, Options{EmitFuzzTest: true})
+		code, err := os.ReadFile(filepath.Join(dir, "generated_fuzz_test.go"))
+		assert.NoError(t, err)
+		assert.Contains(t, string(code), "\t\"\",\n")
+		assert.Contains(t, string(code), "Identify__Result(bytes.NewReader(data), 0)")
+
+		runGo(t, dir, "test", "-run", "^$", "-fuzz", "^FuzzIdentify$", "-fuzztime", "500x", ".")
+	})
+
+	t.Run("seeds, split, self-contained slice reader api", func(t *testing.T) {
+		dir := scratchModule(t, book, Options{EmitFuzzTest: true, PagesPerFile: 2, SelfContained: true, SliceReaderAPI: true})
+		code, err := os.ReadFile(filepath.Join(dir, fuzzFileName))
+		assert.NoError(t, err)
+		assert.True(t, bytes.Contains(code, []byte("Identify__Result(NewSliceReader(bytes.NewReader(data), 0, int64(len(data))), 0)")))
+
+		runGo(t, dir, "test", "-v", "-run", "FuzzIdentify", ".")
+	})
+}
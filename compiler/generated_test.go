@@ -0,0 +1,521 @@
+package compiler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// generatedSample is some data, and what generated code should find in it
+type generatedSample struct {
+	name     string
+	data     string
+	expected string
+	mime     string
+}
+
+// generatedSamples are identified by the code generated from testdata/magic,
+// along with what it should find
+var generatedSamples = []generatedSample{
+	{
+		name: "png",
+		data: "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR" +
+			"\x00\x00\x00\x10\x00\x00\x00\x20\x08\x06\x00\x00\x00",
+		expected: `PNG image data|\b, 16 x|32,|8-bit|\b/color RGBA,|non-interlaced`,
+		mime:     "image/png",
+	},
+	{
+		name: "elf",
+		data: "\x7fELF\x02\x01\x01\x00" + strings.Repeat("\x00", 8) +
+			"\x02\x00\x3e\x00\x01\x00\x00\x00\x40\x10\x40\x00\x00\x00\x00\x00" +
+			strings.Repeat("\x00", 24) + "\x0d\x00\x40\x00",
+		expected: `ELF|64-bit|\b, 13 program headers|LSB|executable,|x86-64,|version 1|(SYSV)|\b, entry point 0x401040`,
+		mime:     "application/x-executable",
+	},
+	{
+		name:     "gif",
+		data:     "GIF89a\x10\x00\x20\x00",
+		expected: `GIF image data|\b, version 89a,|16 x|32`,
+		mime:     "image/gif",
+	},
+	{
+		name:     "zip",
+		data:     "PK\x03\x04\x14\x00\x00\x00\x08\x00\x00\x60\x6e\x52" + strings.Repeat("\x00", 12) + "\x08\x00\x00\x00mimetype",
+		expected: `Zip archive data|\b, at least v2.0 to extract|\b, with mimetype|\b, first entry is the mimetype|\b, last modified Sun, Mar 14 2021|\b at 12:00:00`,
+		mime:     "application/x-zip-mimetype",
+	},
+	{
+		name:     "gzip",
+		data:     "\x1f\x8b\x08\x08\x00\x10\x5e\x5f\x00\x03",
+		expected: `gzip compressed data|\b, deflated|\b, from Unix|\b, was named|\b, last modified: Sun Sep 13 12:26:40 2020`,
+		mime:     "application/gzip",
+	},
+	{
+		name:     "gzip from elsewhere",
+		data:     "\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\x07",
+		expected: `gzip compressed data|\b, deflated|\b, from somewhere else`,
+		mime:     "application/gzip",
+	},
+	{
+		name: "wave",
+		data: "RIFF\x24\x00\x00\x00WAVEfmt " +
+			"\x10\x00\x00\x00\x01\x00\x02\x00",
+		expected: `RIFF (little-endian) data|\b, WAVE audio|\b, format|\b, chunk of 16 bytes|\b, PCM`,
+		mime:     "audio/x-wav",
+	},
+	{
+		name: "big-endian wave",
+		data: "RIFX\x00\x00\x00\x24WAVEfmt " +
+			"\x00\x00\x00\x10\x00\x03\x00\x02",
+		expected: `RIFF (big-endian) data|\b, WAVE audio|\b, format|\b, chunk of 16 bytes|\b, IEEE float`,
+		mime:     "audio/x-wav-float",
+	},
+	{
+		name:     "riff",
+		data:     "RIFF\x04\x00\x00\x00CDXA",
+		expected: `RIFF (little-endian) data|\b, unknown format`,
+		mime:     "application/x-riff",
+	},
+	{
+		name:     "tar",
+		data:     strings.Repeat("\x00", 257) + "ustar\x0000",
+		expected: `POSIX tar archive`,
+		mime:     "application/x-tar",
+	},
+	{
+		name: "windows shortcut",
+		data: "\x4c\x00\x00\x00\x01\x14\x02\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46" +
+			"\x04\x00\x00\x00\x20\x00\x00\x00" + strings.Repeat("\x00", 24) + "\xd2\x04\x00\x00" +
+			strings.Repeat("\x00", 20) + "\x13\x00" +
+			"h\x00t\x00t\x00p\x00:\x00/\x00/\x00e\x00x\x00a\x00m\x00p\x00l\x00e\x00.\x00c\x00o\x00m\x00\xe9\x00",
+		expected: `MS Windows shortcut|\b, Has Description string|\b, Archive|\b, length=1234|\b, links to the web|\b, at example.comé|\b, description "http://example.comé"`,
+		mime:     "application/x-ms-shortcut",
+	},
+	{
+		name: "word document",
+		data: "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1" + strings.Repeat("\x00", 0x448) +
+			"\x06\x09\x02\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46",
+		expected: `Composite Document File V2 Document|\b, Microsoft Word 97-2003|\b, root class 00020906-0000-0000-C000-000000000046`,
+		mime:     "application/msword",
+	},
+	{
+		name:     "truncated compound document",
+		data:     "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1" + strings.Repeat("\x00", 0x450),
+		expected: `Composite Document File V2 Document`,
+		mime:     "application/x-ole-storage",
+	},
+	{
+		name: "gpt",
+		data: strings.Repeat("\x00", 512) + "EFI PART" + strings.Repeat("\x00", 48) +
+			"\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10" + strings.Repeat("\x00", 440) +
+			"\x28\x73\x2a\xc1\x1f\xf8\xd2\x11\xba\x4b\x00\xa0\xc9\x3e\xc9\x3b",
+		expected: `GPT partition table|\b, disk GUID 04030201-0605-0807-090A-0B0C0D0E0F10|\b, first partition is an EFI system partition`,
+	},
+	{
+		name:     "shell script",
+		data:     "#!/bin/sh\necho hi\n",
+		expected: `POSIX shell script text executable`,
+		mime:     "text/x-shellscript",
+	},
+	{
+		name:     "python script",
+		data:     "#!/usr/bin/env python3 -u\nprint()\n",
+		expected: `Python script text executable|\b, with options " -u"`,
+		mime:     "text/x-script.python",
+	},
+	{
+		name:     "python script without options",
+		data:     "#! /usr/bin/python\n -u\n",
+		expected: `Python script text executable`,
+		mime:     "text/x-script.python",
+	},
+	{
+		name:     "html5",
+		data:     "\n<!DOCTYPE html>\n<title>Hello</title>",
+		expected: `HTML document text|\b, with title|"Hello"`,
+		mime:     "text/html",
+	},
+	{
+		name:     "html5 without title",
+		data:     "<!doctype html><p>nothing</p>",
+		expected: `HTML document text`,
+		mime:     "text/html",
+	},
+	{
+		name:     "greeting",
+		data:     "hello  \t world!",
+		expected: "greeting \"hello  \t world\"",
+		mime:     "",
+	},
+	{
+		name:     "html",
+		data:     "\n\n<html><body></body></html>",
+		expected: `HTML document text`,
+		mime:     "text/html",
+	},
+	{
+		name:     "nothing",
+		data:     "nothing to see here",
+		expected: ``,
+		mime:     "",
+	},
+}
+
+// generatedTestSource checks the generated code from the inside: it must find
+// what generatedSamples expect, and find the same thing when identifying from
+// several goroutines at once
+const generatedTestSource = `package generated
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	%s
+)
+
+var samples = []struct {
+	name     string
+	data     string
+	expected string
+	mime     string
+	merged   string
+}{
+%s}
+
+func identifySample(data string) (string, string) {
+	sr := %s
+	result := Identify__Result(sr, 0)
+	return strings.Join(result.Descriptions, "|"), result.MIME
+}
+
+func TestSamples(t *testing.T) {
+	for _, s := range samples {
+		actual, mime := identifySample(s.data)
+		if actual != s.expected {
+			t.Errorf("%%s: expected %%q, got %%q", s.name, s.expected, actual)
+		}
+		if mime != s.mime {
+			t.Errorf("%%s: expected MIME type %%q, got %%q", s.name, s.mime, mime)
+		}
+	}
+}
+
+func TestIdentifyWrapper(t *testing.T) {
+	for _, s := range samples {
+		sr := %sNewSliceReader(strings.NewReader(s.data), 0, int64(len(s.data)))
+		if actual := strings.Join(Identify(sr, 0), "|"); actual != s.expected {
+			t.Errorf("%%s: expected %%q, got %%q", s.name, s.expected, actual)
+		}
+	}
+}
+
+func TestIdentifyString(t *testing.T) {
+	for _, s := range samples {
+		sr := %sNewSliceReader(strings.NewReader(s.data), 0, int64(len(s.data)))
+		if actual := strings.Join(IdentifyStrings(sr), "|"); actual != s.expected {
+			t.Errorf("%%s: expected %%q, got %%q", s.name, s.expected, actual)
+		}
+		if actual := IdentifyString(sr); actual != s.merged {
+			t.Errorf("%%s: expected %%q, got %%q", s.name, s.merged, actual)
+		}
+	}
+}
+
+func TestConcurrentIdentify(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, s := range samples {
+					if actual, mime := identifySample(s.data); actual != s.expected || mime != s.mime {
+						t.Errorf("%%s: expected %%q (%%s), got %%q (%%s)", s.name, s.expected, s.mime, actual, mime)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkIdentify(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, s := range samples {
+			identifySample(s.data)
+		}
+	}
+}
+`
+
+// scratchModule compiles book with opts into a new module, which either
+// uses this repository for its runtime, or is self-contained. The code is
+// split in several files if opts.PagesPerFile is set.
+func scratchModule(t *testing.T, book parser.Spellbook, opts Options) string {
+	if testing.Short() {
+		t.Skip("building generated code is slow")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go tool not found")
+	}
+
+	dir := t.TempDir()
+	opts.Package = "generated"
+	var err error
+	if opts.PagesPerFile > 0 {
+		_, err = CompileToDir(dir, book, opts)
+	} else {
+		err = CompileWithOptions(book, filepath.Join(dir, "generated.go"), opts)
+	}
+	assert.NoError(t, err)
+
+	goMod := "module generated\n\ngo 1.18\n"
+	// parity tests use the interpreter, even next to self-contained code
+	if !opts.SelfContained || opts.ParityCorpus != "" {
+		repoRoot, err := filepath.Abs("..")
+		assert.NoError(t, err)
+		goMod += fmt.Sprintf("\nrequire github.com/9uanhuo/wizardry v0.0.0\n\nreplace github.com/9uanhuo/wizardry => %s\n", repoRoot)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0644)
+	assert.NoError(t, err)
+	return dir
+}
+
+// runGo runs the go tool in dir, and returns its output
+func runGo(t *testing.T, dir string, args ...string) string {
+	out, err := goOutput(dir, args...)
+	assert.NoError(t, err, "go %s:\n%s", strings.Join(args, " "), out)
+	return out
+}
+
+// goOutput runs the go tool in dir, and returns its output even if it fails
+func goOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// testGenerated compiles book with opts, and runs the tests of
+// generatedTestSource on it with the given go test flags
+func testGenerated(t *testing.T, book parser.Spellbook, opts Options, flags ...string) {
+	testGeneratedSamples(t, book, opts, generatedSamples, flags...)
+}
+
+// testGeneratedSamples is testGenerated with other samples than
+// generatedSamples
+func testGeneratedSamples(t *testing.T, book parser.Spellbook, opts Options, samples []generatedSample, flags ...string) {
+	dir := scratchModule(t, book, opts)
+	writeGeneratedTest(t, dir, opts, samples)
+	runGo(t, dir, append(append([]string{"test"}, flags...), "./...")...)
+}
+
+// writeGeneratedTest writes the tests of generatedTestSource, with samples,
+// next to the code generated in dir with opts
+func writeGeneratedTest(t *testing.T, dir string, opts Options, samples []generatedSample) {
+	var imports []string
+	readerQualifier := ""
+	if !opts.SelfContained {
+		imports = append(imports, strconv.Quote(DefaultRuntimeImportPath))
+		readerQualifier = "utils."
+	}
+	// samples go through a plain io.ReaderAt, unless the code only takes
+	// a SliceReader
+	sampleReader := readerQualifier + "NewSliceReader(strings.NewReader(data), 0, int64(len(data)))"
+	if !opts.SliceReaderAPI {
+		imports = append(imports, strconv.Quote("io"))
+		sampleReader = "io.NewSectionReader(strings.NewReader(data), 0, int64(len(data)))"
+	}
+
+	var samplesSource strings.Builder
+	for _, s := range samples {
+		// what the interpreter's callers would print
+		merged := utils.MergeStrings(strings.Split(s.expected, "|"))
+		fmt.Fprintf(&samplesSource, "\t{%s, %s, %s, %s, %s},\n", strconv.Quote(s.name), strconv.Quote(s.data), strconv.Quote(s.expected), strconv.Quote(s.mime), strconv.Quote(merged))
+	}
+	testSource := fmt.Sprintf(generatedTestSource, strings.Join(imports, "\n\t"), samplesSource.String(), sampleReader, readerQualifier, readerQualifier)
+	err := ioutil.WriteFile(filepath.Join(dir, "generated_test.go"), []byte(testSource), 0644)
+	assert.NoError(t, err)
+}
+
+func parseTestMagic(t *testing.T, magdir string) parser.Spellbook {
+	pctx := &parser.ParseContext{
+		Logf: func(format string, args ...interface{}) {},
+	}
+
+	book := make(parser.Spellbook)
+	err := pctx.ParseAll(magdir, book)
+	assert.NoError(t, err)
+	return book
+}
+
+func Test_GeneratedCode(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	t.Run("default runtime", func(t *testing.T) {
+		testGenerated(t, book, Options{})
+	})
+
+	t.Run("self-contained", func(t *testing.T) {
+		testGenerated(t, book, Options{SelfContained: true})
+	})
+
+	t.Run("split", func(t *testing.T) {
+		testGenerated(t, book, Options{PagesPerFile: 1})
+	})
+
+	t.Run("split, self-contained", func(t *testing.T) {
+		testGenerated(t, book, Options{PagesPerFile: 2, SelfContained: true, EmitComments: true})
+	})
+
+	t.Run("structured", func(t *testing.T) {
+		testGenerated(t, book, Options{Structured: true})
+	})
+
+	t.Run("structured, without switches", func(t *testing.T) {
+		testGenerated(t, book, Options{Structured: true, NoSwitches: true, SelfContained: true})
+	})
+
+	t.Run("slice reader api", func(t *testing.T) {
+		testGenerated(t, book, Options{SliceReaderAPI: true})
+	})
+
+	t.Run("slice reader api, self-contained", func(t *testing.T) {
+		testGenerated(t, book, Options{SliceReaderAPI: true, SelfContained: true, PagesPerFile: 3})
+	})
+
+	t.Run("minimal imports", func(t *testing.T) {
+		testGenerated(t, book, Options{MinimalImports: true, PagesPerFile: 3})
+	})
+
+	t.Run("benchmark", func(t *testing.T) {
+		testGenerated(t, book, Options{}, "-bench", ".", "-benchtime", "100x")
+	})
+}
+
+// Test_SamplesInterpreter checks that the interpreter finds what the
+// generated code is expected to
+func Test_SamplesInterpreter(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+	ictx := &interpreter.InterpretContext{
+		Book: book,
+	}
+
+	for _, s := range generatedSamples {
+		sr := utils.NewSliceReader(strings.NewReader(s.data), 0, int64(len(s.data)))
+		matches, err := ictx.IdentifyMatches(sr)
+		assert.NoError(t, err)
+
+		var descriptions []string
+		for _, m := range matches {
+			descriptions = append(descriptions, m.Description)
+		}
+		assert.EqualValues(t, s.expected, strings.Join(descriptions, "|"), s.name)
+		assert.EqualValues(t, s.mime, interpreter.MIMEType(matches), s.name)
+	}
+}
+
+func Test_GeneratedCodeRace(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+	testGenerated(t, book, Options{}, "-race")
+}
+
+func Test_RuntimeImports(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	// helpers and reader from the same package import it once
+	output := filepath.Join(t.TempDir(), "generated.go")
+	err := CompileWithOptions(book, output, Options{Package: "generated"})
+	assert.NoError(t, err)
+	generated, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	code := string(generated)
+	assert.EqualValues(t, 1, strings.Count(code, strconv.Quote(DefaultRuntimeImportPath)))
+	assert.Contains(t, code, "utils.StringTest")
+	assert.NotContains(t, code, "wizardry.")
+
+	// helpers from elsewhere get their own alias
+	err = CompileWithOptions(book, output, Options{Package: "generated", HelpersImportPath: "example.com/helpers"})
+	assert.NoError(t, err)
+	generated, err = ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	code = string(generated)
+	assert.Contains(t, code, `wizardry "example.com/helpers"`)
+	assert.Contains(t, code, "utils "+strconv.Quote(DefaultRuntimeImportPath))
+	assert.Contains(t, code, "wizardry.StringTest")
+}
+
+func Test_SelfContainedImports(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	output := filepath.Join(t.TempDir(), "generated.go")
+	err := CompileWithOptions(book, output, Options{Package: "generated", SelfContained: true})
+	assert.NoError(t, err)
+
+	generated, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	code := string(generated)
+
+	start := strings.Index(code, "import (")
+	end := strings.Index(code[start:], ")")
+	var imports []string
+	for _, line := range strings.Split(code[start+len("import ("):start+end], "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			imports = append(imports, line)
+		}
+	}
+	sort.Strings(imports)
+	assert.EqualValues(t, []string{`"encoding/binary"`, `"errors"`, `"fmt"`, `"io"`, `"regexp"`, `"strings"`, `"sync"`, `"sync/atomic"`, `"time"`, `"unicode/utf16"`, `"unicode/utf8"`}, imports)
+	assert.NotContains(t, code, "wizardry.")
+	assert.NotContains(t, code, "utils.")
+}
+
+// Test_GeneratedCodeStockMagdir builds the code generated from the magic
+// files pointed to by WIZARDRY_MAGDIR, e.g. the Magdir folder of file's
+// sources, in both modes, as one file and split. It has rules the
+// compiler doesn't support, they're skipped.
+func Test_GeneratedCodeStockMagdir(t *testing.T) {
+	magdir := os.Getenv("WIZARDRY_MAGDIR")
+	if magdir == "" {
+		t.Skip("WIZARDRY_MAGDIR is not set")
+	}
+	book := parseTestMagic(t, magdir)
+
+	for _, selfContained := range []bool{false, true} {
+		for _, pagesPerFile := range []int{0, 16} {
+			t.Run(fmt.Sprintf("self-contained=%v,pages-per-file=%d", selfContained, pagesPerFile), func(t *testing.T) {
+				dir := scratchModule(t, book, Options{SelfContained: selfContained, PagesPerFile: pagesPerFile, SkipUnsupported: true})
+				runGo(t, dir, "build", "./...")
+			})
+		}
+	}
+
+	t.Run("structured", func(t *testing.T) {
+		dir := scratchModule(t, book, Options{Structured: true, EmitMatchers: true, SkipUnsupported: true})
+		runGo(t, dir, "build", "./...")
+	})
+
+	t.Run("single dispatch", func(t *testing.T) {
+		dir := scratchModule(t, book, Options{SingleDispatch: true, SkipUnsupported: true})
+		runGo(t, dir, "build", "./...")
+	})
+
+	t.Run("runtime swap", func(t *testing.T) {
+		dir := scratchModule(t, book, Options{RuntimeSwap: true, SkipUnsupported: true})
+		runGo(t, dir, "build", "./...")
+	})
+}
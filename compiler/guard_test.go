@@ -0,0 +1,137 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// pointersMagic tests strings and patterns where pointers say
+const pointersMagic = `
+0	string	PT	pointers
+>(2.b)	string	ok	\b, ok
+>(3.b)	search/8	yes	\b, yes
+>(4.b)	string	!no	\b, not no
+>5	string	five	\b, five
+>>&1	string	six	\b, six
+`
+
+func Test_CompileOffsetGuards(t *testing.T) {
+	book := parseBook(t, pointersMagic)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, "\tvar sz = r.Size()\n")
+	assert.Contains(t, code, "if po < 0 || po >= sz {")
+	assert.Contains(t, code, "if int64(ra)+po < 0 || int64(ra)+po >= sz {")
+	assert.Contains(t, code, "if po+5 < 0 || po+5 >= sz {")
+	assert.Contains(t, code, "if gf+1 < 0 || gf+1 >= sz {")
+	// negated tests aren't guarded, they match where gt fails
+	assert.EqualValues(t, 5, strings.Count(code, ">= sz {"))
+
+	// offsets that don't depend on the target are below MaxInputSize
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", MaxInputSize: 64})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.NotContains(t, code, "if po < 0 || po >= sz {")
+	assert.NotContains(t, code, "if po+5 < 0 || po+5 >= sz {")
+	assert.Contains(t, code, "if gf+1 < 0 || gf+1 >= sz {")
+	assert.EqualValues(t, 3, strings.Count(code, ">= sz {"))
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", NoOffsetGuards: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "sz")
+}
+
+func Test_GeneratedOffsetGuards(t *testing.T) {
+	book := parseBook(t, pointersMagic)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{
+		"PT\x0b\x0d\x0b\x00five six\x00",
+		"PT\x0b\x0d\x0bfive\x00sixno",
+		"PT\x10\x20\x02",
+		"PT\x05\x05\x00",
+		"PT\x06\x04\x06five",
+	} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	// pointers to something else, here or there
+	assert.EqualValues(t, `pointers|\b, not no`, samples[2].expected)
+	assert.EqualValues(t, `pointers|\b, not no`, samples[3].expected)
+
+	for _, opts := range []Options{{}, {Structured: true}, {MaxInputSize: 16}, {NoOffsetGuards: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// nowhereMagic has trees of strings and patterns at pointers, which point
+// past the end of most targets
+func nowhereMagic(trees int) string {
+	var sb strings.Builder
+	for i := 0; i < trees; i++ {
+		fmt.Fprintf(&sb, "(%d.l)\tstring\tMAGIC%02d\tformat %d\n", i*4, i, i)
+		fmt.Fprintf(&sb, "(%d.l+4)\tsearch/64\tFOOTER%02d\tfooter %d\n", i*4, i, i)
+	}
+	return sb.String()
+}
+
+// benchmarkNsPerOp returns the ns/op go test -bench printed for name
+func benchmarkNsPerOp(t *testing.T, output string, name string) float64 {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && strings.HasPrefix(fields[0], name) && fields[3] == "ns/op" {
+			var ns float64
+			_, err := fmt.Sscanf(fields[2], "%g", &ns)
+			assert.NoError(t, err)
+			return ns
+		}
+	}
+	t.Errorf("no result for %s in:\n%s", name, output)
+	return 0
+}
+
+// Test_OffsetGuardsBenchmark compares how long identifying targets that
+// match nothing takes with and without offset guards. It only logs it, it
+// depends on the machine.
+func Test_OffsetGuardsBenchmark(t *testing.T) {
+	book := parseBook(t, nowhereMagic(64))
+
+	rng := rand.New(rand.NewSource(1))
+	var samples []generatedSample
+	for i := 0; i < 16; i++ {
+		data := make([]byte, 256+rng.Intn(256))
+		rng.Read(data)
+		samples = append(samples, generatedSample{name: fmt.Sprintf("garbage %d", i), data: string(data)})
+	}
+
+	var results []float64
+	for _, opts := range []Options{{NoOffsetGuards: true}, {}} {
+		dir := scratchModule(t, book, opts)
+		writeGeneratedTest(t, dir, opts, samples)
+		output := runGo(t, dir, "test", "-run", "^$", "-bench", "BenchmarkIdentify$", "-benchtime", "2000x", "./...")
+		results = append(results, benchmarkNsPerOp(t, output, "BenchmarkIdentify"))
+	}
+	t.Logf("identifying %d targets matching nothing: %.0f ns without offset guards, %.0f ns with them",
+		len(samples), results[0], results[1])
+}
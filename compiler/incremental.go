@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/pkg/errors"
+)
+
+// manifestFileName is where CompileToDir records what it generated each
+// file from, for Incremental runs
+const manifestFileName = "wizardry_manifest.txt"
+
+// manifestEntry is what the manifest says about a file: the hash of what
+// it was generated from, see partKey, and the hash of what was written
+type manifestEntry struct {
+	key     string
+	content string
+}
+
+// readManifest reads the manifest at path, it's empty if there's none
+func readManifest(path string) (map[string]manifestEntry, error) {
+	entries := make(map[string]manifestEntry)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("%s: invalid line %q", path, line)
+		}
+		entries[fields[0]] = manifestEntry{key: fields[1], content: fields[2]}
+	}
+	return entries, errors.WithStack(scanner.Err())
+}
+
+// writeManifest writes the manifest at path, files in name order
+func writeManifest(path string, entries map[string]manifestEntry) error {
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("# generated by github.com/9uanhuo/wizardry, for incremental builds:\n")
+	sb.WriteString("# file, hash of what it's generated from, hash of its contents\n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s %s %s\n", name, entries[name].key, entries[name].content)
+	}
+	return errors.WithStack(ioutil.WriteFile(path, []byte(sb.String()), 0644))
+}
+
+// pageHashes returns a hash of the rules of every page of book, and of the
+// rules of the pages it uses, directly or not, so that it changes when any
+// of them does. Rules are canonicalized like in BookHash.
+func pageHashes(book parser.Spellbook) map[string]string {
+	own := make(map[string][]byte)
+	for page, rules := range book {
+		h := sha256.New()
+		for _, rule := range rules {
+			fmt.Fprintf(h, "%s\n", canonicalLine(rule.Line))
+			if rule.MIME != "" {
+				fmt.Fprintf(h, "!:mime %s\n", rule.MIME)
+			}
+		}
+		own[page] = h.Sum(nil)
+	}
+
+	hashes := make(map[string]string)
+	for page := range book {
+		// the pages it reaches, itself included, loops or not
+		reached := map[string]bool{page: true}
+		pending := []string{page}
+		for len(pending) > 0 {
+			current := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			for _, rule := range book[current] {
+				if uk, ok := rule.Kind.Data.(*parser.UseKind); ok && !reached[uk.Page] {
+					reached[uk.Page] = true
+					pending = append(pending, uk.Page)
+				}
+			}
+		}
+		var pages []string
+		for used := range reached {
+			pages = append(pages, used)
+		}
+		sort.Strings(pages)
+
+		h := sha256.New()
+		for _, used := range pages {
+			fmt.Fprintf(h, "page %q %x\n", used, own[used])
+		}
+		hashes[page] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes
+}
+
+// partKey returns a hash of what the file of cp is generated from: the
+// hashes of its pages, and its code before formatting, which also depends
+// on the rest of the book, e.g. for the entries of descs it refers to, and
+// on the options. The generator counts too, it formats the code.
+func partKey(cp *codePart, hashes map[string]string, opts Options) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\nformat %v\n", GeneratorVersion(), !opts.SkipFormat)
+	for _, page := range cp.pages {
+		fmt.Fprintf(h, "page %q %s\n", page, hashes[page])
+	}
+	h.Write(cp.code)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileHash returns the hash of the contents of the file at path, or an
+// empty string if it can't be read
+func fileHash(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return contentHash(data)
+}
+
+// contentHash returns the hash of data, as recorded in manifests
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,108 @@
+package compiler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PageHashes(t *testing.T) {
+	hashes := pageHashes(parseBook(t, incrementalMagic))
+	assert.Len(t, hashes, 2)
+
+	// whitespace doesn't count
+	spaced := pageHashes(parseBook(t, "0\tname\tchunk\n>0   ubyte   1\tone\n>0\tubyte\t2\ttwo\n0\tstring\tAB\tab\n>2\tuse\tchunk\n"))
+	assert.EqualValues(t, hashes, spaced)
+
+	// the page, and those using it, change
+	changed := pageHashes(parseBook(t, "0\tname\tchunk\n>0\tubyte\t1\tone\n>0\tubyte\t3\ttwo\n0\tstring\tAB\tab\n>2\tuse\tchunk\n"))
+	assert.NotEqual(t, hashes["chunk"], changed["chunk"])
+	assert.NotEqual(t, hashes[""], changed[""])
+
+	// pages using each other are fine, they reach the same pages
+	looped := pageHashes(parseBook(t, "0\tname\ta\n>0\tuse\tb\n0\tname\tb\n>1\tuse\ta\n"))
+	assert.Len(t, looped, 2)
+	assert.EqualValues(t, looped["a"], looped["b"])
+}
+
+// incrementalMagic is a book of two pages, the top-level one using the
+// other
+const incrementalMagic = "0\tname\tchunk\n>0\tubyte\t1\tone\n>0\tubyte\t2\ttwo\n" +
+	"0\tstring\tAB\tab\n>2\tuse\tchunk\n"
+
+func Test_CompileIncremental(t *testing.T) {
+	magdir := t.TempDir()
+	magic := filepath.Join(magdir, "ab")
+	assert.NoError(t, ioutil.WriteFile(magic, []byte(incrementalMagic), 0644))
+	corpus := t.TempDir()
+	for name, data := range map[string]string{"one": "AB\x01", "two": "AB\x02", "tee": "AT\x02"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(corpus, name), []byte(data), 0644))
+	}
+
+	opts := Options{Incremental: true, PagesPerFile: 1, ParityMagdir: magdir, ParityCorpus: corpus}
+	dir := scratchModule(t, parseTestMagic(t, magdir), opts)
+	files := []string{sharedFileName, "wizardry_pages_001.go", "wizardry_pages_002.go"}
+	for _, name := range files {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+	assert.FileExists(t, filepath.Join(dir, manifestFileName))
+
+	// mtimes in the past tell which files were written again
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	touch := func() {
+		for _, name := range files {
+			assert.NoError(t, os.Chtimes(filepath.Join(dir, name), past, past))
+		}
+	}
+	rewritten := func() []string {
+		var names []string
+		for _, name := range files {
+			info, err := os.Stat(filepath.Join(dir, name))
+			assert.NoError(t, err)
+			if !info.ModTime().Equal(past) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	opts.Package = "generated"
+
+	// nothing changed
+	touch()
+	stats, err := CompileToDir(dir, parseTestMagic(t, magdir), opts)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, stats.FilesKept)
+	assert.Empty(t, rewritten())
+
+	// the top-level page changed, along with the hash of the book
+	assert.NoError(t, ioutil.WriteFile(magic, []byte(incrementalMagic+"0\tstring\tAT\tat\n"), 0644))
+	touch()
+	stats, err = CompileToDir(dir, parseTestMagic(t, magdir), opts)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, stats.FilesKept)
+	assert.EqualValues(t, []string{sharedFileName, "wizardry_pages_001.go"}, rewritten())
+	out := runGo(t, dir, "test", "-v", "-run", "TestParity", "./...")
+	assert.Contains(t, out, "/tee (")
+	assert.NotContains(t, out, "FAIL")
+
+	// a file that isn't what was written is written again
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "wizardry_pages_002.go"), []byte("package generated\n"), 0644))
+	touch()
+	stats, err = CompileToDir(dir, parseTestMagic(t, magdir), opts)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, stats.FilesKept)
+	assert.EqualValues(t, []string{"wizardry_pages_002.go"}, rewritten())
+
+	// full rebuilds write everything
+	touch()
+	opts.Incremental = false
+	stats, err = CompileToDir(dir, parseTestMagic(t, magdir), opts)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, stats.FilesKept)
+	assert.EqualValues(t, files, rewritten())
+	runGo(t, dir, "test", "./...")
+}
@@ -0,0 +1,103 @@
+package compiler
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+)
+
+// identUses tells which identifiers some generated code reads, and which
+// it only assigns to, which go doesn't count as using them
+type identUses struct {
+	read    map[string]bool
+	written map[string]bool
+	// unparsed is set when some of the code doesn't parse, then every
+	// identifier counts as read. Formatting the code reports the error.
+	unparsed bool
+}
+
+func newIdentUses() *identUses {
+	return &identUses{
+		read:    make(map[string]bool),
+		written: make(map[string]bool),
+	}
+}
+
+// referenced returns whether name appears in the code at all
+func (iu *identUses) referenced(name string) bool {
+	return iu.unparsed || iu.read[name] || iu.written[name]
+}
+
+// onlyWritten returns whether name is assigned to, but never read
+func (iu *identUses) onlyWritten(name string) bool {
+	return !iu.unparsed && iu.written[name] && !iu.read[name]
+}
+
+// addStatements records the identifiers of the rules in body
+func (iu *identUses) addStatements(body []stmt) {
+	for _, s := range body {
+		switch s := s.(type) {
+		case lineStmt:
+			iu.addCode(s.code)
+		case guardStmt:
+			iu.addExpr(s.failIf)
+		case switchStmt:
+			iu.addExpr(s.subject)
+			for _, c := range s.cases {
+				iu.addExpr(c.value)
+				iu.addStatements(c.body)
+			}
+		case *nodeStmt:
+			iu.addStatements(s.body)
+		}
+	}
+}
+
+// addCode records the identifiers of one or more statements
+func (iu *identUses) addCode(code string) {
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package p; func _() {\n"+code+"\n}", 0)
+	if err != nil {
+		iu.unparsed = true
+		return
+	}
+	iu.add(file.Decls[0].(*ast.FuncDecl).Body)
+}
+
+// addExpr records the identifiers of an expression
+func (iu *identUses) addExpr(code string) {
+	expr, err := parser.ParseExpr(code)
+	if err != nil {
+		iu.unparsed = true
+		return
+	}
+	iu.add(expr)
+}
+
+func (iu *identUses) add(node ast.Node) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n.Tok != token.ASSIGN && n.Tok != token.DEFINE {
+				// x+=y reads x
+				return true
+			}
+			for _, lhs := range n.Lhs {
+				if ident, ok := lhs.(*ast.Ident); ok {
+					iu.written[ident.Name] = true
+				} else {
+					iu.add(lhs)
+				}
+			}
+			for _, rhs := range n.Rhs {
+				iu.add(rhs)
+			}
+			return false
+		case *ast.Ident:
+			iu.read[n.Name] = true
+		case *ast.BranchStmt:
+			// labels aren't variables
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,132 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const matcherTestSource = `package generated
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+var inputs = []string{
+%s}
+
+func TestMatchers(t *testing.T) {
+	for _, data := range inputs {
+		sr := utils.NewSliceReader(strings.NewReader(data), 0, int64(len(data)))
+		expected := len(Identify(sr, 0)) > 0
+		if actual := Is(sr, 0); actual != expected {
+			t.Errorf("%%q: expected %%v, got %%v", data, expected, actual)
+		}
+		if actual := Matchers[""](sr, 0); actual != expected {
+			t.Errorf("%%q: expected %%v from the registry, got %%v", data, expected, actual)
+		}
+	}
+}
+
+// noMatch is made of bytes no rule of testdata/magic looks for
+var noMatch = strings.Repeat("\xee", 512)
+
+func BenchmarkIdentifyNoMatch(b *testing.B) {
+	sr := utils.NewSliceReader(strings.NewReader(noMatch), 0, int64(len(noMatch)))
+	for i := 0; i < b.N; i++ {
+		Identify(sr, 0)
+	}
+}
+
+func BenchmarkIsNoMatch(b *testing.B) {
+	sr := utils.NewSliceReader(strings.NewReader(noMatch), 0, int64(len(noMatch)))
+	for i := 0; i < b.N; i++ {
+		Is(sr, 0)
+	}
+}
+
+func BenchmarkIdentifySamples(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, data := range inputs {
+			Identify(utils.NewSliceReader(strings.NewReader(data), 0, int64(len(data))), 0)
+		}
+	}
+}
+
+func BenchmarkIsSamples(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, data := range inputs {
+			Is(utils.NewSliceReader(strings.NewReader(data), 0, int64(len(data))), 0)
+		}
+	}
+}
+`
+
+func Test_CompileMatchers(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	ubyte	1	one
+>>1	ubyte	x	\b, then %d
+>0	ubyte	2	two
+>0	ubyte	3	three
+>0	ubyte	4	four
+0	string	RIFF	RIFF
+>8	use	chunk
+16	use	chunk
+`)
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "matchers", EmitMatchers: true})
+	assert.NoError(t, err)
+	code := buf.String()
+
+	assert.Contains(t, code, "func Is(r Reader, po int64) bool {")
+	assert.Contains(t, code, "func IsChunk(r Reader, po int64) bool {")
+	assert.Contains(t, code, `"chunk": IsChunk,`)
+	// matchers go through used pages, and return at the first match
+	assert.Contains(t, code, "if !isChunk(r, po+16) {")
+	assert.NotContains(t, code, "isChunk(r, po+8)")
+	assert.Contains(t, code, "case 0x2:\n\t\treturn t")
+
+	// matchers build no descriptions
+	start := strings.Index(code, "func isChunk(")
+	end := start + strings.Index(code[start:], "\n}\n")
+	assert.NotContains(t, code[start:end], "a(")
+	assert.NotContains(t, code[start:end], "fmt.")
+
+	// or count as more rules
+	var plain bytes.Buffer
+	plainStats, err := CompileTo(&plain, book, Options{Package: "matchers"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, plainStats.RulesCompiled, stats.RulesCompiled)
+	assert.EqualValues(t, plainStats.PagesEmitted, stats.PagesEmitted)
+	assert.NotContains(t, plain.String(), "func Is(")
+}
+
+func Test_GeneratedMatchers(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var inputs strings.Builder
+	for _, s := range generatedSamples {
+		fmt.Fprintf(&inputs, "\t%s,\n", strconv.Quote(s.data))
+	}
+	for _, data := range []string{"", "nothing to see", strings.Repeat("\x00", 64)} {
+		fmt.Fprintf(&inputs, "\t%s,\n", strconv.Quote(data))
+	}
+
+	for _, opts := range []Options{{EmitMatchers: true}, {EmitMatchers: true, Structured: true}} {
+		dir := scratchModule(t, book, opts)
+		err := ioutil.WriteFile(filepath.Join(dir, "matchers_test.go"), []byte(fmt.Sprintf(matcherTestSource, inputs.String())), 0644)
+		assert.NoError(t, err)
+		runGo(t, dir, "test", "-bench", ".", "-benchtime", "1000x", "./...")
+	}
+}
@@ -0,0 +1,66 @@
+package compiler
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fiveMagic finds five fragments in "FIVE\x01\x07\x03", two of them in a
+// used page, one of those in a switch
+const fiveMagic = `
+0	name	tail
+>0	ubyte	x	\b, tail %d
+>1	ubyte	2	two
+>1	ubyte	3	three
+>1	ubyte	4	four
+>1	ubyte	5	five
+0	string	FIVE	five fragments
+!:mime	application/x-five
+>4	ubyte	x	\b, first %d
+>5	use	tail
+>5	ubyte	x	\b, last %d
+`
+
+const maxTestSource = `package generated
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMax(t *testing.T) {
+	data := "FIVE\x01\x07\x03"
+	all := IdentifyStrings(strings.NewReader(data))
+	if len(all) != 5 {
+		t.Fatalf("expected 5 fragments, got %q", all)
+	}
+
+	for max := -1; max <= 6; max++ {
+		expected := all
+		if max > 0 && max < len(all) {
+			expected = all[:max]
+		}
+		if actual := IdentifyStringsMax(strings.NewReader(data), max); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("max %d: expected %q, got %q", max, expected, actual)
+		}
+		if mime := Identify__Max(strings.NewReader(data), 0, max).MIME; mime != "application/x-five" {
+			t.Errorf("max %d: expected the MIME type, got %q", max, mime)
+		}
+	}
+}
+`
+
+func Test_GeneratedMax(t *testing.T) {
+	book := parseBook(t, fiveMagic)
+
+	for _, opts := range []Options{{}, {Structured: true}} {
+		dir := scratchModule(t, book, opts)
+		err := ioutil.WriteFile(filepath.Join(dir, "max_test.go"), []byte(maxTestSource), 0644)
+		assert.NoError(t, err)
+		runGo(t, dir, "test", "./...")
+	}
+}
@@ -0,0 +1,120 @@
+package compiler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// modulePath is the module generated code says it comes from
+const modulePath = "github.com/9uanhuo/wizardry"
+
+// GeneratorVersion returns the version of the compiler, as go recorded it
+// in the binary running it, e.g. "github.com/9uanhuo/wizardry v1.2.3", or
+// "(devel)" instead of the version when it's built from a checkout
+func GeneratorVersion() string {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath && dep.Version != "" {
+				version = dep.Version
+			}
+		}
+	}
+	return modulePath + " " + version
+}
+
+// countBookRules returns how many rules book has, on all pages
+func countBookRules(book parser.Spellbook) int {
+	count := 0
+	for _, rules := range book {
+		count += len(rules)
+	}
+	return count
+}
+
+// BookHash returns a hash of the rules of book, which only changes when
+// they do: pages are hashed in name order, and rules in the order of the
+// book, with the whitespace around their fields normalized. Where they were
+// read from doesn't count. Generated code has the hash of the book it was
+// generated from as GeneratedBookHash, comparing it with the hash of the
+// magic as it is now tells whether the code is stale.
+func BookHash(book parser.Spellbook) string {
+	var pages []string
+	for page := range book {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	h := sha256.New()
+	for _, page := range pages {
+		fmt.Fprintf(h, "page %q\n", page)
+		for _, rule := range book[page] {
+			fmt.Fprintf(h, "%s\n", canonicalLine(rule.Line))
+			if rule.MIME != "" {
+				fmt.Fprintf(h, "!:mime %s\n", rule.MIME)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalLine returns the line of a rule with a tab between its offset,
+// type, test and description, and no whitespace around them. Whitespace in
+// the description is kept, it's shown.
+func canonicalLine(line string) string {
+	var fields []string
+	i := 0
+	for len(fields) < 3 {
+		for i < len(line) && utils.IsWhitespace(line[i]) {
+			i++
+		}
+		start := i
+		for i < len(line) && !utils.IsWhitespace(line[i]) {
+			if line[i] == '\\' {
+				// escaped whitespace doesn't end tests
+				i++
+			}
+			i++
+		}
+		if i > len(line) {
+			i = len(line)
+		}
+		fields = append(fields, line[start:i])
+	}
+	description := strings.TrimSpace(line[i:])
+	if description != "" {
+		fields = append(fields, description)
+	}
+	return strings.TrimRight(strings.Join(fields, "\t"), "\t")
+}
+
+// sourceFiles returns the magic files the rules of book were read from,
+// relative to root like in comments, sorted, or nil if that's unknown
+func sourceFiles(book parser.Spellbook, root string) []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, rules := range book {
+		for _, rule := range rules {
+			if rule.SourceFile == "" {
+				continue
+			}
+			file := sourcePath(rule.SourceFile, root)
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
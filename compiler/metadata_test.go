@@ -0,0 +1,70 @@
+package compiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CanonicalLine(t *testing.T) {
+	assert.EqualValues(t, "0\tstring\tAB\tab", canonicalLine("0   string  AB\tab"))
+	assert.EqualValues(t, ">4\tulelong\tx\t\\b, %d  bytes", canonicalLine(">4 ulelong x  \\b, %d  bytes  "))
+	assert.EqualValues(t, "0\tstring\tA\\ B\ta b", canonicalLine("0\tstring\tA\\ B\ta b"))
+	assert.EqualValues(t, "0\tstring\tAB", canonicalLine("0\tstring\tAB\t"))
+	assert.EqualValues(t, ">0\tuse\tchunk", canonicalLine(">0\tuse\tchunk"))
+	assert.EqualValues(t, "0\tname", canonicalLine("0\tname"))
+}
+
+func Test_BookHash(t *testing.T) {
+	magic := "0\tstring\tAB\tab\n>2\tubyte\t1\tone\n!:mime\tapplication/x-ab\n0\tname\tpage\n>0\tubyte\t2\ttwo\n"
+	hash := BookHash(parseBook(t, magic))
+	assert.Len(t, hash, 64)
+
+	// pages come out of a map, parsing again mustn't change anything
+	for i := 0; i < 10; i++ {
+		assert.EqualValues(t, hash, BookHash(parseBook(t, magic)))
+	}
+
+	// nor does spacing the fields differently
+	assert.EqualValues(t, hash, BookHash(parseBook(t, "0 string AB  ab\n>2   ubyte 1\tone\n!:mime\tapplication/x-ab\n0\tname\tpage\n>0\tubyte\t2\ttwo\n")))
+
+	// but values, descriptions, MIME types and pages do
+	for _, other := range []string{
+		"0\tstring\tAB\tab\n>2\tubyte\t3\tone\n!:mime\tapplication/x-ab\n0\tname\tpage\n>0\tubyte\t2\ttwo\n",
+		"0\tstring\tAB\tab\n>2\tubyte\t1\tuno\n!:mime\tapplication/x-ab\n0\tname\tpage\n>0\tubyte\t2\ttwo\n",
+		"0\tstring\tAB\tab\n>2\tubyte\t1\tone\n!:mime\tapplication/x-ba\n0\tname\tpage\n>0\tubyte\t2\ttwo\n",
+		"0\tstring\tAB\tab\n>2\tubyte\t1\tone\n!:mime\tapplication/x-ab\n0\tname\tother\n>0\tubyte\t2\ttwo\n",
+	} {
+		assert.NotEqual(t, hash, BookHash(parseBook(t, other)), "for %q", other)
+	}
+}
+
+func Test_CompileMetadata(t *testing.T) {
+	magdir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(magdir, "ab"), []byte("0\tstring\tAB\tab\n>2\tubyte\t1\tone\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(magdir, "cd"), []byte("0\tstring\tCD\tcd\n"), 0644))
+	book := parseTestMagic(t, magdir)
+
+	var first, second bytes.Buffer
+	_, err := CompileTo(&first, book, Options{Package: "generated", SourceRoot: magdir})
+	assert.NoError(t, err)
+	_, err = CompileTo(&second, parseTestMagic(t, magdir), Options{Package: "generated", SourceRoot: magdir})
+	assert.NoError(t, err)
+	assert.EqualValues(t, first.String(), second.String())
+
+	code := first.String()
+	assert.Contains(t, code, "const GeneratedFromRuleCount = 3\n")
+	assert.Contains(t, code, "const GeneratedBookHash = "+strconv.Quote(BookHash(book))+"\n")
+	assert.Contains(t, code, "const GeneratorVersion = "+strconv.Quote(GeneratorVersion())+"\n")
+	assert.Contains(t, code, "var GeneratedFromFiles = []string{\n\t\"ab\",\n\t\"cd\",\n}")
+
+	// rules that weren't read from files don't list any
+	first.Reset()
+	_, err = CompileTo(&first, parseBook(t, "0\tstring\tAB\tab\n"), Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.NotContains(t, first.String(), "GeneratedFromFiles")
+}
@@ -0,0 +1,138 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// generatedImports returns the packages code imports, sorted
+func generatedImports(t *testing.T, code []byte) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), "generated.go", code, parser.ImportsOnly)
+	assert.NoError(t, err)
+	var imports []string
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		assert.NoError(t, err)
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+func Test_CompileMinimalImports(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+	for page, rules := range parseBook(t, floatMagic) {
+		book[page] = append(book[page], rules...)
+	}
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"encoding/binary", "fmt", DefaultRuntimeImportPath, "io", "math", "regexp"}, generatedImports(t, buf.Bytes()))
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", MinimalImports: true})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.EqualValues(t, []string{"encoding/binary", DefaultRuntimeImportPath, "strconv"}, generatedImports(t, buf.Bytes()))
+	assert.Contains(t, code, "func sf(format string, a interface{}) string {")
+	assert.Contains(t, code, "= utils.MustCompileRegex(")
+	assert.Contains(t, code, "var g8 = utils.Float64FromBits")
+	assert.Contains(t, code, "return utils.ReadUint(r, off, ")
+
+	// inlined readers get a buffer per identification, not from a pool
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", MinimalImports: true, InlineReaders: true})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.EqualValues(t, []string{"encoding/binary", DefaultRuntimeImportPath, "strconv"}, generatedImports(t, buf.Bytes()))
+	assert.Contains(t, code, "\ttb := new([8]byte)\n")
+	assert.NotContains(t, code, "tbPool")
+
+	// nothing to format
+	buf.Reset()
+	_, err = CompileTo(&buf, parseBook(t, "0\tstring\tAB\tab\n>2\tubyte\t1\t\\b, one\n"), Options{Package: "generated", MinimalImports: true})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{DefaultRuntimeImportPath}, generatedImports(t, buf.Bytes()))
+	assert.NotContains(t, buf.String(), "func sf(")
+
+	_, err = CompileTo(&buf, book, Options{Package: "generated", MinimalImports: true, Trace: true})
+	assert.EqualError(t, err, "MinimalImports can't be used with Trace")
+	_, err = CompileTo(&buf, book, Options{Package: "generated", MinimalImports: true, SelfContained: true})
+	assert.EqualError(t, err, "MinimalImports can't be used with SelfContained")
+}
+
+const sprintfTestSource = `package generated
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSprintf(t *testing.T) {
+	var specs []string
+	for _, flags := range []string{"", "-", "+", " ", "#", "0", "-0", "+0", " 0", "#0", "+#", "-+ #0"} {
+		for _, width := range []string{"", "1", "5", "12"} {
+			for _, prec := range []string{"", ".", ".0", ".2", ".10"} {
+				specs = append(specs, "%" + flags + width + prec)
+			}
+		}
+	}
+
+	values := map[string][]interface{}{
+		"d":      {int64(0), int64(42), int64(-42), int64(math.MinInt64), int8(-128), int16(300), int32(-70000), uint64(math.MaxUint64)},
+		"c":      {rune(0), rune('A'), rune(0xe9)},
+		"oxX":    {uint64(0), uint64(8), uint64(255), uint64(math.MaxUint64)},
+		"s":      {"", "abc", "héllo wörld", []byte("\xff\xfebin"), []byte{}},
+		"eEfFgG": {0.0, math.Copysign(0, -1), 1.5, -2.25e-7, 123456789.0, 1e21, 100.0, math.Inf(1), math.Inf(-1), math.NaN()},
+	}
+	for verbs, vs := range values {
+		for _, verb := range verbs {
+			for _, spec := range specs {
+				format := "a%%b " + spec + string(verb) + " %%c"
+				for _, v := range vs {
+					if expected, actual := fmt.Sprintf(format, v), sf(format, v); actual != expected {
+						t.Errorf("%q of %#v: expected %q, got %q", format, v, expected, actual)
+					}
+				}
+			}
+		}
+	}
+}
+`
+
+// Test_GeneratedSprintf checks that sf formats like fmt.Sprintf
+func Test_GeneratedSprintf(t *testing.T) {
+	dir := scratchModule(t, parseBook(t, "0\tubyte\tx\tbyte %d\n"), Options{MinimalImports: true})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sprintf_test.go"), []byte(sprintfTestSource), 0644))
+	runGo(t, dir, "test", "-run", "TestSprintf", "./...")
+}
+
+// Test_GeneratedTinyGo builds the code generated from testdata/magic with
+// TinyGo, and checks what it identifies, if TinyGo is installed
+func Test_GeneratedTinyGo(t *testing.T) {
+	tinygo, err := exec.LookPath("tinygo")
+	if err != nil {
+		t.Skip("tinygo not found")
+	}
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+	opts := Options{MinimalImports: true}
+	dir := scratchModule(t, book, opts)
+	writeGeneratedTest(t, dir, opts, generatedSamples)
+
+	cmd := exec.Command(tinygo, "test", "./...")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, fmt.Sprintf("tinygo test:\n%s", out))
+}
@@ -0,0 +1,232 @@
+package compiler
+
+import (
+	"fmt"
+	"go/format"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parityFileName is where CompileToDir puts the parity test
+const parityFileName = "wizardry_parity_test.go"
+
+// parityTestSource identifies every file of a corpus with both the generated
+// code and the interpreter. The interpreter keeps going after the first
+// top-level rule, like generated code, and the separators it inserts
+// between top-level rules are left out.
+const parityTestSource = `// this file has been generated by github.com/9uanhuo/wizardry
+// from a set of magic rules. you probably don't want to edit it by hand
+
+package %s
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/compiler"
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	%s
+)
+
+// paths relative to the directory of this package
+const (
+	parityMagdir = %s
+	parityCorpus = %s
+	paritySortByStrength = %v
+)
+
+// parityOnlyPages is the part of the book the code was generated from
+var parityOnlyPages = %#v
+
+// paritySeparator stands in for the separators between top-level rules
+const paritySeparator = "\x00wizardry-parity\x00"
+
+func TestParity(t *testing.T) {
+	if _, err := os.Stat(parityCorpus); os.IsNotExist(err) {
+		t.Skipf("corpus %%s not found", parityCorpus)
+	}
+
+	book := make(parser.Spellbook)
+	pctx := &parser.ParseContext{Logf: func(format string, args ...interface{}) {}}
+	err := pctx.ParseAll(parityMagdir, book)
+	if err != nil {
+		t.Fatalf("parsing %%s: %%+v", parityMagdir, err)
+	}
+	if len(parityOnlyPages) > 0 {
+		book, err = compiler.PruneBook(book, parityOnlyPages)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if paritySortByStrength {
+		sortTrees(book)
+	}
+
+	ictx := &interpreter.InterpretContext{
+		Book:               book,
+		KeepGoing:          true,
+		KeepGoingSeparator: paritySeparator,
+	}
+
+	err = filepath.Walk(parityCorpus, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		t.Run(filepath.ToSlash(path), func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			%sresult := Identify__Result(%sNewSliceReader(f, 0, info.Size()), 0)
+
+			matches, err := ictx.IdentifyMatches(utils.NewSliceReader(f, 0, info.Size()))
+			if err != nil {
+				t.Errorf("interpreter: %%v", err)
+			}
+			var expected []string
+			for _, m := range matches {
+				if m.Description != paritySeparator {
+					expected = append(expected, m.Description)
+				}
+			}
+
+			if actual := strings.Join(result.Descriptions, "|"); actual != strings.Join(expected, "|") {
+				t.Errorf("interpreter found %%q, generated code %%q", strings.Join(expected, "|"), actual)
+			}
+			if mime := interpreter.MIMEType(matches); result.MIME != mime {
+				t.Errorf("interpreter found MIME type %%q, generated code %%q", mime, result.MIME)
+			}
+%s		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sortTrees orders the top-level trees of book strongest first, like the
+// generated code
+func sortTrees(book parser.Spellbook) {
+	var trees [][]parser.Rule
+	for _, rule := range book[""] {
+		if rule.Level == 0 || len(trees) == 0 {
+			trees = append(trees, nil)
+		}
+		trees[len(trees)-1] = append(trees[len(trees)-1], rule)
+	}
+	sort.SliceStable(trees, func(i, j int) bool {
+		return trees[i][0].Strength() > trees[j][0].Strength()
+	})
+
+	var rules []parser.Rule
+	for _, tree := range trees {
+		rules = append(rules, tree...)
+	}
+	book[""] = rules
+}
+%s`
+
+// parityTraceStart collects what the generated code traces while it
+// identifies a file
+const parityTraceStart = `var trace []string
+			Trace = func(line string) { trace = append(trace, line) }
+			defer func() { Trace = nil }()
+			`
+
+// parityTraceCheck checks the rules the interpreter matched were traced in
+// the same order
+const parityTraceCheck = `			checkTrace(t, trace, matches)
+`
+
+const parityTraceSource = `
+// checkTrace checks that the rules of matches show up in trace, in order
+func checkTrace(t *testing.T, trace []string, matches []interpreter.Match) {
+	i := 0
+	for _, m := range matches {
+		if m.Description == paritySeparator {
+			continue
+		}
+		for i < len(trace) && trace[i] != m.Line {
+			i++
+		}
+		if i == len(trace) {
+			t.Errorf("rule %q matched, but wasn't traced in order", m.Line)
+			return
+		}
+		i++
+	}
+}
+`
+
+// WriteParityTest writes a test for the code generated with opts, which
+// checks that it identifies every file under opts.ParityCorpus the same way
+// as the interpreter does with the magic files at opts.ParityMagdir. The
+// test goes in the same package as the generated code, and skips itself
+// when the corpus doesn't exist. It imports this repository, even when the
+// generated code is self-contained. With opts.Trace, it also checks that the
+// rules the interpreter matched are traced, in the same order.
+func WriteParityTest(w io.Writer, opts Options) error {
+	if opts.ParityMagdir == "" || opts.ParityCorpus == "" {
+		return errors.New("a parity test needs both a magdir and a corpus")
+	}
+
+	// the generated code may take another SliceReader than the interpreter
+	readerImport := ""
+	rq := "utils."
+	if opts.SelfContained {
+		rq = ""
+	} else if opts.ReaderImportPath != "" && opts.ReaderImportPath != DefaultRuntimeImportPath {
+		readerImport = "reader " + strconv.Quote(opts.ReaderImportPath)
+		rq = "reader."
+	}
+	traceStart, traceCheck, traceSource := "", "", ""
+	if opts.Trace {
+		traceStart, traceCheck, traceSource = parityTraceStart, parityTraceCheck, parityTraceSource
+	}
+	source := fmt.Sprintf(parityTestSource, opts.Package, readerImport,
+		strconv.Quote(filepath.ToSlash(opts.ParityMagdir)),
+		strconv.Quote(filepath.ToSlash(opts.ParityCorpus)),
+		opts.SortByStrength, opts.OnlyPages, traceStart, rq, traceCheck, traceSource)
+
+	code, err := format.Source([]byte(source))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = w.Write(code)
+	return errors.WithStack(err)
+}
+
+// parityTestPath is where CompileWithOptions puts the parity test of the
+// code generated into output
+func parityTestPath(output string) string {
+	return strings.TrimSuffix(output, ".go") + "_parity_test.go"
+}
+
+// writeParityTestFile writes the parity test of the code generated with opts
+// to path
+func writeParityTestFile(path string, opts Options) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	opts.logf("Generating parity test into: %s", path)
+	err = WriteParityTest(f, opts)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(f.Close())
+}
@@ -0,0 +1,114 @@
+package compiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCorpus writes generatedSamples to dir, with a few more files in a
+// subdirectory
+func writeCorpus(t *testing.T, dir string) {
+	sub := filepath.Join(dir, "more")
+	assert.NoError(t, os.MkdirAll(sub, 0755))
+
+	for _, s := range generatedSamples {
+		name := strings.ReplaceAll(s.name, " ", "-")
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(s.data), 0644))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sub, "empty"), nil, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sub, "gif-and-more"), []byte("GIF87a\x01\x00\x01\x00trailing"), 0644))
+}
+
+func Test_WriteParityTest(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteParityTest(&buf, Options{Package: "generated", ParityMagdir: "magic", ParityCorpus: "corpus"})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, "package generated\n")
+	assert.Contains(t, code, `parityCorpus         = "corpus"`)
+	assert.Contains(t, code, "Identify__Result(utils.NewSliceReader(f, 0, info.Size()), 0)")
+	assert.NotContains(t, code, "Trace")
+
+	buf.Reset()
+	err = WriteParityTest(&buf, Options{Package: "generated", ParityMagdir: "magic", ParityCorpus: "corpus", Trace: true})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Trace = func(line string) { trace = append(trace, line) }")
+	assert.Contains(t, buf.String(), "checkTrace(t, trace, matches)")
+
+	buf.Reset()
+	err = WriteParityTest(&buf, Options{Package: "generated", ParityMagdir: "magic", ParityCorpus: "corpus", SelfContained: true})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Identify__Result(NewSliceReader(f, 0, info.Size()), 0)")
+
+	buf.Reset()
+	err = WriteParityTest(&buf, Options{Package: "generated", ParityMagdir: "magic", ParityCorpus: "corpus", ReaderImportPath: "example.com/reader"})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `reader "example.com/reader"`)
+	assert.Contains(t, buf.String(), "Identify__Result(reader.NewSliceReader(f, 0, info.Size()), 0)")
+
+	err = WriteParityTest(&buf, Options{Package: "generated", ParityMagdir: "magic"})
+	assert.Error(t, err)
+}
+
+func Test_GeneratedParity(t *testing.T) {
+	magdir, err := filepath.Abs(filepath.Join("testdata", "magic"))
+	assert.NoError(t, err)
+	book := parseTestMagic(t, magdir)
+
+	corpus := t.TempDir()
+	writeCorpus(t, corpus)
+
+	// all of them, with a function per page, then with SingleDispatch
+	for _, singleDispatch := range []bool{false, true} {
+		for _, opts := range []Options{
+			{},
+			{SelfContained: true, PagesPerFile: 4},
+			{SortByStrength: true},
+			{Structured: true},
+			{OnlyPages: []string{"PNG", "Zip archive", "RIFF (big-endian)"}},
+			{Trace: true},
+			{Trace: true, Structured: true, SelfContained: true},
+			{StringBlobThreshold: 8},
+			{StringBlobThreshold: 1, SelfContained: true, PagesPerFile: 3},
+			{MinimalImports: true, Structured: true},
+			{RuntimeSwap: true, PagesPerFile: 2},
+		} {
+			opts.SingleDispatch = singleDispatch
+			opts.ParityMagdir = magdir
+			opts.ParityCorpus = corpus
+			dir := scratchModule(t, book, opts)
+
+			out := runGo(t, dir, "test", "-v", "-run", "TestParity", "./...")
+			assert.Contains(t, out, "--- PASS: TestParity/")
+			assert.Contains(t, out, "/more/gif-and-more")
+			assert.NotContains(t, out, "SKIP")
+		}
+	}
+
+	t.Run("missing corpus", func(t *testing.T) {
+		dir := scratchModule(t, book, Options{
+			ParityMagdir: magdir,
+			ParityCorpus: filepath.Join(corpus, "missing"),
+		})
+		out := runGo(t, dir, "test", "-v", "-run", "TestParity", "./...")
+		assert.Contains(t, out, "--- SKIP: TestParity")
+	})
+
+	t.Run("divergence", func(t *testing.T) {
+		// the interpreter gets other rules than the code was generated from
+		other := filepath.Join(t.TempDir(), "magic")
+		assert.NoError(t, os.MkdirAll(other, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(other, "gif"), []byte("0\tstring\tGIF8\tnot quite GIF\n"), 0644))
+
+		dir := scratchModule(t, book, Options{ParityMagdir: other, ParityCorpus: corpus})
+		out, err := goOutput(dir, "test", "-run", "TestParity", "./...")
+		assert.Error(t, err)
+		assert.Contains(t, out, `interpreter found "not quite GIF", generated code "GIF image data|`)
+	})
+}
@@ -0,0 +1,45 @@
+package compiler
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// sourcePath returns the path of a magic file as written in generated code:
+// relative to root, or just its name when root is empty or doesn't contain
+// it, so that the output doesn't depend on where the magic lives
+func sourcePath(file string, root string) string {
+	if root != "" {
+		if filepath.IsAbs(root) != filepath.IsAbs(file) {
+			// Rel needs both relative or both absolute
+			root, _ = filepath.Abs(root)
+			file, _ = filepath.Abs(file)
+		}
+		rel, err := filepath.Rel(root, file)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(file)
+}
+
+// ruleProvenance returns where rule comes from, then the rule itself, e.g.
+// "elf:12: 0 string \177ELF ELF"
+func ruleProvenance(rule parser.Rule, root string) string {
+	if rule.SourceFile == "" {
+		return rule.Line
+	}
+	return fmt.Sprintf("%s:%d: %s", sourcePath(rule.SourceFile, root), rule.SourceLine, rule.Line)
+}
+
+// lineDirective returns the //line directive attributing the code after it
+// to rule, or "" if we don't know which file the rule comes from
+func lineDirective(rule parser.Rule, root string) string {
+	if rule.SourceFile == "" {
+		return ""
+	}
+	return fmt.Sprintf("//line %s:%d", sourcePath(rule.SourceFile, root), rule.SourceLine)
+}
@@ -0,0 +1,65 @@
+package compiler
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SourcePath(t *testing.T) {
+	root := filepath.Join("testdata", "magic")
+	assert.EqualValues(t, "elf", sourcePath(filepath.Join(root, "elf"), root))
+	assert.EqualValues(t, "more/elf", sourcePath(filepath.Join(root, "more", "elf"), root))
+	abs, err := filepath.Abs(root)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "elf", sourcePath(filepath.Join(root, "elf"), abs))
+
+	// outside of the root, or without one, only the name is kept
+	assert.EqualValues(t, "elf", sourcePath(filepath.Join("elsewhere", "elf"), root))
+	assert.EqualValues(t, "elf", sourcePath(filepath.Join(abs, "elf"), ""))
+}
+
+func Test_CompileProvenance(t *testing.T) {
+	magdir := filepath.Join("testdata", "magic")
+	book := parseTestMagic(t, magdir)
+
+	opts := Options{Package: "generated", EmitComments: true, LineDirectives: true, SourceRoot: magdir}
+	for _, structured := range []bool{false, true} {
+		opts.Structured = structured
+
+		var out bytes.Buffer
+		_, err := CompileTo(&out, book, opts)
+		assert.NoError(t, err)
+		code := out.String()
+
+		assert.Contains(t, code, "// archives:2: 0\tstring\tPK\\003\\004\tZip archive data\n")
+		assert.Contains(t, code, "// archives:18: >2\tubyte\t8\t\\b, deflated\n")
+		// directives stay at the start of their line, after the comment
+		assert.Contains(t, code, "\\b, deflated\n//line archives:18\n")
+		assert.Contains(t, code, "\n//line archives:2\n")
+		assert.NotContains(t, code, "testdata")
+	}
+
+	// the formatter doesn't move them either
+	opts.SkipFormat = true
+	var out bytes.Buffer
+	_, err := CompileTo(&out, book, opts)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "\n//line archives:18\n")
+
+	// rules that weren't read from a file have no provenance
+	out.Reset()
+	_, err = CompileTo(&out, parseBook(t, "0\tstring\tAB\tab\n"), Options{Package: "generated", EmitComments: true, LineDirectives: true})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "// 0\tstring\tAB\tab\n")
+	assert.NotContains(t, out.String(), "//line")
+}
+
+func Test_GeneratedProvenance(t *testing.T) {
+	magdir := filepath.Join("testdata", "magic")
+	book := parseTestMagic(t, magdir)
+
+	testGenerated(t, book, Options{EmitComments: true, LineDirectives: true, SourceRoot: magdir})
+}
@@ -0,0 +1,161 @@
+package compiler
+
+import (
+	"bytes"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/pkg/errors"
+)
+
+// PruneBook returns the part of book needed by the entries of only: the
+// top-level trees whose description starts with an entry, the pages named
+// by one, and every page they use, directly or not. The top-level page is
+// always there, even when none of its trees are kept. Entries that match
+// neither a tree nor a page are an error.
+func PruneBook(book parser.Spellbook, only []string) (parser.Spellbook, error) {
+	pruned, _, err := pruneBook(book, only)
+	return pruned, err
+}
+
+// pruneBook is PruneBook, and also returns the pages that were asked for by
+// name, which have to be emitted even if nothing uses them
+func pruneBook(book parser.Spellbook, only []string) (parser.Spellbook, []string, error) {
+	pruned := make(parser.Spellbook)
+	var roots []string
+
+	var pending []string
+	keep := func(page string) {
+		if _, ok := pruned[page]; ok {
+			return
+		}
+		if rules, ok := book[page]; ok {
+			pruned[page] = rules
+			pending = append(pending, page)
+		}
+	}
+
+	var rules []parser.Rule
+	for _, tree := range splitTrees(book[""]) {
+		for _, entry := range only {
+			if bytes.HasPrefix(tree[0].Description, []byte(entry)) {
+				rules = append(rules, tree...)
+				break
+			}
+		}
+	}
+	pruned[""] = rules
+	pending = append(pending, "")
+
+	var missing []string
+	for _, entry := range only {
+		if _, ok := book[entry]; ok && entry != "" {
+			keep(entry)
+			roots = append(roots, entry)
+			continue
+		}
+		found := false
+		for _, rule := range rules {
+			if rule.Level == 0 && bytes.HasPrefix(rule.Description, []byte(entry)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, entry)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, errors.Errorf("no page or top-level rule matches %q", missing)
+	}
+
+	// then whatever the kept rules use, until nothing changes
+	for len(pending) > 0 {
+		page := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for _, rule := range pruned[page] {
+			if rule.Kind.Family == parser.KindFamilyUse {
+				uk, _ := rule.Kind.Data.(*parser.UseKind)
+				keep(uk.Page)
+			}
+		}
+	}
+
+	return pruned, roots, nil
+}
+
+// splitTrees cuts rules into top-level trees: a rule of level 0 and the
+// rules under it
+func splitTrees(rules []parser.Rule) [][]parser.Rule {
+	var trees [][]parser.Rule
+	for _, rule := range rules {
+		if rule.Level == 0 || len(trees) == 0 {
+			trees = append(trees, nil)
+		}
+		trees[len(trees)-1] = append(trees[len(trees)-1], rule)
+	}
+	return trees
+}
+
+// pruneFarRules returns book without the rules that can't match an input of
+// at most maxSize bytes, because they read at or past maxSize, and without
+// the rules under them. Pages that were only reached, from the top-level
+// page or from roots, through pruned rules are dropped too. It also returns
+// how many rules were pruned, those of dropped pages included.
+func pruneFarRules(book parser.Spellbook, maxSize int64, roots []string) (parser.Spellbook, int) {
+	pruned := make(parser.Spellbook)
+	count := 0
+	for page, rules := range book {
+		var kept []parser.Rule
+		farLevel := -1
+		for _, rule := range rules {
+			if farLevel >= 0 && rule.Level > farLevel {
+				count++
+				continue
+			}
+			farLevel = -1
+			if readsPast(rule, maxSize) {
+				farLevel = rule.Level
+				count++
+				continue
+			}
+			kept = append(kept, rule)
+		}
+		pruned[page] = kept
+	}
+
+	before := computePagesUsage(book, roots...)
+	after := computePagesUsage(pruned, roots...)
+	for page, rules := range pruned {
+		_, wasUsed := before[page]
+		if _, used := after[page]; wasUsed && !used {
+			count += len(rules)
+			delete(pruned, page)
+		}
+	}
+	return pruned, count
+}
+
+// readsPast returns true if rule only matches when it can read at or past
+// maxSize. Relative offsets are at least what they add to the end of the
+// previous match, indirect ones could be anything, and rules that match
+// without reading anything can't be pruned.
+func readsPast(rule parser.Rule, maxSize int64) bool {
+	of := rule.Offset
+	if of.OffsetType != parser.OffsetTypeDirect || of.Direct < maxSize {
+		return false
+	}
+
+	switch rule.Kind.Family {
+	case parser.KindFamilyInteger:
+		ik, _ := rule.Kind.Data.(*parser.IntegerKind)
+		return !ik.MatchAny
+	case parser.KindFamilyString:
+		sk, _ := rule.Kind.Data.(*parser.StringKind)
+		return !sk.Negate && sk.Value != ""
+	case parser.KindFamilySearch:
+		sk, _ := rule.Kind.Data.(*parser.SearchKind)
+		return sk.Value != ""
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package compiler
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PruneBook(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	pruned, err := PruneBook(book, []string{"GIF", "RIFF (big-endian)"})
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 2)
+	var descriptions []string
+	for _, rule := range pruned[""] {
+		if rule.Level == 0 {
+			descriptions = append(descriptions, string(rule.Description))
+		}
+	}
+	assert.EqualValues(t, []string{"GIF image data", "RIFF (big-endian) data"}, descriptions)
+	// used through \^riff-chunk
+	assert.EqualValues(t, book["riff-chunk"], pruned["riff-chunk"])
+
+	// pages can be asked for by name, the top-level page is still there
+	pruned, err = PruneBook(book, []string{"riff-chunk"})
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 2)
+	assert.Empty(t, pruned[""])
+
+	_, err = PruneBook(book, []string{"GIF", "JPEG", "no-such-page"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `["JPEG" "no-such-page"]`)
+}
+
+func Test_CompileOnlyPages(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+	pageFuncs := regexp.MustCompile(`(?m)^func identify(\w*)\(`)
+
+	var all bytes.Buffer
+	_, err := CompileTo(&all, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+
+	var some bytes.Buffer
+	opts := Options{Package: "generated", OnlyPages: []string{"PNG", "Zip archive", "RIFF (big-endian)"}}
+	stats, err := CompileTo(&some, book, opts)
+	assert.NoError(t, err)
+	assert.Less(t, some.Len(), all.Len()/2)
+	// the top-level page, and riff-chunk swapped only
+	assert.EqualValues(t, 2, stats.PagesEmitted)
+	assert.Len(t, pageFuncs.FindAllString(some.String(), -1), 2)
+	assert.NotContains(t, some.String(), "GIF image data")
+	assert.NotContains(t, some.String(), "regexp")
+
+	// a page asked for by name is emitted even though nothing uses it
+	some.Reset()
+	stats, err = CompileTo(&some, book, Options{Package: "generated", OnlyPages: []string{"riff-chunk"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, stats.PagesEmitted)
+	assert.Contains(t, some.String(), `"riff-chunk": Identify`)
+
+	_, err = CompileTo(&some, book, Options{Package: "generated", OnlyPages: []string{"JPEG"}})
+	assert.Error(t, err)
+}
+
+func Test_GeneratedOnlyPages(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var samples []generatedSample
+	for _, s := range generatedSamples {
+		switch s.name {
+		case "png", "zip", "big-endian wave":
+			samples = append(samples, s)
+		case "gif", "wave":
+			// left out
+			s.expected = ""
+			s.mime = ""
+			samples = append(samples, s)
+		}
+	}
+	assert.Len(t, samples, 5)
+
+	testGeneratedSamples(t, book, Options{OnlyPages: []string{"PNG", "Zip archive", "RIFF (big-endian)"}}, samples)
+}
+
+// farMagic has rules past 64KiB, at fixed offsets, relative ones, in a
+// search, and under near rules, and a page only far rules use
+const farMagic = `
+0	name	far-page
+>0	ubyte	x	\b, far page
+0	name	near-page
+>0	ubyte	x	\b, near page
+0	string	NEAR	near
+>1048576	string	FAR	\b, far child
+>>0	ubyte	x	\b, under far
+>>>0	ubyte	x	\b, under under far
+>4	ubyte	1	\b, one
+>&65536	ubelong	0x1234	\b, relative far
+>(4.b)	ubyte	2	\b, indirect
+>1048576	ubyte	x	\b, any byte
+>1048576	string	!X	\b, not X
+>4	use	near-page
+1048576	string	FAR	far
+>0	use	far-page
+65536	search/4096	FAR	searched far
+65535	string	CLOSE	close
+`
+
+func Test_PruneFarRules(t *testing.T) {
+	book := parseBook(t, farMagic)
+
+	pruned, count := pruneFarRules(book, 65536, nil)
+	// the far child, the two under it, the relative one, the far tree,
+	// the searched one, and far-page, its name rule included
+	assert.EqualValues(t, 9, count)
+	_, ok := pruned["far-page"]
+	assert.False(t, ok)
+	assert.EqualValues(t, book["near-page"], pruned["near-page"])
+
+	var lines []string
+	for _, rule := range pruned[""] {
+		lines = append(lines, canonicalLine(rule.Line))
+	}
+	assert.EqualValues(t, []string{
+		"0\tstring\tNEAR\tnear",
+		">4\tubyte\t1\t\\b, one",
+		">(4.b)\tubyte\t2\t\\b, indirect",
+		">1048576\tubyte\tx\t\\b, any byte",
+		">1048576\tstring\t!X\t\\b, not X",
+		">4\tuse\tnear-page",
+		"65535\tstring\tCLOSE\tclose",
+	}, lines)
+
+	// pages asked for by name stay
+	pruned, count = pruneFarRules(book, 65536, []string{"far-page"})
+	assert.EqualValues(t, 7, count)
+	assert.EqualValues(t, book["far-page"], pruned["far-page"])
+
+	// nothing's far enough
+	pruned, count = pruneFarRules(book, 1<<21, nil)
+	assert.EqualValues(t, 0, count)
+	assert.EqualValues(t, book, pruned)
+}
+
+func Test_CompileMaxInputSize(t *testing.T) {
+	book := parseBook(t, farMagic)
+
+	var out bytes.Buffer
+	stats, err := CompileTo(&out, book, Options{Package: "generated", MaxInputSize: 65536})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 9, stats.RulesPruned)
+	code := out.String()
+	assert.Contains(t, code, "near")
+	assert.NotContains(t, code, "far")
+	assert.NotContains(t, code, `"FAR"`)
+
+	out.Reset()
+	stats, err = CompileTo(&out, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, stats.RulesPruned)
+	assert.Contains(t, out.String(), `"FAR"`)
+}
+
+func Test_GeneratedMaxInputSize(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	// the samples are all headers, and much smaller than that
+	testGeneratedSamples(t, book, Options{MaxInputSize: 65536}, generatedSamples)
+}
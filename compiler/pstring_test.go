@@ -0,0 +1,74 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GeneratedPString(t *testing.T) {
+	book := parseBook(t, `
+0	string	B	byte length
+>1	pstring	Hello	\b, says "%s"
+>>&0	ubyte	x	\b, then %d
+>1	pstring/B	!Bye	\b, doesn't say bye
+0	string	H	big-endian short length
+>1	pstring/H	Hello	\b, says "%s"
+0	string	h	little-endian short length
+>1	pstring/hc	hello	\b, says "%s"
+0	string	L	big-endian long length
+>1	pstring/LJ	Hello	\b, says "%s"
+>>&0	ubyte	x	\b, then %d
+0	string	l	little-endian long length
+>1	pstring/l	Hello	\b, says "%s"
+`)
+
+	inputs := []struct {
+		name string
+		data string
+	}{
+		{"byte", "B\x0bHello world\x2a"},
+		{"byte, too short", "B\x04Hello"},
+		{"byte, past the end", "B\x0cHello world"},
+		{"byte, bye", "B\x03Bye"},
+		{"big-endian short", "H\x00\x05Hello"},
+		{"big-endian short, wrong order", "H\x05\x00Hello"},
+		{"little-endian short", "h\x05\x00HELLO"},
+		{"big-endian long, including itself", "L\x00\x00\x00\x09Hello\x2a"},
+		{"big-endian long, too short for itself", "L\x00\x00\x00\x02Hello"},
+		{"little-endian long", "l\x06\x00\x00\x00Hello!"},
+		{"little-endian long, huge", "l\xff\xff\xff\xffHello!"},
+	}
+
+	// the generated code must find what the interpreter does
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, in := range inputs {
+		sr := utils.NewSliceReader(strings.NewReader(in.data), 0, int64(len(in.data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     in.name,
+			data:     in.data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+
+	assert.EqualValues(t, `byte length|\b, says "Hello world"|\b, then 42|\b, doesn't say bye`, samples[0].expected)
+	assert.EqualValues(t, `byte length|\b, doesn't say bye`, samples[1].expected)
+	// strings that don't fit never match, even negated
+	assert.EqualValues(t, `byte length`, samples[2].expected)
+	assert.EqualValues(t, `byte length`, samples[3].expected)
+	assert.EqualValues(t, `big-endian short length|\b, says "Hello"`, samples[4].expected)
+	assert.EqualValues(t, `big-endian short length`, samples[5].expected)
+	assert.EqualValues(t, `little-endian short length|\b, says "HELLO"`, samples[6].expected)
+	assert.EqualValues(t, `big-endian long length|\b, says "Hello"|\b, then 42`, samples[7].expected)
+	assert.EqualValues(t, `big-endian long length`, samples[8].expected)
+	assert.EqualValues(t, `little-endian long length|\b, says "Hello!"`, samples[9].expected)
+	assert.EqualValues(t, `little-endian long length`, samples[10].expected)
+
+	testGeneratedSamples(t, book, Options{}, samples)
+}
@@ -0,0 +1,209 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// reader is a function generated code reads an unsigned integer with
+type reader struct {
+	byteWidth  int
+	endianness parser.Endianness
+}
+
+// name is what generated code calls r. Single bytes read the same in both
+// byte orders, so there's only one reader for them.
+func (r reader) name() string {
+	if r.byteWidth == 1 {
+		return "f1"
+	}
+	return fmt.Sprintf("f%d%s", r.byteWidth, endiannessString(r.endianness, false))
+}
+
+// swapName is what generated code calls to read in r's byte order, or the
+// other one if it's swapped at run time
+func (r reader) swapName() string {
+	return fmt.Sprintf("s%d%s", r.byteWidth, endiannessString(r.endianness, false))
+}
+
+// readerName returns the reader for byteWidth bytes in the given byte
+// order, swapped if needed
+func readerName(byteWidth int, en parser.Endianness, swapEndian bool) string {
+	return reader{byteWidth: byteWidth, endianness: en.MaybeSwapped(swapEndian)}.name()
+}
+
+// usedReaders lists the readers the rules of book may call, narrowest
+// first. It errs on the side of listing too many, since an unused reader
+// only takes up space.
+func usedReaders(book parser.Spellbook, usages map[string]*PageUsage) []reader {
+	set := make(map[string]reader)
+	for page, rules := range book {
+		usage := usages[page]
+		if usage == nil {
+			continue
+		}
+
+		var swaps []bool
+		if usage.EmitNormal {
+			swaps = append(swaps, false)
+		}
+		if usage.EmitSwapped {
+			swaps = append(swaps, true)
+		}
+
+		ruleReaders(rules, func(byteWidth int, en parser.Endianness) {
+			for _, swapEndian := range swaps {
+				r := reader{byteWidth: byteWidth, endianness: en.MaybeSwapped(swapEndian)}
+				if byteWidth == 1 {
+					r.endianness = parser.LittleEndian
+				}
+				set[r.name()] = r
+			}
+		})
+	}
+	return sortedReaders(set)
+}
+
+// swapReaders lists the readers, as written, that the rules of the pages
+// used in both byte orders read with, which RuntimeSwap emits once: they
+// need one picking the byte order at run time, unless they read a single
+// byte.
+func swapReaders(book parser.Spellbook, usages map[string]*PageUsage) []reader {
+	set := make(map[string]reader)
+	for page, rules := range book {
+		usage := usages[page]
+		if usage == nil || !usage.EmitNormal || !usage.EmitSwapped {
+			continue
+		}
+		ruleReaders(rules, func(byteWidth int, en parser.Endianness) {
+			if byteWidth > 1 {
+				r := reader{byteWidth: byteWidth, endianness: en}
+				set[r.name()] = r
+			}
+		})
+	}
+	return sortedReaders(set)
+}
+
+// ruleReaders calls add with the width and byte order of every integer
+// rules reads, values, pointers and lengths
+func ruleReaders(rules []parser.Rule, add func(byteWidth int, en parser.Endianness)) {
+	for _, rule := range rules {
+		if rule.Offset.OffsetType == parser.OffsetTypeIndirect {
+			add(rule.Offset.Indirect.ByteWidth, rule.Offset.Indirect.Endianness)
+		}
+
+		switch kind := rule.Kind.Data.(type) {
+		case *parser.IntegerKind:
+			add(kind.ByteWidth, kind.Endianness)
+		case *parser.DateKind:
+			add(kind.ByteWidth, kind.Endianness)
+		case *parser.FloatKind:
+			add(kind.ByteWidth, kind.Endianness)
+		case *parser.PStringKind:
+			add(kind.LengthWidth, kind.LengthEndianness)
+		case *parser.SwitchKind:
+			add(kind.ByteWidth, kind.Endianness)
+		}
+	}
+}
+
+// sortedReaders returns the readers of set, narrowest first
+func sortedReaders(set map[string]reader) []reader {
+	readers := make([]reader, 0, len(set))
+	for _, r := range set {
+		readers = append(readers, r)
+	}
+	sort.Slice(readers, func(i, j int) bool {
+		if readers[i].byteWidth != readers[j].byteWidth {
+			return readers[i].byteWidth < readers[j].byteWidth
+		}
+		return readers[i].endianness < readers[j].endianness
+	})
+	return readers
+}
+
+// sharedReads groups the siblings among children that read the same
+// integer: at the same offset, which mustn't be relative to anything but
+// the page, with the same width and byte order. Each group reads it once,
+// into locals of its own, so that siblings in between may read other
+// things. Siblings that follow each other, the first without children,
+// already share rc, so they're only grouped if another sibling of theirs is
+// further away. It returns the group of every sibling that shares its read,
+// groups are numbered from 0 in the order of their first sibling, and how
+// many groups there are.
+func sharedReads(children []*ruleNode) (map[*ruleNode]int, int) {
+	type readKey struct {
+		offset parser.Offset
+		reader reader
+	}
+	var keys []readKey
+	var members [][]*ruleNode
+	// where each of them is, and which read
+	position := make(map[*ruleNode]int)
+	read := make(map[*ruleNode]int)
+	for i, child := range children {
+		rule := child.rule
+		if !readsValue(rule) || !fixedOffset(rule.Offset) {
+			continue
+		}
+		ik, _ := rule.Kind.Data.(*parser.IntegerKind)
+		key := readKey{offset: canonicalOffset(rule.Offset), reader: reader{byteWidth: ik.ByteWidth, endianness: ik.Endianness}}
+		if ik.ByteWidth == 1 {
+			key.reader.endianness = parser.LittleEndian
+		}
+
+		index := -1
+		for i, other := range keys {
+			if other.reader == key.reader && other.offset.Equals(key.offset) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			index = len(keys)
+			keys = append(keys, key)
+			members = append(members, nil)
+		}
+		members[index] = append(members[index], child)
+		position[child] = i
+		read[child] = index
+	}
+
+	groups := make(map[*ruleNode]int)
+	count := 0
+	for _, siblings := range members {
+		apart := false
+		for _, sibling := range siblings[1:] {
+			prev := children[position[sibling]-1]
+			if p, ok := read[prev]; !ok || p != read[sibling] || len(prev.children) > 0 {
+				apart = true
+				break
+			}
+		}
+		if !apart {
+			continue
+		}
+		for _, sibling := range siblings {
+			groups[sibling] = count
+		}
+		count++
+	}
+	return groups, count
+}
+
+// fixedOffset tells whether o is the same wherever its rule is in the page:
+// it isn't relative to the previous match, and if it's indirect, the
+// pointer isn't either, and the compiler follows it
+func fixedOffset(o parser.Offset) bool {
+	if o.IsRelative {
+		return false
+	}
+	if o.OffsetType == parser.OffsetTypeIndirect {
+		indirect := o.Indirect
+		return !indirect.IsRelative && !indirect.IsNested() && !dividesByNonPositive(indirect)
+	}
+	return true
+}
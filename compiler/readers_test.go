@@ -0,0 +1,159 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const sharedReadsMagic = "0\tstring\tMZ\texe\n" +
+	">0x3c\tulelong\t>0\t\\b, header\n" +
+	">4\tuleshort\t1\t\\b, one\n" +
+	">0x3c\tulelong\t0x40\t\\b, right after\n" +
+	">4\tuleshort\t2\t\\b, two\n" +
+	">0x3c\tubelong\tx\t\\b, big %d\n" +
+	">&0\tubyte\t1\t\\b, then one\n" +
+	">8\tubyte\t1\t\\b, eight\n" +
+	">8\tubyte\t2\t\\b, also eight\n" +
+	">&0\tubyte\t2\t\\b, then two\n" +
+	">0x3c\tulelong\tx\t\\b, at %d\n"
+
+func Test_SharedReads(t *testing.T) {
+	nodes := treeify(parseBook(t, sharedReadsMagic)[""])[0].children
+
+	groups, count := sharedReads(nodes)
+	assert.EqualValues(t, 2, count)
+	assert.EqualValues(t, map[*ruleNode]int{
+		// at 0x3c, the big endian one isn't
+		nodes[0]: 0, nodes[2]: 0, nodes[9]: 0,
+		// at 4
+		nodes[1]: 1, nodes[3]: 1,
+		// the ones at 8 follow each other, and relative offsets aren't fixed
+	}, groups)
+}
+
+func Test_CompileSharedReads(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, parseBook(t, sharedReadsMagic), Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.EqualValues(t, 1, strings.Count(code, "f4l(r, po+0x3c)"))
+	assert.EqualValues(t, 1, strings.Count(code, "f2l(r, po+4)"))
+	assert.EqualValues(t, 1, strings.Count(code, "f4b(r, po+0x3c)"))
+	assert.Contains(t, code, "rd0, ok0 = f4l(r, po+0x3c)")
+	assert.Contains(t, code, "rd1, ok1 = f2l(r, po+4)")
+}
+
+func Test_GeneratedSharedReads(t *testing.T) {
+	book := parseBook(t, sharedReadsMagic)
+	samples := []generatedSample{
+		{name: "two", data: "MZ\x00\x00\x02\x00\x00\x00\x01\x00\x00\x00" + strings.Repeat("\x00", 48) + "\x40\x00\x00\x00", expected: `exe|\b, header|\b, right after|\b, two|\b, big 1073741824|\b, eight|\b, at 64`},
+		{name: "one", data: "MZ\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00" + strings.Repeat("\x00", 48) + "\x00\x00\x00\x00", expected: `exe|\b, one|\b, big 0|\b, also eight|\b, at 0`},
+	}
+	for _, opts := range []Options{{}, {SingleDispatch: true, Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// readersMagic uses a reader of every width and byte order
+const readersMagic = "0\tubyte\tx\tbyte %d\n" +
+	">0\tleshort\tx\t\\b, %d\n" +
+	">0\tbeshort\tx\t\\b, %d\n" +
+	">0\tlelong\tx\t\\b, %d\n" +
+	">0\tbelong\tx\t\\b, %d\n" +
+	">0\tlequad\tx\t\\b, %d\n" +
+	">0\tbequad\tx\t\\b, %d\n"
+
+// generatedReadersSource checks the readers of generated code against what
+// utils.ReadUint returned, in windows of data ending anywhere
+const generatedReadersSource = `package generated
+
+import (
+	"strings"
+	"testing"
+%s)
+
+const data = %q
+
+var readerCases = []struct {
+	start  int64
+	size   int64
+	reader string
+	off    int64
+	v      uint64
+	ok     bool
+}{
+%s}
+
+func TestReaders(t *testing.T) {
+	for _, c := range readerCases {
+		r := %sNewSliceReader(strings.NewReader(data), c.start, c.size)
+		var v uint64
+		var ok bool
+		switch c.reader {
+		case "f1":
+			v, ok = f1(r%s, c.off)
+		case "f2l":
+			v, ok = f2l(r%[5]s, c.off)
+		case "f2b":
+			v, ok = f2b(r%[5]s, c.off)
+		case "f4l":
+			v, ok = f4l(r%[5]s, c.off)
+		case "f4b":
+			v, ok = f4b(r%[5]s, c.off)
+		case "f8l":
+			v, ok = f8l(r%[5]s, c.off)
+		case "f8b":
+			v, ok = f8b(r%[5]s, c.off)
+		}
+		if v != c.v || ok != c.ok {
+			t.Errorf("%%s at %%d in %%d bytes at %%d = %%d, %%v, utils.ReadUint returned %%d, %%v", c.reader, c.off, c.size, c.start, v, ok, c.v, c.ok)
+		}
+	}
+}
+`
+
+func Test_GeneratedReaders(t *testing.T) {
+	data := "\x81\x02\x83\x04\x85\x06\x87\x08\x89\x0a\x8b"
+	readers := []reader{{1, parser.LittleEndian}}
+	for _, width := range []int{2, 4, 8} {
+		for _, endianness := range []parser.Endianness{parser.LittleEndian, parser.BigEndian} {
+			readers = append(readers, reader{width, endianness})
+		}
+	}
+
+	var cases strings.Builder
+	for start := int64(0); start <= int64(len(data)); start++ {
+		for size := int64(0); start+size <= int64(len(data)); size++ {
+			sr := utils.NewSliceReader(strings.NewReader(data), start, size)
+			for _, rd := range readers {
+				for off := int64(-1); off <= size; off++ {
+					v, ok := utils.ReadUint(sr, off, rd.byteWidth, rd.endianness.ByteOrder())
+					fmt.Fprintf(&cases, "\t{%d, %d, %q, %d, %d, %v},\n", start, size, rd.name(), off, v, ok)
+				}
+			}
+		}
+	}
+
+	book := parseBook(t, readersMagic)
+	for _, opts := range []Options{{}, {InlineReaders: true}, {SelfContained: true}, {SelfContained: true, InlineReaders: true}} {
+		dir := scratchModule(t, book, opts)
+		imports, qualifier, tb := "\n\tutils \"github.com/9uanhuo/wizardry/utils\"\n", "utils.", ""
+		if opts.SelfContained {
+			imports, qualifier = "", ""
+		}
+		if opts.InlineReaders {
+			tb = ", new([8]byte)"
+		}
+		source := fmt.Sprintf(generatedReadersSource, imports, data, cases.String(), qualifier, tb)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "readers_test.go"), []byte(source), 0644))
+		runGo(t, dir, "test", "-run", "TestReaders", "./...")
+	}
+}
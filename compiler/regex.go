@@ -0,0 +1,44 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// regexVars names the package-level variables holding the compiled
+// patterns of regex rules, one per pattern (flags included). It returns
+// the names by pattern, and the patterns in the order they should be
+// declared. Patterns Go's regexp can't compile are reported as a
+// *RuleError.
+func regexVars(book parser.Spellbook) (map[string]string, []string, error) {
+	var pages []string
+	for page := range book {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	names := make(map[string]string)
+	var patterns []string
+	for _, page := range pages {
+		for _, rule := range book[page] {
+			rk, ok := rule.Kind.Data.(*parser.RegexKind)
+			if !ok {
+				continue
+			}
+
+			pattern := rk.Pattern()
+			if _, ok := names[pattern]; ok {
+				continue
+			}
+			if _, err := rk.Regexp(); err != nil {
+				return nil, nil, ruleError(page, rule, err)
+			}
+
+			names[pattern] = fmt.Sprintf("re%d", len(patterns))
+			patterns = append(patterns, pattern)
+		}
+	}
+	return names, patterns, nil
+}
@@ -0,0 +1,176 @@
+package compiler
+
+import "fmt"
+
+// stmt is a statement of the code generated for a rule. Rules can fail
+// halfway through, in which case the rest of their code, and their
+// children, don't run: how that's written is up to the renderer.
+type stmt interface{}
+
+// lineStmt is a line of code, emitted as-is
+type lineStmt struct {
+	code string
+}
+
+// markStmt records what the code after it is generated from, for
+// FormatError
+type markStmt struct {
+	source string
+}
+
+// directiveStmt is a //line directive, which must start at the beginning
+// of its line
+type directiveStmt struct {
+	directive string
+}
+
+// guardStmt ends the rule when failIf holds. okIf is its opposite, both
+// are written out to keep the generated code readable.
+type guardStmt struct {
+	failIf string
+	okIf   string
+}
+
+// failStmt ends the rule, whatever happens
+type failStmt struct{}
+
+// switchStmt runs the body of the case matching subject, the rule fails if
+// none does. The statements after it only run when a case matched.
+type switchStmt struct {
+	subject string
+	cases   []switchCase
+}
+
+type switchCase struct {
+	value string
+	body  []stmt
+}
+
+// nodeStmt is the code of a rule, children included. Its label is where
+// the rule goes when it fails, for renderers that need one.
+type nodeStmt struct {
+	label string
+	body  []stmt
+}
+
+// canFail returns whether the rule may end early
+func (ns *nodeStmt) canFail() bool {
+	for _, s := range ns.body {
+		switch s.(type) {
+		case guardStmt, failStmt, switchStmt:
+			return true
+		}
+	}
+	return false
+}
+
+// codeWriter is what renderers write generated code with
+type codeWriter struct {
+	emit      func(format string, args ...interface{})
+	emitLabel func(label string)
+	// emitDirective writes a line as-is, without indenting it
+	emitDirective func(directive string)
+	withIndent    func(f indentCallback)
+	markSource    func(format string, args ...interface{})
+}
+
+// renderer writes the code of a rule
+type renderer func(cw *codeWriter, ns *nodeStmt)
+
+// renderGoto writes a rule as a flat list of statements: when it fails, it
+// jumps to a label right after its code
+func renderGoto(cw *codeWriter, ns *nodeStmt) {
+	renderGotoBody(cw, ns.label, ns.body)
+	if ns.canFail() {
+		cw.emitLabel(ns.label)
+	}
+}
+
+// renderGotoBody writes body for renderGoto, failing to label
+func renderGotoBody(cw *codeWriter, label string, body []stmt) {
+	for _, s := range body {
+		switch s := s.(type) {
+		case lineStmt:
+			cw.emit("%s", s.code)
+		case markStmt:
+			cw.markSource("%s", s.source)
+		case directiveStmt:
+			cw.emitDirective(s.directive)
+		case guardStmt:
+			cw.emit("if %s {goto %s}", s.failIf, label)
+		case failStmt:
+			cw.emit("goto %s", label)
+		case switchStmt:
+			cw.emit("switch %s {", s.subject)
+			cw.withIndent(func() {
+				for _, c := range s.cases {
+					if len(c.body) == 1 {
+						if line, ok := c.body[0].(lineStmt); ok {
+							cw.emit("case %s: %s", c.value, line.code)
+							continue
+						}
+					}
+					cw.emit("case %s: {", c.value)
+					cw.withIndent(func() {
+						renderGotoBody(cw, label, c.body)
+					})
+					cw.emit("}")
+				}
+				cw.emit("default: {goto %s}", label)
+			})
+			cw.emit("}")
+		case *nodeStmt:
+			renderGoto(cw, s)
+		default:
+			panic(fmt.Sprintf("unknown statement %T", s))
+		}
+	}
+}
+
+// renderStructured writes a rule as nested blocks: the statements after a
+// test go in an if block, and are repeated in every case of a switch. It
+// needs no labels.
+func renderStructured(cw *codeWriter, ns *nodeStmt) {
+	renderBlock(cw, ns.body)
+}
+
+// renderBlock writes body for renderStructured
+func renderBlock(cw *codeWriter, body []stmt) {
+	for i, s := range body {
+		rest := body[i+1:]
+
+		switch s := s.(type) {
+		case lineStmt:
+			cw.emit("%s", s.code)
+		case markStmt:
+			cw.markSource("%s", s.source)
+		case directiveStmt:
+			cw.emitDirective(s.directive)
+		case guardStmt:
+			cw.emit("if %s {", s.okIf)
+			cw.withIndent(func() {
+				renderBlock(cw, rest)
+			})
+			cw.emit("}")
+			return
+		case failStmt:
+			// nothing after it ever runs
+			return
+		case switchStmt:
+			cw.emit("switch %s {", s.subject)
+			for _, c := range s.cases {
+				cw.emit("case %s:", c.value)
+				cw.withIndent(func() {
+					renderBlock(cw, c.body)
+					renderBlock(cw, rest)
+				})
+			}
+			cw.emit("}")
+			return
+		case *nodeStmt:
+			renderStructured(cw, s)
+		default:
+			panic(fmt.Sprintf("unknown statement %T", s))
+		}
+	}
+}
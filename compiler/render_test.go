@@ -0,0 +1,130 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// renderToString renders ns with two spaces per indent, and labels without
+func renderToString(render renderer, ns *nodeStmt) string {
+	var out strings.Builder
+	indentLevel := 0
+	cw := &codeWriter{
+		emit: func(format string, args ...interface{}) {
+			out.WriteString(strings.Repeat("  ", indentLevel))
+			fmt.Fprintf(&out, format, args...)
+			out.WriteString("\n")
+		},
+		emitLabel: func(label string) {
+			out.WriteString(label + ":\n")
+		},
+		emitDirective: func(directive string) {
+			out.WriteString(directive + "\n")
+		},
+		withIndent: func(f indentCallback) {
+			indentLevel++
+			f()
+			indentLevel--
+		},
+		markSource: func(format string, args ...interface{}) {},
+	}
+	render(cw, ns)
+	return out.String()
+}
+
+func Test_Renderers(t *testing.T) {
+	ns := &nodeStmt{
+		label: "fail1",
+		body: []stmt{
+			markStmt{"rule"},
+			lineStmt{"rc,m=f1(r,tb,po)"},
+			guardStmt{failIf: "!m", okIf: "m"},
+			switchStmt{
+				subject: "rc",
+				cases: []switchCase{
+					{value: "0x1", body: []stmt{lineStmt{`a("one")`}}},
+					{value: "0x2", body: []stmt{
+						&nodeStmt{label: "fail2", body: []stmt{
+							guardStmt{failIf: "rA<0", okIf: "rA>=0"},
+							lineStmt{`a("two")`},
+						}},
+					}},
+				},
+			},
+			lineStmt{"d[0]=t"},
+		},
+	}
+
+	assert.EqualValues(t, `rc,m=f1(r,tb,po)
+if !m {goto fail1}
+switch rc {
+  case 0x1: a("one")
+  case 0x2: {
+    if rA<0 {goto fail2}
+    a("two")
+fail2:
+  }
+  default: {goto fail1}
+}
+d[0]=t
+fail1:
+`, renderToString(renderGoto, ns))
+
+	assert.EqualValues(t, `rc,m=f1(r,tb,po)
+if m {
+  switch rc {
+  case 0x1:
+    a("one")
+    d[0]=t
+  case 0x2:
+    if rA>=0 {
+      a("two")
+    }
+    d[0]=t
+  }
+}
+`, renderToString(renderStructured, ns))
+
+	// nothing runs after a rule fails for good
+	unsupported := &nodeStmt{
+		label: "fail3",
+		body:  []stmt{lineStmt{"// fixme"}, failStmt{}, lineStmt{`a("never")`}},
+	}
+	assert.EqualValues(t, "// fixme\ngoto fail3\na(\"never\")\nfail3:\n", renderToString(renderGoto, unsupported))
+	assert.EqualValues(t, "// fixme\n", renderToString(renderStructured, unsupported))
+
+	// directives aren't indented
+	directed := &nodeStmt{
+		label: "fail5",
+		body:  []stmt{guardStmt{failIf: "!m", okIf: "m"}, directiveStmt{"//line elf:3"}, lineStmt{`a("elf")`}},
+	}
+	assert.EqualValues(t, "if !m {goto fail5}\n//line elf:3\na(\"elf\")\nfail5:\n", renderToString(renderGoto, directed))
+	assert.EqualValues(t, "if m {\n//line elf:3\n  a(\"elf\")\n}\n", renderToString(renderStructured, directed))
+
+	// rules that can't fail need no label
+	assert.EqualValues(t, "d[0]=f\n", renderToString(renderGoto, &nodeStmt{label: "fail4", body: []stmt{lineStmt{"d[0]=f"}}}))
+}
+
+func Test_CompileStructured(t *testing.T) {
+	book := parseTestMagic(t, filepath.Join("testdata", "magic"))
+
+	var gotos, structured bytes.Buffer
+	gotoStats, err := CompileTo(&gotos, book, Options{Package: "generated", EmitMatchers: true})
+	assert.NoError(t, err)
+	stats, err := CompileTo(&structured, book, Options{Package: "generated", EmitMatchers: true, Structured: true})
+	assert.NoError(t, err)
+
+	assert.Contains(t, gotos.String(), "goto ")
+	assert.NotContains(t, structured.String(), "goto ")
+	assert.Contains(t, structured.String(), "\tif rA >= 0 {\n")
+
+	// the same rules, written differently
+	assert.EqualValues(t, gotoStats.RulesCompiled, stats.RulesCompiled)
+	assert.EqualValues(t, gotoStats.RulesSkipped, stats.RulesSkipped)
+	assert.EqualValues(t, gotoStats.PagesEmitted, stats.PagesEmitted)
+}
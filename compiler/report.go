@@ -0,0 +1,68 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// PageStats describes what CompileTo generated for a page
+type PageStats struct {
+	// Page is the name of the page, "" for the top-level page
+	Page string
+
+	// EmitNormal and EmitSwapped tell which endiannesses the page was
+	// emitted for
+	EmitNormal  bool
+	EmitSwapped bool
+
+	// RulesCompiled, RulesSkipped and SwitchCases are counted like in
+	// Stats, for both endiannesses
+	RulesCompiled int
+	RulesSkipped  int
+	SwitchCases   int
+
+	// BytesEmitted is the size of the code of the page, matchers and
+	// exported functions included, before it's formatted
+	BytesEmitted int64
+}
+
+// WriteReport writes a table of the pages in stats to w, biggest first,
+// followed by the totals
+func (stats Stats) WriteReport(w io.Writer) error {
+	pages := make([]PageStats, len(stats.Pages))
+	copy(pages, stats.Pages)
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].BytesEmitted > pages[j].BytesEmitted
+	})
+
+	var total PageStats
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "bytes\trules\tskipped\tswitch cases\tvariants\t  page\n")
+	for _, ps := range pages {
+		name := strconv.Quote(ps.Page)
+		if ps.Page == "" {
+			name = "(top level)"
+		}
+
+		variants := ""
+		if ps.EmitNormal {
+			variants += "N"
+		}
+		if ps.EmitSwapped {
+			variants += "S"
+		}
+
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t  %s\n", ps.BytesEmitted, ps.RulesCompiled, ps.RulesSkipped, ps.SwitchCases, variants, name)
+		total.BytesEmitted += ps.BytesEmitted
+		total.RulesCompiled += ps.RulesCompiled
+		total.RulesSkipped += ps.RulesSkipped
+		total.SwitchCases += ps.SwitchCases
+	}
+	fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t\t  %d pages\n", total.BytesEmitted, total.RulesCompiled, total.RulesSkipped, total.SwitchCases, len(pages))
+	return errors.WithStack(tw.Flush())
+}
@@ -0,0 +1,70 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reportMagic has a big page, with a switch, and a small one used swapped
+const reportMagic = `
+0	name	big
+>0	ubyte	1	one
+>0	ubyte	2	two
+>0	ubyte	3	three
+>0	ubyte	4	four
+>1	string	abc	abc
+>>4	ulelong	>10	\b, large
+>>>8	ubeshort	x	\b, %d
+>>>10	string	def	def
+>1	lequad	&4	flagged
+0	name	small
+>0	ubyte	1	one
+0	string	BIG
+>4	use	big
+>4	use	\^small
+`
+
+func Test_WriteReport(t *testing.T) {
+	book := parseBook(t, reportMagic)
+
+	var out bytes.Buffer
+	stats, err := CompileTo(&out, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+
+	assert.Len(t, stats.Pages, 3)
+	byName := make(map[string]PageStats)
+	var compiled, skipped, cases int
+	for _, ps := range stats.Pages {
+		byName[ps.Page] = ps
+		compiled += ps.RulesCompiled
+		skipped += ps.RulesSkipped
+		cases += ps.SwitchCases
+	}
+	assert.EqualValues(t, stats.RulesCompiled, compiled)
+	assert.EqualValues(t, stats.RulesSkipped, skipped)
+	assert.EqualValues(t, stats.SwitchCases, cases)
+
+	big, small := byName["big"], byName["small"]
+	assert.True(t, big.EmitNormal)
+	assert.False(t, big.EmitSwapped)
+	assert.False(t, small.EmitNormal)
+	assert.True(t, small.EmitSwapped)
+	assert.EqualValues(t, 4, big.SwitchCases)
+	assert.EqualValues(t, 0, small.SwitchCases)
+	assert.EqualValues(t, 10, big.RulesCompiled)
+	assert.EqualValues(t, 2, small.RulesCompiled)
+	assert.True(t, big.BytesEmitted > small.BytesEmitted, "%d <= %d", big.BytesEmitted, small.BytesEmitted)
+
+	var report bytes.Buffer
+	assert.NoError(t, stats.WriteReport(&report))
+	lines := strings.Split(strings.TrimSuffix(report.String(), "\n"), "\n")
+	assert.Len(t, lines, 5)
+	assert.Contains(t, lines[0], "switch cases")
+	// biggest first
+	assert.True(t, strings.HasSuffix(lines[1], ` "big"`), lines[1])
+	assert.True(t, strings.HasSuffix(lines[4], " 3 pages"), lines[4])
+	assert.Contains(t, report.String(), ` S  "small"`)
+}
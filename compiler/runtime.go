@@ -0,0 +1,1081 @@
+package compiler
+
+// selfContainedImports are the packages selfContainedRuntime needs
+var selfContainedImports = []string{"encoding/binary", "errors", "io", "regexp", "strings", "sync", "sync/atomic", "time", "unicode/utf16", "unicode/utf8"}
+
+// selfContainedRuntime is emitted in generated code in SelfContained mode,
+// instead of importing SliceReader, ReadUint, StringTest, SearchTest,
+// RegexTest, FormatDate, FormatGUID and the string16 helpers from the utils
+// package.
+// It must behave like them.
+const selfContainedRuntime = `// SliceReader is a window on a target, identification functions read
+// through it
+type SliceReader struct {
+	reader   io.ReaderAt
+	offset   int64
+	size     int64
+	textHint int32
+}
+
+// NewSliceReader returns a window of size bytes, starting at offset in reader
+func NewSliceReader(reader io.ReaderAt, offset int64, size int64) *SliceReader {
+	return &SliceReader{
+		reader: reader,
+		offset: offset,
+		size:   size,
+	}
+}
+
+// Size returns the size of the window
+func (sr *SliceReader) Size() int64 {
+	return sr.size
+}
+
+// ReadAt reads from the window, index is relative to its start. It returns
+// io.EOF along with what it read if it couldn't fill buf, and nil if it
+// could.
+func (sr *SliceReader) ReadAt(buf []byte, index int64) (int, error) {
+	if index < 0 {
+		return 0, errors.New("SliceReader.ReadAt: negative offset")
+	}
+	if index >= sr.size {
+		return 0, io.EOF
+	}
+	want := len(buf)
+	if remaining := sr.size - index; remaining < int64(len(buf)) {
+		buf = buf[:remaining]
+	}
+	n, err := sr.reader.ReadAt(buf, index+sr.offset)
+	if n < want && err == nil {
+		err = io.EOF
+	} else if n == want && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+var uintBufPool = sync.Pool{
+	New: func() interface{} { return new([8]byte) },
+}
+
+// ReadUint reads an unsigned integer of width bytes, 1, 2, 4 or 8, at off
+// in byte order bo, which may be nil for single bytes. It fails for
+// negative offsets, integers that don't fit before the end of sr, other
+// widths, and reads that fail.
+func ReadUint(sr *SliceReader, off int64, width int, bo binary.ByteOrder) (uint64, bool) {
+	if width != 1 && width != 2 && width != 4 && width != 8 {
+		return 0, false
+	}
+	if off < 0 || off > sr.size-int64(width) {
+		return 0, false
+	}
+	buf := uintBufPool.Get().(*[8]byte)
+	defer uintBufPool.Put(buf)
+	b := buf[:width]
+	if n, _ := sr.ReadAt(b, off); n < width {
+		return 0, false
+	}
+	switch width {
+	case 1:
+		return uint64(b[0]), true
+	case 2:
+		return uint64(bo.Uint16(b)), true
+	case 4:
+		return uint64(bo.Uint32(b)), true
+	}
+	return bo.Uint64(b), true
+}
+
+// TextHint returns TextTarget if the window looks like text, BinaryTarget
+// otherwise. It's only worked out once.
+func (sr *SliceReader) TextHint() StringTestFlags {
+	hint := atomic.LoadInt32(&sr.textHint)
+	if hint == 0 {
+		hint = int32(BinaryTarget)
+		if looksLikeText(sr) {
+			hint = int32(TextTarget)
+		}
+		atomic.StoreInt32(&sr.textHint, hint)
+	}
+	return StringTestFlags(hint)
+}
+
+// looksLikeText tells whether the start of the window is text: ASCII,
+// UTF-8, UTF-16 with a BOM, or ISO-8859 without C1 control characters
+func looksLikeText(sr *SliceReader) bool {
+	size := sr.size
+	if size > 64*1024 {
+		size = 64 * 1024
+	}
+	if size <= 0 {
+		return false
+	}
+	sample := make([]byte, size)
+	n, err := sr.ReadAt(sample, 0)
+	if n < len(sample) && err != nil && err != io.EOF {
+		return false
+	}
+	sample = sample[:n]
+	truncated := int64(n) < sr.size
+
+	switch {
+	case len(sample) >= 2 && (sample[0] == 0xff && sample[1] == 0xfe || sample[0] == 0xfe && sample[1] == 0xff):
+		units := make([]uint16, 0, len(sample)/2)
+		for i := 2; i+1 < len(sample); i += 2 {
+			if sample[0] == 0xfe {
+				units = append(units, uint16(sample[i])<<8|uint16(sample[i+1]))
+			} else {
+				units = append(units, uint16(sample[i+1])<<8|uint16(sample[i]))
+			}
+		}
+		for _, r := range utf16.Decode(units) {
+			if !isTextRune(r) {
+				return false
+			}
+		}
+		return true
+	case len(sample) >= 3 && string(sample[:3]) == "\xef\xbb\xbf":
+		return looksLikeUTF8(sample[3:], truncated)
+	}
+	if looksLikeUTF8(sample, truncated) {
+		return true
+	}
+	for _, b := range sample {
+		if !isTextRune(rune(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// looksLikeUTF8 tells whether sample is UTF-8 text, which may be cut in
+// half at the end if the target is truncated
+func looksLikeUTF8(sample []byte, truncated bool) bool {
+	for len(sample) > 0 {
+		r, width := utf8.DecodeRune(sample)
+		if r == utf8.RuneError && width <= 1 {
+			return truncated && !utf8.FullRune(sample)
+		}
+		if !isTextRune(r) {
+			return false
+		}
+		sample = sample[width:]
+	}
+	return true
+}
+
+// isTextRune tells whether r may appear in text: printable ASCII, the usual
+// control characters, and anything past ASCII but C1 control characters
+// other than NEL
+func isTextRune(r rune) bool {
+	switch {
+	case r < 0x80:
+		return (r >= 0x20 && r < 0x7f) || (r >= 0x07 && r <= 0x0d) || r == 0x1b
+	case r < 0xa0:
+		return r == 0x85
+	}
+	return true
+}
+
+// StringTestFlags describes how to perform a string test
+type StringTestFlags int64
+
+const (
+	// CompactWhitespace ("W" flag) compacts whitespace in the target
+	CompactWhitespace StringTestFlags = 1 << iota
+	// OptionalBlanks ("w" flag) treats every blank in the magic as an optional blank
+	OptionalBlanks
+	// LowerMatchesBoth ("c" flag) makes lower case characters in the magic
+	// match both cases
+	LowerMatchesBoth
+	// UpperMatchesBoth ("C" flag) makes upper case characters in the magic
+	// match both cases
+	UpperMatchesBoth
+	// ForceText ("t" flag) forces the test to be done for text files
+	ForceText
+	// ForceBinary ("b" flag) forces the test to be done for binary files
+	ForceBinary
+	// FullWord ("f" flag) requires the match to be a full word
+	FullWord
+	// TextTarget and BinaryTarget say what the target looks like, for
+	// ForceText and ForceBinary tests
+	TextTarget
+	BinaryTarget
+)
+
+// TargetExcluded tells whether flags say the test is for another kind of
+// target than the one they hint at
+func TargetExcluded(flags StringTestFlags) bool {
+	return (flags&ForceText > 0 && flags&BinaryTarget > 0) || (flags&ForceBinary > 0 && flags&TextTarget > 0)
+}
+
+func isAlphanumeric(c byte) bool {
+	return ('0' <= c && c <= '9') || isLowerLetter(c) || isUpperLetter(c)
+}
+
+// isFullWord tells whether the bytes around start and end, if any, aren't
+// letters or digits
+func isFullWord(sr *SliceReader, start int64, end int64) bool {
+	var b [1]byte
+	if start > 0 {
+		if n, _ := sr.ReadAt(b[:], start-1); n == 1 && isAlphanumeric(b[0]) {
+			return false
+		}
+	}
+	if n, _ := sr.ReadAt(b[:], end); n == 1 && isAlphanumeric(b[0]) {
+		return false
+	}
+	return true
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 4096)
+		return &buf
+	},
+}
+
+// byteView reads a target in chunks, to look at it one byte at a time
+type byteView struct {
+	sr     *SliceReader
+	buf    *[]byte
+	bufOff int64
+	bufLen int64
+}
+
+// get returns the byte at index i, or -1 if it can't be read
+func (bv *byteView) get(i int64) int {
+	if i < 0 || i >= bv.sr.size {
+		return -1
+	}
+	if i >= bv.bufOff && i < bv.bufOff+bv.bufLen {
+		return int((*bv.buf)[i-bv.bufOff])
+	}
+
+	if bv.buf == nil {
+		bv.buf = bufPool.Get().(*[]byte)
+	}
+	chunk := *bv.buf
+	if remaining := bv.sr.size - i; int64(len(chunk)) > remaining {
+		chunk = chunk[:remaining]
+	}
+	n, _ := bv.sr.ReadAt(chunk, i)
+	if n <= 0 {
+		bv.bufLen = 0
+		return -1
+	}
+	bv.bufOff = i
+	bv.bufLen = int64(n)
+	return int(chunk[0])
+}
+
+func (bv *byteView) release() {
+	if bv.buf != nil {
+		bufPool.Put(bv.buf)
+		bv.buf = nil
+	}
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isLowerLetter(c byte) bool {
+	return 'a' <= c && c <= 'z'
+}
+
+func isUpperLetter(c byte) bool {
+	return 'A' <= c && c <= 'Z'
+}
+
+func toLower(c byte) byte {
+	if isUpperLetter(c) {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+func toUpper(c byte) byte {
+	if isLowerLetter(c) {
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+// StringTest looks for a string pattern in the target, at targetIndex. It
+// returns the index right after the match, or -1.
+func StringTest(sr *SliceReader, targetIndex int64, pattern string, flags StringTestFlags) int64 {
+	if TargetExcluded(flags) {
+		return -1
+	}
+	end := stringMatch(sr, targetIndex, pattern, flags)
+	if end >= 0 && flags&FullWord > 0 && !isFullWord(sr, targetIndex, end) {
+		return -1
+	}
+	return end
+}
+
+func stringMatch(sr *SliceReader, targetIndex int64, pattern string, flags StringTestFlags) int64 {
+	bv := &byteView{sr: sr}
+	defer bv.release()
+
+	patternIndex := 0
+	for {
+		patternByte := pattern[patternIndex]
+		targetInt := bv.get(targetIndex)
+		if targetInt == -1 {
+			if flags&OptionalBlanks > 0 && isWhitespace(patternByte) {
+				patternIndex++
+				if patternIndex >= len(pattern) {
+					return targetIndex
+				}
+				continue
+			}
+			return -1
+		}
+		targetByte := byte(targetInt)
+
+		switch {
+		case flags&CompactWhitespace > 0 && isWhitespace(patternByte):
+			if isWhitespace(targetByte) {
+				targetIndex++
+				patternIndex++
+				if patternIndex >= len(pattern) || !isWhitespace(pattern[patternIndex]) {
+					for {
+						targetInt = bv.get(targetIndex)
+						if targetInt == -1 || !isWhitespace(byte(targetInt)) {
+							break
+						}
+						targetIndex++
+					}
+				}
+			} else if flags&OptionalBlanks > 0 {
+				patternIndex++
+			} else {
+				return -1
+			}
+		case patternByte == targetByte:
+			targetIndex++
+			patternIndex++
+		case flags&OptionalBlanks > 0 && isWhitespace(patternByte):
+			patternIndex++
+		case flags&LowerMatchesBoth > 0 && isLowerLetter(patternByte) && toLower(targetByte) == patternByte:
+			targetIndex++
+			patternIndex++
+		case flags&UpperMatchesBoth > 0 && isUpperLetter(patternByte) && toUpper(targetByte) == patternByte:
+			targetIndex++
+			patternIndex++
+		default:
+			return -1
+		}
+
+		if patternIndex >= len(pattern) {
+			return targetIndex
+		}
+	}
+}
+
+// DefaultSearchRange is the range of search tests that don't have one
+const DefaultSearchRange = 8192
+
+// SearchTest looks for pattern starting within maxLen bytes of targetIndex,
+// the match may run past them, DefaultSearchRange if it's zero. It
+// returns the position of the match relative to targetIndex and its
+// length, or -1, 0. Case and blank flags compare like StringTest, so the
+// match may not be as long as pattern, FullWord only finds full words, and
+// ForceText and ForceBinary fail for the other kind of target.
+func SearchTest(sr *SliceReader, targetIndex int64, maxLen int64, pattern string, flags StringTestFlags) (int64, int64) {
+	if TargetExcluded(flags) {
+		return -1, 0
+	}
+	if maxLen == 0 {
+		maxLen = DefaultSearchRange
+	}
+	remaining := sr.size - targetIndex
+	// matches start before rangeEnd
+	rangeEnd := maxLen
+	if rangeEnd > remaining {
+		rangeEnd = remaining
+	}
+	if targetIndex < 0 || rangeEnd <= 0 {
+		return -1, 0
+	}
+	caseFlags := flags & (LowerMatchesBoth | UpperMatchesBoth)
+	blankFlags := flags & (CompactWhitespace | OptionalBlanks)
+
+	// with optional blanks, matches are no longer than the pattern, so the
+	// longest part of it without blanks is found, and the match starts at
+	// that part or before it. Compacted blanks make matches as long as they
+	// want, only the part of the pattern starting them can be found.
+	anchor, anchorStarts := pattern, true
+	anchorEnd := rangeEnd - 1 + int64(len(pattern))
+	switch {
+	case flags&CompactWhitespace > 0:
+		anchor = leadingNonBlank(pattern)
+		anchorEnd = rangeEnd - 1 + int64(len(anchor))
+	case flags&OptionalBlanks > 0:
+		anchor, anchorStarts = longestNonBlank(pattern), false
+	}
+	if anchorEnd > remaining {
+		anchorEnd = remaining
+	}
+	window := NewSliceReader(sr, targetIndex, remaining)
+
+	// next is the first start that wasn't checked
+	var next int64
+	for next < rangeEnd {
+		last := rangeEnd - 1
+		if anchor != "" {
+			found := searchAnchor(sr, targetIndex+next, anchorEnd-next, anchor, caseFlags)
+			if found < 0 {
+				return -1, 0
+			}
+			last = next + found
+			if anchorStarts {
+				next = last
+			}
+		}
+		for ; next <= last && next < rangeEnd; next++ {
+			end := next + int64(len(pattern))
+			if blankFlags > 0 {
+				end = stringMatch(window, next, pattern, caseFlags|blankFlags)
+				if end < 0 {
+					continue
+				}
+			}
+			if flags&FullWord > 0 && !isFullWord(sr, targetIndex+next, targetIndex+end) {
+				continue
+			}
+			return next, end - next
+		}
+	}
+	return -1, 0
+}
+
+// Finder is SearchTest for one pattern and its flags, generated code has
+// one per search rule. There's nothing to prepare here, it only keeps them.
+type Finder struct {
+	pattern string
+	flags   StringTestFlags
+}
+
+// MakeFinder returns the finder of pattern with flags, it ignores ForceText
+// and ForceBinary
+func MakeFinder(pattern string, flags StringTestFlags) *Finder {
+	return &Finder{pattern: pattern, flags: flags &^ (ForceText | ForceBinary)}
+}
+
+// Find is SearchTest with the pattern and flags of the finder
+func (f *Finder) Find(sr *SliceReader, targetIndex int64, maxLen int64) (int64, int64) {
+	return SearchTest(sr, targetIndex, maxLen, f.pattern, f.flags)
+}
+
+// searchAnchor returns where pattern is first found within maxLen bytes
+// of targetIndex, compared with caseMatch, relative to targetIndex, or -1
+func searchAnchor(sr *SliceReader, targetIndex int64, maxLen int64, pattern string, caseFlags StringTestFlags) int64 {
+	if int64(len(pattern)) > maxLen {
+		return -1
+	}
+
+	bufp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bufp)
+	buf := *bufp
+	if len(buf) < 2*len(pattern) {
+		buf = make([]byte, 2*len(pattern))
+	}
+
+	var pos int64
+	for pos+int64(len(pattern)) <= maxLen {
+		chunk := buf
+		if remaining := maxLen - pos; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, _ := sr.ReadAt(chunk, targetIndex+pos)
+		for i := 0; i+len(pattern) <= n; i++ {
+			if caseFlags == 0 {
+				if string(chunk[i:i+len(pattern)]) == pattern {
+					return pos + int64(i)
+				}
+			} else if caseMatch(chunk[i:i+len(pattern)], pattern, caseFlags) {
+				return pos + int64(i)
+			}
+		}
+		if n < len(chunk) {
+			// short read, there's nothing more
+			return -1
+		}
+		pos += int64(n - len(pattern) + 1)
+	}
+	return -1
+}
+
+// leadingNonBlank returns the part of pattern before its first blank
+func leadingNonBlank(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		if isWhitespace(pattern[i]) {
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
+
+// longestNonBlank returns the longest part of pattern without blanks, the
+// first one if there are several
+func longestNonBlank(pattern string) string {
+	longest := ""
+	start := 0
+	for i := 0; i <= len(pattern); i++ {
+		if i == len(pattern) || isWhitespace(pattern[i]) {
+			if i-start > len(longest) {
+				longest = pattern[start:i]
+			}
+			start = i + 1
+		}
+	}
+	return longest
+}
+
+// caseMatch tells whether target is pattern, as compared by stringMatch
+// with only case flags
+func caseMatch(target []byte, pattern string, flags StringTestFlags) bool {
+	for i := 0; i < len(pattern); i++ {
+		p, b := pattern[i], target[i]
+		switch {
+		case p == b:
+		case flags&LowerMatchesBoth > 0 && isLowerLetter(p) && toLower(b) == p:
+		case flags&UpperMatchesBoth > 0 && isUpperLetter(p) && toUpper(b) == p:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// MaxRegexBytes is how much of the target a regex test looks at, at most
+const MaxRegexBytes = 8192
+
+// RegexTest looks for re within maxLen bytes of targetIndex, or maxLen
+// lines (of 80 bytes at most) if lines is set, up to MaxRegexBytes. It
+// returns the start and end of the match relative to targetIndex, or -1, -1.
+func RegexTest(sr *SliceReader, targetIndex int64, maxLen int64, lines bool, re *regexp.Regexp) (int64, int64) {
+	windowLen := maxLen
+	if lines {
+		windowLen = maxLen * 80
+	}
+	if remaining := sr.size - targetIndex; windowLen <= 0 || windowLen > remaining {
+		windowLen = remaining
+	}
+	if windowLen > MaxRegexBytes {
+		windowLen = MaxRegexBytes
+	}
+	if targetIndex < 0 || windowLen <= 0 {
+		return -1, -1
+	}
+
+	window := make([]byte, windowLen)
+	n, _ := sr.ReadAt(window, targetIndex)
+	if n <= 0 {
+		return -1, -1
+	}
+	window = window[:n]
+
+	if lines && maxLen > 0 {
+		seen := int64(0)
+		for i, b := range window {
+			if b == '\n' {
+				seen++
+				if seen == maxLen {
+					window = window[:i+1]
+					break
+				}
+			}
+		}
+	}
+
+	loc := re.FindIndex(window)
+	if loc == nil {
+		return -1, -1
+	}
+	return int64(loc[0]), int64(loc[1])
+}
+
+// DateFormat tells how a date is stored
+type DateFormat int
+
+const (
+	// DateFormatUnix is a number of seconds since the epoch
+	DateFormatUnix DateFormat = iota
+	// DateFormatDOSDate is a day, month and year packed in 16 bits
+	DateFormatDOSDate
+	// DateFormatDOSTime is an hour, minute and second packed in 16 bits,
+	// with a 2-second resolution
+	DateFormatDOSTime
+)
+
+// FormatDate formats a date read by a date test like file(1) does. width is
+// how many bytes were read, 32-bit UNIX dates are signed. UNIX dates are
+// printed in UTC, or in the local time zone if local is set. DOS dates and
+// times are already local.
+func FormatDate(value uint64, width int, local bool, format DateFormat) string {
+	switch format {
+	case DateFormatDOSDate:
+		day := int(value & 0x1f)
+		month := time.Month((value >> 5) & 0xf)
+		year := int((value>>9)&0x7f) + 1980
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Format("Mon, Jan 02 2006")
+	case DateFormatDOSTime:
+		return fmt.Sprintf("%02d:%02d:%02d", (value>>11)&0x1f, (value>>5)&0x3f, (value&0x1f)*2)
+	}
+
+	seconds := int64(value)
+	if width == 4 {
+		seconds = int64(int32(value))
+	}
+	t := time.Unix(seconds, 0).UTC()
+	if local {
+		t = t.Local()
+	}
+	return t.Format("Mon Jan _2 15:04:05 2006")
+}
+
+// MaxFormattedString caps how many bytes of the target a %s conversion prints
+const MaxFormattedString = 96
+
+// MaxString16Units caps how many UTF-16 code units String16End looks at
+const MaxString16Units = 4096
+
+// readUnit16 reads the UTF-16 code unit at index, or returns -1
+func readUnit16(sr *SliceReader, index int64, bigEndian bool, buf []byte) int {
+	if index < 0 {
+		return -1
+	}
+	n, _ := sr.ReadAt(buf[:2], index)
+	if n < 2 {
+		return -1
+	}
+	if bigEndian {
+		return int(buf[0])<<8 | int(buf[1])
+	}
+	return int(buf[1])<<8 | int(buf[0])
+}
+
+// String16Test looks for a pattern stored as UTF-16 at targetIndex: every
+// byte of the pattern must be a code unit of the target. LowerMatchesBoth
+// and UpperMatchesBoth make letters match either case like they do for
+// StringTest, other flags are ignored. It returns the index right after
+// the match, or -1.
+func String16Test(sr *SliceReader, targetIndex int64, pattern string, bigEndian bool, flags StringTestFlags) int64 {
+	var buf [2]byte
+	for i := 0; i < len(pattern); i++ {
+		unit := readUnit16(sr, targetIndex, bigEndian, buf[:])
+		if unit != int(pattern[i]) && !foldedUnit16(unit, pattern[i], flags) {
+			return -1
+		}
+		targetIndex += 2
+	}
+	return targetIndex
+}
+
+// foldedUnit16 tells whether unit is b in the other case, and flags say
+// that b matches both
+func foldedUnit16(unit int, b byte, flags StringTestFlags) bool {
+	switch {
+	case flags&LowerMatchesBoth > 0 && isLowerLetter(b):
+		return unit == int(toUpper(b))
+	case flags&UpperMatchesBoth > 0 && isUpperLetter(b):
+		return unit == int(toLower(b))
+	}
+	return false
+}
+
+// String16End returns the index of the NUL code unit ending the UTF-16
+// string at targetIndex, or of the end of the target, looking at up to
+// MaxString16Units units. It returns -1 if there's no code unit to read at
+// targetIndex at all.
+func String16End(sr *SliceReader, targetIndex int64, bigEndian bool) int64 {
+	var buf [2]byte
+	if readUnit16(sr, targetIndex, bigEndian, buf[:]) < 0 {
+		return -1
+	}
+
+	end := targetIndex
+	for i := 0; i < MaxString16Units; i++ {
+		unit := readUnit16(sr, end, bigEndian, buf[:])
+		if unit <= 0 {
+			break
+		}
+		end += 2
+	}
+	return end
+}
+
+// DecodeUTF16 decodes up to maxUnits UTF-16 code units at off as UTF-8,
+// stopping at a NUL code unit, or at the end of the target, where a lone
+// byte isn't a unit. Surrogate pairs decode to the character they stand
+// for, a pair cut by maxUnits is left out, and unpaired surrogates decode
+// to U+FFFD.
+func DecodeUTF16(sr *SliceReader, off int64, maxUnits int64, bigEndian bool) string {
+	var buf [2]byte
+	var units []uint16
+	for int64(len(units)) < maxUnits {
+		unit := readUnit16(sr, off+2*int64(len(units)), bigEndian, buf[:])
+		if unit <= 0 {
+			break
+		}
+		units = append(units, uint16(unit))
+	}
+	if n := len(units); n > 0 && int64(n) == maxUnits && 0xd800 <= units[n-1] && units[n-1] < 0xdc00 {
+		// the low surrogate would be next
+		units = units[:n-1]
+	}
+	return string(utf16.Decode(units))
+}
+
+// DecodeString16 decodes the UTF-16 code units from start to end with
+// DecodeUTF16, and returns up to MaxFormattedString bytes of them, without
+// cutting characters
+func DecodeString16(sr *SliceReader, start int64, end int64, bigEndian bool) string {
+	units := (end - start) / 2
+	if units > MaxFormattedString {
+		units = MaxFormattedString
+	}
+	s := DecodeUTF16(sr, start, units, bigEndian)
+	if len(s) > MaxFormattedString {
+		cut := MaxFormattedString
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut]
+	}
+	return s
+}
+
+// MergeStrings joins the descriptions found by an identification function
+// with spaces, except before those starting with \b, as written in magic
+// or decoded into a backspace, any number of times
+func MergeStrings(outStrings []string) string {
+	var sb strings.Builder
+	for _, s := range outStrings {
+		join := false
+		for {
+			if strings.HasPrefix(s, "\\b") {
+				s = s[2:]
+			} else if strings.HasPrefix(s, "\b") {
+				s = s[1:]
+			} else {
+				break
+			}
+			join = true
+		}
+		if s == "" {
+			continue
+		}
+		if !join && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(s)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// GUIDSize is how many bytes a GUID takes
+const GUIDSize = 16
+
+// FormatGUID formats a GUID stored like Windows does it, its first three
+// fields little-endian, in its canonical text form, e.g.
+// "00020906-0000-0000-C000-000000000046". b must hold GUIDSize bytes.
+func FormatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15])
+}
+`
+
+// sprintfRuntime is emitted in generated code in MinimalImports mode, in
+// place of fmt.Sprintf. It formats values the way fmt does, for the formats
+// descriptions turn into: text around a single conversion, whose verb is
+// one of "dcoxXseEfFgG", and whose argument is what describe* pass for it.
+const sprintfRuntime = `// sf formats a like fmt.Sprintf(format, a) does, format being text, with
+// %% for %, around a single conversion
+func sf(format string, a interface{}) string {
+	var b []byte
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b = append(b, c)
+			continue
+		}
+		i++
+		if format[i] == '%' {
+			b = append(b, '%')
+			continue
+		}
+		var s fs
+		i = s.parse(format, i)
+		b = s.format(b, format[i], a)
+	}
+	return string(b)
+}
+
+// fs is the flags, width and precision of a conversion, sf uses one per
+// call
+type fs struct {
+	minus, plus, space, sharp, zero bool
+	wid, prec                       int
+	widPresent, precPresent         bool
+}
+
+// parse reads the flags, width and precision of format starting at i, and
+// returns where the verb is
+func (s *fs) parse(format string, i int) int {
+flags:
+	for ; i < len(format); i++ {
+		switch format[i] {
+		case '-':
+			s.minus = true
+		case '+':
+			s.plus = true
+		case ' ':
+			s.space = true
+		case '#':
+			s.sharp = true
+		case '0':
+			s.zero = true
+		default:
+			break flags
+		}
+	}
+	s.wid, s.widPresent, i = s.number(format, i)
+	if i < len(format) && format[i] == '.' {
+		s.prec, _, i = s.number(format, i+1)
+		s.precPresent = true
+	}
+	return i
+}
+
+// number reads the decimal number of format starting at i, if any
+func (s *fs) number(format string, i int) (int, bool, int) {
+	n, found := 0, false
+	for ; i < len(format) && format[i] >= '0' && format[i] <= '9'; i++ {
+		n = n*10 + int(format[i]-'0')
+		found = true
+	}
+	return n, found, i
+}
+
+// format appends a formatted with verb to b
+func (s *fs) format(b []byte, verb byte, a interface{}) []byte {
+	switch v := a.(type) {
+	case string:
+		return s.str(b, v)
+	case []byte:
+		return s.str(b, string(v))
+	case float64:
+		return s.float(b, v, verb)
+	case uint64:
+		return s.integer(b, v, false, verb)
+	case int64:
+		return s.integer(b, uint64(v), v < 0, verb)
+	case int32:
+		if verb == 'c' {
+			return s.pad(b, string(rune(v)))
+		}
+		return s.integer(b, uint64(v), v < 0, verb)
+	case int16:
+		return s.integer(b, uint64(v), v < 0, verb)
+	case int8:
+		return s.integer(b, uint64(v), v < 0, verb)
+	}
+	return b
+}
+
+// pad appends v to b, padded to the width, which counts runes
+func (s *fs) pad(b []byte, v string) []byte {
+	n := s.wid - len([]rune(v))
+	if !s.widPresent || n <= 0 {
+		return append(b, v...)
+	}
+	p := byte(' ')
+	if s.zero && !s.minus {
+		p = '0'
+	}
+	if s.minus {
+		b = append(b, v...)
+	}
+	for ; n > 0; n-- {
+		b = append(b, p)
+	}
+	if !s.minus {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// str appends v, cut to the precision, in runes
+func (s *fs) str(b []byte, v string) []byte {
+	if s.precPresent {
+		n := s.prec
+		for i := range v {
+			n--
+			if n < 0 {
+				v = v[:i]
+				break
+			}
+		}
+	}
+	return s.pad(b, v)
+}
+
+// integer appends u, negated if negative, in the base of verb
+func (s *fs) integer(b []byte, u uint64, negative bool, verb byte) []byte {
+	if negative {
+		u = -u
+	}
+
+	// digits are padded with zeros to the precision, or the width
+	prec := 0
+	if s.precPresent {
+		prec = s.prec
+		if prec == 0 && u == 0 {
+			s.zero = false
+			return s.pad(b, "")
+		}
+	} else if s.zero && !s.minus && s.widPresent {
+		prec = s.wid
+		if negative || s.plus || s.space {
+			prec--
+		}
+	}
+
+	base := 10
+	switch verb {
+	case 'o':
+		base = 8
+	case 'x', 'X':
+		base = 16
+	}
+	digits := []byte(strconv.FormatUint(u, base))
+	if verb == 'X' {
+		for i, d := range digits {
+			if d >= 'a' {
+				digits[i] = d - 'a' + 'A'
+			}
+		}
+	}
+	var n []byte
+	for i := len(digits); i < prec; i++ {
+		n = append(n, '0')
+	}
+	n = append(n, digits...)
+
+	if s.sharp {
+		switch {
+		case base == 8 && n[0] != '0':
+			n = append([]byte{'0'}, n...)
+		case verb == 'x':
+			n = append([]byte("0x"), n...)
+		case verb == 'X':
+			n = append([]byte("0X"), n...)
+		}
+	}
+	switch {
+	case negative:
+		n = append([]byte{'-'}, n...)
+	case s.plus:
+		n = append([]byte{'+'}, n...)
+	case s.space:
+		n = append([]byte{' '}, n...)
+	}
+
+	// zeros are already there
+	s.zero = false
+	return s.pad(b, string(n))
+}
+
+// float appends v formatted with verb
+func (s *fs) float(b []byte, v float64, verb byte) []byte {
+	prec := 6
+	switch verb {
+	case 'g', 'G':
+		prec = -1
+	case 'F':
+		verb = 'f'
+	}
+	if s.precPresent {
+		prec = s.prec
+	}
+	// the sign goes first, with room for one
+	n := strconv.AppendFloat([]byte{'+'}, v, verb, prec, 64)
+	if n[1] == '-' || n[1] == '+' {
+		n = n[1:]
+	} else {
+		n[0] = '+'
+	}
+	if s.space && n[0] == '+' && !s.plus {
+		n[0] = ' '
+	}
+
+	// infinities and NaN aren't padded with zeros
+	if n[1] == 'I' || n[1] == 'N' {
+		s.zero = false
+		if n[1] == 'N' && !s.space && !s.plus {
+			n = n[1:]
+		}
+		return s.pad(b, string(n))
+	}
+
+	// # keeps the decimal point, and the trailing zeros of %g
+	if s.sharp {
+		digits := 0
+		if verb == 'g' || verb == 'G' {
+			digits = prec
+			if digits == -1 {
+				digits = 6
+			}
+		}
+		var tail []byte
+		point, nonZero := false, false
+		for i := 1; i < len(n); i++ {
+			switch n[i] {
+			case '.':
+				point = true
+			case 'e', 'E':
+				tail = append(tail, n[i:]...)
+				n = n[:i]
+			default:
+				if n[i] != '0' {
+					nonZero = true
+				}
+				if nonZero {
+					digits--
+				}
+			}
+		}
+		if !point {
+			if len(n) == 2 && n[1] == '0' {
+				digits--
+			}
+			n = append(n, '.')
+		}
+		for ; digits > 0; digits-- {
+			n = append(n, '0')
+		}
+		n = append(n, tail...)
+	}
+
+	if s.plus || n[0] != '+' {
+		// zeros go between the sign and the number
+		if s.zero && !s.minus && s.widPresent && s.wid > len(n) {
+			b = append(b, n[0])
+			for i := len(n); i < s.wid; i++ {
+				b = append(b, '0')
+			}
+			return append(b, n[1:]...)
+		}
+		return s.pad(b, string(n))
+	}
+	return s.pad(b, string(n[1:]))
+}
+`
@@ -0,0 +1,354 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// runtimeStringTestSource checks the StringTest, SearchTest, MergeStrings
+// and string16 helpers of selfContainedRuntime against what the ones of
+// utils returned
+const runtimeStringTestSource = `package generated
+
+import (
+	"strings"
+	"testing"
+)
+
+var stringTestCases = []struct {
+	target   string
+	index    int64
+	pattern  string
+	flags    StringTestFlags
+	expected int64
+}{
+%s}
+
+var searchTestCases = []struct {
+	target   string
+	index    int64
+	maxLen   int64
+	pattern  string
+	flags    StringTestFlags
+	pos      int64
+	length   int64
+}{
+%s}
+
+var mergeStringsCases = []struct {
+	fragments []string
+	expected  string
+}{
+%s}
+
+var string16Cases = []struct {
+	target    string
+	index     int64
+	pattern   string
+	bigEndian bool
+	flags     StringTestFlags
+	expected  int64
+}{
+%s}
+
+var decode16Cases = []struct {
+	target    string
+	start     int64
+	end       int64
+	bigEndian bool
+	utf16     string
+	formatted string
+}{
+%s}
+
+func TestStringTest(t *testing.T) {
+	for _, c := range stringTestCases {
+		sr := NewSliceReader(strings.NewReader(c.target), 0, int64(len(c.target)))
+		if actual := StringTest(sr, c.index, c.pattern, c.flags); actual != c.expected {
+			t.Errorf("StringTest(%%q, %%d, %%q, %%d) = %%d, utils.StringTest returned %%d", c.target, c.index, c.pattern, c.flags, actual, c.expected)
+		}
+	}
+}
+
+func TestSearchTest(t *testing.T) {
+	for _, c := range searchTestCases {
+		sr := NewSliceReader(strings.NewReader(c.target), 0, int64(len(c.target)))
+		if pos, length := SearchTest(sr, c.index, c.maxLen, c.pattern, c.flags); pos != c.pos || length != c.length {
+			t.Errorf("SearchTest(%%q, %%d, %%d, %%q, %%d) = %%d, %%d, utils.SearchTest returned %%d, %%d", c.target, c.index, c.maxLen, c.pattern, c.flags, pos, length, c.pos, c.length)
+		}
+	}
+}
+
+func TestString16(t *testing.T) {
+	for _, c := range string16Cases {
+		sr := NewSliceReader(strings.NewReader(c.target), 0, int64(len(c.target)))
+		if actual := String16Test(sr, c.index, c.pattern, c.bigEndian, c.flags); actual != c.expected {
+			t.Errorf("String16Test(%%q, %%d, %%q, %%v, %%d) = %%d, utils.String16Test returned %%d", c.target, c.index, c.pattern, c.bigEndian, c.flags, actual, c.expected)
+		}
+	}
+	for _, c := range decode16Cases {
+		sr := NewSliceReader(strings.NewReader(c.target), 0, int64(len(c.target)))
+		if actual := DecodeUTF16(sr, c.start, c.end-c.start, c.bigEndian); actual != c.utf16 {
+			t.Errorf("DecodeUTF16(%%q, %%d, %%d, %%v) = %%q, utils.DecodeUTF16 returned %%q", c.target, c.start, c.end-c.start, c.bigEndian, actual, c.utf16)
+		}
+		if actual := DecodeString16(sr, c.start, c.end, c.bigEndian); actual != c.formatted {
+			t.Errorf("DecodeString16(%%q, %%d, %%d, %%v) = %%q, utils.DecodeString16 returned %%q", c.target, c.start, c.end, c.bigEndian, actual, c.formatted)
+		}
+	}
+}
+
+func TestMergeStrings(t *testing.T) {
+	for _, c := range mergeStringsCases {
+		if actual := MergeStrings(c.fragments); actual != c.expected {
+			t.Errorf("MergeStrings(%%q) = %%q, utils.MergeStrings returned %%q", c.fragments, actual, c.expected)
+		}
+	}
+}
+`
+
+func Test_SelfContainedStringTest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// few different bytes, so that patterns match often
+	alphabet := "aAbB \t\x00."
+	randomString := func(max int) string {
+		b := make([]byte, rng.Intn(max))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	var cases strings.Builder
+	matched := 0
+	for i := 0; i < 2000; i++ {
+		target := randomString(12)
+		pattern := randomString(3) + "a"
+		index := int64(rng.Intn(len(target)+2)) - 1
+		flags := utils.StringTestFlags(rng.Intn(int(utils.FullWord) * 2))
+		if flags&(utils.ForceText|utils.ForceBinary) > 0 {
+			flags |= []utils.StringTestFlags{0, utils.TextTarget, utils.BinaryTarget}[rng.Intn(3)]
+		}
+
+		expected := utils.StringTest(utils.NewSliceReader(strings.NewReader(target), 0, int64(len(target))), index, pattern, flags)
+		assert.EqualValues(t, expected, utils.StringTestBytes([]byte(target), index, pattern, flags))
+		if expected >= 0 {
+			matched++
+		}
+		fmt.Fprintf(&cases, "\t{%s, %d, %s, %d, %d},\n", strconv.Quote(target), index, strconv.Quote(pattern), flags, expected)
+	}
+	assert.Greater(t, matched, 25)
+
+	var searchCases strings.Builder
+	matched = 0
+	for i := 0; i < 2000; i++ {
+		target := randomString(40)
+		pattern := randomString(3) + "a"
+		index := int64(rng.Intn(len(target) + 2))
+		maxLen := int64(rng.Intn(len(target)+4)) - 2
+		flags := utils.StringTestFlags(rng.Intn(int(utils.FullWord) * 2))
+		if flags&(utils.ForceText|utils.ForceBinary) > 0 {
+			flags |= []utils.StringTestFlags{0, utils.TextTarget, utils.BinaryTarget}[rng.Intn(3)]
+		}
+
+		pos, length := utils.SearchTest(utils.NewSliceReaderFromBytes([]byte(target)), index, maxLen, pattern, flags)
+		if pos >= 0 {
+			matched++
+		}
+		fmt.Fprintf(&searchCases, "\t{%s, %d, %d, %s, %d, %d, %d},\n", strconv.Quote(target), index, maxLen, strconv.Quote(pattern), flags, pos, length)
+	}
+	assert.Greater(t, matched, 25)
+
+	var mergeCases strings.Builder
+	for _, fragments := range [][]string{
+		{"Zip archive data", `\b, at least v2.0`},
+		{"Zip archive data", "\b, at least v2.0"},
+		{"version", `\b\b1`, "\b" + `\b` + "\b.1"},
+		{`\b, first`, "second"},
+		{"a", `b\bc`, "", `\b`, "d "},
+		{"", "a", "", "", "b"},
+	} {
+		fmt.Fprintf(&mergeCases, "\t{%#v, %s},\n", fragments, strconv.Quote(utils.MergeStrings(fragments)))
+	}
+
+	// units of either case, surrogates and NULs, in either byte order
+	units := []uint16{'a', 'A', 'b', 0, 0xe9, 0xd83d, 0xde00, 0x0141}
+	randomTarget16 := func(max int) string {
+		b := make([]byte, 0, 2*max+1)
+		for i := rng.Intn(max); i > 0; i-- {
+			unit := units[rng.Intn(len(units))]
+			b = append(b, byte(unit), byte(unit>>8))
+		}
+		if rng.Intn(4) == 0 {
+			// odd-length
+			b = append(b, 'a')
+		}
+		if rng.Intn(2) == 0 {
+			// the other byte order, mostly
+			b = append([]byte{0}, b...)
+		}
+		return string(b)
+	}
+	var string16Cases strings.Builder
+	matched = 0
+	for i := 0; i < 1000; i++ {
+		target := randomTarget16(8)
+		pattern := []string{"a", "A", "ab", "Ab", "aA", ""}[rng.Intn(6)]
+		index := int64(rng.Intn(len(target)+2)) - 1
+		bigEndian := rng.Intn(2) == 0
+		flags := []utils.StringTestFlags{0, utils.LowerMatchesBoth, utils.UpperMatchesBoth}[rng.Intn(3)]
+
+		expected := utils.String16Test(utils.NewSliceReaderFromBytes([]byte(target)), index, pattern, bigEndian, flags)
+		if expected >= 0 && pattern != "" {
+			matched++
+		}
+		fmt.Fprintf(&string16Cases, "\t{%s, %d, %s, %v, %d, %d},\n", strconv.Quote(target), index, strconv.Quote(pattern), bigEndian, flags, expected)
+	}
+	assert.Greater(t, matched, 10)
+
+	var decode16Cases strings.Builder
+	for i := 0; i < 1000; i++ {
+		target := randomTarget16(8)
+		start := int64(rng.Intn(len(target) + 2))
+		end := start + int64(rng.Intn(len(target)+2))
+		bigEndian := rng.Intn(2) == 0
+
+		sr := utils.NewSliceReaderFromBytes([]byte(target))
+		fmt.Fprintf(&decode16Cases, "\t{%s, %d, %d, %v, %s, %s},\n", strconv.Quote(target), start, end, bigEndian,
+			strconv.Quote(utils.DecodeUTF16(sr, start, end-start, bigEndian)), strconv.Quote(utils.DecodeString16(sr, start, end, bigEndian)))
+	}
+
+	dir := scratchModule(t, parseBook(t, "0\tstring\tAB\tab\n"), Options{SelfContained: true})
+	source := fmt.Sprintf(runtimeStringTestSource, cases.String(), searchCases.String(), mergeCases.String(), string16Cases.String(), decode16Cases.String())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stringtest_test.go"), []byte(source), 0644))
+	runGo(t, dir, "test", "-run", "TestStringTest|TestSearchTest|TestMergeStrings|TestString16", "./...")
+}
+
+// targetsMagic has rules for text targets, binary ones, and full words
+const targetsMagic = `
+0	ubyte	x	target
+>0	string/t	hello	\b, text hello
+>0	string/b	hello	\b, binary hello
+>0	string/f	hel	\b, hel, the word
+>0	search/32/f	world	\b, world, the word
+>0	search/t/32	hello	\b, found in text
+>0	search/32/b	world	\b, found in binary
+`
+
+func Test_GeneratedStringTargets(t *testing.T) {
+	book := parseBook(t, targetsMagic)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, `rA = gt(r, po, "hello", 16|r.TextHint())`)
+	assert.Contains(t, code, `rA = gt(r, po, "hel", 64)`)
+	assert.Contains(t, code, `var hf0 = utils.MakeFinder("world", 64)`)
+	assert.Contains(t, code, `rA, _ = ht(r, po, 32, hf0, 64)`)
+	// finders don't tell text and binary targets apart, ht does
+	assert.Contains(t, code, `var hf2 = utils.MakeFinder("world", 0)`)
+	assert.Contains(t, code, `rA, _ = ht(r, po, 32, hf2, 32|r.TextHint())`)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{"hello there\n", "hello\x00world", "hel world", "helloworld world\n", "helloworld\x00", "caf\xc3\xa9 hello", "hello caf\xe9\n", "hello\xc2\x80", "\xff\xfehello world\n"} {
+		result, err := ictx.Identify(utils.NewSliceReaderFromBytes([]byte(data)))
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	assert.EqualValues(t, `target|\b, binary hello|\b, world, the word|\b, found in binary`, samples[1].expected)
+	assert.EqualValues(t, `target|\b, text hello|\b, found in text`, samples[6].expected)
+	assert.EqualValues(t, `target|\b, binary hello`, samples[7].expected)
+	assert.EqualValues(t, `target|\b, world, the word|\b, found in text`, samples[8].expected)
+
+	for _, opts := range []Options{{}, {SelfContained: true}, {Structured: true, SliceReaderAPI: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// blanksMagic searches with variable blanks, and looks right after the
+// match
+const blanksMagic = `
+0	search/32/W	a\ b	compact
+>&0	ubyte	0x21	\b, bang
+0	search/32/cw	A\ b\ c	optional
+>&0	ubyte	0x21	\b, bang
+`
+
+func Test_GeneratedSearchBlanks(t *testing.T) {
+	book := parseBook(t, blanksMagic)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.Contains(t, code, `var hf0 = utils.MakeFinder("a b", 1)`)
+	assert.Contains(t, code, `rA, rB = ht(r, po, 32, hf0, 1)`)
+	assert.Contains(t, code, `gf = po + rA + rB`)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{"xx a    b!", "xx a  b !", "xx ab!", "Abc!", "A B C!", "a b c!", "A b  c!"} {
+		result, err := ictx.Identify(utils.NewSliceReaderFromBytes([]byte(data)))
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	assert.EqualValues(t, `compact|\b, bang`, samples[0].expected)
+	assert.EqualValues(t, `optional|\b, bang`, samples[3].expected)
+
+	for _, opts := range []Options{{}, {SelfContained: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// rangeMagic has search rules whose matches start in their range and run
+// past it, or whose range is the default one
+const rangeMagic = `
+0	ubyte	x	range
+>0	search/3	ab	\b, short
+>>&0	string	xx	\b, then xx
+>0	search/0	ab	\b, default
+>0	search/1/W	x\ a	\b, blanks
+`
+
+func Test_GeneratedSearchRange(t *testing.T) {
+	book := parseBook(t, rangeMagic)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{"xxabxx", "xxxabxx", "x   a", "axx", strings.Repeat("x", 8190) + "ab", strings.Repeat("x", 8192) + "ab"} {
+		result, err := ictx.Identify(utils.NewSliceReaderFromBytes([]byte(data)))
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%d", len(samples)),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	assert.EqualValues(t, `range|\b, short|\b, then xx|\b, default`, samples[0].expected)
+	assert.EqualValues(t, `range|\b, blanks`, samples[2].expected)
+	assert.EqualValues(t, `range|\b, default`, samples[4].expected)
+	assert.EqualValues(t, `range`, samples[5].expected)
+
+	for _, opts := range []Options{{}, {SelfContained: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
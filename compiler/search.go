@@ -0,0 +1,53 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// finderKey is the pattern of a search rule, with the flags its finder
+// is made with
+type finderKey struct {
+	pattern string
+	flags   utils.StringTestFlags
+}
+
+// searchFinderKey returns the key of the finder of sk, finders ignore
+// ForceText and ForceBinary
+func searchFinderKey(sk *parser.SearchKind) finderKey {
+	return finderKey{pattern: sk.Value, flags: sk.Flags &^ (utils.ForceText | utils.ForceBinary)}
+}
+
+// finderVars names the package-level variables holding the finders of
+// search rules, one per pattern and flags, so that they're only prepared
+// once. It returns the names by key, and the keys in the order they
+// should be declared.
+func finderVars(book parser.Spellbook) (map[finderKey]string, []finderKey) {
+	var pages []string
+	for page := range book {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	names := make(map[finderKey]string)
+	var keys []finderKey
+	for _, page := range pages {
+		for _, rule := range book[page] {
+			sk, ok := rule.Kind.Data.(*parser.SearchKind)
+			if !ok {
+				continue
+			}
+
+			key := searchFinderKey(sk)
+			if _, ok := names[key]; ok {
+				continue
+			}
+			names[key] = fmt.Sprintf("hf%d", len(keys))
+			keys = append(keys, key)
+		}
+	}
+	return names, keys
+}
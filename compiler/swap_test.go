@@ -0,0 +1,143 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// swappedMagic uses chunk in both byte orders, and inner through chunk,
+// swapped back
+const swappedMagic = `
+0	name	inner
+>0	ubeshort	0x102	\b, inner big-endian
+>0	uleshort	0x102	\b, inner little-endian
+0	name	chunk
+>0	ulelong	x	\b, size %d
+>4	lestring16	AB	\b, AB
+>(8.s)	ubyte	x	\b, pointed at %d
+>10	use	\^inner
+0	string	LE	little
+>2	use	chunk
+0	string	BE	big
+>2	use	\^chunk
+0	string	NO	not swapped
+>2	use	inner
+`
+
+func Test_CompileRuntimeSwap(t *testing.T) {
+	book := parseBook(t, swappedMagic)
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, stats.PagesEmitted)
+
+	buf.Reset()
+	stats, err = CompileTo(&buf, book, Options{Package: "generated", RuntimeSwap: true, EmitMatchers: true})
+	assert.NoError(t, err)
+	code := buf.String()
+	assert.EqualValues(t, 3, stats.PagesEmitted)
+	assert.Contains(t, code, "func identifyChunk(swap bool, r *utils.SliceReader, po int64, mx int) ([]string, string) {")
+	assert.NotContains(t, code, "func identifyChunk__Swapped(")
+	assert.Contains(t, code, "func isChunk(swap bool, r *utils.SliceReader, po int64) bool {")
+	// the exported functions are still there
+	assert.Contains(t, code, "func IdentifyChunk__Swapped(r Reader, po int64) []string {")
+	assert.Contains(t, code, "o, u := identifyChunk(t, sl(r), po, 0)")
+	assert.Contains(t, code, "return isChunk(t, sl(r), po)")
+
+	// what the page reads depends on swap
+	assert.Contains(t, code, "func s4l(r *utils.SliceReader, off int64, swap bool) (uint64, bool) {")
+	assert.Contains(t, code, "rc, m = s4l(r, po, swap)")
+	assert.Contains(t, code, "ra, k = s2l(r, po+8, swap)")
+	assert.Contains(t, code, "rA = ut(r, po+4, \"AB\", swap, 0)")
+	assert.Contains(t, code, "o, u := identifyInner(!swap, r, po+10, mx-len(out))")
+	assert.Contains(t, code, "o, u := identifyChunk(t, r, po+2, mx-len(out))")
+	// inner is used both ways too, single bytes read the same
+	assert.Contains(t, code, "rc, m = s2b(r, po, swap)")
+	assert.NotContains(t, code, "s1(")
+
+	buf.Reset()
+	_, err = CompileTo(&buf, book, Options{Package: "generated", RuntimeSwap: true, SingleDispatch: true})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.Contains(t, code, "\tcase 2, 3: // \"chunk\", swapped or not\n")
+	assert.Contains(t, code, "o, u := identifyPage(2, !swap, r, po+10, mx-len(out))")
+
+	// pages used one way only keep a function of their own
+	buf.Reset()
+	_, err = CompileTo(&buf, parseBook(t, "0\tname\tbe\n>0\tulelong\t1\tone\n0\tstring\tBE\tbig\n>2\tuse\t\\^be\n"), Options{Package: "generated", RuntimeSwap: true})
+	assert.NoError(t, err)
+	code = buf.String()
+	assert.Contains(t, code, "func identifyBe__Swapped(r *utils.SliceReader, po int64, mx int) ([]string, string) {")
+	assert.Contains(t, code, "rc, m = f4b(r, po)")
+	assert.NotContains(t, code, "swap bool")
+}
+
+func Test_GeneratedRuntimeSwap(t *testing.T) {
+	book := parseBook(t, swappedMagic)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{
+		"LE\x05\x00\x00\x00A\x00B\x00\x0a\x00\x02\x01\x09",
+		"BE\x00\x00\x00\x05\x00A\x00B\x00\x0a\x01\x02\x09",
+		"BE\x00\x00\x00\x05A\x00B\x00\x00\x0b\x02\x01\x09",
+		"NO\x01\x02",
+	} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	assert.EqualValues(t, `little|\b, size 5|\b, AB|\b, pointed at 2|\b, inner big-endian`, samples[0].expected)
+	assert.EqualValues(t, `big|\b, size 5|\b, AB|\b, pointed at 1|\b, inner big-endian`, samples[1].expected)
+
+	for _, opts := range []Options{
+		{RuntimeSwap: true},
+		{RuntimeSwap: true, Structured: true, EmitMatchers: true},
+		{RuntimeSwap: true, SingleDispatch: true, AllowCycles: true},
+	} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+
+	testGenerated(t, parseTestMagic(t, filepath.Join("testdata", "magic")), Options{RuntimeSwap: true, EmitMatchers: true})
+}
+
+// Test_RuntimeSwapSize compares the size of the code generated with and
+// without RuntimeSwap, from the magic files WIZARDRY_MAGDIR points to if
+// it's set, testdata/magic otherwise. It only logs it.
+func Test_RuntimeSwapSize(t *testing.T) {
+	magdir := os.Getenv("WIZARDRY_MAGDIR")
+	if magdir == "" {
+		magdir = filepath.Join("testdata", "magic")
+	}
+	book := parseTestMagic(t, magdir)
+
+	var twice, once bytes.Buffer
+	_, err := CompileTo(&twice, book, Options{Package: "generated", SkipUnsupported: true})
+	assert.NoError(t, err)
+	_, err = CompileTo(&once, book, Options{Package: "generated", SkipUnsupported: true, RuntimeSwap: true})
+	assert.NoError(t, err)
+	assert.Less(t, once.Len(), twice.Len())
+
+	opts := Options{SkipUnsupported: true}
+	perOrder := generatedTextSize(t, book, opts)
+	opts.RuntimeSwap = true
+	runtime := generatedTextSize(t, book, opts)
+	t.Logf("generated code: %d bytes with a function per byte order, %d with RuntimeSwap (%.1f%%)",
+		twice.Len(), once.Len(), 100*float64(once.Len())/float64(twice.Len()))
+	t.Logf("text of the generated package: %d bytes with a function per byte order, %d with RuntimeSwap (%.1f%%)",
+		perOrder, runtime, 100*float64(runtime)/float64(perOrder))
+}
@@ -4,20 +4,62 @@ import (
 	"fmt"
 
 	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// minStringSwitch is how many sibling string tests it takes to merge them
+// into a string switch, fewer are cheaper to test one by one
+const minStringSwitch = 4
+
+type streakKind int
+
+const (
+	streakNone streakKind = iota
+	streakInteger
+	streakString
 )
 
 func switchify(node *ruleNode) *ruleNode {
-	var lastChild *ruleNode
+	if node.rule.Kind.Family == parser.KindFamilyStringSwitch {
+		// already merged, when a page is compiled a second time with
+		// swapped endianness
+		for _, child := range node.children {
+			switchify(child)
+		}
+		return node
+	}
+
 	var streak []*ruleNode
+	var kind streakKind
 
 	var newChildren []*ruleNode
 
 	endStreak := func() {
-		switch len(streak) {
-		case 0:
+		switch {
+		case len(streak) == 0:
 			return
-		case 1:
-			newChildren = append(newChildren, streak[0])
+		case kind == streakString && len(streak) >= minStringSwitch:
+			// the string tests become the children of the switch, they
+			// keep theirs
+			model := streak[0].rule.Kind.Data.(*parser.StringKind)
+			for _, child := range streak {
+				child.matched = true
+			}
+			newChildren = append(newChildren, &ruleNode{
+				id: streak[0].id,
+				rule: parser.Rule{
+					Kind: parser.Kind{
+						Family: parser.KindFamilyStringSwitch,
+						Data:   &parser.StringSwitchKind{Length: len(model.Value)},
+					},
+					Level:  streak[0].rule.Level,
+					Offset: streak[0].rule.Offset,
+					Line:   fmt.Sprintf("(switch generated from %d string tests)", len(streak)),
+				},
+				children: streak,
+			})
+		case kind == streakString || len(streak) == 1:
+			newChildren = append(newChildren, streak...)
 		default:
 			model := streak[0].rule.Kind.Data.(*parser.IntegerKind)
 			sk := &parser.SwitchKind{
@@ -29,7 +71,9 @@ func switchify(node *ruleNode) *ruleNode {
 				ik := child.rule.Kind.Data.(*parser.IntegerKind)
 				sk.Cases = append(sk.Cases, &parser.SwitchCase{
 					Description: child.rule.Description,
+					MIME:        child.rule.MIME,
 					Value:       ik.Value,
+					Line:        child.rule.Line,
 				})
 			}
 			newChildren = append(newChildren, &ruleNode{
@@ -51,36 +95,17 @@ func switchify(node *ruleNode) *ruleNode {
 	for _, childIn := range node.children {
 		child := switchify(childIn)
 
-		candidate := false
-
-		if child.rule.Kind.Family == parser.KindFamilyInteger && len(child.children) == 0 {
-			ik, _ := child.rule.Kind.Data.(*parser.IntegerKind)
-			if ik.IntegerTest == parser.IntegerTestEqual && !ik.DoAnd && ik.AdjustmentType == parser.AdjustmentNone {
-				candidate = true
-			}
-		}
-
-		if !candidate {
+		childKind := switchableKind(child)
+		if childKind == streakNone {
 			endStreak()
 			newChildren = append(newChildren, child)
 		} else {
-			if len(streak) > 0 {
-				if !lastChild.rule.Offset.Equals(child.rule.Offset) {
-					endStreak()
-				}
-				ik, _ := child.rule.Kind.Data.(*parser.IntegerKind)
-				jk, _ := lastChild.rule.Kind.Data.(*parser.IntegerKind)
-				if ik.ByteWidth != jk.ByteWidth {
-					endStreak()
-				}
-				if ik.Signed != jk.Signed {
-					endStreak()
-				}
+			if len(streak) > 0 && (kind != childKind || !canJoinStreak(streak, child)) {
+				endStreak()
 			}
+			kind = childKind
 			streak = append(streak, child)
 		}
-
-		lastChild = child
 	}
 
 	endStreak()
@@ -89,3 +114,68 @@ func switchify(node *ruleNode) *ruleNode {
 
 	return node
 }
+
+// generatedSwitch tells whether rule was made up by switchify, rather than
+// read from magic
+func generatedSwitch(rule parser.Rule) bool {
+	return rule.Kind.Family == parser.KindFamilySwitch || rule.Kind.Family == parser.KindFamilyStringSwitch
+}
+
+// switchableKind returns which kind of switch child could be merged into,
+// if any
+func switchableKind(child *ruleNode) streakKind {
+	of := child.rule.Offset
+	// relative offsets move between siblings, whenever one of them matches
+	if of.IsRelative || (of.OffsetType == parser.OffsetTypeIndirect && of.Indirect.IsRelative) {
+		return streakNone
+	}
+
+	switch child.rule.Kind.Family {
+	case parser.KindFamilyInteger:
+		// cases only have a description and a MIME type, anything else the
+		// rule does would be lost
+		ik, _ := child.rule.Kind.Data.(*parser.IntegerKind)
+		if len(child.children) == 0 && !ik.MatchAny && ik.IntegerTest == parser.IntegerTestEqual &&
+			!ik.DoAnd && ik.AdjustmentType == parser.AdjustmentNone {
+			return streakInteger
+		}
+	case parser.KindFamilyString:
+		sk, _ := child.rule.Kind.Data.(*parser.StringKind)
+		if !sk.Negate && sk.Flags == 0 && sk.Value != "" && len(sk.Value) <= utils.MaxFormattedString &&
+			of.OffsetType == parser.OffsetTypeDirect {
+			return streakString
+		}
+	}
+	return streakNone
+}
+
+// canJoinStreak returns whether child tests the same thing as the rules of
+// streak, so that they can all share a switch
+func canJoinStreak(streak []*ruleNode, child *ruleNode) bool {
+	model := streak[0]
+	if !model.rule.Offset.Equals(child.rule.Offset) {
+		return false
+	}
+
+	switch ck := child.rule.Kind.Data.(type) {
+	case *parser.IntegerKind:
+		mk, _ := model.rule.Kind.Data.(*parser.IntegerKind)
+		if ck.ByteWidth != mk.ByteWidth || ck.Endianness != mk.Endianness || ck.Signed != mk.Signed {
+			return false
+		}
+		// only one case of a switch runs, and go doesn't allow duplicate
+		// ones anyway
+		value := utils.TruncateUint(uint64(ck.Value), ck.ByteWidth)
+		for _, other := range streak {
+			ik, _ := other.rule.Kind.Data.(*parser.IntegerKind)
+			if utils.TruncateUint(uint64(ik.Value), ik.ByteWidth) == value {
+				return false
+			}
+		}
+		return true
+	case *parser.StringKind:
+		mk, _ := model.rule.Kind.Data.(*parser.StringKind)
+		return len(ck.Value) == len(mk.Value)
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// switchShape describes the children of the first rule of book, after
+// switchify
+func switchShape(t *testing.T, magic string) []string {
+	book := parseBook(t, magic)
+	root := switchify(treeify(book[""])[0])
+
+	var shape []string
+	for _, child := range root.children {
+		switch kind := child.rule.Kind.Data.(type) {
+		case *parser.SwitchKind:
+			var values []string
+			for _, c := range kind.Cases {
+				values = append(values, fmt.Sprintf("%d", c.Value))
+			}
+			shape = append(shape, "switch "+strings.Join(values, ","))
+		case *parser.StringSwitchKind:
+			shape = append(shape, fmt.Sprintf("string switch of %d", len(child.children)))
+		default:
+			shape = append(shape, string(child.rule.Description))
+		}
+	}
+	return shape
+}
+
+func Test_SwitchifyEligibility(t *testing.T) {
+	cases := []struct {
+		name     string
+		magic    string
+		expected []string
+	}{
+		{"plain", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	2	two
+>1	byte	3	three
+`, []string{"switch 1,2,3"}},
+		{"mask", `
+0	string	X	x
+>1	byte	1	one
+>1	byte&0x0f	2	two
+>1	byte	3	three
+`, []string{"one", "two", "three"}},
+		{"adjustment", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	2	two
+>1	byte+1	3	three
+`, []string{"switch 1,2", "three"}},
+		{"signedness", `
+0	string	X	x
+>1	byte	1	one
+>1	ubyte	2	two
+>1	ubyte	3	three
+`, []string{"one", "switch 2,3"}},
+		{"width", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	2	two
+>1	short	3	three
+`, []string{"switch 1,2", "three"}},
+		{"endianness", `
+0	string	X	x
+>1	leshort	1	one
+>1	leshort	2	two
+>1	beshort	3	three
+>1	beshort	4	four
+`, []string{"switch 1,2", "switch 3,4"}},
+		{"match any", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	x	any
+>1	byte	2	two
+`, []string{"one", "any", "two"}},
+		{"test", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	>1	more
+>1	byte	!3	not three
+`, []string{"one", "more", "not three"}},
+		{"children", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	2	two
+>>2	byte	1	child
+>1	byte	3	three
+`, []string{"one", "two", "three"}},
+		{"relative offset", `
+0	string	X	x
+>&0	byte	1	one
+>&0	byte	2	two
+>&0	byte	3	three
+`, []string{"one", "two", "three"}},
+		{"duplicate value", `
+0	string	X	x
+>1	byte	1	one
+>1	byte	2	two
+>1	byte	-1	minus one
+>1	byte	0xff	also minus one
+`, []string{"switch 1,2,-1", "also minus one"}},
+		{"strings", `
+0	string	X	x
+>1	string	ab	ab
+>1	string	cd	cd
+>1	string	ab	ab again
+>1	string	ef	ef
+>1	string/c	gh	gh
+`, []string{"string switch of 4", "gh"}},
+	}
+
+	for _, c := range cases {
+		assert.EqualValues(t, c.expected, switchShape(t, c.magic), c.name)
+	}
+}
+
+// Test_GeneratedSwitchEligibility used to find only one of the rules that
+// match, or none
+func Test_GeneratedSwitchEligibility(t *testing.T) {
+	book := parseBook(t, `
+0	string	X	x
+>1	byte	1	one
+>1	byte	2	two
+>1	byte	x	\b, byte %d
+0	string	Y	y
+>1	leshort	1	little one
+>1	leshort	2	little two
+>1	beshort	0x100	big 256
+>1	beshort	0x200	big 512
+`)
+
+	samples := []generatedSample{
+		{name: "match any", data: "X\x00", expected: `x|\b, byte 0`},
+		{name: "match any and value", data: "X\x02", expected: `x|two|\b, byte 2`},
+		{name: "both endiannesses", data: "Y\x01\x00", expected: `y|little one|big 256`},
+	}
+	testGeneratedSamples(t, book, Options{}, samples)
+}
+
+const stringSwitchMagic = `
+0	string	IMG	image
+>3	string	GIF8	\b, gif
+>>&0	string	9a	\b 89a
+>>&0	string	7a	\b 87a
+>3	string	PNG!	\b, png
+>>7	ubyte	x	\b, depth %d
+>3	string	JPEG	\b, jpeg
+>3	string	GIF8	\b, really gif
+>3	string	TIFF	\b, tiff
+>>&0	ubyte	1	\b, little-endian
+>3	string	WEBP	\b, webp
+>3	string	BMP	\b, short
+>3	default	x	\b, unknown
+`
+
+func Test_StringSwitch(t *testing.T) {
+	book := parseBook(t, stringSwitchMagic)
+
+	var buf bytes.Buffer
+	stats, err := CompileTo(&buf, book, Options{Package: "images"})
+	assert.NoError(t, err)
+	code := buf.String()
+	// all six four-byte tests are read once, the shorter one isn't merged
+	assert.EqualValues(t, 1, strings.Count(code, "switch string(rs(r, po+3, po+7)) {"))
+	assert.EqualValues(t, 1, strings.Count(code, `case "GIF8":`))
+	assert.Contains(t, code, `gt(r, po+3, "BMP", 0)`)
+
+	buf.Reset()
+	unswitched, err := CompileTo(&buf, book, Options{Package: "images", NoSwitches: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "switch string(")
+	assert.EqualValues(t, unswitched.RulesCompiled, stats.RulesCompiled)
+}
+
+func Test_GeneratedStringSwitch(t *testing.T) {
+	book := parseBook(t, stringSwitchMagic)
+
+	inputs := []struct {
+		name string
+		data string
+	}{
+		{"gif 89a", "IMGGIF89a"},
+		{"gif 87a", "IMGGIF87a"},
+		{"png", "IMGPNG!\x08"},
+		{"jpeg", "IMGJPEG"},
+		{"tiff", "IMGTIFF\x01"},
+		{"webp", "IMGWEBP"},
+		{"bmp", "IMGBMP?"},
+		{"unknown", "IMGXXXX"},
+		{"cut short", "IMGGIF"},
+	}
+
+	// both variants must find what the interpreter does
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, in := range inputs {
+		sr := utils.NewSliceReader(strings.NewReader(in.data), 0, int64(len(in.data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     in.name,
+			data:     in.data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+
+	// siblings testing the same string all match, in order
+	assert.EqualValues(t, `image|\b, gif|\b 89a|\b, really gif`, samples[0].expected)
+	assert.EqualValues(t, `image|\b, tiff|\b, little-endian`, samples[4].expected)
+	assert.EqualValues(t, `image|\b, unknown`, samples[7].expected)
+
+	for _, opts := range []Options{{}, {NoSwitches: true}, {Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples, "-bench", "Identify", "-benchtime", "1000x")
+	}
+}
@@ -0,0 +1,95 @@
+package compiler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// pageSymbols assigns every page a distinct suffix for the names of its
+// functions (IdentifyXxx and identifyXxx). Pages are mangled by
+// manglePageName, pages that end up with the same symbol get a short hash
+// of their name appended, the first one in sorted order excepted, so that
+// symbols are stable across runs. Symbols of functions that aren't pages
+// are never used.
+func pageSymbols(pages []string) map[string]string {
+	sorted := append([]string(nil), pages...)
+	sort.Strings(sorted)
+
+	symbols := make(map[string]string)
+	taken := make(map[string]bool)
+	// IdentifyString and IdentifyStrings wrap the top-level page
+	for _, reserved := range reservedSymbols {
+		taken[reserved] = true
+	}
+	for _, page := range sorted {
+		if _, ok := symbols[page]; ok {
+			continue
+		}
+
+		symbol := manglePageName(page)
+		if taken[symbol] {
+			hashed := fmt.Sprintf("%s_%s", symbol, pageHash(page))
+			symbol = hashed
+			for i := 2; taken[symbol]; i++ {
+				symbol = fmt.Sprintf("%s%d", hashed, i)
+			}
+		}
+
+		symbols[page] = symbol
+		taken[symbol] = true
+	}
+	return symbols
+}
+
+// reservedSymbols are the suffixes of generated functions that don't
+// identify a page
+var reservedSymbols = []string{"String", "Strings"}
+
+// manglePageName turns a page name into an exported Go identifier: letters
+// and digits are kept, everything else separates words, which are
+// title-cased and joined. Names that don't start with an upper case letter
+// get a "Page" prefix. The top-level page "" stays empty. Symbols never
+// contain two underscores in a row, which is how swapped variants are told
+// apart.
+func manglePageName(page string) string {
+	if page == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	startWord := true
+	for _, r := range page {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			startWord = true
+			continue
+		}
+		if startWord {
+			r = unicode.ToUpper(r)
+			startWord = false
+		}
+		sb.WriteRune(r)
+	}
+
+	symbol := sb.String()
+	for _, r := range symbol {
+		if !unicode.IsUpper(r) {
+			symbol = "Page" + symbol
+		}
+		break
+	}
+	if symbol == "" {
+		symbol = "Page"
+	}
+	return symbol
+}
+
+// pageHash returns a short hash of a page name, to tell apart pages whose
+// names mangle to the same symbol
+func pageHash(page string) string {
+	h := fnv.New32a()
+	h.Write([]byte(page))
+	return fmt.Sprintf("%06x", h.Sum32()&0xffffff)
+}
@@ -0,0 +1,161 @@
+package compiler
+
+import (
+	"bytes"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ManglePageName(t *testing.T) {
+	for _, tc := range []struct {
+		page   string
+		symbol string
+	}{
+		{"", ""},
+		{"elf-le", "ElfLe"},
+		{"ms_dos", "MsDos"},
+		{"msdos", "Msdos"},
+		{"riff-walk", "RiffWalk"},
+		{"9660", "Page9660"},
+		{"4dos", "Page4dos"},
+		{"x86.header", "X86Header"},
+		{"café", "Café"},
+		{"日本", "Page日本"},
+		{"---", "Page"},
+		{"foo__swapped", "FooSwapped"},
+	} {
+		symbol := manglePageName(tc.page)
+		assert.EqualValues(t, tc.symbol, symbol, "for %q", tc.page)
+		if symbol != "" {
+			assert.True(t, token.IsIdentifier(symbol) && token.IsExported(symbol), "%q should be an exported identifier", symbol)
+		}
+	}
+}
+
+func Test_PageSymbols(t *testing.T) {
+	pages := []string{"msdos", "ms_dos", "Ms-Dos", "ms dos", "", "9660", "Page9660", "page-9660"}
+	symbols := pageSymbols(pages)
+
+	seen := make(map[string]string)
+	for _, page := range pages {
+		symbol, ok := symbols[page]
+		assert.True(t, ok, "no symbol for %q", page)
+		if other, ok := seen[symbol]; ok {
+			t.Errorf("%q and %q both got symbol %q", page, other, symbol)
+		}
+		seen[symbol] = page
+		assert.NotContains(t, symbol, "__")
+	}
+
+	// the first page in sorted order keeps the plain symbol
+	assert.EqualValues(t, "MsDos", symbols["Ms-Dos"])
+	assert.EqualValues(t, "MsDos_"+pageHash("ms dos"), symbols["ms dos"])
+	assert.EqualValues(t, "Msdos", symbols["msdos"])
+	assert.EqualValues(t, "", symbols[""])
+
+	// the wrappers of the top-level page keep their names
+	reserved := pageSymbols([]string{"string", "strings"})
+	assert.EqualValues(t, "String_"+pageHash("string"), reserved["string"])
+	assert.EqualValues(t, "Strings_"+pageHash("strings"), reserved["strings"])
+
+	// symbols don't depend on the order pages come in
+	reversed := make([]string, len(pages))
+	for i, page := range pages {
+		reversed[len(pages)-1-i] = page
+	}
+	assert.EqualValues(t, symbols, pageSymbols(reversed))
+}
+
+func Test_CollidingPagesBuild(t *testing.T) {
+	book := parseBook(t, `
+0	name	ms_dos
+>0	ubyte	1	underscore
+0	name	ms-dos
+>0	ubyte	2	dash
+0	name	9660
+>0	ubyte	3	digits
+0	string	MZ	MZ
+>2	use	ms_dos
+>2	use	ms-dos
+>2	use	\^ms-dos
+>2	use	9660
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	// "ms-dos" sorts first
+	assert.EqualValues(t, 1, strings.Count(code, "func identifyMsDos("))
+	assert.EqualValues(t, 1, strings.Count(code, "func identifyMsDos__Swapped("))
+	assert.EqualValues(t, 1, strings.Count(code, "func identifyMsDos_"+pageHash("ms_dos")+"("))
+	assert.Contains(t, code, `//   "9660": IdentifyPage9660`)
+
+	dir := scratchModule(t, book, Options{})
+	runGo(t, dir, "build", "./...")
+}
+
+const pagesTestSource = `package generated
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+func TestPages(t *testing.T) {
+	data := "\x01\x00"
+	for name, direct := range map[string]func(Reader, int64) []string{
+		"":           Identify,
+		"riff-walk":  IdentifyRiffWalk,
+		"riff-walk^": IdentifyRiffWalk__Swapped,
+	} {
+		identify, ok := Pages[name]
+		if !ok {
+			t.Errorf("no page %q", name)
+			continue
+		}
+		sr := utils.NewSliceReader(strings.NewReader(data), 0, int64(len(data)))
+		expected := strings.Join(direct(sr, 0), "|")
+		if actual := strings.Join(identify(sr, 0), "|"); actual != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, actual)
+		}
+	}
+	if len(Pages) != 3 {
+		t.Errorf("expected 3 pages, got %d", len(Pages))
+	}
+}
+`
+
+func Test_PagesRegistry(t *testing.T) {
+	book := parseBook(t, `
+0	name	riff-walk
+>0	leshort	1	little-endian one
+>0	leshort	0x100	big-endian one
+0	name	unused
+>0	ubyte	1	never emitted
+0	ubyte	1	top
+>0	use	riff-walk
+>0	use	\^riff-walk
+`)
+
+	var buf bytes.Buffer
+	_, err := CompileTo(&buf, book, Options{Package: "generated"})
+	assert.NoError(t, err)
+	code := buf.String()
+	// keyed by page names, not symbols
+	assert.Contains(t, code, `"riff-walk":  IdentifyRiffWalk,`)
+	assert.Contains(t, code, `"riff-walk^": IdentifyRiffWalk__Swapped,`)
+	assert.NotContains(t, code, `"unused"`)
+
+	dir := scratchModule(t, book, Options{})
+	err = ioutil.WriteFile(filepath.Join(dir, "pages_test.go"), []byte(pagesTestSource), 0644)
+	assert.NoError(t, err)
+	runGo(t, dir, "test", "./...")
+}
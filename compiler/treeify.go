@@ -4,6 +4,8 @@ import (
 	"github.com/9uanhuo/wizardry/parser"
 )
 
+// treeify turns the rules of a page into trees. Nodes get the index of
+// their rule as id, so that the same page always yields the same labels.
 func treeify(rules []parser.Rule) []*ruleNode {
 	var rootNodes []*ruleNode
 	var nodeStack []*ruleNode
@@ -0,0 +1,75 @@
+package compiler
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/pkg/errors"
+)
+
+// errNestedIndirect is the error of rules at nested indirect offsets, only
+// the interpreter knows how to follow them
+var errNestedIndirect = errors.New("nested indirect offsets aren't supported")
+
+// compiledFamilies are the kinds of rules emitNode turns into code. Rules of
+// other kinds are unsupported: emitNode makes them fail, along with their
+// children.
+var compiledFamilies = map[parser.KindFamily]bool{
+	parser.KindFamilyInteger:      true,
+	parser.KindFamilyDate:         true,
+	parser.KindFamilyFloat:        true,
+	parser.KindFamilyString:       true,
+	parser.KindFamilyGuid:         true,
+	parser.KindFamilyString16:     true,
+	parser.KindFamilyPString:      true,
+	parser.KindFamilySearch:       true,
+	parser.KindFamilyRegex:        true,
+	parser.KindFamilyUse:          true,
+	parser.KindFamilyName:         true,
+	parser.KindFamilyClear:        true,
+	parser.KindFamilyDefault:      true,
+	parser.KindFamilySwitch:       true,
+	parser.KindFamilyStringSwitch: true,
+}
+
+// unsupportedRules returns a *RuleError for every rule of book the compiler
+// can't turn into code, pages in name order, rules in book order. Rules
+// under them aren't listed, unless they're unsupported too, but they never
+// match either.
+func unsupportedRules(book parser.Spellbook) []*RuleError {
+	var pages []string
+	for page := range book {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	var unsupported []*RuleError
+	for _, page := range pages {
+		for _, rule := range book[page] {
+			if rule.Offset.OffsetType == parser.OffsetTypeIndirect && rule.Offset.Indirect.IsNested() {
+				unsupported = append(unsupported, ruleError(page, rule, errNestedIndirect))
+				continue
+			}
+
+			if !compiledFamilies[rule.Kind.Family] {
+				unsupported = append(unsupported, ruleError(page, rule, errors.Errorf("%s rules aren't supported", kindName(rule))))
+			}
+		}
+	}
+	return unsupported
+}
+
+// kindName returns the type of rule as written in its line, without its
+// flags, e.g. "octal" for octal/12
+func kindName(rule parser.Rule) string {
+	fields := strings.Split(canonicalLine(rule.Line), "\t")
+	if len(fields) < 2 {
+		return rule.Kind.String()
+	}
+	name := fields[1]
+	if i := strings.IndexAny(name, "/&"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
@@ -0,0 +1,99 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+const unsupportedMagic = `0	string	DER	der
+>3	der	seq	\b, sequence
+>>5	ubyte	1	\b, one
+>3	ubyte	2	\b, two
+0	string	TAR	tar
+>124	octal/12	>0	\b, with data
+`
+
+func Test_CompileUnsupported(t *testing.T) {
+	magdir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(magdir, "unsupported"), []byte(unsupportedMagic), 0644))
+	book := parseTestMagic(t, magdir)
+
+	var out bytes.Buffer
+	_, err := CompileTo(&out, book, Options{Package: "generated"})
+	assert.Error(t, err)
+	assert.Zero(t, out.Len())
+	var ue *UnsupportedError
+	if assert.True(t, errors.As(err, &ue), "expected an *UnsupportedError, got %v", err) {
+		assert.Len(t, ue.Rules, 2)
+		assert.EqualValues(t, 2, ue.Rules[0].LineNumber)
+		assert.EqualValues(t, 6, ue.Rules[1].LineNumber)
+	}
+	path := filepath.Join(magdir, "unsupported")
+	assert.Contains(t, err.Error(), path+`:2: can't compile rule ">3\tder\tseq\t\\b, sequence" of page "": der rules aren't supported`)
+	assert.Contains(t, err.Error(), path+`:6: can't compile rule ">124\toctal/12\t>0\t\\b, with data" of page "": octal rules aren't supported`)
+
+	stats, err := CompileTo(&out, book, Options{Package: "generated", SkipUnsupported: true})
+	assert.NoError(t, err)
+	assert.Len(t, stats.Unsupported, 2)
+	assert.EqualValues(t, 2, stats.RulesSkipped)
+	assert.Contains(t, out.String(), `"\\b, two"`)
+}
+
+func Test_GeneratedSkipUnsupported(t *testing.T) {
+	book := parseBook(t, unsupportedMagic)
+	samples := []generatedSample{
+		{name: "der", data: "DER\x02\x00\x01", expected: `der|\b, two`},
+		{name: "tar", data: "TAR", expected: "tar"},
+	}
+	testGeneratedSamples(t, book, Options{SkipUnsupported: true}, samples)
+}
+
+// one rule of every kind the parser knows
+const everyKindMagic = `0	name	sub
+>0	ubyte	1	one
+0	ubyte	1	integer
+0	date	0	date
+0	float	0	float
+0	string	A	string
+0	guid	00000000-0000-0000-0000-000000000000	guid
+0	lestring16	A	string16
+0	pstring	A	pstring
+0	search/4	A	search
+0	regex	A	regex
+0	use	sub
+0	clear	x
+0	default	x	default
+0	der	seq	der
+0	octal	>0	octal
+`
+
+func Test_CompiledFamilies(t *testing.T) {
+	book := parseBook(t, everyKindMagic)
+
+	families := map[parser.KindFamily]bool{}
+	for _, rules := range book {
+		for _, rule := range rules {
+			families[rule.Kind.Family] = true
+		}
+	}
+	for family := parser.KindFamilyInteger; family <= parser.KindFamilyGuid; family++ {
+		assert.True(t, families[family], "no rule of family %d in the test magic", family)
+	}
+
+	var out bytes.Buffer
+	stats, err := CompileTo(&out, book, Options{Package: "generated", SkipUnsupported: true})
+	assert.NoError(t, err)
+	unsupported := 0
+	for family := range families {
+		if !compiledFamilies[family] {
+			unsupported++
+		}
+	}
+	assert.Len(t, stats.Unsupported, unsupported)
+}
@@ -1,36 +1,133 @@
 package compiler
 
 import (
+	"sort"
+
 	"github.com/9uanhuo/wizardry/parser"
 )
 
-func computePagesUsage(book parser.Spellbook) map[string]*PageUsage {
-	// look at all rules to see which pages are used, and whether they're used
-	// in normal endianness or swapped endianness
+// usedPage is a page, in normal or swapped endianness
+type usedPage struct {
+	page    string
+	swapped bool
+}
+
+// computePagesUsage follows uses from the top-level page, and from roots,
+// to see which pages are used, and whether they're used in normal endianness, swapped
+// endianness, or both. Pages nothing reaches aren't used. Swapping
+// composes: a page used as \^a, that uses \^b, runs b in normal endianness,
+// and the pages b uses as they're written.
+func computePagesUsage(book parser.Spellbook, roots ...string) map[string]*PageUsage {
 	usages := make(map[string]*PageUsage)
-	usages[""] = &PageUsage{
-		EmitNormal: true,
+
+	var pending []usedPage
+	mark := func(up usedPage) {
+		usage, ok := usages[up.page]
+		if !ok {
+			usage = &PageUsage{}
+			usages[up.page] = usage
+		}
+
+		if up.swapped {
+			if usage.EmitSwapped {
+				return
+			}
+			usage.EmitSwapped = true
+		} else {
+			if usage.EmitNormal {
+				return
+			}
+			usage.EmitNormal = true
+		}
+		pending = append(pending, up)
+	}
+
+	// the top-level page, then whatever it needs, until nothing changes
+	mark(usedPage{page: ""})
+	for _, root := range roots {
+		mark(usedPage{page: root})
 	}
+	for len(pending) > 0 {
+		up := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
 
-	for _, rules := range book {
-		for _, rule := range rules {
+		for _, rule := range book[up.page] {
 			if rule.Kind.Family == parser.KindFamilyUse {
 				uk, _ := rule.Kind.Data.(*parser.UseKind)
-				var usage *PageUsage
-				var ok bool
-				if usage, ok = usages[uk.Page]; !ok {
-					usage = &PageUsage{}
-					usages[uk.Page] = usage
-				}
+				mark(usedPage{page: uk.Page, swapped: up.swapped != uk.SwapEndian})
+			}
+		}
+	}
+
+	return usages
+}
+
+// checkUseCycles returns a *UseCycleError for the first loop of uses it
+// finds in book, following pages in name order and their rules in book
+// order, or nil if there's none. Swapping endianness doesn't break loops,
+// and uses of missing pages are ignored. root is passed to ruleProvenance.
+func checkUseCycles(book parser.Spellbook, root string) error {
+	var pages []string
+	for page := range book {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	// pages being followed, and the use rules that led from one to the
+	// next, pages that are done aren't part of any loop
+	var stack []string
+	var uses []parser.Rule
+	onStack := make(map[string]bool)
+	done := make(map[string]bool)
+
+	var follow func(page string) error
+	follow = func(page string) error {
+		stack = append(stack, page)
+		onStack[page] = true
+
+		for _, rule := range book[page] {
+			if rule.Kind.Family != parser.KindFamilyUse {
+				continue
+			}
+			uk, _ := rule.Kind.Data.(*parser.UseKind)
+			if _, ok := book[uk.Page]; !ok || done[uk.Page] {
+				continue
+			}
 
-				if uk.SwapEndian {
-					usage.EmitSwapped = true
-				} else {
-					usage.EmitNormal = true
+			uses = append(uses, rule)
+			if onStack[uk.Page] {
+				// the loop starts where the used page was first followed
+				start := len(stack) - 1
+				for stack[start] != uk.Page {
+					start--
+				}
+				uce := &UseCycleError{}
+				uce.Pages = append(uce.Pages, stack[start:]...)
+				uce.Pages = append(uce.Pages, uk.Page)
+				for _, use := range uses[start:] {
+					uce.Uses = append(uce.Uses, ruleProvenance(use, root))
 				}
+				return uce
 			}
+			if err := follow(uk.Page); err != nil {
+				return err
+			}
+			uses = uses[:len(uses)-1]
 		}
+
+		stack = stack[:len(stack)-1]
+		onStack[page] = false
+		done[page] = true
+		return nil
 	}
 
-	return usages
+	for _, page := range pages {
+		if done[page] {
+			continue
+		}
+		if err := follow(page); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,147 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// swapChainMagic uses a three-page chain, swapped on the way in and the
+// way out
+const swapChainMagic = `
+0	name	outer
+>0	use	inner
+0	name	inner
+>0	beshort	0x0102	big
+>0	leshort	0x0102	little
+>0	use	\^last
+0	name	last
+>2	ubeshort	x	\b, last %#x
+0	string	SW
+>2	use	\^outer
+0	string	NO
+>2	use	outer
+`
+
+func Test_ComputePagesUsage(t *testing.T) {
+	book := parseBook(t, swapChainMagic)
+	usages := computePagesUsage(book)
+
+	assert.EqualValues(t, &PageUsage{EmitNormal: true}, usages[""])
+	// used as written, and swapped through \^outer
+	assert.EqualValues(t, &PageUsage{EmitNormal: true, EmitSwapped: true}, usages["outer"])
+	assert.EqualValues(t, &PageUsage{EmitNormal: true, EmitSwapped: true}, usages["inner"])
+	assert.EqualValues(t, &PageUsage{EmitNormal: true, EmitSwapped: true}, usages["last"])
+
+	// only swapped once, from a swapped page
+	book = parseBook(t, `
+0	name	a
+>0	use	b
+0	name	b
+>0	use	\^c
+0	name	c
+>0	ubyte	1	one
+0	string	X
+>1	use	\^a
+`)
+	usages = computePagesUsage(book)
+	assert.EqualValues(t, &PageUsage{EmitSwapped: true}, usages["a"])
+	assert.EqualValues(t, &PageUsage{EmitSwapped: true}, usages["b"])
+	// swapped twice is the normal endianness
+	assert.EqualValues(t, &PageUsage{EmitNormal: true}, usages["c"])
+}
+
+func Test_GeneratedSwapChain(t *testing.T) {
+	book := parseBook(t, swapChainMagic)
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	var samples []generatedSample
+	for _, data := range []string{"SW\x01\x02\x03\x04", "SW\x02\x01\x03\x04", "NO\x01\x02\x03\x04", "NO\x02\x01\x03\x04"} {
+		sr := utils.NewSliceReader(bytes.NewReader([]byte(data)), 0, int64(len(data)))
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		samples = append(samples, generatedSample{
+			name:     fmt.Sprintf("%x", data),
+			data:     data,
+			expected: strings.Join(result, "|"),
+		})
+	}
+	// \^last swaps back in a swapped page
+	assert.EqualValues(t, `little|\b, last 0x304`, samples[0].expected)
+	assert.EqualValues(t, `big|\b, last 0x304`, samples[1].expected)
+	assert.EqualValues(t, `big|\b, last 0x403`, samples[2].expected)
+	assert.EqualValues(t, `little|\b, last 0x403`, samples[3].expected)
+
+	for _, opts := range []Options{{}, {EmitMatchers: true, Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
+
+// cycleMagic has pages using each other in a loop, and a page using itself
+const cycleMagic = `
+0	name	a
+>0	ubyte	>0	\b, %d
+>>1	use	b
+0	name	b
+>0	use	\^a
+0	name	c
+>0	use	c
+0	string	CY	cyclic
+>2	use	a
+0	string	SELF	self
+>0	use	c
+0	string	U16
+>3	lestring16	x	\b, %s
+>3	use	c
+`
+
+func Test_CheckUseCycles(t *testing.T) {
+	magdir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(magdir, "cycle"), []byte(cycleMagic), 0644))
+	book := parseTestMagic(t, magdir)
+
+	var out bytes.Buffer
+	_, err := CompileTo(&out, book, Options{Package: "generated", SourceRoot: magdir})
+	assert.Error(t, err)
+	var uce *UseCycleError
+	assert.True(t, errors.As(err, &uce), "expected a *UseCycleError, got %v", err)
+	if uce != nil {
+		assert.EqualValues(t, []string{"a", "b", "a"}, uce.Pages)
+		assert.EqualValues(t, []string{"cycle:4: >>1\tuse\tb", "cycle:6: >0\tuse\t\\^a"}, uce.Uses)
+	}
+	assert.Contains(t, err.Error(), `"a" -> "b" -> "a"`)
+
+	// pages using themselves loop too
+	delete(book, "a")
+	err = checkUseCycles(book, magdir)
+	assert.True(t, errors.As(err, &uce), "expected a *UseCycleError, got %v", err)
+	if uce != nil {
+		assert.EqualValues(t, []string{"c", "c"}, uce.Pages)
+	}
+
+	// the stock magic has no loops
+	assert.NoError(t, checkUseCycles(parseTestMagic(t, filepath.Join("testdata", "magic")), ""))
+}
+
+func Test_GeneratedAllowCycles(t *testing.T) {
+	book := parseBook(t, cycleMagic)
+
+	// loops stop at maxUseDepth, or when the rules stop matching
+	samples := []generatedSample{
+		{name: "cyclic", data: "CY\x01\x02\x03", expected: `cyclic|\b, 1|\b, 2|\b, 3`},
+		{name: "self", data: "SELF", expected: `self`},
+		// pages don't shadow what generated code declares
+		{name: "string16", data: "U16a\x00b\x00", expected: `\b, ab`},
+	}
+	for _, opts := range []Options{{AllowCycles: true}, {AllowCycles: true, EmitMatchers: true, Structured: true}} {
+		testGeneratedSamples(t, book, opts, samples)
+	}
+}
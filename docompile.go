@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/9uanhuo/wizardry/compiler"
 	"github.com/9uanhuo/wizardry/parser"
@@ -31,10 +33,64 @@ func doCompile() error {
 		return errors.WithStack(err)
 	}
 
-	err = compiler.Compile(book, *compileArgs.output, *compileArgs.chatty, *compileArgs.emitComments, *compileArgs.pkg)
+	opts := compiler.Options{
+		Package:             *compileArgs.pkg,
+		EmitComments:        *compileArgs.emitComments,
+		Trace:               *compileArgs.trace,
+		HelpersImportPath:   *compileArgs.runtime,
+		ReaderImportPath:    *compileArgs.runtime,
+		SelfContained:       *compileArgs.selfContained,
+		SkipFormat:          *compileArgs.noFormat,
+		PagesPerFile:        *compileArgs.pagesPerFile,
+		Structured:          *compileArgs.structured,
+		LineDirectives:      *compileArgs.lineDirs,
+		SourceRoot:          *compileArgs.sourceRoot,
+		OnlyPages:           *compileArgs.only,
+		SliceReaderAPI:      *compileArgs.sliceReader,
+		AllowCycles:         *compileArgs.allowCycles,
+		EmitFuzzTest:        *compileArgs.fuzzTest,
+		MaxInputSize:        *compileArgs.maxInputSize,
+		SkipUnsupported:     *compileArgs.skipUnsupported,
+		EmitFilter:          *compileArgs.filter,
+		StringBlobThreshold: *compileArgs.stringBlob,
+		SingleDispatch:      *compileArgs.singleDispatch,
+		MinimalImports:      *compileArgs.minimalImports,
+		RuntimeSwap:         *compileArgs.runtimeSwap,
+		Incremental:         *compileArgs.incremental,
+		Logf:                Logf,
+	}
+	if opts.SourceRoot == "" {
+		opts.SourceRoot = magdir
+	}
+
+	if *compileArgs.parityCorpus != "" {
+		// the test runs from the directory of the generated package
+		opts.ParityMagdir, err = filepath.Abs(magdir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		opts.ParityCorpus, err = filepath.Abs(*compileArgs.parityCorpus)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var stats compiler.Stats
+	if opts.PagesPerFile > 0 {
+		stats, err = compiler.CompileToDir(*compileArgs.output, book, opts)
+	} else {
+		stats, err = compiler.CompileToFile(book, *compileArgs.output, opts)
+	}
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	if *compileArgs.report {
+		err = stats.WriteReport(os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
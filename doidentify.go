@@ -44,17 +44,18 @@ func doIdentify() error {
 	stat, _ := targetReader.Stat()
 
 	ictx := &interpreter.InterpretContext{
-		Logf: NoLogf,
-		Book: book,
+		Logf:      NoLogf,
+		Book:      book,
+		KeepGoing: *identifyArgs.keepGoing,
 	}
 
 	if *appArgs.debugInterpreter {
 		ictx.Logf = Logf
 	}
 
-	sr := utils.NewSliceReader(targetReader, 0, stat.Size())
-
-	result, err := ictx.Identify(sr)
+	// only the blocks rules look at are read, large targets or not
+	cr := utils.NewCachingReaderAt(targetReader, stat.Size(), utils.DefaultBlockSize)
+	result, err := ictx.IdentifyReaderAt(cr, stat.Size())
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,87 @@
+package interpreter
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// IdentifyTarget is one of the targets identified by IdentifyAll
+type IdentifyTarget struct {
+	// Name is copied to the result, to tell targets apart
+	Name     string
+	ReaderAt io.ReaderAt
+	Size     int64
+}
+
+// Result is the outcome of identifying one target with IdentifyAll
+type Result struct {
+	Name    string
+	Matches []Match
+	// Err is what IdentifyMatches returned for this target
+	Err error
+}
+
+// Descriptions returns the description of every match, like Identify
+func (r Result) Descriptions() []string {
+	return descriptions(r.Matches)
+}
+
+// IdentifyAll identifies many targets using up to parallelism goroutines,
+// or one per CPU if parallelism is 0 or less. Each worker reuses the same
+// evaluation state from one target to the next. Results are in the same
+// order as targets. An error for one target is recorded in its result and
+// doesn't stop the others.
+func (ctx *InterpretContext) IdentifyAll(targets []IdentifyTarget, parallelism int) ([]Result, error) {
+	if ctx.Book == nil {
+		return nil, ErrNilBook
+	}
+
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if parallelism > len(targets) {
+		parallelism = len(targets)
+	}
+
+	results := make([]Result, len(targets))
+	// workers take the next target by bumping this
+	nextIndex := int64(-1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			st := acquireIdentifyState()
+			defer st.release()
+
+			for {
+				index := int(atomic.AddInt64(&nextIndex, 1))
+				if index >= len(targets) {
+					return
+				}
+
+				target := targets[index]
+				result := &results[index]
+				result.Name = target.Name
+
+				if target.ReaderAt == nil {
+					result.Err = ErrNilReader
+					continue
+				}
+
+				sr := utils.NewSliceReader(target.ReaderAt, 0, target.Size)
+				result.Matches, result.Err = ctx.identifyMatches(st, sr, true)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
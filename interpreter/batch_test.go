@@ -0,0 +1,86 @@
+package interpreter
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeBatch(numTargets int) []IdentifyTarget {
+	var targets []IdentifyTarget
+	for i := 0; i < numTargets; i++ {
+		sample := identifySamples[i%len(identifySamples)]
+		targets = append(targets, IdentifyTarget{
+			Name:     fmt.Sprintf("sample-%d", i),
+			ReaderAt: bytes.NewReader(sample),
+			Size:     int64(len(sample)),
+		})
+	}
+	return targets
+}
+
+func Test_IdentifyAll(t *testing.T) {
+	ictx := &InterpretContext{
+		Book: parseBook(t, samplesMagic),
+	}
+
+	targets := makeBatch(100)
+	// errors are per target
+	targets[42].ReaderAt = nil
+
+	for _, parallelism := range []int{0, 1, 8} {
+		results, err := ictx.IdentifyAll(targets, parallelism)
+		assert.NoError(t, err)
+		assert.Len(t, results, len(targets))
+
+		for i, result := range results {
+			assert.EqualValues(t, targets[i].Name, result.Name)
+
+			if i == 42 {
+				assert.Equal(t, ErrNilReader, result.Err)
+				continue
+			}
+
+			expected, err := ictx.IdentifyReaderAt(targets[i].ReaderAt, targets[i].Size)
+			assert.NoError(t, err)
+			assert.NoError(t, result.Err)
+			assert.EqualValues(t, expected, result.Descriptions())
+		}
+	}
+
+	_, err := (&InterpretContext{}).IdentifyAll(targets, 1)
+	assert.Equal(t, ErrNilBook, err)
+
+	results, err := ictx.IdentifyAll(nil, 4)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func benchmarkBatch(b *testing.B, identify func(ictx *InterpretContext, targets []IdentifyTarget)) {
+	ictx := &InterpretContext{
+		Book: parseBook(b, samplesMagic),
+	}
+	targets := makeBatch(1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		identify(ictx, targets)
+	}
+}
+
+func Benchmark_IdentifyLoop(b *testing.B) {
+	benchmarkBatch(b, func(ictx *InterpretContext, targets []IdentifyTarget) {
+		for _, target := range targets {
+			ictx.IdentifyReaderAt(target.ReaderAt, target.Size)
+		}
+	})
+}
+
+func Benchmark_IdentifyAll(b *testing.B) {
+	benchmarkBatch(b, func(ictx *InterpretContext, targets []IdentifyTarget) {
+		ictx.IdentifyAll(targets, 0)
+	})
+}
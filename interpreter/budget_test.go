@@ -0,0 +1,69 @@
+package interpreter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const budgetMagic = `
+0	name	chunk
+>0	string	data	data chunk
+0	string	RIFF	RIFF
+>4	use	chunk
+>8	use	chunk
+>12	search/0x10000	NEEDLE	needle
+>0	string	R	starts with R
+`
+
+func Test_MaxRulesEvaluated(t *testing.T) {
+	ictx := &InterpretContext{
+		Book: parseBook(t, budgetMagic),
+	}
+	target := []byte("RIFFdatadata")
+
+	result, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"RIFF", "data chunk", "data chunk", "starts with R"}, result)
+
+	// RIFF, use, name and data in the first chunk, use and name in the second
+	ictx.MaxRulesEvaluated = 6
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.EqualValues(t, []string{"RIFF", "data chunk"}, result)
+
+	var bee *BudgetExceededError
+	assert.True(t, errors.As(err, &bee))
+	assert.EqualValues(t, "rules", bee.Budget)
+	assert.EqualValues(t, 6, bee.Limit)
+
+	ictx.MaxRulesEvaluated = 100
+	_, err = ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+}
+
+func Test_MaxBytesExamined(t *testing.T) {
+	ictx := &InterpretContext{
+		Book:         parseBook(t, budgetMagic),
+		FallbackData: true,
+	}
+	target := append([]byte("RIFFdatadata"), bytes.Repeat([]byte{0}, 0x10000)...)
+
+	result, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"RIFF", "data chunk", "data chunk", "starts with R"}, result)
+
+	// the search goes through the whole target, the last rule never runs
+	ictx.MaxBytesExamined = 0x1000
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.EqualValues(t, []string{"RIFF", "data chunk", "data chunk"}, result)
+
+	// the first string test is already over budget
+	ictx.MaxBytesExamined = 1
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.EqualValues(t, []string{"RIFF"}, result)
+}
@@ -0,0 +1,88 @@
+package interpreter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// sparseTarget creates a file of size bytes starting with header, which
+// takes no room on most filesystems
+func sparseTarget(t testing.TB, header []byte, size int64) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	_, err = f.Write(header)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_CachingReaderAtIdentify(t *testing.T) {
+	ictx := &InterpretContext{Book: parseBook(t, samplesMagic)}
+
+	for _, sample := range identifySamples {
+		expected, err := ictx.Identify(newBytesReader(sample))
+		assert.NoError(t, err)
+		for _, blockSize := range []int{1, 16, 4096} {
+			actual, err := ictx.Identify(utils.NewCachingSliceReader(bytes.NewReader(sample), int64(len(sample)), blockSize))
+			assert.NoError(t, err)
+			assert.EqualValues(t, expected, actual)
+		}
+	}
+
+	// only the head of large files is read
+	const size = 4 << 30
+	f := sparseTarget(t, identifySamples[1], size)
+	cr := utils.NewCachingReaderAt(f, size, 0)
+	result, err := ictx.IdentifyReaderAt(cr, size)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "ELF 64-bit LSB executable, x86-64", utils.MergeStrings(result))
+	assert.EqualValues(t, utils.DefaultBlockSize, cr.BytesRead())
+}
+
+// BenchmarkIdentifyLargeFile identifies a 4GiB file, with the magdir
+// WIZARDRY_MAGDIR points to if it's set, and reports how many bytes of it
+// were read
+func BenchmarkIdentifyLargeFile(b *testing.B) {
+	book := make(parser.Spellbook)
+	if magdir := os.Getenv("WIZARDRY_MAGDIR"); magdir != "" {
+		pctx := &parser.ParseContext{
+			Logf: func(format string, args ...interface{}) {},
+		}
+		err := pctx.ParseAll(magdir, book)
+		if err != nil {
+			b.Fatal(err)
+		}
+	} else {
+		book = parseBook(b, samplesMagic)
+	}
+	ictx := &InterpretContext{
+		Book: book,
+	}
+
+	const size = 4 << 30
+	f := sparseTarget(b, identifySamples[1], size)
+
+	var read int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cr := utils.NewCachingReaderAt(f, size, 0)
+		ictx.IdentifyReaderAt(cr, size)
+		read += cr.BytesRead()
+	}
+	b.ReportMetric(float64(read)/float64(b.N), "read-bytes/op")
+}
@@ -0,0 +1,58 @@
+package interpreter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DateKind(t *testing.T) {
+	book := parseBook(t, `
+0	string	D	dated
+>1	ledate	>0	\b, modified %s
+>1	ledate	x	\b, raw %d
+>5	bedate	x	\b, before the epoch: %s
+>9	leqdate	x	\b, 64-bit %s
+`)
+
+	dk, ok := book[""][1].Kind.Data.(*parser.DateKind)
+	assert.True(t, ok)
+	assert.EqualValues(t, 4, dk.ByteWidth)
+	assert.EqualValues(t, parser.LittleEndian, dk.Endianness)
+
+	data := []byte("D\x00\x10\x5e\x5f\xff\xff\xff\xff\x00\x10\x5e\x5f\x00\x00\x00\x00")
+	assert.EqualValues(t,
+		"dated, modified Sun Sep 13 12:26:40 2020, raw 1600000000, before the epoch: Wed Dec 31 23:59:59 1969, 64-bit Sun Sep 13 12:26:40 2020",
+		identify(t, book, data))
+
+	// "x" matches even if the value is cut short
+	assert.EqualValues(t, "dated, raw %d", identify(t, book, []byte("D\x00\x10")))
+}
+
+func Test_DateLocal(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+2", 2*60*60)
+
+	book := parseBook(t, `
+0	string	D	dated
+>1	leldate	x	\b, local %s
+>1	ledate	x	\b, UTC %s
+`)
+	assert.EqualValues(t,
+		"dated, local Sun Sep 13 14:26:40 2020, UTC Sun Sep 13 12:26:40 2020",
+		identify(t, book, []byte("D\x00\x10\x5e\x5f")))
+}
+
+func Test_DateDOS(t *testing.T) {
+	book := parseBook(t, `
+0	string	D	dated
+>1	lemsdosdate	x	\b, on %s
+>3	bemsdostime	!0	\b at %s
+`)
+	assert.EqualValues(t,
+		"dated, on Sun, Mar 14 2021 at 12:34:56",
+		identify(t, book, []byte("D\x6e\x52\x64\x5c")))
+}
@@ -0,0 +1,181 @@
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+const (
+	derTagUTF8String      = 12
+	derTagPrintableString = 19
+	derTagIA5String       = 22
+	derTagUTCTime         = 23
+)
+
+// derElement is the tag-length header of a DER-encoded element
+type derElement struct {
+	Tag           uint32
+	Constructed   bool
+	HeaderLength  int64
+	ContentLength int64
+}
+
+// readDerElement parses the tag and length at offset. It returns false if
+// the encoding is not valid DER (indefinite or non-minimal lengths, tags that
+// don't fit in 32 bits) or if the element extends past the end of sr.
+func readDerElement(sr *utils.SliceReader, offset int64) (*derElement, bool) {
+	el := &derElement{}
+	j := offset
+
+	b, ok := readDerByte(sr, j)
+	if !ok {
+		return nil, false
+	}
+	j++
+
+	el.Constructed = b&0x20 != 0
+	el.Tag = uint32(b & 0x1f)
+	if el.Tag == 0x1f {
+		// high tag number form, base-128 with continuation bits
+		el.Tag = 0
+		for numBytes := 0; ; numBytes++ {
+			if numBytes == 4 {
+				return nil, false
+			}
+
+			b, ok = readDerByte(sr, j)
+			if !ok {
+				return nil, false
+			}
+			j++
+
+			if numBytes == 0 && b == 0x80 {
+				// leading zero, not minimal
+				return nil, false
+			}
+
+			el.Tag = el.Tag<<7 | uint32(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	b, ok = readDerByte(sr, j)
+	if !ok {
+		return nil, false
+	}
+	j++
+
+	switch {
+	case b < 0x80:
+		// short form
+		el.ContentLength = int64(b)
+	case b == 0x80:
+		// indefinite form is BER, not DER
+		return nil, false
+	default:
+		numBytes := int(b & 0x7f)
+		if numBytes > 4 {
+			return nil, false
+		}
+
+		for i := 0; i < numBytes; i++ {
+			b, ok = readDerByte(sr, j)
+			if !ok {
+				return nil, false
+			}
+			j++
+
+			if i == 0 && b == 0 {
+				// leading zero, not minimal
+				return nil, false
+			}
+			el.ContentLength = el.ContentLength<<8 | int64(b)
+		}
+
+		if el.ContentLength < 0x80 {
+			// should have used the short form
+			return nil, false
+		}
+	}
+
+	el.HeaderLength = j - offset
+	if offset+el.HeaderLength+el.ContentLength > sr.Size() {
+		return nil, false
+	}
+
+	return el, true
+}
+
+// readDerByte reads the byte at offset, through utils.ReadUint's pooled
+// scratch buffer so walking headers doesn't allocate
+func readDerByte(sr *utils.SliceReader, offset int64) (byte, bool) {
+	v, ok := utils.ReadUint(sr, offset, 1, nil)
+	return byte(v), ok
+}
+
+// formatDerContent formats the content of an element the way file(1) does
+// before comparing it with the magic: strings as-is, UTC times as a date,
+// everything else as lower-case hex
+func formatDerContent(tag uint32, content []byte) string {
+	switch tag {
+	case derTagUTF8String, derTagPrintableString, derTagIA5String:
+		return string(content)
+	case derTagUTCTime:
+		if len(content) >= 12 {
+			d := content
+			return fmt.Sprintf("20%s-%s-%s %s:%s:%s GMT",
+				d[0:2], d[2:4], d[4:6], d[6:8], d[8:10], d[10:12])
+		}
+	}
+
+	var sb strings.Builder
+	for _, b := range content {
+		fmt.Fprintf(&sb, "%02x", b)
+	}
+	return sb.String()
+}
+
+// derTest matches the element at offset against a der rule. On success, it
+// returns the element and the offset continuation rules should use: the
+// start of the content for constructed elements (so they can be walked
+// into), and the end of the element for primitive ones (so the next sibling
+// can be tested).
+func derTest(sr *utils.SliceReader, offset int64, dk *parser.DerKind) (*derElement, int64, bool) {
+	el, ok := readDerElement(sr, offset)
+	if !ok {
+		return nil, 0, false
+	}
+
+	// like file(1), only the tag number is compared, not its class
+	if el.Tag != dk.Tag {
+		return nil, 0, false
+	}
+
+	if dk.Length >= 0 && el.ContentLength != dk.Length {
+		return nil, 0, false
+	}
+
+	contentOffset := offset + el.HeaderLength
+
+	if dk.HasValue && dk.Value != "x" {
+		content := make([]byte, el.ContentLength)
+		n, _ := sr.ReadAt(content, contentOffset)
+		if int64(n) < el.ContentLength {
+			return nil, 0, false
+		}
+
+		if formatDerContent(el.Tag, content) != dk.Value {
+			return nil, 0, false
+		}
+	}
+
+	if el.Constructed {
+		return el, contentOffset, true
+	}
+	return el, contentOffset + el.ContentLength, true
+}
@@ -0,0 +1,59 @@
+package interpreter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const certMagic = `
+0	der	seq
+>&0	der	seq
+>>&0	der	eoc
+>>>&0	der	int1=02	DER Encoded Certificate, version 3
+`
+
+func Test_DerCertificate(t *testing.T) {
+	cert, err := os.ReadFile("testdata/cert.der")
+	assert.NoError(t, err)
+
+	book := parseBook(t, certMagic)
+	assert.EqualValues(t, "DER Encoded Certificate, version 3", identify(t, book, cert))
+
+	// truncated certificates are not valid DER
+	assert.EqualValues(t, "", identify(t, book, cert[:len(cert)-1]))
+}
+
+func Test_DerTest(t *testing.T) {
+	book := parseBook(t, `
+0	der	seq	sequence
+>&0	der	int2	\b, int
+>>&0	der	prt_str=hi	\b, then hi
+0	der	set	set
+`)
+
+	assert.EqualValues(t, "sequence, int, then hi", identify(t, book, []byte{
+		0x30, 0x08,
+		0x02, 0x02, 0x01, 0x00,
+		0x13, 0x02, 'h', 'i',
+	}))
+
+	// wrong length on the integer
+	assert.EqualValues(t, "sequence", identify(t, book, []byte{
+		0x30, 0x07,
+		0x02, 0x01, 0x01,
+		0x13, 0x02, 'h', 'i',
+	}))
+
+	// long form length
+	long := []byte{0x31, 0x81, 0x80}
+	long = append(long, make([]byte, 0x80)...)
+	assert.EqualValues(t, "set", identify(t, book, long))
+
+	// indefinite length is BER, not DER
+	assert.EqualValues(t, "", identify(t, book, []byte{0x30, 0x80, 0x00, 0x00}))
+
+	// long form used for a short length is not minimal
+	assert.EqualValues(t, "", identify(t, book, []byte{0x30, 0x81, 0x01, 0x00}))
+}
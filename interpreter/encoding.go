@@ -0,0 +1,47 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// TextEncoding is the character encoding of a target that looks like text
+type TextEncoding = utils.TextEncoding
+
+const (
+	// EncodingNone is for targets that don't look like text
+	EncodingNone = utils.EncodingNone
+	// EncodingASCII is for printable 7-bit ASCII
+	EncodingASCII = utils.EncodingASCII
+	// EncodingUTF8 is for valid UTF-8 with at least one non-ASCII character
+	EncodingUTF8 = utils.EncodingUTF8
+	// EncodingUTF16LE is for little-endian UTF-16, which requires a BOM
+	EncodingUTF16LE = utils.EncodingUTF16LE
+	// EncodingUTF16BE is for big-endian UTF-16, which requires a BOM
+	EncodingUTF16BE = utils.EncodingUTF16BE
+	// EncodingISO8859 is for 8-bit text that isn't valid UTF-8
+	EncodingISO8859 = utils.EncodingISO8859
+)
+
+// LineTerminators is a set of the kinds of line terminators found in text
+type LineTerminators = utils.LineTerminators
+
+const (
+	// LineTerminatorCRLF is "\r\n"
+	LineTerminatorCRLF = utils.LineTerminatorCRLF
+	// LineTerminatorCR is a "\r" not followed by "\n"
+	LineTerminatorCR = utils.LineTerminatorCR
+	// LineTerminatorLF is a "\n" not preceded by "\r"
+	LineTerminatorLF = utils.LineTerminatorLF
+	// LineTerminatorNEL is U+0085, the EBCDIC/ISO-8859 "next line"
+	LineTerminatorNEL = utils.LineTerminatorNEL
+)
+
+// TextInfo is what DetectText found out about a target
+type TextInfo = utils.TextInfo
+
+// DetectText looks at the start of the target to find out whether it's
+// text, in which encoding, and which line terminators it uses. It's what
+// t and b string tests go by, see utils.DetectText.
+func DetectText(sr *utils.SliceReader) TextInfo {
+	return utils.DetectText(sr)
+}
@@ -0,0 +1,131 @@
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNilBook is returned when identifying without a spellbook
+	ErrNilBook = errors.New("interpreter: nil spellbook")
+	// ErrNilReader is returned when identifying a nil target
+	ErrNilReader = errors.New("interpreter: nil reader")
+	// ErrReaderTooSmall is reported when the target is empty, so no rule can match
+	ErrReaderTooSmall = errors.New("interpreter: reader too small")
+	// ErrPageNotFound is matched by errors.Is for any *PageNotFoundError
+	ErrPageNotFound = errors.New("interpreter: page not found")
+	// ErrBudgetExceeded is matched by errors.Is for any *BudgetExceededError
+	ErrBudgetExceeded = errors.New("interpreter: evaluation budget exceeded")
+	// ErrInvalidStride is returned by ScanStride for strides that aren't positive
+	ErrInvalidStride = errors.New("interpreter: scan stride must be positive")
+)
+
+// PageNotFoundError is reported when a use rule names a page that isn't
+// in the spellbook
+type PageNotFoundError struct {
+	// Page is the name of the missing page
+	Page string
+	// Line is the magic source line of the use rule
+	Line string
+	// File and LineNumber tell where the use rule was read from, File is
+	// empty if it wasn't read from a file
+	File       string
+	LineNumber int
+}
+
+var _ error = (*PageNotFoundError)(nil)
+
+func (e *PageNotFoundError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("interpreter: %s:%d: page %q not found, used by rule %q", e.File, e.LineNumber, e.Page, e.Line)
+	}
+	return fmt.Sprintf("interpreter: page %q not found, used by rule %q", e.Page, e.Line)
+}
+
+// Is makes errors.Is(err, ErrPageNotFound) work
+func (e *PageNotFoundError) Is(target error) bool {
+	return target == ErrPageNotFound
+}
+
+// BudgetExceededError is returned, along with the matches found so far,
+// when identification stops because it used up its evaluation budget
+type BudgetExceededError struct {
+	// Budget is "rules" for MaxRulesEvaluated, "bytes" for MaxBytesExamined
+	Budget string
+	// Limit is the value of the budget that was exceeded
+	Limit int64
+}
+
+var _ error = (*BudgetExceededError)(nil)
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("interpreter: evaluation budget exceeded (%d %s)", e.Limit, e.Budget)
+}
+
+// Is makes errors.Is(err, ErrBudgetExceeded) work
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// ReadError is reported when reading from the target fails, for any other
+// reason than reading past its end
+type ReadError struct {
+	// Offset is where the read started
+	Offset int64
+	// Err is what the reader returned
+	Err error
+}
+
+var _ error = (*ReadError)(nil)
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("interpreter: reading at %d: %s", e.Offset, e.Err.Error())
+}
+
+// Unwrap returns the error the reader returned
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned along with partial results when identification
+// ran into non-fatal errors. Each of them is inspectable with errors.Is and
+// errors.As, through the MultiError.
+type MultiError struct {
+	Errors []error
+}
+
+var _ error = (*MultiError)(nil)
+
+func (e *MultiError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d errors: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Is makes errors.Is(err, target) work if any of the errors matches target
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As makes errors.As(err, target) work if any of the errors matches target,
+// the first one that does is stored in target
+func (e *MultiError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package interpreter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PageNotFound(t *testing.T) {
+	book := parseBook(t, `
+0	string	AB	letters
+>2	use	missing
+0	string	CD	more letters
+`)
+
+	var warnings []error
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+		Book: book,
+		Warn: func(err error) {
+			warnings = append(warnings, err)
+		},
+	}
+
+	// non-strict mode keeps going
+	result, err := ictx.Identify(newBytesReader([]byte("ABCD")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"letters"}, result)
+	if assert.Len(t, warnings, 1) {
+		assert.True(t, errors.Is(warnings[0], ErrPageNotFound))
+	}
+
+	ictx.Strict = true
+	result, err = ictx.Identify(newBytesReader([]byte("ABCD")))
+	assert.EqualValues(t, []string{"letters"}, result)
+	assert.True(t, errors.Is(err, ErrPageNotFound))
+
+	var pnf *PageNotFoundError
+	if assert.True(t, errors.As(err, &pnf)) {
+		assert.EqualValues(t, "missing", pnf.Page)
+		assert.EqualValues(t, ">2\tuse\tmissing", pnf.Line)
+		assert.EqualValues(t, "", pnf.File)
+		assert.EqualValues(t, `interpreter: page "missing" not found, used by rule ">2\tuse\tmissing"`, pnf.Error())
+	}
+
+	// pages that exist don't trip strict mode
+	_, err = ictx.Identify(newBytesReader([]byte("CD")))
+	assert.NoError(t, err)
+
+	// where the use rule was read from, if it was read from a file
+	pctx := &parser.ParseContext{Logf: t.Logf}
+	sourced := make(parser.Spellbook)
+	assert.NoError(t, pctx.ParseSource("Magdir/letters", strings.NewReader("0\tstring\tAB\tletters\n>2\tuse\tmissing\n"), sourced))
+	ictx.Book = sourced
+	_, err = ictx.Identify(newBytesReader([]byte("ABCD")))
+	if assert.True(t, errors.As(err, &pnf)) {
+		assert.EqualValues(t, "Magdir/letters", pnf.File)
+		assert.EqualValues(t, 2, pnf.LineNumber)
+		assert.EqualValues(t, `interpreter: Magdir/letters:2: page "missing" not found, used by rule ">2\tuse\tmissing"`, pnf.Error())
+	}
+}
+
+func Test_NilAndEmpty(t *testing.T) {
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+	}
+
+	_, err := ictx.Identify(newBytesReader([]byte("AB")))
+	assert.True(t, errors.Is(err, ErrNilBook))
+
+	ictx.Book = parseBook(t, "0\tstring\tAB\tletters\n")
+	_, err = ictx.Identify(nil)
+	assert.True(t, errors.Is(err, ErrNilReader))
+
+	result, err := ictx.Identify(newBytesReader(nil))
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	ictx.Strict = true
+	_, err = ictx.Identify(newBytesReader(nil))
+	assert.True(t, errors.Is(err, ErrReaderTooSmall))
+}
+
+func Test_PartialResults(t *testing.T) {
+	book := parseBook(t, `
+0	name	healthy
+>0	string	CD	\b, healthy page
+
+0	string	AB	letters
+>2	use	missing
+>2	use	healthy
+>0x400	ulong	0	\b, never read
+0	string	ABCD	other tree
+`)
+
+	data := make([]byte, 0x800)
+	copy(data, "ABCD")
+	fr := &failingReader{
+		data:      data,
+		threshold: 0x400,
+	}
+
+	ictx := &InterpretContext{
+		Book:      book,
+		Strict:    true,
+		KeepGoing: true,
+	}
+
+	result, err := ictx.IdentifyReaderAt(fr, int64(len(data)))
+	assert.EqualValues(t, "letters, healthy page\\012- other tree", utils.MergeStrings(result))
+
+	var multi *MultiError
+	if assert.True(t, errors.As(err, &multi)) {
+		assert.Len(t, multi.Errors, 2)
+	}
+
+	var pnf *PageNotFoundError
+	if assert.True(t, errors.As(err, &pnf)) {
+		assert.EqualValues(t, "missing", pnf.Page)
+	}
+
+	var readErr *ReadError
+	if assert.True(t, errors.As(err, &readErr)) {
+		assert.EqualValues(t, 0x400, readErr.Offset)
+	}
+	assert.False(t, errors.Is(err, ErrBudgetExceeded))
+
+	// fatal errors return nothing
+	result, err = ictx.IdentifyReaderAt(nil, 0)
+	assert.Nil(t, result)
+	assert.Equal(t, ErrNilReader, err)
+}
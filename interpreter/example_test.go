@@ -0,0 +1,23 @@
+package interpreter_test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/interpreter"
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+func ExampleInterpretContext_Identify() {
+	book := make(parser.Spellbook)
+	pctx := &parser.ParseContext{Logf: func(format string, args ...interface{}) {}}
+	if err := pctx.Parse(strings.NewReader("0\tstring\t\\x89PNG\tPNG image data\n"), book); err != nil {
+		panic(err)
+	}
+
+	ictx := &interpreter.InterpretContext{Book: book}
+	result, _ := ictx.Identify(utils.NewSliceReaderFromBytes([]byte("\x89PNG\r\n\x1a\n")))
+	fmt.Println(utils.MergeStrings(result))
+	// Output: PNG image data
+}
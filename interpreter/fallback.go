@@ -0,0 +1,20 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// fallbackEmpty describes empty targets
+const fallbackEmpty = "empty"
+
+// fallbackMatch describes a target no rule matched, like file(1) does
+func fallbackMatch(sr *utils.SliceReader) Match {
+	if sr.Size() <= 0 {
+		return Match{Description: fallbackEmpty}
+	}
+
+	return Match{
+		Description: DetectText(sr).String(),
+		Range:       Range{Offset: 0, Length: sr.Size()},
+	}
+}
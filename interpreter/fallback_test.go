@@ -0,0 +1,43 @@
+package interpreter
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FallbackData(t *testing.T) {
+	book := parseBook(t, `
+0	string	\x89PNG	PNG image data
+`)
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(0xfeed)).Read(random)
+	// make sure it's not accidentally a PNG
+	random[0] = 0
+
+	identifyWith := func(fallback bool, target []byte) []string {
+		ictx := &InterpretContext{
+			Book:         book,
+			FallbackData: fallback,
+		}
+		result, err := ictx.Identify(newBytesReader(target))
+		assert.NoError(t, err)
+		return result
+	}
+
+	// off by default
+	assert.Empty(t, identifyWith(false, random))
+	assert.Empty(t, identifyWith(false, []byte{}))
+
+	assert.EqualValues(t, []string{"data"}, identifyWith(true, random))
+	assert.EqualValues(t, []string{"empty"}, identifyWith(true, []byte{}))
+	assert.EqualValues(t, []string{"ASCII text"}, identifyWith(true, []byte("hello\n\tworld\n")))
+	assert.EqualValues(t, []string{"UTF-8 Unicode text, with CRLF line terminators"}, identifyWith(true, []byte("h\xc3\xa9llo\r\n")))
+	// NUL is not text
+	assert.EqualValues(t, []string{"data"}, identifyWith(true, []byte("hello\x00world\n")))
+
+	// only used when nothing matched
+	assert.EqualValues(t, []string{"PNG image data"}, identifyWith(true, []byte("\x89PNG\r\n")))
+}
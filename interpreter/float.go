@@ -0,0 +1,38 @@
+package interpreter
+
+import (
+	"math"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// floatValue reinterprets the bits read by a float test. Floats are widened
+// to float64, which represents them exactly.
+func floatValue(fk *parser.FloatKind, bits uint64) float64 {
+	if fk.ByteWidth == 4 {
+		return float64(math.Float32frombits(uint32(bits)))
+	}
+	return math.Float64frombits(bits)
+}
+
+// floatTest performs the comparison of fk on a value read from the target.
+// Like in file(1), comparisons with NaN are false, except "!", and negative
+// zero equals zero.
+func floatTest(fk *parser.FloatKind, targetValue float64) bool {
+	l := fk.Value
+	if fk.ByteWidth == 4 {
+		l = float64(float32(l))
+	}
+
+	switch fk.FloatTest {
+	case parser.IntegerTestEqual:
+		return targetValue == l
+	case parser.IntegerTestNotEqual:
+		return targetValue != l
+	case parser.IntegerTestLessThan:
+		return targetValue < l
+	case parser.IntegerTestGreaterThan:
+		return targetValue > l
+	}
+	return false
+}
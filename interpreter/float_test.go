@@ -0,0 +1,37 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FloatKind(t *testing.T) {
+	book := parseBook(t, `
+0	befloat	x	float %g
+>0	befloat	=0	\b, zero
+>0	befloat	!1.5	\b, not 1.5
+>0	befloat	<0	\b, negative
+>0	befloat	>0	\b, positive
+>4	ledouble	>100	\b, big double %.1f
+`)
+
+	fk, ok := book[""][0].Kind.Data.(*parser.FloatKind)
+	assert.True(t, ok)
+	assert.EqualValues(t, 4, fk.ByteWidth)
+	assert.EqualValues(t, parser.BigEndian, fk.Endianness)
+	assert.True(t, fk.MatchAny)
+
+	assert.EqualValues(t, "float 1.5, positive", identify(t, book, []byte("\x3f\xc0\x00\x00")))
+	assert.EqualValues(t, "float -2, not 1.5, negative", identify(t, book, []byte("\xc0\x00\x00\x00")))
+
+	// negative zero equals zero
+	assert.EqualValues(t, "float -0, zero, not 1.5", identify(t, book, []byte("\x80\x00\x00\x00")))
+
+	// NaN is only different from everything
+	assert.EqualValues(t, "float NaN, not 1.5", identify(t, book, []byte("\x7f\xc0\x00\x00")))
+
+	assert.EqualValues(t, "float 0, zero, not 1.5, big double 1024.5",
+		identify(t, book, []byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x90\x40")))
+}
@@ -0,0 +1,98 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// formatDescription substitutes the value a rule read for the printf-style
+// conversion in its description, like file(1) does for "%d bytes" or
+// "version %s". Only the first conversion is substituted, "%%" is a literal
+// percent sign. Numbers come from res.Value, and so do dates printed with
+// "%s" and the bits of floats, strings and GUIDs are read from the target
+// at res.Range. Descriptions without a conversion, or rules that didn't read
+// anything, are returned as-is. Escapes are decoded, except for a leading
+// \b, which is kept for MergeStrings.
+func formatDescription(sr *utils.SliceReader, rule *parser.Rule, res *RuleResult) string {
+	text, join := utils.DecodeDescription(string(rule.Description))
+	if join {
+		return utils.DescriptionJoin + formatText(sr, rule, res, text)
+	}
+	return formatText(sr, rule, res, text)
+}
+
+// formatText is formatDescription, for the decoded description text
+func formatText(sr *utils.SliceReader, rule *parser.Rule, res *RuleResult, text string) string {
+	c, ok := utils.ParseConversion(text)
+	if !ok {
+		return c.Prefix
+	}
+
+	if dk, ok := rule.Kind.Data.(*parser.DateKind); ok && res.HasValue && c.Verb == 's' {
+		return c.FormatString(utils.FormatDate(dateValue(dk, res.Value), dk.ByteWidth, dk.Local, dk.Format))
+	}
+
+	if _, ok := rule.Kind.Data.(*parser.GuidKind); ok && c.Verb == 's' {
+		if b := readRange(sr, res.Range); len(b) == utils.GUIDSize {
+			return c.FormatString(utils.FormatGUID(b))
+		}
+		return c.Unformatted()
+	}
+
+	if fk, ok := rule.Kind.Data.(*parser.FloatKind); ok {
+		if res.HasValue {
+			return c.FormatFloat(floatValue(fk, res.Value))
+		}
+		return c.Unformatted()
+	}
+
+	if res.HasValue {
+		return c.FormatInteger(res.Value, signedValue(rule, res.Value))
+	}
+
+	if c.Verb == 's' {
+		b := res.Bytes
+		if b == nil {
+			b = readRange(sr, res.Range)
+		}
+		if b != nil {
+			return c.FormatBytes(b)
+		}
+	}
+	return c.Unformatted()
+}
+
+// signedValue sign-extends values read by signed integer tests
+func signedValue(rule *parser.Rule, value uint64) int64 {
+	if ik, ok := rule.Kind.Data.(*parser.IntegerKind); ok && ik.Signed {
+		return int64(utils.SignExtend(value, ik.ByteWidth))
+	}
+	return int64(value)
+}
+
+// dateValue applies the mask of a date test to the value it read
+func dateValue(dk *parser.DateKind, value uint64) uint64 {
+	if dk.DoAnd {
+		value &= dk.AndValue
+	}
+	return value
+}
+
+// readRange returns the bytes of the target covered by r, up to
+// utils.MaxFormattedString bytes, or nil if they can't be read
+func readRange(sr *utils.SliceReader, r Range) []byte {
+	length := r.Length
+	if length > utils.MaxFormattedString {
+		length = utils.MaxFormattedString
+	}
+	if length <= 0 || r.Offset < 0 {
+		return nil
+	}
+
+	b := make([]byte, length)
+	n, _ := sr.ReadAt(b, r.Offset)
+	if n <= 0 {
+		return nil
+	}
+	return b[:n]
+}
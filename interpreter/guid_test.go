@@ -0,0 +1,29 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GuidKind(t *testing.T) {
+	book := parseBook(t, `
+0	guid	00020906-0000-0000-C000-000000000046	word
+>&0	ubyte	x	\b, then %d
+0	guid	x	class %s
+0	guid	not-a-guid	never
+`)
+	assert.Len(t, book[""], 3)
+
+	gk, ok := book[""][0].Kind.Data.(*parser.GuidKind)
+	assert.True(t, ok)
+	// the first three fields are little-endian
+	assert.EqualValues(t, []byte("\x06\x09\x02\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46"), gk.Value)
+
+	assert.EqualValues(t, "word, then 42", identify(t, book, []byte("\x06\x09\x02\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46\x2a")))
+	assert.EqualValues(t, "class 04030201-0605-0807-090A-0B0C0D0E0F10", identify(t, book, []byte("\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10")))
+
+	// GUIDs cut short don't match
+	assert.EqualValues(t, "", identify(t, book, []byte("\x06\x09\x02\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00")))
+}
@@ -0,0 +1,63 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// integerTest performs the test described by ik on a value read from the
+// target, the same way file(1)'s mconvert and magiccheck do: the mask is
+// applied first, then the adjustment, both in unsigned arithmetic truncated
+// to the width of the test. Only then are both sides sign-extended (for
+// signed tests) and compared.
+func integerTest(ik *parser.IntegerKind, targetValue uint64) bool {
+	v := targetValue
+
+	if ik.DoAnd {
+		v &= ik.AndValue
+	}
+	v = utils.TruncateUint(v, ik.ByteWidth)
+
+	adjustment := utils.TruncateUint(uint64(ik.AdjustmentValue), ik.ByteWidth)
+	switch ik.AdjustmentType {
+	case parser.AdjustmentAdd:
+		v += adjustment
+	case parser.AdjustmentSub:
+		v -= adjustment
+	case parser.AdjustmentMul:
+		v *= adjustment
+	case parser.AdjustmentDiv:
+		if adjustment == 0 {
+			return false
+		}
+		v /= adjustment
+	}
+	v = utils.TruncateUint(v, ik.ByteWidth)
+
+	l := utils.TruncateUint(uint64(ik.Value), ik.ByteWidth)
+
+	if ik.Signed {
+		v = utils.SignExtend(v, ik.ByteWidth)
+		l = utils.SignExtend(l, ik.ByteWidth)
+	}
+
+	switch ik.IntegerTest {
+	case parser.IntegerTestEqual:
+		return v == l
+	case parser.IntegerTestNotEqual:
+		return v != l
+	case parser.IntegerTestLessThan:
+		if ik.Signed {
+			return int64(v) < int64(l)
+		}
+		return v < l
+	case parser.IntegerTestGreaterThan:
+		if ik.Signed {
+			return int64(v) > int64(l)
+		}
+		return v > l
+	case parser.IntegerTestAnd:
+		return v&l == l
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IntegerOrdering(t *testing.T) {
+	cases := []struct {
+		line     string
+		target   []byte
+		expected bool
+	}{
+		// the mask is applied before sign extension, so the result is negative
+		{"0\tbyte&0xf0\t<0x20\tmatch", []byte{0xf5}, true},
+		// adjustments wrap around at the width of the test
+		{"0\tubyte+16\t0x05\tmatch", []byte{0xf5}, true},
+		{"0\tuleshort*2\t0x0002\tmatch", []byte{0x01, 0x80}, true},
+		// mask, then adjust
+		{"0\tubyte/4&0xf0\t0x0c\tmatch", []byte{0x3f}, true},
+		{"0\tubyte/4&0xf0\t0x0f\tmatch", []byte{0x3f}, false},
+		// signed values are compared after sign extension
+		{"0\tbyte\t-1\tmatch", []byte{0xff}, true},
+		{"0\tbeshort\t-2\tmatch", []byte{0xff, 0xfe}, true},
+		{"0\tbelong\t<0\tmatch", []byte{0x80, 0x00, 0x00, 0x00}, true},
+		{"0\tubelong\t<0\tmatch", []byte{0x80, 0x00, 0x00, 0x00}, false},
+		// like the ELF and mach-o flags tests
+		{"0\tleshort&0xff00\t0x3e00\tmatch", []byte{0x12, 0x3e}, true},
+		{"0\tulelong\t&0x00010000\tmatch", []byte{0x00, 0x00, 0x03, 0x00}, true},
+		{"0\tulelong\t&0x00010000\tmatch", []byte{0x00, 0x00, 0x02, 0x00}, false},
+		// division by zero never matches
+		{"0\tubyte/0\tx\tmatch", []byte{0x00}, true},
+		{"0\tubyte/0\t0\tmatch", []byte{0x00}, false},
+	}
+
+	for _, c := range cases {
+		book := parseBook(t, c.line)
+		expected := ""
+		if c.expected {
+			expected = "match"
+		}
+		assert.EqualValues(t, expected, identify(t, book, c.target), "for %q on %x", c.line, c.target)
+	}
+}
@@ -1,63 +1,441 @@
 package interpreter
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"io"
+	"sync/atomic"
 
 	"github.com/9uanhuo/wizardry/parser"
 	"github.com/9uanhuo/wizardry/utils"
 )
 
-// MaxLevels is the maximum level of magic rules that are interpreted
+// MaxLevels is how deep the rules of a page can go before the interpreter
+// needs to allocate to keep track of their levels. Deeper pages work too.
 const MaxLevels = 32
 
+// DefaultKeepGoingSeparator separates the output of top-level rules
+// when KeepGoing is set. The leading \b swallows the space MergeStrings
+// would insert before it.
+const DefaultKeepGoingSeparator = `\b\012-`
+
+// initialMatchesCap is the capacity results start with, most identifications
+// only produce a few fragments
+const initialMatchesCap = 8
+
 // LogFunc logs something somewhere
 type LogFunc func(format string, args ...interface{})
 
+// WarnFunc receives non-fatal errors
+type WarnFunc func(err error)
+
+// StringTestFunc performs string tests, see utils.StringTest
+type StringTestFunc func(sr *utils.SliceReader, targetIndex int64, pattern string, flags utils.StringTestFlags) int64
+
+// SearchTestFunc performs search tests, see utils.SearchTest
+type SearchTestFunc func(sr *utils.SliceReader, targetIndex int64, maxLen int64, pattern string, flags utils.StringTestFlags) (int64, int64)
+
 // InterpretContext holds state for the interpreter
 type InterpretContext struct {
+	// Logf receives a trace of the evaluation, it may be nil. Leaving it nil
+	// avoids formatting anything, which matters when identifying many files.
 	Logf LogFunc
 	Book parser.Spellbook
+
+	// Tracer receives the same trace as structured events, it may be nil
+	Tracer Tracer
+
+	// StringTest and SearchTest replace the implementations of string and
+	// search tests, to stub them out or try faster ones. When nil, the ones
+	// from utils are used, search tests through the finders of their
+	// rules, prepared once. Flags passed to them may say what the target
+	// looks like, see utils.TextTarget.
+	StringTest StringTestFunc
+	SearchTest SearchTestFunc
+
+	// DeduplicateFragments drops fragments that repeat the previous one, or
+	// that were already produced by the same rule, as happens when several
+	// sibling rules use the same page
+	DeduplicateFragments bool
+
+	// Strict makes authoring mistakes, like using a page that doesn't
+	// exist, part of the errors Identify returns. Otherwise, they're only
+	// passed to Warn. Either way, identification goes on with the rest of
+	// the rules.
+	Strict bool
+	Warn   WarnFunc
+
+	// MaxSearchBytes caps the range of search rules, where their matches
+	// may start, regardless of the range they ask for. 0 means unlimited.
+	MaxSearchBytes int64
+
+	// ExcludeFamilies lists kinds of tests that are never performed, like
+	// file -e: excluded rules don't match, and neither do their children
+	ExcludeFamilies []parser.KindFamily
+	// ExcludeIndirect excludes rules with indirect offsets in the same way
+	ExcludeIndirect bool
+
+	// FallbackData makes identification always produce something, like
+	// file(1): "empty" for empty targets, a description of the encoding for
+	// targets that look like text (see DetectText), and "data" for
+	// everything else, when no rule matched
+	FallbackData bool
+
+	// KeepGoing evaluates every top-level rule, like file -k. By default,
+	// identification stops after the first top-level rule that produces
+	// output, along with its children.
+	KeepGoing bool
+	// KeepGoingSeparator is the fragment inserted between the output of
+	// top-level rules with KeepGoing. It defaults to file's "\012- ", which
+	// is DefaultKeepGoingSeparator once merged with utils.MergeStrings.
+	KeepGoingSeparator string
+
+	// MaxRulesEvaluated and MaxBytesExamined bound the work a single
+	// identification may do, so pathological rules or targets can't take
+	// forever. When either is exceeded, identification stops and returns
+	// the matches found so far along with a *BudgetExceededError. Bytes
+	// examined include the whole range scanned by search rules. 0 means
+	// unlimited.
+	MaxRulesEvaluated int
+	MaxBytesExamined  int64
+
+	// CollectStats counts evaluated and matched rules, see Stats
+	CollectStats bool
+
+	// stats holds the *statsCollector, created on first use. It's not a
+	// sync.Once so that contexts can still be copied by value.
+	stats atomic.Value
 }
 
-// Identify follows the rules in a spellbook to find out the type of a file
+// Range is a span of bytes in the target
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Match is a description fragment produced by a rule that matched, along
+// with the bytes its test examined
+type Match struct {
+	Description string
+
+	// Line is the magic source line of the rule that produced the fragment
+	Line string
+
+	// Range covers the bytes read for integer tests, and the bytes that
+	// matched for string, search and regex tests
+	Range
+
+	// Dereferences covers the bytes read to resolve an indirect offset, if any
+	Dereferences []Range
+
+	// Breadcrumb lists the pages that led to the rule, starting with the
+	// top-level page "", e.g. ["", "riff-walk", "wave-chunks"]
+	Breadcrumb []string
+
+	// MIME is the type given by a "!:mime" line after the rule, if any.
+	// Rules without a description don't produce matches, so their MIME
+	// type is ignored.
+	MIME string
+
+	// rule is the rule that produced the fragment, which DeduplicateFragments
+	// tells matches apart by
+	rule *parser.Rule
+}
+
+// Identify follows the rules in a spellbook to find out the type of a file.
+//
+// Only a few conditions are fatal and return no result at all: a nil
+// spellbook, a nil target, and an empty target in Strict mode. Anything
+// else that goes wrong along the way (reads that fail for another reason
+// than reaching the end of the target, pages that don't exist in Strict
+// mode, running out of evaluation budget) is collected, and returned as a
+// *MultiError along with the descriptions found anyway.
 func (ctx *InterpretContext) Identify(sr *utils.SliceReader) ([]string, error) {
-	outStrings, err := ctx.identifyInternal(sr, 0, "", false)
-	if err != nil {
-		return nil, err
+	st := acquireIdentifyState()
+	defer st.release()
+
+	// only descriptions come out of here, breadcrumbs would be thrown away
+	matches, err := ctx.identifyMatches(st, sr, false)
+	return descriptions(matches), err
+}
+
+// descriptions returns the description of every match, or nil if there
+// are none
+func descriptions(matches []Match) []string {
+	if len(matches) == 0 {
+		return nil
 	}
 
-	return outStrings, nil
+	outStrings := make([]string, 0, len(matches))
+	for _, m := range matches {
+		outStrings = append(outStrings, m.Description)
+	}
+	return outStrings
 }
 
-func (ctx *InterpretContext) identifyInternal(sr *utils.SliceReader, pageOffset int64, page string, swapEndian bool) ([]string, error) {
-	var outStrings []string
+// MIMEType returns the MIME type of the first tree of matches: the type of
+// the matching top-level rule, overridden by deeper rules that have their
+// own. It returns "" if none of them has a MIME type.
+func MIMEType(matches []Match) string {
+	mime := ""
+	for _, m := range matches {
+		if m.Line == "" {
+			// separator between trees, or fallback
+			break
+		}
+		if m.MIME != "" {
+			mime = m.MIME
+		}
+	}
+	return mime
+}
+
+// IdentifyReaderAt is like Identify, for targets that are not wrapped in a
+// SliceReader. Reads that come back short or fail partway through make the
+// rules that need those bytes fail, they don't abort identification. Failed
+// reads are reported as a *ReadError in the returned *MultiError.
+func (ctx *InterpretContext) IdentifyReaderAt(r io.ReaderAt, size int64) ([]string, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
 
-	matchedLevels := make([]bool, MaxLevels)
-	everMatchedLevels := make([]bool, MaxLevels)
-	globalOffset := int64(0)
+	return ctx.Identify(utils.NewSliceReader(r, 0, size))
+}
 
-	ctx.Logf("|====> identifying at %d using page %s (%d rules)", pageOffset, page, len(ctx.Book[page]))
+// IdentifyMatches is like Identify, but also reports which bytes each
+// matching rule examined
+func (ctx *InterpretContext) IdentifyMatches(sr *utils.SliceReader) ([]Match, error) {
+	st := acquireIdentifyState()
+	defer st.release()
 
-	if page != "" {
-		matchedLevels[0] = true
-		everMatchedLevels[0] = true
+	return ctx.identifyMatches(st, sr, true)
+}
+
+// identifyMatches does the work of IdentifyMatches with a given state, which
+// is reset before returning so it can be reused. Matches only get a
+// breadcrumb if breadcrumbs is set.
+func (ctx *InterpretContext) identifyMatches(st *identifyState, sr *utils.SliceReader, breadcrumbs bool) ([]Match, error) {
+	if ctx.Book == nil {
+		return nil, ErrNilBook
 	}
 
-	for _, rule := range ctx.Book[page] {
-		stopProcessing := false
+	if sr == nil {
+		return nil, ErrNilReader
+	}
 
-		// if any of the deeper levels have ever matched, stop working
-		for l := rule.Level + 1; l < len(matchedLevels); l++ {
-			if everMatchedLevels[l] {
-				stopProcessing = true
-				break
-			}
+	if sr.Size() <= 0 {
+		err := ctx.warn(ErrReaderTooSmall)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	defer st.reset()
+	ctx.prepareState(st)
+	st.breadcrumbs = breadcrumbs
+
+	matches := ctx.identifyInternal(st, sr, 0, "", false)
+
+	if ctx.DeduplicateFragments {
+		matches = deduplicateMatches(matches)
+	}
 
-		if stopProcessing {
+	err := st.err()
+	if len(matches) == 0 && ctx.FallbackData && err == nil {
+		matches = append(matches, fallbackMatch(sr))
+	}
+
+	return matches, err
+}
+
+// prepareState sets up st for an evaluation with the settings of ctx
+func (ctx *InterpretContext) prepareState(st *identifyState) {
+	if ctx.CollectStats {
+		st.stats = ctx.collector()
+	}
+	st.tracer = ctx.tracer()
+
+	st.stringTest = ctx.StringTest
+	if st.stringTest == nil {
+		st.stringTest = utils.StringTest
+	}
+	st.searchTest = ctx.SearchTest
+}
+
+func (ctx *InterpretContext) isExcluded(rule parser.Rule) bool {
+	if ctx.ExcludeIndirect && rule.Offset.OffsetType == parser.OffsetTypeIndirect {
+		return true
+	}
+
+	for _, family := range ctx.ExcludeFamilies {
+		if rule.Kind.Family == family {
+			return true
+		}
+	}
+	return false
+}
+
+// separateTrees inserts KeepGoingSeparator at the given boundaries
+// between the output of top-level rules
+func (ctx *InterpretContext) separateTrees(matches []Match, boundaries []int) []Match {
+	separator := ctx.KeepGoingSeparator
+	if separator == "" {
+		separator = DefaultKeepGoingSeparator
+	}
+
+	result := make([]Match, 0, len(matches)+len(boundaries))
+	start := 0
+	for _, boundary := range boundaries {
+		if boundary == len(matches) {
+			// nothing came after
 			break
 		}
+		result = append(result, matches[start:boundary]...)
+		result = append(result, Match{Description: separator})
+		start = boundary
+	}
+	return append(result, matches[start:]...)
+}
+
+// checkBudget returns an error once the evaluation budget is spent
+func (ctx *InterpretContext) checkBudget(st *identifyState) error {
+	if ctx.MaxRulesEvaluated > 0 && st.rulesEvaluated >= ctx.MaxRulesEvaluated {
+		return &BudgetExceededError{Budget: "rules", Limit: int64(ctx.MaxRulesEvaluated)}
+	}
+	if ctx.MaxBytesExamined > 0 && st.bytesExamined > ctx.MaxBytesExamined {
+		return &BudgetExceededError{Budget: "bytes", Limit: ctx.MaxBytesExamined}
+	}
+	return nil
+}
+
+// warn returns err in strict mode, and passes it to Warn otherwise
+func (ctx *InterpretContext) warn(err error) error {
+	if ctx.Strict {
+		return err
+	}
+
+	ctx.logf("warning: %s", err.Error())
+	if ctx.Warn != nil {
+		ctx.Warn(err)
+	}
+	return nil
+}
+
+// warnState is like warn, except errors are recorded in st in strict mode,
+// so identification goes on
+func (ctx *InterpretContext) warnState(st *identifyState, err error) {
+	if warnErr := ctx.warn(err); warnErr != nil {
+		st.fail(warnErr)
+	}
+}
+
+// logf is for cold paths, hot paths check Logf themselves so that
+// arguments aren't boxed for nothing
+func (ctx *InterpretContext) logf(format string, args ...interface{}) {
+	if ctx.Logf != nil {
+		ctx.Logf(format, args...)
+	}
+}
+
+func deduplicateMatches(matches []Match) []Match {
+	type fragment struct {
+		rule        *parser.Rule
+		description string
+	}
+	seen := make(map[fragment]bool)
+
+	var result []Match
+	for _, m := range matches {
+		if len(result) > 0 && result[len(result)-1].Description == m.Description {
+			continue
+		}
+
+		f := fragment{m.rule, m.Description}
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+
+		result = append(result, m)
+	}
+	return result
+}
+
+// pageLevels returns how many levels the rules of a page use
+func pageLevels(rules []parser.Rule) int {
+	levels := 0
+	for _, rule := range rules {
+		if rule.Level >= levels {
+			levels = rule.Level + 1
+		}
+	}
+	return levels
+}
+
+// identifyInternal evaluates the rules of a page at pageOffset. Errors are
+// recorded in st, if the evaluation budget runs out, the matches found so
+// far are returned and st.stopped is set.
+func (ctx *InterpretContext) identifyInternal(st *identifyState, sr *utils.SliceReader, pageOffset int64, page string, swapEndian bool) []Match {
+	var outMatches []Match
+
+	// pages rarely go deeper than MaxLevels, those that do need more room
+	var matchedBuf, everMatchedBuf [MaxLevels]bool
+	matchedLevels, everMatchedLevels := matchedBuf[:], everMatchedBuf[:]
+	if levels := pageLevels(ctx.Book[page]); levels > MaxLevels {
+		matchedLevels = make([]bool, levels)
+		everMatchedLevels = make([]bool, levels)
+	}
+	// globalOffset is the absolute offset right after the last match, rules
+	// at the start of a page are relative to the page itself
+	globalOffset := pageOffset
+	tracer := st.tracer
+	rules := ctx.Book[page]
+
+	st.crumbs = append(st.crumbs, page)
+	defer func() {
+		st.crumbs = st.crumbs[:len(st.crumbs)-1]
+	}()
+	// shared by all the matches of this evaluation, built on first match
+	var breadcrumb []string
+
+	stats := st.stats
+	var pageCounters *counters
+	if stats != nil {
+		pageCounters = stats.page(page)
+		atomic.AddInt64(&pageCounters.entered, 1)
+	}
+
+	if tracer != nil {
+		tracer.PageEntered(PageEvent{
+			Page:       page,
+			Offset:     pageOffset,
+			SwapEndian: swapEndian,
+			Depth:      st.depth,
+			NumRules:   len(rules),
+		})
+	}
+
+	if page != "" {
+		matchedLevels[0] = true
+		everMatchedLevels[0] = true
+	}
+
+	// where the output of the current top-level rule starts, and where
+	// separators go between the output of top-level rules with KeepGoing
+	treeStart := 0
+	var treeBoundaries []int
+
+	for ruleIndex, rule := range rules {
+		if page == "" && rule.Level == 0 {
+			if len(outMatches) > treeStart {
+				// the previous top-level rule (or its children) produced output
+				if !ctx.KeepGoing {
+					break
+				}
+				treeBoundaries = append(treeBoundaries, len(outMatches))
+			}
+			treeStart = len(outMatches)
+		}
 
 		skipRule := false
 		for l := 0; l < rule.Level; l++ {
@@ -72,226 +450,226 @@ func (ctx *InterpretContext) identifyInternal(sr *utils.SliceReader, pageOffset
 			continue
 		}
 
-		lookupOffset := int64(0)
-
-		ctx.Logf("| %s", rule)
+		if ctx.isExcluded(rule) {
+			// excluded rules never match, so their children are skipped too
+			matchedLevels[rule.Level] = false
+			if tracer != nil {
+				tracer.RuleEvaluated(RuleEvent{
+					Page:    page,
+					Depth:   st.depth,
+					Rule:    &rules[ruleIndex],
+					Outcome: OutcomeExcluded,
+				})
+			}
+			continue
+		}
 
-		switch rule.Offset.OffsetType {
-		case parser.OffsetTypeIndirect:
-			indirect := rule.Offset.Indirect
-			offsetAddress := indirect.OffsetAddress
+		if st.stopped {
+			return outMatches
+		}
+		if err := ctx.checkBudget(st); err != nil {
+			ctx.logf("%s, stopping", err.Error())
+			st.fail(err)
+			st.stopped = true
+			return outMatches
+		}
+		st.rulesEvaluated++
 
-			if indirect.IsRelative {
-				offsetAddress += int64(globalOffset)
-			}
+		var lookupOffset int64
 
-			readAddress, err := readAnyUint(sr, int(offsetAddress), indirect.ByteWidth, indirect.Endianness.MaybeSwapped(swapEndian))
-			if err != nil {
-				ctx.Logf("Error while dereferencing: %s - skipping rule", err.Error())
-				continue
+		// readFailed is for rules that can't be tested at all
+		readFailed := func(err error) {
+			var readErr *ReadError
+			if errors.As(err, &readErr) {
+				st.fail(err)
 			}
-			lookupOffset = int64(readAddress)
-
-			offsetAdjustValue := indirect.OffsetAdjustmentValue
-			if indirect.OffsetAdjustmentIsRelative {
-				offsetAdjustAddress := int64(offsetAddress) + offsetAdjustValue
-				readAdjustAddress, err := readAnyUint(sr, int(offsetAdjustAddress), indirect.ByteWidth, indirect.Endianness)
-				if err != nil {
-					ctx.Logf("Error while dereferencing: %s - skipping rule", err.Error())
-					continue
-				}
-				offsetAdjustValue = int64(readAdjustAddress)
+			if stats != nil {
+				stats.readFailed()
 			}
-
-			switch indirect.OffsetAdjustmentType {
-			case parser.AdjustmentAdd:
-				lookupOffset = lookupOffset + offsetAdjustValue
-			case parser.AdjustmentSub:
-				lookupOffset = lookupOffset - offsetAdjustValue
-			case parser.AdjustmentMul:
-				lookupOffset = lookupOffset * offsetAdjustValue
-			case parser.AdjustmentDiv:
-				lookupOffset = lookupOffset / offsetAdjustValue
+			if tracer != nil {
+				tracer.RuleEvaluated(RuleEvent{
+					Page:    page,
+					Depth:   st.depth,
+					Rule:    &rules[ruleIndex],
+					Offset:  lookupOffset,
+					Outcome: OutcomeReadFailed,
+					Err:     err,
+				})
 			}
-
-		case parser.OffsetTypeDirect:
-			lookupOffset = rule.Offset.Direct + pageOffset
 		}
 
-		if rule.Offset.IsRelative {
-			lookupOffset += globalOffset
+		lookupOffset, derefs, err := resolveRuleOffset(st, sr, &rules[ruleIndex], pageOffset, globalOffset, swapEndian)
+		if err != nil {
+			readFailed(err)
+			continue
 		}
 
-		if lookupOffset < 0 || lookupOffset >= sr.Size() {
-			ctx.Logf("we done goofed, lookupOffset %d is out of bounds, skipping %#v", lookupOffset, rule)
-			continue
+		if stats != nil {
+			stats.ruleEvaluated(pageCounters, rule.Kind.Family)
 		}
 
-		success := false
+		res := RuleResult{
+			Offset:       lookupOffset,
+			Range:        Range{Offset: lookupOffset},
+			Dereferences: derefs,
+		}
+		outcome := OutcomeNotMatched
 
 		switch rule.Kind.Family {
-		case parser.KindFamilyInteger:
-			ik, _ := rule.Kind.Data.(*parser.IntegerKind)
-
-			if ik.MatchAny {
-				success = true
-			} else {
-				targetValue, err := readAnyUint(sr, int(lookupOffset), ik.ByteWidth, ik.Endianness)
-				if err != nil {
-					ctx.Logf("in integer test, while reading target value: %s", err.Error())
-					continue
-				}
-
-				if ik.DoAnd {
-					targetValue &= ik.AndValue
-				}
-
-				switch ik.AdjustmentType {
-				case parser.AdjustmentAdd:
-					targetValue = uint64(int64(targetValue) + ik.AdjustmentValue)
-				case parser.AdjustmentSub:
-					targetValue = uint64(int64(targetValue) - ik.AdjustmentValue)
-				case parser.AdjustmentMul:
-					targetValue = uint64(int64(targetValue) * ik.AdjustmentValue)
-				case parser.AdjustmentDiv:
-					targetValue = uint64(int64(targetValue) / ik.AdjustmentValue)
-				}
-
-				switch ik.IntegerTest {
-				case parser.IntegerTestEqual:
-					success = targetValue == uint64(ik.Value)
-				case parser.IntegerTestNotEqual:
-					success = targetValue != uint64(ik.Value)
-				case parser.IntegerTestLessThan:
-					if ik.Signed {
-						switch ik.ByteWidth {
-						case 1:
-							success = int8(targetValue) < int8(ik.Value)
-						case 2:
-							success = int16(targetValue) < int16(ik.Value)
-						case 4:
-							success = int32(targetValue) < int32(ik.Value)
-						case 8:
-							success = int64(targetValue) < int64(ik.Value)
-						}
-					} else {
-						success = targetValue < uint64(ik.Value)
-					}
-				case parser.IntegerTestGreaterThan:
-					if ik.Signed {
-						switch ik.ByteWidth {
-						case 1:
-							success = int8(targetValue) > int8(ik.Value)
-						case 2:
-							success = int16(targetValue) > int16(ik.Value)
-						case 4:
-							success = int32(targetValue) > int32(ik.Value)
-						case 8:
-							success = int64(targetValue) > int64(ik.Value)
-						}
-					} else {
-						success = targetValue > uint64(ik.Value)
-					}
-				}
-
-				if success {
-					globalOffset = lookupOffset + int64(ik.ByteWidth)
-				}
+		case parser.KindFamilyInteger, parser.KindFamilyString, parser.KindFamilySearch,
+			parser.KindFamilyDer, parser.KindFamilyOctal, parser.KindFamilyRegex, parser.KindFamilyDate,
+			parser.KindFamilyFloat, parser.KindFamilyPString, parser.KindFamilyString16,
+			parser.KindFamilyGuid:
+			err = ctx.testRule(st, sr, &rules[ruleIndex], swapEndian, &res)
+			if err != nil {
+				readFailed(err)
+				continue
 			}
 
-		case parser.KindFamilyString:
-			sk, _ := rule.Kind.Data.(*parser.StringKind)
-
-			matchLen := utils.StringTest(sr, lookupOffset, string(sk.Value), sk.Flags)
-			success = matchLen >= 0
-
-			if sk.Negate {
-				success = !success
-			} else {
-				if success {
-					globalOffset = lookupOffset + int64(matchLen)
-				}
+			if res.Matched {
+				globalOffset = res.NextOffset
 			}
 
-		case parser.KindFamilySearch:
-			sk, _ := rule.Kind.Data.(*parser.SearchKind)
-
-			matchPos := utils.SearchTest(sr, lookupOffset, sk.MaxLen, string(sk.Value))
-			success = matchPos >= 0
-
-			if success {
-				globalOffset = lookupOffset + matchPos + int64(len(sk.Value))
-			}
+		case parser.KindFamilyName:
+			// name rules start a page, they always succeed
+			res.Matched = true
 
 		case parser.KindFamilyDefault:
 			// default tests match if nothing has matched before
 			if !everMatchedLevels[rule.Level] {
-				success = true
+				res.Matched = true
 			}
 
 		case parser.KindFamilyUse:
 			uk, _ := rule.Kind.Data.(*parser.UseKind)
 
-			ctx.Logf("|====> using %s", uk.Page)
+			if _, ok := ctx.Book[uk.Page]; !ok {
+				err = &PageNotFoundError{
+					Page:       uk.Page,
+					Line:       rule.Line,
+					File:       rule.SourceFile,
+					LineNumber: rule.SourceLine,
+				}
+				ctx.warnState(st, err)
+				break
+			}
 
-			subStrings, err := ctx.identifyInternal(sr, lookupOffset, uk.Page, uk.SwapEndian)
-			if err != nil {
-				return nil, err
+			// swapping inside a swapped page brings us back to normal
+			key := memoKey{
+				page:       uk.Page,
+				offset:     lookupOffset,
+				swapEndian: swapEndian != uk.SwapEndian,
 			}
-			outStrings = append(outStrings, subStrings...)
+
+			subMatches, ok := st.recall(key)
+			outcome = OutcomeUsed
+			if ok {
+				outcome = OutcomeReused
+			}
+
+			if tracer != nil {
+				tracer.RuleEvaluated(RuleEvent{
+					Page:    page,
+					Depth:   st.depth,
+					Rule:    &rules[ruleIndex],
+					Offset:  lookupOffset,
+					Outcome: outcome,
+				})
+			}
+
+			if !ok {
+				st.depth++
+				subMatches = ctx.identifyInternal(st, sr, key.offset, key.page, key.swapEndian)
+				st.depth--
+				if st.stopped {
+					// keep what the page found before running out
+					return append(outMatches, subMatches...)
+				}
+				st.remember(key, subMatches)
+			}
+			outMatches = append(outMatches, subMatches...)
 
 		case parser.KindFamilyClear:
 			everMatchedLevels[rule.Level] = false
 		}
 
-		if success {
-			descString := string(rule.Description)
+		if res.Matched {
+			outcome = OutcomeMatched
 
-			ctx.Logf("|==========> rule matched!")
+			if stats != nil {
+				stats.ruleMatched(pageCounters, rule.Kind.Family)
+			}
 
-			if descString != "" {
-				outStrings = append(outStrings, descString)
+			if len(rule.Description) > 0 {
+				if outMatches == nil {
+					outMatches = make([]Match, 0, initialMatchesCap)
+				}
+				if breadcrumb == nil && st.breadcrumbs {
+					breadcrumb = st.breadcrumb()
+				}
+				if bytes.IndexByte(rule.Description, '%') >= 0 {
+					readMatchAnyValue(sr, &rules[ruleIndex], swapEndian, &res)
+				}
+				outMatches = append(outMatches, Match{
+					Description:  formatDescription(sr, &rules[ruleIndex], &res),
+					Line:         rule.Line,
+					Range:        res.Range,
+					Dereferences: derefs,
+					Breadcrumb:   breadcrumb,
+					MIME:         rule.MIME,
+					rule:         &rules[ruleIndex],
+				})
 			}
 			matchedLevels[rule.Level] = true
 			everMatchedLevels[rule.Level] = true
+			if rule.Level+1 < len(everMatchedLevels) {
+				// children start a new group for default and clear
+				everMatchedLevels[rule.Level+1] = false
+			}
 		} else {
 			matchedLevels[rule.Level] = false
 		}
-	}
 
-	ctx.Logf("|====> done identifying at %d using page %s (%d rules)", pageOffset, page, len(ctx.Book[page]))
-
-	return outStrings, nil
-}
+		// use rules that did use a page were traced before evaluating it
+		if tracer != nil && outcome != OutcomeUsed && outcome != OutcomeReused {
+			tracer.RuleEvaluated(RuleEvent{
+				Page:     page,
+				Depth:    st.depth,
+				Rule:     &rules[ruleIndex],
+				Offset:   lookupOffset,
+				Value:    res.Value,
+				HasValue: res.HasValue,
+				Outcome:  outcome,
+				Err:      err,
+			})
+		}
+	}
 
-func readAnyUint(sr *utils.SliceReader, j int, byteWidth int, endianness parser.Endianness) (uint64, error) {
-	if int64(j+byteWidth) > sr.Size() {
-		return 0, io.EOF
+	if len(treeBoundaries) > 0 {
+		outMatches = ctx.separateTrees(outMatches, treeBoundaries)
 	}
 
-	intBytes := make([]byte, byteWidth)
-	n, err := sr.ReadAt(intBytes, int64(j))
-	if n < byteWidth {
-		if err != nil && err != io.EOF {
-			return 0, err
-		}
-		return 0, io.EOF
+	if tracer != nil {
+		tracer.PageLeft(PageEvent{
+			Page:       page,
+			Offset:     pageOffset,
+			SwapEndian: swapEndian,
+			Depth:      st.depth,
+			NumRules:   len(rules),
+		})
 	}
 
-	var ret uint64
+	return outMatches
+}
 
-	switch byteWidth {
-	case 1:
-		ret = uint64(intBytes[0])
-	case 2:
-		ret = uint64(endianness.ByteOrder().Uint16(intBytes))
-	case 4:
-		ret = uint64(endianness.ByteOrder().Uint32(intBytes))
-	case 8:
-		ret = uint64(endianness.ByteOrder().Uint64(intBytes))
-	default:
-		return 0, fmt.Errorf("dunno how to read an uint of %d bytes", byteWidth)
+// readUint reads an unsigned integer of byteWidth bytes at offset j, with
+// utils.ReadUintErr. Reads that would extend past the end of sr return
+// io.EOF, reads before its start utils.ErrNegativeOffset, and other
+// failures are reported as a *ReadError.
+func readUint(sr *utils.SliceReader, j int64, byteWidth int, endianness parser.Endianness) (uint64, error) {
+	v, err := utils.ReadUintErr(sr, j, byteWidth, endianness.ByteOrder())
+	if err != nil && err != io.EOF && err != utils.ErrNegativeOffset {
+		return 0, &ReadError{Offset: j, Err: err}
 	}
-
-	return ret, nil
+	return v, err
 }
@@ -0,0 +1,788 @@
+package interpreter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseBook(t testing.TB, magic string) parser.Spellbook {
+	pctx := &parser.ParseContext{
+		Logf: func(format string, args ...interface{}) {},
+	}
+
+	book := make(parser.Spellbook)
+	err := pctx.Parse(strings.NewReader(magic), book)
+	assert.NoError(t, err)
+	return book
+}
+
+func newBytesReader(target []byte) *utils.SliceReader {
+	return utils.NewSliceReader(bytes.NewReader(target), 0, int64(len(target)))
+}
+
+func identify(t testing.TB, book parser.Spellbook, target []byte) string {
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+		Book: book,
+	}
+
+	result, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	return utils.MergeStrings(result)
+}
+
+func Test_ReadUint(t *testing.T) {
+	sr := newBytesReader([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+
+	v, err := readUint(sr, 0, 2, parser.LittleEndian)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x0201, v)
+
+	v, err = readUint(sr, 2, 4, parser.BigEndian)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x03040506, v)
+
+	v, err = readUint(sr, 5, 1, parser.BigEndian)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x06, v)
+
+	// straddles the end
+	_, err = readUint(sr, sr.Size()-1, 2, parser.LittleEndian)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = readUint(sr, sr.Size()-4, 8, parser.LittleEndian)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = readUint(sr, -1, 1, parser.LittleEndian)
+	assert.Equal(t, utils.ErrNegativeOffset, err)
+
+	_, err = readUint(sr, 0, 3, parser.LittleEndian)
+	assert.Error(t, err)
+
+	// signed
+	i, ok := utils.ReadInt(sr, 0, 2, binary.BigEndian)
+	assert.True(t, ok)
+	assert.EqualValues(t, 0x0102, i)
+	i, ok = utils.ReadInt(newBytesReader([]byte{0xff, 0xfe}), 0, 2, binary.BigEndian)
+	assert.True(t, ok)
+	assert.EqualValues(t, -2, i)
+	_, ok = utils.ReadInt(sr, 5, 2, binary.BigEndian)
+	assert.False(t, ok)
+}
+
+func Test_ReadUintTails(t *testing.T) {
+	data := []byte{0x81, 0x02, 0x83, 0x04, 0x85, 0x06, 0x87, 0x08, 0x89, 0x0a, 0x8b}
+
+	// expected reads data[start:] at off like it should be read
+	expected := func(start int64, off int64, width int, bo binary.ByteOrder) (uint64, bool) {
+		window := data[start:]
+		if off < 0 || off+int64(width) > int64(len(window)) {
+			return 0, false
+		}
+		var b [8]byte
+		copy(b[:], window[off:off+int64(width)])
+		switch width {
+		case 1:
+			return uint64(b[0]), true
+		case 2:
+			return uint64(bo.Uint16(b[:])), true
+		case 4:
+			return uint64(bo.Uint32(b[:])), true
+		}
+		return bo.Uint64(b[:]), true
+	}
+
+	readers := map[string]func() *utils.SliceReader{
+		"reader": func() *utils.SliceReader { return newBytesReader(data) },
+		"bytes":  func() *utils.SliceReader { return utils.NewSliceReaderFromBytes(data) },
+		"caching": func() *utils.SliceReader {
+			return utils.NewCachingSliceReader(bytes.NewReader(data), int64(len(data)), 3)
+		},
+	}
+	for name, newReader := range readers {
+		for start := int64(0); start <= int64(len(data)); start++ {
+			sr := newReader().Slice(start)
+			for _, width := range []int{1, 2, 4, 8} {
+				for _, endianness := range []parser.Endianness{parser.LittleEndian, parser.BigEndian} {
+					bo := endianness.ByteOrder()
+					for off := int64(-2); off <= sr.Size()+1; off++ {
+						ev, eok := expected(start, off, width, bo)
+						v, ok := utils.ReadUint(sr, off, width, bo)
+						assert.EqualValues(t, eok, ok, "%s: %d bytes at %d+%d", name, width, start, off)
+						assert.EqualValues(t, ev, v, "%s: %d bytes at %d+%d", name, width, start, off)
+
+						iv, err := readUint(sr, off, width, endianness)
+						assert.EqualValues(t, eok, err == nil, "%s: %d bytes at %d+%d", name, width, start, off)
+						assert.EqualValues(t, ev, iv, "%s: %d bytes at %d+%d", name, width, start, off)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_ReadUintAllocs(t *testing.T) {
+	for _, sr := range []*utils.SliceReader{newBytesReader(make([]byte, 64)), utils.NewSliceReaderFromBytes(make([]byte, 64))} {
+		allocs := testing.AllocsPerRun(100, func() {
+			readUint(sr, 12, 4, parser.LittleEndian)
+		})
+		assert.EqualValues(t, 0, allocs)
+	}
+}
+
+func Benchmark_ReadUint(b *testing.B) {
+	for name, sr := range map[string]*utils.SliceReader{
+		"reader": newBytesReader(make([]byte, 64)),
+		"bytes":  utils.NewSliceReaderFromBytes(make([]byte, 64)),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				readUint(sr, int64(i%56), 8, parser.BigEndian)
+			}
+		})
+	}
+}
+
+func Test_NestedSwap(t *testing.T) {
+	book := parseBook(t, `
+0	name	innermost
+>0	beshort	0x0102	big-endian
+>0	leshort	0x0102	little-endian
+0	name	inner
+>0	use	\^innermost
+0	name	outer
+>0	use	\^inner
+0	use	outer
+`)
+
+	// outer is normal, inner is swapped, innermost is swapped twice
+	assert.EqualValues(t, "big-endian", identify(t, book, []byte{0x01, 0x02}))
+	assert.EqualValues(t, "little-endian", identify(t, book, []byte{0x02, 0x01}))
+
+	book = parseBook(t, `
+0	name	innermost
+>0	beshort	0x0102	big-endian
+>0	leshort	0x0102	little-endian
+0	name	inner
+>0	use	innermost
+0	use	\^inner
+`)
+
+	// inner is swapped, so is innermost
+	assert.EqualValues(t, "little-endian", identify(t, book, []byte{0x01, 0x02}))
+	assert.EqualValues(t, "big-endian", identify(t, book, []byte{0x02, 0x01}))
+}
+
+func Test_MatchRanges(t *testing.T) {
+	book := parseBook(t, `
+0	search/64	MAGIC	magic found
+>&0	string	v1	version 1
+0	string	HDR
+>(4.l+2)	ubyte	0x42	header points at a B
+`)
+
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+		Book: book,
+	}
+
+	target := []byte("....xxMAGICv1")
+	matches, err := ictx.IdentifyMatches(newBytesReader(target))
+	assert.NoError(t, err)
+	if assert.Len(t, matches, 2) {
+		assert.EqualValues(t, "magic found", matches[0].Description)
+		assert.EqualValues(t, Range{6, 5}, matches[0].Range)
+		assert.Empty(t, matches[0].Dereferences)
+
+		assert.EqualValues(t, "version 1", matches[1].Description)
+		assert.EqualValues(t, Range{11, 2}, matches[1].Range)
+	}
+
+	target = []byte{'H', 'D', 'R', 0, 8, 0, 0, 0, 0, 0, 0x42}
+	matches, err = ictx.IdentifyMatches(newBytesReader(target))
+	assert.NoError(t, err)
+	if assert.Len(t, matches, 1) {
+		assert.EqualValues(t, "header points at a B", matches[0].Description)
+		assert.EqualValues(t, Range{10, 1}, matches[0].Range)
+		assert.EqualValues(t, []Range{{4, 4}}, matches[0].Dereferences)
+	}
+}
+
+func Test_DeduplicateFragments(t *testing.T) {
+	book := parseBook(t, `
+0	name	audio
+>0	string	PCM	audio data
+0	string	RIFF	RIFF
+>4	use	audio
+>4	use	audio
+>7	ubyte	1	\b, mono
+>7	ubyte	2	\b, stereo
+>4	use	audio
+`)
+
+	target := []byte("RIFFPCM\x02")
+	assert.EqualValues(t, "RIFF audio data audio data, stereo audio data", identify(t, book, target))
+
+	ictx := &InterpretContext{
+		Logf:                 t.Logf,
+		Book:                 book,
+		DeduplicateFragments: true,
+	}
+	result, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "RIFF audio data, stereo", utils.MergeStrings(result))
+
+	// rules that read the same are still different rules
+	book = parseBook(t, `
+0	name	one
+>0	string	PCM	pcm
+0	name	two
+>0	string	PCM	pcm
+0	string	RIFF	RIFF
+>4	use	one
+>7	ubyte	2	\b, stereo
+>4	use	two
+`)
+	ictx.Book = book
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "RIFF pcm, stereo pcm", utils.MergeStrings(result))
+}
+
+func Test_MaxSearchBytes(t *testing.T) {
+	book := parseBook(t, `
+0	search/0x40000	NEEDLE	found a needle
+`)
+
+	target := make([]byte, 0x8000)
+	copy(target[0x100:], "NEEDLE")
+
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+		Book: book,
+	}
+
+	result, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"found a needle"}, result)
+
+	// still found inside the clamp
+	ictx.MaxSearchBytes = 0x200
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"found a needle"}, result)
+
+	// but not past it
+	ictx.MaxSearchBytes = 0x80
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+}
+
+// zeroReader is a sparse target that's all zeroes
+type zeroReader struct{}
+
+func (zr zeroReader) ReadAt(buf []byte, off int64) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func benchmarkSparseSearch(b *testing.B, maxSearchBytes int64) {
+	book := parseBook(b, `
+0	search/0x4000000	NEEDLE	found a needle
+0	name	chunk
+>0	search/0x4000000	NEEDLE	found a needle in a chunk
+0	ubyte	0
+>0x20000000	use	chunk
+`)
+
+	ictx := &InterpretContext{
+		Logf:           func(format string, args ...interface{}) {},
+		Book:           book,
+		MaxSearchBytes: maxSearchBytes,
+	}
+	sr := utils.NewSliceReader(zeroReader{}, 0, 1024*1024*1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ictx.Identify(sr)
+	}
+}
+
+func Benchmark_SparseSearchUnlimited(b *testing.B) {
+	benchmarkSparseSearch(b, 0)
+}
+
+func Benchmark_SparseSearchClamped(b *testing.B) {
+	benchmarkSparseSearch(b, 64*1024)
+}
+
+// failingReader fails to read anything past a threshold
+type failingReader struct {
+	data      []byte
+	threshold int64
+}
+
+func (fr *failingReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off >= fr.threshold {
+		return 0, errors.New("simulated read failure")
+	}
+
+	end := off + int64(len(buf))
+	if end > fr.threshold {
+		n := copy(buf, fr.data[off:fr.threshold])
+		return n, errors.New("simulated read failure")
+	}
+
+	return copy(buf, fr.data[off:end]), nil
+}
+
+func Test_IdentifyReaderAt(t *testing.T) {
+	book := parseBook(t, `
+0	string	HEAD	header format
+>0x800	ulong	0x12345678	\b, with a trailer
+>4	search/0x4000	TAIL	\b, with a tail
+0	search/0x4000	DEEP	deep format
+`)
+
+	data := make([]byte, 0x4000)
+	copy(data, "HEAD")
+	binary.LittleEndian.PutUint32(data[0x800:], 0x12345678)
+	copy(data[0x1000:], "TAIL")
+
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+		Book: book,
+	}
+
+	result, err := ictx.IdentifyReaderAt(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "header format, with a trailer, with a tail", utils.MergeStrings(result))
+
+	fr := &failingReader{
+		data:      data,
+		threshold: 0x400,
+	}
+	result, err = ictx.IdentifyReaderAt(fr, int64(len(data)))
+	assert.EqualValues(t, "header format", utils.MergeStrings(result))
+
+	// the failed read is reported along with the result
+	var readErr *ReadError
+	if assert.True(t, errors.As(err, &readErr)) {
+		assert.EqualValues(t, 0x800, readErr.Offset)
+		assert.EqualValues(t, "simulated read failure", readErr.Err.Error())
+	}
+}
+
+const excludeMagic = `
+0	string	\x89PNG	PNG image data
+0	string	HDR
+>(4.l)	string	DATA	indirect format
+0	search/0x1000	<html	HTML document
+`
+
+func Test_ExcludeFamilies(t *testing.T) {
+	book := parseBook(t, excludeMagic)
+
+	ictx := &InterpretContext{
+		Logf: t.Logf,
+		Book: book,
+	}
+
+	html := []byte("\n\n   <html><body></body></html>")
+	png := []byte("\x89PNG\r\n\x1a\n")
+	indirect := []byte("HDR\x00\x08\x00\x00\x00DATA")
+
+	assertIdentifies := func(expected string, target []byte) {
+		result, err := ictx.Identify(newBytesReader(target))
+		assert.NoError(t, err)
+		assert.EqualValues(t, expected, utils.MergeStrings(result))
+	}
+
+	assertIdentifies("HTML document", html)
+	assertIdentifies("PNG image data", png)
+	assertIdentifies("indirect format", indirect)
+
+	ictx.ExcludeFamilies = []parser.KindFamily{parser.KindFamilySearch}
+	ictx.ExcludeIndirect = true
+	assertIdentifies("", html)
+	assertIdentifies("PNG image data", png)
+	assertIdentifies("", indirect)
+}
+
+func benchmarkExclude(b *testing.B, exclude []parser.KindFamily) {
+	ictx := &InterpretContext{
+		Logf:            func(format string, args ...interface{}) {},
+		Book:            parseBook(b, excludeMagic),
+		ExcludeFamilies: exclude,
+	}
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 100)
+	sr := newBytesReader(text)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ictx.Identify(sr)
+	}
+}
+
+func Benchmark_ExcludeNothing(b *testing.B) {
+	benchmarkExclude(b, nil)
+}
+
+func Benchmark_ExcludeSearch(b *testing.B) {
+	benchmarkExclude(b, []parser.KindFamily{parser.KindFamilySearch})
+}
+
+func Test_UseMemo(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	search/0x100	data	data chunk
+0	string	RIFF	RIFF
+>4	use	chunk
+>4	use	chunk
+>4	use	chunk
+>8	use	chunk
+`)
+
+	entered := 0
+	ictx := &InterpretContext{
+		Logf: func(format string, args ...interface{}) {
+			if strings.HasPrefix(format, "|====> identifying at") && args[1] == "chunk" {
+				entered++
+			}
+		},
+		Book: book,
+	}
+
+	result, err := ictx.Identify(newBytesReader([]byte("RIFFxxxxdata")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"RIFF", "data chunk", "data chunk", "data chunk", "data chunk"}, result)
+
+	// once at offset 4, once at offset 8
+	assert.EqualValues(t, 2, entered)
+
+	// the memo doesn't outlive an identification
+	entered = 0
+	_, err = ictx.Identify(newBytesReader([]byte("RIFFxxxxdata")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, entered)
+}
+
+// identifySamples are small targets of various types, for benchmarks that
+// run a whole magdir
+var identifySamples = [][]byte{
+	[]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x01\x00\x00\x00\x01\x00\x08\x06\x00\x00\x00"),
+	append([]byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00\x01\x00\x00\x00"), make([]byte, 40)...),
+	append([]byte("PK\x03\x04\x14\x00\x00\x00\x08\x00"), make([]byte, 20)...),
+	[]byte("#!/bin/sh\necho hello\n"),
+	bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 20),
+}
+
+// BenchmarkIdentifyStockMagdir identifies a few samples with the magdir
+// pointed to by WIZARDRY_MAGDIR, e.g. the Magdir folder of file's sources
+func BenchmarkIdentifyStockMagdir(b *testing.B) {
+	magdir := os.Getenv("WIZARDRY_MAGDIR")
+	if magdir == "" {
+		b.Skip("WIZARDRY_MAGDIR is not set")
+	}
+
+	pctx := &parser.ParseContext{
+		Logf: func(format string, args ...interface{}) {},
+	}
+	book := make(parser.Spellbook)
+	err := pctx.ParseAll(magdir, book)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ictx := &InterpretContext{
+		Book: book,
+	}
+
+	var readers []*utils.SliceReader
+	for _, sample := range identifySamples {
+		readers = append(readers, newBytesReader(sample))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sr := range readers {
+			ictx.Identify(sr)
+		}
+	}
+}
+
+const samplesMagic = `
+0	string	\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR	PNG image data
+>16	belong	x	\b, %d x
+>20	belong	x	%d,
+>24	byte	8	8-bit
+0	name	elf-le
+>16	leshort	2	executable,
+>18	leshort	62	x86-64
+0	string	\x7fELF	ELF
+>4	byte	2	64-bit
+>5	byte	1	LSB
+>>0	use	elf-le
+0	string	PK\003\004	Zip archive data
+>4	byte	0x14	\b, at least v2.0 to extract
+0	string/wt	#!\ /bin/sh	POSIX shell script text executable
+0	string/c	the	English text
+`
+
+func Test_IdentifyWithoutLogf(t *testing.T) {
+	book := parseBook(t, samplesMagic)
+
+	for _, sample := range identifySamples {
+		logged := &InterpretContext{
+			Logf: t.Logf,
+			Book: book,
+		}
+		expected, err := logged.Identify(newBytesReader(sample))
+		assert.NoError(t, err)
+
+		silent := &InterpretContext{
+			Book: book,
+		}
+		actual, err := silent.Identify(newBytesReader(sample))
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, expected, actual)
+	}
+}
+
+func Test_IdentifyAllocs(t *testing.T) {
+	ictx := &InterpretContext{
+		Book: parseBook(t, samplesMagic),
+	}
+	sr := newBytesReader(identifySamples[1])
+
+	result, err := ictx.Identify(sr)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "ELF 64-bit LSB executable, x86-64", utils.MergeStrings(result))
+
+	if raceEnabled {
+		t.Skip("allocation counts are meaningless with -race")
+	}
+
+	// the results and their description strings, nothing per rule
+	allocs := testing.AllocsPerRun(100, func() {
+		ictx.Identify(sr)
+	})
+	assert.True(t, allocs <= 8, "%v allocs per Identify", allocs)
+}
+
+func Test_InjectedTests(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	string	data	data chunk
+>0	search/0x10	list	list chunk
+0	string	RIFF	RIFF
+>4	use	chunk
+>>0	string	never	never
+>8	string	WAVE	WAVE
+>>12	search/0x100	fmt	with format
+0	string	RIFX	big-endian RIFF
+`)
+
+	var attempts []string
+	ictx := &InterpretContext{
+		Book: book,
+		// every string test matches
+		StringTest: func(sr *utils.SliceReader, targetIndex int64, pattern string, flags utils.StringTestFlags) int64 {
+			attempts = append(attempts, fmt.Sprintf("string %q at %d", pattern, targetIndex))
+			return targetIndex + int64(len(pattern))
+		},
+		// no search test does
+		SearchTest: func(sr *utils.SliceReader, targetIndex int64, maxLen int64, pattern string, flags utils.StringTestFlags) (int64, int64) {
+			attempts = append(attempts, fmt.Sprintf("search %q at %d", pattern, targetIndex))
+			return -1, 0
+		},
+	}
+
+	result, err := ictx.Identify(newBytesReader(make([]byte, 32)))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"RIFF", "data chunk", "WAVE"}, result)
+
+	assert.EqualValues(t, []string{
+		`string "RIFF" at 0`,
+		`string "data" at 4`,
+		`search "list" at 4`,
+		// use rules don't have children
+		`string "WAVE" at 8`,
+		`search "fmt" at 12`,
+		// the first top-level rule whose children matched ends identification,
+		// RIFX is never tried
+	}, attempts)
+}
+
+func Test_Breadcrumbs(t *testing.T) {
+	book := parseBook(t, `
+0	name	wave-chunks
+>0	string	fmt\x20	\b, with format
+>0	string	data	\b, with data
+0	name	riff-walk
+>0	string	WAVE	\b, WAVE audio
+>>4	use	wave-chunks
+>>8	use	wave-chunks
+0	string	RIFF	RIFF
+>8	use	riff-walk
+>12	use	wave-chunks
+`)
+
+	ictx := &InterpretContext{
+		Book: book,
+	}
+
+	matches, err := ictx.IdentifyMatches(newBytesReader([]byte("RIFFxxxxWAVEfmt data")))
+	assert.NoError(t, err)
+
+	type fragment struct {
+		description string
+		line        string
+		breadcrumb  []string
+	}
+	var fragments []fragment
+	for _, m := range matches {
+		fragments = append(fragments, fragment{m.Description, m.Line, m.Breadcrumb})
+	}
+
+	assert.EqualValues(t, []fragment{
+		{"RIFF", "0\tstring\tRIFF\tRIFF", []string{""}},
+		{`\b, WAVE audio`, ">0\tstring\tWAVE\t\\b, WAVE audio", []string{"", "riff-walk"}},
+		{`\b, with format`, ">0\tstring\tfmt\\x20\t\\b, with format", []string{"", "riff-walk", "wave-chunks"}},
+		{`\b, with data`, ">0\tstring\tdata\t\\b, with data", []string{"", "riff-walk", "wave-chunks"}},
+		// remembered from the first use, but reached directly this time
+		{`\b, with format`, ">0\tstring\tfmt\\x20\t\\b, with format", []string{"", "wave-chunks"}},
+	}, fragments)
+}
+
+func Test_KeepGoing(t *testing.T) {
+	book := parseBook(t, `
+0	string	PK\003\004	Zip archive data
+>4	byte	0x14	\b, at least v2.0 to extract
+0	string	PK	PK-prefixed data
+0	string	ZZ	never
+0	search/0x100	mimetypeapplication/epub+zip	EPUB document
+`)
+	target := []byte("PK\003\004\x14\x00\x00\x00mimetypeapplication/epub+zip")
+
+	ictx := &InterpretContext{
+		Book: book,
+	}
+
+	// by default, the first top-level rule with output wins
+	result, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"Zip archive data", `\b, at least v2.0 to extract`}, result)
+	assert.EqualValues(t, "Zip archive data, at least v2.0 to extract", utils.MergeStrings(result))
+
+	ictx.KeepGoing = true
+	result, err = ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{
+		"Zip archive data", `\b, at least v2.0 to extract`,
+		DefaultKeepGoingSeparator,
+		"PK-prefixed data",
+		DefaultKeepGoingSeparator,
+		"EPUB document",
+	}, result)
+	assert.EqualValues(t, `Zip archive data, at least v2.0 to extract\012- PK-prefixed data\012- EPUB document`, utils.MergeStrings(result))
+
+	// no trailing separator when the last rules don't match
+	result, err = ictx.Identify(newBytesReader([]byte("PK\003\004")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, `Zip archive data\012- PK-prefixed data`, utils.MergeStrings(result))
+
+	ictx.KeepGoingSeparator = "|"
+	result, err = ictx.Identify(newBytesReader([]byte("PK\003\004")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"Zip archive data", "|", "PK-prefixed data"}, result)
+}
+
+func Test_MIMEType(t *testing.T) {
+	book := parseBook(t, `
+0	name	zip-entries
+>30	string	mimetype	\b, with mimetype
+!:mime	application/x-zip-with-mimetype
+0	string	PK\003\004	Zip archive data
+!:mime	application/zip
+>4	byte	0x14	\b, at least v2.0 to extract
+!:ext	zip
+>0	use	zip-entries
+0	string	PK	PK-prefixed data
+!:mime	application/x-pk
+0	string	GIF8	GIF image data
+!:mime	image/gif
+`)
+
+	ictx := &InterpretContext{
+		Book: book,
+	}
+
+	mimeType := func(target string) string {
+		matches, err := ictx.IdentifyMatches(newBytesReader([]byte(target)))
+		assert.NoError(t, err)
+		return MIMEType(matches)
+	}
+
+	assert.EqualValues(t, "image/gif", mimeType("GIF89a"))
+	assert.EqualValues(t, "application/zip", mimeType("PK\003\004\x14\x00"))
+	// deeper rules override the top-level rule
+	zipWithMIME := "PK\003\004\x14\x00" + strings.Repeat("\x00", 24) + "mimetype"
+	assert.EqualValues(t, "application/x-zip-with-mimetype", mimeType(zipWithMIME))
+	assert.EqualValues(t, "", mimeType("nothing"))
+
+	// only the first tree counts
+	ictx.KeepGoing = true
+	assert.EqualValues(t, "application/zip", mimeType("PK\003\004\x14\x00"))
+
+	// !: lines after rules that were skipped are ignored
+	book = parseBook(t, `
+0	string	AB	AB
+!:mime	text/x-ab
+0	nonsense	AB	nonsense
+!:mime	text/x-nonsense
+`)
+	assert.EqualValues(t, "text/x-ab", book[""][0].MIME)
+	assert.Len(t, book[""], 1)
+}
+
+func Test_DeepLevels(t *testing.T) {
+	const levels = 40
+
+	var magic strings.Builder
+	magic.WriteString("0\tubyte\t0\tlevel 0\n")
+	for i := 1; i < levels; i++ {
+		fmt.Fprintf(&magic, "%s%d\tubyte\t%d\t%d\n", strings.Repeat(">", i), i, i, i)
+	}
+	fmt.Fprintf(&magic, "%s%d\tdefault\tx\t\\b, no %d\n", strings.Repeat(">", levels-1), levels-1, levels-1)
+	book := parseBook(t, magic.String())
+
+	target := []byte{0}
+	expected := []string{"level 0"}
+	for i := 1; i < levels; i++ {
+		target = append(target, byte(i))
+		expected = append(expected, fmt.Sprintf("%d", i))
+	}
+	assert.EqualValues(t, strings.Join(expected, " "), identify(t, book, target))
+
+	target[levels-1] = 0xff
+	expected[levels-1] = fmt.Sprintf("\\b, no %d", levels-1)
+	assert.EqualValues(t, utils.MergeStrings(expected), identify(t, book, target))
+}
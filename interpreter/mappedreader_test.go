@@ -0,0 +1,99 @@
+package interpreter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSamples writes identifySamples to dir, copies times copies of them,
+// and returns their paths
+func writeSamples(t testing.TB, dir string, copies int) []string {
+	var paths []string
+	for i := 0; i < copies; i++ {
+		for j, sample := range identifySamples {
+			path := filepath.Join(dir, fmt.Sprintf("sample-%d-%d", i, j))
+			err := ioutil.WriteFile(path, sample, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func Test_MappedReaderIdentify(t *testing.T) {
+	ictx := &InterpretContext{Book: parseBook(t, samplesMagic)}
+
+	for i, path := range writeSamples(t, t.TempDir(), 1) {
+		expected, err := ictx.Identify(newBytesReader(identifySamples[i]))
+		assert.NoError(t, err)
+
+		sr, closer, err := utils.NewMappedReader(path)
+		assert.NoError(t, err)
+		actual, err := ictx.Identify(sr)
+		assert.NoError(t, err)
+		assert.EqualValues(t, expected, actual)
+		assert.NoError(t, closer())
+	}
+}
+
+// BenchmarkIdentifyDirectory identifies a directory of files, mapped or
+// read from, with the magdir WIZARDRY_MAGDIR points to if it's set
+func BenchmarkIdentifyDirectory(b *testing.B) {
+	book := make(parser.Spellbook)
+	if magdir := os.Getenv("WIZARDRY_MAGDIR"); magdir != "" {
+		pctx := &parser.ParseContext{
+			Logf: func(format string, args ...interface{}) {},
+		}
+		err := pctx.ParseAll(magdir, book)
+		if err != nil {
+			b.Fatal(err)
+		}
+	} else {
+		book = parseBook(b, samplesMagic)
+	}
+	ictx := &InterpretContext{
+		Book: book,
+	}
+	paths := writeSamples(b, b.TempDir(), 20)
+
+	b.Run("mapped", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				sr, closer, err := utils.NewMappedReader(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ictx.Identify(sr)
+				closer()
+			}
+		}
+	})
+
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				f, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				stat, err := f.Stat()
+				if err != nil {
+					b.Fatal(err)
+				}
+				ictx.IdentifyReaderAt(f, stat.Size())
+				f.Close()
+			}
+		}
+	})
+}
@@ -0,0 +1,33 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_MergeStringsSamples checks merged descriptions of samples against
+// what file(1) 5.44 prints for them with samplesMagic
+func Test_MergeStringsSamples(t *testing.T) {
+	book := parseBook(t, samplesMagic)
+	expected := []string{
+		"PNG image data, 256 x 256, 8-bit",
+		"ELF 64-bit LSB executable, x86-64",
+		"Zip archive data, at least v2.0 to extract",
+	}
+	for i, e := range expected {
+		assert.EqualValues(t, e, identify(t, book, identifySamples[i]))
+	}
+}
+
+// Test_MergeStringsOpts checks the fragments of samples that utils merges
+// in its own Test_MergeStringsOpts
+func Test_MergeStringsOpts(t *testing.T) {
+	ictx := &InterpretContext{Book: parseBook(t, samplesMagic)}
+	zip, err := ictx.Identify(newBytesReader(identifySamples[2]))
+	assert.NoError(t, err)
+	png, err := ictx.Identify(newBytesReader(identifySamples[0]))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"Zip archive data", `\b, at least v2.0 to extract`}, zip)
+	assert.EqualValues(t, []string{"PNG image data", `\b, 256 x`, "256,", "8-bit"}, png)
+}
@@ -0,0 +1,69 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// readOctal reads a number written in ASCII octal digits at offset, the way
+// tar headers store sizes and modes. Leading spaces and NULs are skipped,
+// then digits are read until the first non-octal character or until maxLen
+// bytes have been looked at. It returns the value and how many bytes were
+// consumed (padding included), or false if there were no digits or the value
+// doesn't fit in 64 bits.
+func readOctal(sr *utils.SliceReader, offset int64, maxLen int64) (uint64, int64, bool) {
+	if remaining := sr.Size() - offset; maxLen > remaining {
+		maxLen = remaining
+	}
+	if maxLen <= 0 {
+		return 0, 0, false
+	}
+
+	bv := utils.ByteView{Input: sr, BufSize: maxLen}
+	defer bv.Release()
+
+	var j int64
+	for j < maxLen {
+		c := bv.Get(offset + j)
+		if c != ' ' && c != 0 {
+			break
+		}
+		j++
+	}
+
+	var value uint64
+	numDigits := 0
+	for j < maxLen {
+		c := bv.Get(offset + j)
+		if c < 0 || !utils.IsOctalNumber(byte(c)) {
+			break
+		}
+		if value > (^uint64(0))>>3 {
+			// would overflow
+			return 0, 0, false
+		}
+		value = value<<3 | uint64(c-'0')
+		numDigits++
+		j++
+	}
+
+	if numDigits == 0 {
+		return 0, 0, false
+	}
+	return value, j, true
+}
+
+// octalTest reads an octal field and performs the test described by octk on
+// it. It returns the value read, the number of bytes consumed, and whether
+// the test succeeded. The value is only meaningful if hasValue is true.
+func octalTest(sr *utils.SliceReader, offset int64, octk *parser.OctalKind) (value uint64, consumed int64, hasValue bool, success bool) {
+	value, consumed, hasValue = readOctal(sr, offset, octk.MaxLen)
+	if !hasValue {
+		return 0, 0, false, false
+	}
+
+	if octk.MatchAny {
+		return value, consumed, true, true
+	}
+	return value, consumed, true, integerTest(&octk.IntegerKind, value)
+}
@@ -0,0 +1,103 @@
+package interpreter
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const tarMagic = `
+257	string	ustar	tar archive
+>100	octal/8&0777	=0644	\b, mode 644
+>124	octal/12	>0	\b, with content
+>>&0	byte	0	\b, NUL-terminated size
+>124	octal/12	0	\b, empty
+`
+
+func tarHeader(t *testing.T, size int64) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "hello.txt",
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+	})
+	assert.NoError(t, err)
+	_, err = tw.Write(make([]byte, size))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func Test_OctalTar(t *testing.T) {
+	book := parseBook(t, tarMagic)
+
+	header := tarHeader(t, 1000)
+	assert.EqualValues(t, "tar archive, mode 644, with content, NUL-terminated size", identify(t, book, header))
+
+	rt := &recordingTracer{}
+	ictx := &InterpretContext{
+		Book:   book,
+		Tracer: rt,
+	}
+	_, err := ictx.Identify(newBytesReader(header))
+	assert.NoError(t, err)
+
+	var values []uint64
+	for _, ev := range rt.rules {
+		if ev.HasValue {
+			values = append(values, ev.Value)
+		}
+	}
+	assert.EqualValues(t, []uint64{0644, 1000, 0, 1000}, values)
+
+	assert.EqualValues(t, "tar archive, mode 644, empty", identify(t, book, tarHeader(t, 0)))
+}
+
+func Test_OctalPadding(t *testing.T) {
+	book := parseBook(t, tarMagic)
+
+	// old tar implementations pad fields with leading spaces instead of zeroes,
+	// and terminate them with a space and/or a NUL
+	header := tarHeader(t, 1000)
+	copy(header[100:108], "   644 \x00")
+	copy(header[124:136], "      1750 ")
+	assert.EqualValues(t, "tar archive, mode 644, with content", identify(t, book, header))
+
+	// leading NULs are skipped too
+	copy(header[124:136], "\x00\x00\x00\x00\x00\x00\x00\x001750")
+	assert.EqualValues(t, "tar archive, mode 644, with content", identify(t, book, header))
+}
+
+func Test_ReadOctal(t *testing.T) {
+	sr := newBytesReader([]byte("  0755 12345678"))
+
+	v, n, ok := readOctal(sr, 0, 8)
+	assert.True(t, ok)
+	assert.EqualValues(t, 0755, v)
+	assert.EqualValues(t, 6, n)
+
+	// stops at the field width
+	v, n, ok = readOctal(sr, 7, 4)
+	assert.True(t, ok)
+	assert.EqualValues(t, 01234, v)
+	assert.EqualValues(t, 4, n)
+
+	// stops at the first non-octal digit
+	v, n, ok = readOctal(sr, 7, 12)
+	assert.True(t, ok)
+	assert.EqualValues(t, 01234567, v)
+	assert.EqualValues(t, 7, n)
+
+	// only padding
+	_, _, ok = readOctal(sr, 0, 2)
+	assert.False(t, ok)
+
+	// too big for 64 bits
+	_, _, ok = readOctal(newBytesReader(bytes.Repeat([]byte("7"), 23)), 0, 32)
+	assert.False(t, ok)
+}
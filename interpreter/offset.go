@@ -0,0 +1,159 @@
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+var (
+	// errDivisionByZero is returned when an offset adjustment divides by zero
+	errDivisionByZero = errors.New("division by zero in offset adjustment")
+	// errOffsetOverflow is returned when an indirect offset can't be
+	// represented: it overflowed, went below zero, or doesn't fit in an int64
+	errOffsetOverflow = errors.New("offset overflow")
+)
+
+// resolveIndirect follows an indirect offset and returns the offset it
+// points to. Nested indirect offsets (for the address or the adjustment)
+// are resolved first, with their own width and endianness. Every read
+// is recorded in derefs.
+//
+// Like direct offsets, addresses are relative to pageOffset (the offset the
+// page was used at), or to globalOffset for relative ones, and so are the
+// pointers read from the target: the returned offset is page-relative, it's
+// up to the caller to add pageOffset or globalOffset.
+//
+// Values read from the target are unsigned, and so is all the arithmetic
+// done on them: an 8-byte pointer with the high bit set is a huge offset,
+// not a negative one. errOffsetOverflow is returned if the result doesn't
+// fit in an int64.
+func resolveIndirect(sr *utils.SliceReader, indirect *parser.IndirectOffset, pageOffset int64, globalOffset int64, swapEndian bool, derefs *[]Range) (int64, error) {
+	offsetAddress := indirect.OffsetAddress
+
+	if indirect.AddressIndirect != nil {
+		nestedAddress, err := resolveIndirect(sr, indirect.AddressIndirect, pageOffset, globalOffset, swapEndian, derefs)
+		if err != nil {
+			return 0, err
+		}
+		offsetAddress = nestedAddress
+	}
+
+	base := pageOffset
+	if indirect.IsRelative {
+		base = globalOffset
+	}
+	address, ok := addOffset(uint64(base), offsetAddress)
+	if !ok || address > math.MaxInt64 {
+		return 0, errOffsetOverflow
+	}
+	offsetAddress = int64(address)
+
+	readAddress, err := readUint(sr, offsetAddress, indirect.ByteWidth, indirect.Endianness.MaybeSwapped(swapEndian))
+	if err != nil {
+		return 0, fmt.Errorf("while reading address at %d: %w", offsetAddress, err)
+	}
+	lookupOffset := readAddress
+	*derefs = append(*derefs, Range{offsetAddress, int64(indirect.ByteWidth)})
+
+	if indirect.OffsetAdjustmentType != parser.AdjustmentNone {
+		var offsetAdjustValue uint64
+		negative := false
+
+		switch {
+		case indirect.OffsetAdjustmentIndirect != nil:
+			nestedAdjustment, err := resolveIndirect(sr, indirect.OffsetAdjustmentIndirect, pageOffset, globalOffset, swapEndian, derefs)
+			if err != nil {
+				return 0, err
+			}
+			offsetAdjustValue = uint64(nestedAdjustment)
+		case indirect.OffsetAdjustmentIsRelative:
+			address, ok := addOffset(uint64(offsetAddress), indirect.OffsetAdjustmentValue)
+			if !ok || address > math.MaxInt64 {
+				return 0, errOffsetOverflow
+			}
+			offsetAdjustAddress := int64(address)
+			readAdjustAddress, err := readUint(sr, offsetAdjustAddress, indirect.ByteWidth, indirect.Endianness.MaybeSwapped(swapEndian))
+			if err != nil {
+				return 0, fmt.Errorf("while reading adjustment at %d: %w", offsetAdjustAddress, err)
+			}
+			offsetAdjustValue = readAdjustAddress
+			*derefs = append(*derefs, Range{offsetAdjustAddress, int64(indirect.ByteWidth)})
+		default:
+			// constant adjustments come from the magic and may be negative
+			negative = indirect.OffsetAdjustmentValue < 0
+			offsetAdjustValue = absUint(indirect.OffsetAdjustmentValue)
+		}
+
+		lookupOffset, err = adjustOffset(lookupOffset, indirect.OffsetAdjustmentType, offsetAdjustValue, negative)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if lookupOffset > math.MaxInt64 {
+		return 0, errOffsetOverflow
+	}
+	return int64(lookupOffset), nil
+}
+
+// adjustOffset applies an offset adjustment in unsigned arithmetic. negative
+// flips the sign of the adjustment value, adding a negative value subtracts
+// it, and so on. Multiplying or dividing by a negative value can't give a
+// valid offset, so it's reported as an overflow, like any result that wraps
+// around.
+func adjustOffset(v uint64, adjustmentType parser.Adjustment, adjustment uint64, negative bool) (uint64, error) {
+	switch adjustmentType {
+	case parser.AdjustmentAdd, parser.AdjustmentSub:
+		subtract := (adjustmentType == parser.AdjustmentSub) != negative
+		if subtract {
+			r, borrow := bits.Sub64(v, adjustment, 0)
+			if borrow != 0 {
+				return 0, errOffsetOverflow
+			}
+			return r, nil
+		}
+		r, carry := bits.Add64(v, adjustment, 0)
+		if carry != 0 {
+			return 0, errOffsetOverflow
+		}
+		return r, nil
+	case parser.AdjustmentMul:
+		if negative && adjustment != 0 && v != 0 {
+			return 0, errOffsetOverflow
+		}
+		hi, lo := bits.Mul64(v, adjustment)
+		if hi != 0 {
+			return 0, errOffsetOverflow
+		}
+		return lo, nil
+	case parser.AdjustmentDiv:
+		if adjustment == 0 {
+			return 0, errDivisionByZero
+		}
+		if negative {
+			return 0, errOffsetOverflow
+		}
+		return v / adjustment, nil
+	}
+	return v, nil
+}
+
+// addOffset adds a signed value to an unsigned offset, it returns false if
+// the result would go below zero or wrap around
+func addOffset(v uint64, delta int64) (uint64, bool) {
+	r, err := adjustOffset(v, parser.AdjustmentAdd, absUint(delta), delta < 0)
+	return r, err == nil
+}
+
+// absUint returns the absolute value of v, math.MinInt64 included
+func absUint(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1
+	}
+	return uint64(v)
+}
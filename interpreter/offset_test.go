@@ -0,0 +1,305 @@
+package interpreter
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResolveIndirect(t *testing.T) {
+	target := make([]byte, 0x100)
+	// PE-style header pointer
+	binary.LittleEndian.PutUint32(target[0x3c:], 0x80)
+	// a short at 0x84 that points elsewhere
+	binary.LittleEndian.PutUint16(target[0x84:], 0xc0)
+	// a big-endian short used as an adjustment
+	binary.BigEndian.PutUint16(target[0x40:], 0x10)
+	sr := newBytesReader(target)
+
+	resolve := func(indirect *parser.IndirectOffset, globalOffset int64) (int64, []Range, error) {
+		var derefs []Range
+		offset, err := resolveIndirect(sr, indirect, 0, globalOffset, false, &derefs)
+		return offset, derefs, err
+	}
+
+	// (0x3c.l+0x18)
+	offset, derefs, err := resolve(&parser.IndirectOffset{
+		ByteWidth:             4,
+		OffsetAddress:         0x3c,
+		OffsetAdjustmentType:  parser.AdjustmentAdd,
+		OffsetAdjustmentValue: 0x18,
+	}, 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x98, offset)
+	assert.EqualValues(t, []Range{{0x3c, 4}}, derefs)
+
+	// ((0x3c.l+4).s)
+	offset, derefs, err = resolve(&parser.IndirectOffset{
+		ByteWidth: 2,
+		AddressIndirect: &parser.IndirectOffset{
+			ByteWidth:             4,
+			OffsetAddress:         0x3c,
+			OffsetAdjustmentType:  parser.AdjustmentAdd,
+			OffsetAdjustmentValue: 4,
+		},
+	}, 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0xc0, offset)
+	assert.EqualValues(t, []Range{{0x3c, 4}, {0x84, 2}}, derefs)
+
+	// (0x3c.l+(0x40.S)), inner read of a different width and endianness
+	offset, derefs, err = resolve(&parser.IndirectOffset{
+		ByteWidth:            4,
+		OffsetAddress:        0x3c,
+		OffsetAdjustmentType: parser.AdjustmentAdd,
+		OffsetAdjustmentIndirect: &parser.IndirectOffset{
+			ByteWidth:     2,
+			Endianness:    parser.BigEndian,
+			OffsetAddress: 0x40,
+		},
+	}, 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x90, offset)
+	assert.EqualValues(t, []Range{{0x3c, 4}, {0x40, 2}}, derefs)
+
+	// (&0x3c.l-4) with a global offset
+	offset, _, err = resolve(&parser.IndirectOffset{
+		IsRelative:            true,
+		ByteWidth:             4,
+		OffsetAddress:         0x2c,
+		OffsetAdjustmentType:  parser.AdjustmentSub,
+		OffsetAdjustmentValue: 4,
+	}, 0x10)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x7c, offset)
+
+	// nested read out of bounds
+	_, _, err = resolve(&parser.IndirectOffset{
+		ByteWidth: 4,
+		AddressIndirect: &parser.IndirectOffset{
+			ByteWidth:             4,
+			OffsetAddress:         0x3c,
+			OffsetAdjustmentType:  parser.AdjustmentMul,
+			OffsetAdjustmentValue: 0x100,
+		},
+	}, 0)
+	assert.Error(t, err)
+
+	// division by zero
+	_, _, err = resolve(&parser.IndirectOffset{
+		ByteWidth:             4,
+		OffsetAddress:         0x3c,
+		OffsetAdjustmentType:  parser.AdjustmentDiv,
+		OffsetAdjustmentValue: 0,
+	}, 0)
+	assert.Equal(t, errDivisionByZero, err)
+}
+
+func Test_NestedIndirectRules(t *testing.T) {
+	book := parseBook(t, `
+0	string	MZ
+>((0x3c.l+4).s)	string	OK	nested address
+>(0x3c.l+(0x40.S))	string	PE	nested adjustment
+>((0x3c.l*0x100).s)	string	OK	never
+`)
+
+	target := make([]byte, 0x100)
+	copy(target, "MZ")
+	binary.LittleEndian.PutUint32(target[0x3c:], 0x80)
+	binary.LittleEndian.PutUint16(target[0x84:], 0xc0)
+	binary.BigEndian.PutUint16(target[0x40:], 0x10)
+	copy(target[0x90:], "PE")
+	copy(target[0xc0:], "OK")
+
+	assert.EqualValues(t, "nested address nested adjustment", identify(t, book, target))
+	assert.EqualValues(t, "((0x3c.longle+4).shortle)", book[""][1].Offset.String())
+	assert.EqualValues(t, "(0x3c.longle+(0x40.shortbe))", book[""][2].Offset.String())
+}
+
+func Test_ResolveIndirectQuad(t *testing.T) {
+	for _, tc := range []struct {
+		address    uint64
+		adjustment parser.Adjustment
+		value      int64
+		offset     int64
+		err        error
+	}{
+		{1 << 63, parser.AdjustmentNone, 0, 0, errOffsetOverflow},
+		{1<<64 - 1, parser.AdjustmentNone, 0, 0, errOffsetOverflow},
+		{1<<63 - 1, parser.AdjustmentNone, 0, 1<<63 - 1, nil},
+		{1<<63 - 1, parser.AdjustmentAdd, 1, 0, errOffsetOverflow},
+		{1<<64 - 1, parser.AdjustmentAdd, 1, 0, errOffsetOverflow},
+		{1 << 63, parser.AdjustmentSub, 1, 1<<63 - 1, nil},
+		{1 << 63, parser.AdjustmentAdd, -1, 1<<63 - 1, nil},
+		{1<<64 - 1, parser.AdjustmentDiv, 2, 1<<63 - 1, nil},
+		{1<<64 - 1, parser.AdjustmentDiv, -1, 0, errOffsetOverflow},
+		{1 << 62, parser.AdjustmentMul, 4, 0, errOffsetOverflow},
+		{1 << 61, parser.AdjustmentMul, 2, 1 << 62, nil},
+		{4, parser.AdjustmentSub, 8, 0, errOffsetOverflow},
+		{4, parser.AdjustmentAdd, math.MinInt64, 0, errOffsetOverflow},
+	} {
+		target := make([]byte, 16)
+		binary.LittleEndian.PutUint64(target, tc.address)
+		sr := newBytesReader(target)
+
+		var derefs []Range
+		offset, err := resolveIndirect(sr, &parser.IndirectOffset{
+			ByteWidth:             8,
+			OffsetAdjustmentType:  tc.adjustment,
+			OffsetAdjustmentValue: tc.value,
+		}, 0, 0, false, &derefs)
+		assert.Equal(t, tc.err, err, "%#x %d %d", tc.address, tc.adjustment, tc.value)
+		assert.EqualValues(t, tc.offset, offset, "%#x %d %d", tc.address, tc.adjustment, tc.value)
+		assert.True(t, offset >= 0)
+	}
+}
+
+func FuzzResolveIndirect(f *testing.F) {
+	f.Add(uint64(1<<63), int64(0), uint8(parser.AdjustmentAdd), int64(0))
+	f.Add(uint64(1<<64-1), int64(0), uint8(parser.AdjustmentAdd), int64(1))
+	f.Add(uint64(1<<63-1), int64(1<<63-1), uint8(parser.AdjustmentSub), int64(-1))
+	f.Add(uint64(1<<62), int64(8), uint8(parser.AdjustmentMul), int64(-2))
+	f.Add(uint64(0x10), int64(4), uint8(parser.AdjustmentDiv), int64(math.MinInt64))
+
+	f.Fuzz(func(t *testing.T, address uint64, globalOffset int64, adjustment uint8, value int64) {
+		if globalOffset < 0 {
+			globalOffset = -(globalOffset + 1)
+		}
+
+		target := make([]byte, 16)
+		binary.LittleEndian.PutUint64(target, address)
+		sr := newBytesReader(target)
+
+		var derefs []Range
+		offset, err := resolveIndirect(sr, &parser.IndirectOffset{
+			ByteWidth:             8,
+			OffsetAdjustmentType:  parser.Adjustment(adjustment % 5),
+			OffsetAdjustmentValue: value,
+		}, 0, globalOffset, false, &derefs)
+		if err == nil && offset < 0 {
+			t.Errorf("negative offset %d for %#x %d %d", offset, address, adjustment%5, value)
+		}
+
+		// relative rules add the global offset afterwards
+		book := parser.Spellbook{"": []parser.Rule{{
+			Line: "(0.q)",
+			Offset: parser.Offset{
+				OffsetType: parser.OffsetTypeIndirect,
+				IsRelative: true,
+				Indirect: &parser.IndirectOffset{
+					ByteWidth:             8,
+					OffsetAdjustmentType:  parser.Adjustment(adjustment % 5),
+					OffsetAdjustmentValue: value,
+				},
+			},
+			Kind: parser.Kind{Family: parser.KindFamilyDefault},
+		}}}
+		ictx := &InterpretContext{Book: book}
+		_, err = ictx.Identify(sr)
+		assert.NoError(t, err)
+	})
+}
+
+func Test_QuadIndirectRules(t *testing.T) {
+	book := parseBook(t, `
+0	string	PTR
+>(8.q)	string	OK	pointer followed
+>(8.q+1)	string	K	pointer adjusted
+>(16.q)	string	OK	never
+>(16.q+1)	string	OK	never either
+`)
+
+	target := make([]byte, 0x30)
+	copy(target, "PTR")
+	binary.LittleEndian.PutUint64(target[8:], 0x20)
+	binary.LittleEndian.PutUint64(target[16:], 1<<63)
+	copy(target[0x20:], "OK")
+
+	assert.EqualValues(t, "pointer followed pointer adjusted", identify(t, book, target))
+	assert.EqualValues(t, "(0x8.quadle+1)", book[""][2].Offset.String())
+
+	binary.LittleEndian.PutUint64(target[16:], 1<<64-1)
+	assert.EqualValues(t, "pointer followed pointer adjusted", identify(t, book, target))
+}
+
+const riffWalkMagic = `
+0	name	riff-walk
+>0	string	fmt\x20	\b, fmt
+>>&4	leshort	1	PCM
+>>>&0	leshort	2	stereo
+>0	string	data	\b, data
+>>(&0.l+8)	string	END	\b, end
+>(4.l+8)	use	riff-walk
+
+0	name	riff
+>0	string	RIFF	RIFF
+>>8	string	WAVE	\b, WAVE
+>>>12	use	riff-walk
+
+0	string	RIFF
+>0	use	riff
+0	string	CONT	container
+>512	use	riff
+`
+
+func wave() []byte {
+	var b []byte
+	le16 := func(v uint16) {
+		b = append(b, byte(v), byte(v>>8))
+	}
+	le32 := func(v uint32) {
+		le16(uint16(v))
+		le16(uint16(v >> 16))
+	}
+	b = append(b, "RIFF"...)
+	le32(40)
+	b = append(b, "WAVE"...)
+	b = append(b, "fmt "...)
+	le32(16)
+	// PCM, stereo, 44.1kHz, 16-bit
+	le16(1)
+	le16(2)
+	le32(44100)
+	le32(44100 * 4)
+	le16(4)
+	le16(16)
+	b = append(b, "data"...)
+	le32(4)
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, "END"...)
+	return b
+}
+
+func Test_PageOffsets(t *testing.T) {
+	book := parseBook(t, riffWalkMagic)
+
+	standalone := wave()
+	contained := make([]byte, 512)
+	copy(contained, "CONT")
+	contained = append(contained, standalone...)
+
+	assert.EqualValues(t, "RIFF, WAVE, fmt PCM stereo, data, end", identify(t, book, standalone))
+	assert.EqualValues(t, "container RIFF, WAVE, fmt PCM stereo, data, end", identify(t, book, contained))
+
+	ictx := &InterpretContext{Book: book}
+	standaloneMatches, err := ictx.IdentifyMatches(newBytesReader(standalone))
+	assert.NoError(t, err)
+	containedMatches, err := ictx.IdentifyMatches(newBytesReader(contained))
+	assert.NoError(t, err)
+
+	// same page, same rules, same ranges, only 512 bytes further
+	assert.EqualValues(t, len(standaloneMatches)+1, len(containedMatches))
+	for i, m := range standaloneMatches {
+		c := containedMatches[i+1]
+		assert.EqualValues(t, m.Line, c.Line)
+		assert.EqualValues(t, m.Offset+512, c.Offset, m.Line)
+		assert.EqualValues(t, m.Length, c.Length, m.Line)
+		assert.EqualValues(t, len(m.Dereferences), len(c.Dereferences), m.Line)
+		for j, deref := range m.Dereferences {
+			assert.EqualValues(t, deref.Offset+512, c.Dereferences[j].Offset, m.Line)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// pstringLength reads the length of a pstring at offset. It returns false
+// if the length can't be read, or if the string doesn't fit in the target.
+func pstringLength(sr *utils.SliceReader, offset int64, pk *parser.PStringKind, swapEndian bool) (int64, bool) {
+	width := int64(pk.LengthWidth)
+	length, err := readUint(sr, offset, pk.LengthWidth, pk.LengthEndianness.MaybeSwapped(swapEndian))
+	if err != nil {
+		return 0, false
+	}
+
+	if pk.LengthIncludesItself {
+		if length < uint64(width) {
+			return 0, false
+		}
+		length -= uint64(width)
+	}
+
+	if length > uint64(sr.Size()-offset-width) {
+		return 0, false
+	}
+	return int64(length), true
+}
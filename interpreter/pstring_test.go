@@ -0,0 +1,49 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PStringKind(t *testing.T) {
+	book := parseBook(t, `
+0	pstring/hJc	magic	pstring "%s"
+>&0	string	!x	\b, then not x
+0	pstring	!magic	not magic
+`)
+
+	pk, ok := book[""][0].Kind.Data.(*parser.PStringKind)
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, pk.LengthWidth)
+	assert.EqualValues(t, parser.LittleEndian, pk.LengthEndianness)
+	assert.True(t, pk.LengthIncludesItself)
+	assert.EqualValues(t, "magic", pk.Value)
+
+	// relative offsets start after the whole string
+	assert.EqualValues(t, `pstring "MAGIC!", then not x`, identify(t, book, []byte("\x08\x00MAGIC!y")))
+	assert.EqualValues(t, `not magic`, identify(t, book, []byte("\x05hello")))
+	assert.EqualValues(t, ``, identify(t, book, []byte("\x05magic")))
+
+	// the string must fit in the target
+	assert.EqualValues(t, ``, identify(t, book, []byte("\x05hel")))
+
+	// matches cover the string, negated or not
+	ictx := &InterpretContext{Book: book}
+	for _, c := range []struct {
+		target string
+		ranges []Range
+	}{
+		{"\x08\x00MAGIC!y", []Range{{2, 6}, {8, 0}}},
+		{"\x05hello", []Range{{1, 5}}},
+	} {
+		matches, err := ictx.IdentifyMatches(newBytesReader([]byte(c.target)))
+		assert.NoError(t, err)
+		var ranges []Range
+		for _, m := range matches {
+			ranges = append(ranges, m.Range)
+		}
+		assert.EqualValues(t, c.ranges, ranges, "for %q", c.target)
+	}
+}
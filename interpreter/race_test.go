@@ -0,0 +1,7 @@
+//go:build race
+
+package interpreter
+
+// raceEnabled is true when running tests with -race, which makes sync.Pool
+// drop items at random and skews allocation counts
+const raceEnabled = true
@@ -0,0 +1,73 @@
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RegexKind(t *testing.T) {
+	book := parseBook(t, `
+0	regex/1l	^#![\ \t]*/(usr/)?bin/(env\ +)?python	Python script text executable
+0	regex/4lc	^<html	HTML document text
+0	regex/16s	[0-9]+\.[0-9]+	version
+>&0	ubyte	x	\b, starts with %c
+`)
+
+	rk, ok := book[""][0].Kind.Data.(*parser.RegexKind)
+	assert.True(t, ok)
+	assert.EqualValues(t, `^#![ \t]*/(usr/)?bin/(env +)?python`, rk.Value)
+	assert.EqualValues(t, 1, rk.MaxLen)
+	assert.True(t, rk.Lines)
+
+	assert.EqualValues(t, "Python script text executable", identify(t, book, []byte("#! /usr/bin/env python\nprint(1)\n")))
+	assert.EqualValues(t, "Python script text executable", identify(t, book, []byte("#!/bin/python")))
+
+	// ^ matches at the start of every line, within the limit
+	assert.EqualValues(t, "HTML document text", identify(t, book, []byte("\n\n<HTML>")))
+	assert.EqualValues(t, "", identify(t, book, []byte("\n\n\n\n<html>")))
+
+	// with the s flag, relative offsets start at the start of the match
+	assert.EqualValues(t, "version, starts with 1", identify(t, book, []byte("release 12.4")))
+}
+
+func Test_RegexFormat(t *testing.T) {
+	book := parseBook(t, `
+0	regex	[a-z]+\ [0-9]+	found "%s"
+>&0	string	!x	\b, then x
+`)
+	assert.EqualValues(t, `found "emacs 29", then x`, identify(t, book, []byte("GNU emacs 29 y")))
+}
+
+func Test_RegexInvalid(t *testing.T) {
+	// patterns that don't compile are reported when parsing, and their rule
+	// is left out
+	var logged []string
+	pctx := &parser.ParseContext{
+		Logf: func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		},
+	}
+	book := make(parser.Spellbook)
+	assert.NoError(t, pctx.Parse(strings.NewReader("0\tregex\ta(?<b\tnever\n0\tregex\tb\tb\n"), book))
+	assert.Len(t, book[""], 1)
+	assert.Contains(t, strings.Join(logged, "\n"), "in regex test, error parsing regexp")
+
+	ictx := &InterpretContext{
+		Book: book,
+	}
+	result, err := ictx.Identify(newBytesReader([]byte("a(b")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"b"}, result)
+}
+
+func Test_RegexWindow(t *testing.T) {
+	book := parseBook(t, "0\tregex\tneedle\tfound")
+
+	// the window stops at utils.MaxRegexBytes
+	assert.EqualValues(t, "found", identify(t, book, []byte(strings.Repeat(" ", 8000)+"needle")))
+	assert.EqualValues(t, "", identify(t, book, []byte(strings.Repeat(" ", 9000)+"needle")))
+}
@@ -0,0 +1,439 @@
+package interpreter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// ErrRuleNeedsBook is returned by EvaluateRule for use rules, which can
+// only be evaluated along with the page they use
+var ErrRuleNeedsBook = errors.New("interpreter: use rules can't be evaluated without a spellbook")
+
+// RuleResult is what evaluating a single rule found out
+type RuleResult struct {
+	// Matched is true if the rule's test succeeded
+	Matched bool
+
+	// Offset is the absolute offset the rule was tested at
+	Offset int64
+
+	// Range covers the bytes read for integer and octal tests, and the bytes
+	// that matched for string, search and regex tests, like Match.Range
+	Range Range
+
+	// Dereferences covers the bytes read to resolve an indirect offset, if any
+	Dereferences []Range
+
+	// Value is the number read by integer, date, float and octal tests, if
+	// HasValue is set
+	Value    uint64
+	HasValue bool
+
+	// Bytes are the bytes matched by string, pstring, search and regex tests,
+	// only set by EvaluateRule, or the decoded string matched by string16
+	// tests
+	Bytes []byte
+
+	// NextOffset is where relative rules that follow this one start, if it
+	// matched
+	NextOffset int64
+
+	// Description is the description of the rule, formatted with the value
+	// it read. It's only set if the rule matched.
+	Description string
+}
+
+// EvaluateRule tests a single rule against sr, as if it was part of a page
+// used at baseOffset, which is also where relative offsets start. It goes
+// through the same code as Identify, so a rule evaluated on its own behaves
+// exactly like it would in a spellbook, minus its parents and siblings.
+// Errors are returned for rules that can't be tested at all, like rules
+// whose offset is out of bounds.
+func EvaluateRule(sr *utils.SliceReader, rule parser.Rule, baseOffset int64) (RuleResult, error) {
+	if sr == nil {
+		return RuleResult{}, ErrNilReader
+	}
+
+	ctx := &InterpretContext{}
+	st := acquireIdentifyState()
+	defer st.release()
+	defer st.reset()
+	ctx.prepareState(st)
+
+	lookupOffset, derefs, err := resolveRuleOffset(st, sr, &rule, baseOffset, baseOffset, false)
+	res := RuleResult{
+		Offset:       lookupOffset,
+		Range:        Range{Offset: lookupOffset},
+		Dereferences: derefs,
+	}
+	if err != nil {
+		return res, err
+	}
+
+	switch rule.Kind.Family {
+	case parser.KindFamilyUse:
+		return res, ErrRuleNeedsBook
+	case parser.KindFamilyName, parser.KindFamilyDefault:
+		// nothing matched before, since there's nothing before
+		res.Matched = true
+	case parser.KindFamilyClear:
+		// clear never matches
+	default:
+		err = ctx.testRule(st, sr, &rule, false, &res)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if res.Matched {
+		switch rule.Kind.Family {
+		case parser.KindFamilyInteger:
+			readMatchAnyValue(sr, &rule, false, &res)
+		case parser.KindFamilyString, parser.KindFamilyPString, parser.KindFamilySearch, parser.KindFamilyRegex:
+			res.Bytes = readRange(sr, res.Range)
+		}
+		res.Description = formatDescription(sr, &rule, &res)
+	}
+	return res, nil
+}
+
+// readMatchAnyValue reads the value of an "x" integer test, which matches
+// without reading anything, for descriptions that show it. The value is
+// left out if it can't be read.
+func readMatchAnyValue(sr *utils.SliceReader, rule *parser.Rule, swapEndian bool, res *RuleResult) {
+	ik, _ := rule.Kind.Data.(*parser.IntegerKind)
+	if ik == nil || !ik.MatchAny || res.HasValue {
+		return
+	}
+	value, err := readUint(sr, res.Offset, ik.ByteWidth, ik.Endianness.MaybeSwapped(swapEndian))
+	if err == nil {
+		res.Value = value
+		res.HasValue = true
+	}
+}
+
+// resolveRuleOffset returns the absolute offset a rule is tested at. Direct
+// and indirect offsets are relative to pageOffset, or to globalOffset for
+// relative rules. globalOffset is absolute, so the same page behaves the same
+// wherever it's used. The offset is returned even if it's out of bounds,
+// along with an error.
+func resolveRuleOffset(st *identifyState, sr *utils.SliceReader, rule *parser.Rule, pageOffset int64, globalOffset int64, swapEndian bool) (int64, []Range, error) {
+	var lookupOffset int64
+	var derefs []Range
+
+	switch rule.Offset.OffsetType {
+	case parser.OffsetTypeIndirect:
+		var err error
+		lookupOffset, err = resolveIndirect(sr, rule.Offset.Indirect, pageOffset, globalOffset, swapEndian, &derefs)
+		for _, deref := range derefs {
+			st.bytesExamined += deref.Length
+		}
+		if err != nil {
+			return 0, derefs, fmt.Errorf("while dereferencing: %w", err)
+		}
+
+	case parser.OffsetTypeDirect:
+		lookupOffset = rule.Offset.Direct
+	}
+
+	base := pageOffset
+	if rule.Offset.IsRelative {
+		base = globalOffset
+	}
+	absoluteOffset, ok := addOffset(uint64(base), lookupOffset)
+	if !ok || absoluteOffset > math.MaxInt64 {
+		return 0, derefs, fmt.Errorf("offset %d+%d: %w", base, lookupOffset, errOffsetOverflow)
+	}
+	lookupOffset = int64(absoluteOffset)
+
+	if lookupOffset >= sr.Size() {
+		return lookupOffset, derefs, fmt.Errorf("offset %d is out of bounds", lookupOffset)
+	}
+	return lookupOffset, derefs, nil
+}
+
+// testRule performs the test of integer, date, float, guid, string,
+// pstring, string16, search, regex, der and octal rules at res.Offset, and
+// fills in res. Other kinds of rules depend on the rules around them, they're
+// handled by identifyInternal. Errors are for tests that couldn't be
+// performed at all.
+func (ctx *InterpretContext) testRule(st *identifyState, sr *utils.SliceReader, rule *parser.Rule, swapEndian bool, res *RuleResult) error {
+	lookupOffset := res.Offset
+
+	switch rule.Kind.Family {
+	case parser.KindFamilyInteger:
+		ik, _ := rule.Kind.Data.(*parser.IntegerKind)
+		res.Range.Length = int64(ik.ByteWidth)
+
+		if ik.MatchAny {
+			res.Matched = true
+		} else {
+			st.bytesExamined += int64(ik.ByteWidth)
+			value, err := readUint(sr, lookupOffset, ik.ByteWidth, ik.Endianness.MaybeSwapped(swapEndian))
+			if err != nil {
+				return fmt.Errorf("in integer test, while reading target value: %w", err)
+			}
+			res.Value = value
+			res.HasValue = true
+			res.Matched = integerTest(ik, value)
+		}
+
+		if res.Matched {
+			res.NextOffset = lookupOffset + int64(ik.ByteWidth)
+		}
+
+	case parser.KindFamilyDate:
+		dk, _ := rule.Kind.Data.(*parser.DateKind)
+		res.Range.Length = int64(dk.ByteWidth)
+
+		st.bytesExamined += int64(dk.ByteWidth)
+		value, err := readUint(sr, lookupOffset, dk.ByteWidth, dk.Endianness.MaybeSwapped(swapEndian))
+		if err == nil {
+			res.Value = value
+			res.HasValue = true
+		}
+
+		if dk.MatchAny {
+			res.Matched = true
+		} else {
+			if err != nil {
+				return fmt.Errorf("in date test, while reading target value: %w", err)
+			}
+			res.Matched = integerTest(&dk.IntegerKind, value)
+		}
+
+		if res.Matched {
+			res.NextOffset = lookupOffset + int64(dk.ByteWidth)
+		}
+
+	case parser.KindFamilyFloat:
+		fk, _ := rule.Kind.Data.(*parser.FloatKind)
+		res.Range.Length = int64(fk.ByteWidth)
+
+		st.bytesExamined += int64(fk.ByteWidth)
+		value, err := readUint(sr, lookupOffset, fk.ByteWidth, fk.Endianness.MaybeSwapped(swapEndian))
+		if err == nil {
+			res.Value = value
+			res.HasValue = true
+		}
+
+		if fk.MatchAny {
+			res.Matched = true
+		} else {
+			if err != nil {
+				return fmt.Errorf("in float test, while reading target value: %w", err)
+			}
+			res.Matched = floatTest(fk, floatValue(fk, value))
+		}
+
+		if res.Matched {
+			res.NextOffset = lookupOffset + int64(fk.ByteWidth)
+		}
+
+	case parser.KindFamilyString:
+		sk, _ := rule.Kind.Data.(*parser.StringKind)
+
+		// StringTest returns the offset right after the match
+		matchEnd := st.stringTest(sr, lookupOffset, sk.Value, withTextHint(sr, sk.Flags))
+		matched := matchEnd >= 0
+		if matched {
+			st.bytesExamined += matchEnd - lookupOffset
+		} else {
+			st.bytesExamined += int64(len(sk.Value))
+		}
+
+		if sk.Negate {
+			res.Matched = !matched
+		} else {
+			res.Matched = matched
+			if matched {
+				res.NextOffset = matchEnd
+				res.Range.Length = matchEnd - lookupOffset
+			}
+		}
+
+	case parser.KindFamilyGuid:
+		gk, _ := rule.Kind.Data.(*parser.GuidKind)
+		res.Range.Length = utils.GUIDSize
+
+		st.bytesExamined += utils.GUIDSize
+		guid := make([]byte, utils.GUIDSize)
+		if lookupOffset < 0 || lookupOffset+utils.GUIDSize > sr.Size() {
+			return fmt.Errorf("in guid test, offset %d is out of bounds", lookupOffset)
+		}
+		n, _ := sr.ReadAt(guid, lookupOffset)
+		if n < utils.GUIDSize {
+			return fmt.Errorf("in guid test, could only read %d bytes", n)
+		}
+
+		res.Matched = gk.MatchAny || bytes.Equal(guid, gk.Value)
+		if res.Matched {
+			res.NextOffset = lookupOffset + utils.GUIDSize
+		}
+
+	case parser.KindFamilyString16:
+		sk, _ := rule.Kind.Data.(*parser.String16Kind)
+		bigEndian := sk.Endianness.MaybeSwapped(swapEndian) == parser.BigEndian
+
+		var matchEnd int64
+		if sk.MatchAny {
+			matchEnd = utils.String16End(sr, lookupOffset, bigEndian)
+		} else {
+			matchEnd = utils.String16Test(sr, lookupOffset, sk.Value, bigEndian, 0)
+		}
+		matched := matchEnd >= 0
+		if matched {
+			st.bytesExamined += matchEnd - lookupOffset
+		} else {
+			st.bytesExamined += 2 * int64(len(sk.Value))
+		}
+
+		if sk.Negate {
+			res.Matched = !matched
+		} else {
+			res.Matched = matched
+			if matched {
+				res.NextOffset = matchEnd
+				res.Range.Length = matchEnd - lookupOffset
+				res.Bytes = []byte(utils.DecodeString16(sr, lookupOffset, matchEnd, bigEndian))
+			}
+		}
+
+	case parser.KindFamilyPString:
+		pk, _ := rule.Kind.Data.(*parser.PStringKind)
+
+		st.bytesExamined += int64(pk.LengthWidth)
+		length, ok := pstringLength(sr, lookupOffset, pk, swapEndian)
+		if !ok {
+			break
+		}
+		start := lookupOffset + int64(pk.LengthWidth)
+
+		// the pattern must match within the string
+		matchEnd := st.stringTest(sr, start, pk.Value, withTextHint(sr, pk.Flags))
+		matched := matchEnd >= 0 && matchEnd <= start+length
+		if matched {
+			st.bytesExamined += matchEnd - start
+		} else {
+			st.bytesExamined += int64(len(pk.Value))
+		}
+
+		if pk.Negate {
+			res.Matched = !matched
+		} else {
+			res.Matched = matched
+		}
+		if res.Matched {
+			res.Range = Range{start, length}
+			res.NextOffset = start + length
+		}
+
+	case parser.KindFamilySearch:
+		sk, _ := rule.Kind.Data.(*parser.SearchKind)
+
+		// the range bounds where the match starts, it may run past it
+		maxLen := sk.MaxLen
+		if maxLen == 0 {
+			maxLen = utils.DefaultSearchRange
+		}
+		if remaining := sr.Size() - lookupOffset; maxLen > remaining {
+			maxLen = remaining
+		}
+		if ctx.MaxSearchBytes > 0 && maxLen > ctx.MaxSearchBytes {
+			ctx.logf("clamping search range from %d to %d bytes", maxLen, ctx.MaxSearchBytes)
+			maxLen = ctx.MaxSearchBytes
+		}
+
+		flags := withTextHint(sr, sk.Flags)
+		var matchPos, matchLen int64
+		if st.searchTest != nil {
+			matchPos, matchLen = st.searchTest(sr, lookupOffset, maxLen, sk.Value, flags)
+		} else {
+			matchPos, matchLen = searchTest(sk, sr, lookupOffset, maxLen, flags)
+		}
+		res.Matched = matchPos >= 0
+		if res.Matched {
+			st.bytesExamined += matchPos + matchLen
+			res.NextOffset = lookupOffset + matchPos + matchLen
+			res.Range = Range{lookupOffset + matchPos, matchLen}
+		} else {
+			st.bytesExamined += maxLen
+		}
+
+	case parser.KindFamilyRegex:
+		rk, _ := rule.Kind.Data.(*parser.RegexKind)
+
+		re, err := rk.Regexp()
+		if err != nil {
+			return fmt.Errorf("in regex test: %w", err)
+		}
+
+		matchStart, matchEnd := utils.RegexTest(sr, lookupOffset, rk.MaxLen, rk.Lines, re)
+		res.Matched = matchStart >= 0
+		if res.Matched {
+			st.bytesExamined += matchEnd
+			res.NextOffset = lookupOffset + matchEnd
+			if rk.MatchStart {
+				res.NextOffset = lookupOffset + matchStart
+			}
+			res.Range = Range{lookupOffset + matchStart, matchEnd - matchStart}
+		} else {
+			examined := sr.Size() - lookupOffset
+			if examined > utils.MaxRegexBytes {
+				examined = utils.MaxRegexBytes
+			}
+			st.bytesExamined += examined
+		}
+
+	case parser.KindFamilyDer:
+		dk, _ := rule.Kind.Data.(*parser.DerKind)
+
+		el, nextOffset, matched := derTest(sr, lookupOffset, dk)
+		res.Matched = matched
+		if matched {
+			st.bytesExamined += el.HeaderLength
+			if dk.HasValue {
+				st.bytesExamined += el.ContentLength
+			}
+			res.NextOffset = nextOffset
+			res.Range.Length = el.HeaderLength + el.ContentLength
+		}
+
+	case parser.KindFamilyOctal:
+		octk, _ := rule.Kind.Data.(*parser.OctalKind)
+
+		value, consumed, hasValue, matched := octalTest(sr, lookupOffset, octk)
+		res.Value = value
+		res.HasValue = hasValue
+		res.Matched = matched
+		if hasValue {
+			st.bytesExamined += consumed
+		} else {
+			st.bytesExamined += octk.MaxLen
+		}
+
+		if matched {
+			res.NextOffset = lookupOffset + consumed
+			res.Range.Length = consumed
+		}
+
+	default:
+		return fmt.Errorf("rule %q is not a test", rule.Line)
+	}
+
+	return nil
+}
+
+// withTextHint adds what the target looks like to flags, for tests that
+// are only done for text or binary targets
+func withTextHint(sr *utils.SliceReader, flags utils.StringTestFlags) utils.StringTestFlags {
+	if flags&(utils.ForceText|utils.ForceBinary) > 0 {
+		flags |= sr.TextHint()
+	}
+	return flags
+}
@@ -0,0 +1,99 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseRule(t *testing.T, line string) parser.Rule {
+	book := parseBook(t, line)
+	rules := book[""]
+	assert.Len(t, rules, 1, line)
+	return rules[0]
+}
+
+func Test_EvaluateRule(t *testing.T) {
+	target := []byte("\x7fELF\x02\x01\x01\x00" +
+		"\xfe\xff\x00\x00" +
+		"v1.23\x00" +
+		"  0755 \x00")
+
+	for _, tc := range []struct {
+		line        string
+		base        int64
+		matched     bool
+		offset      int64
+		value       uint64
+		hasValue    bool
+		bytes       string
+		description string
+	}{
+		{line: "0\tstring\t\\x7fELF\tELF", matched: true, bytes: "\x7fELF", description: "ELF"},
+		{line: "4\tbyte\t2\t64-bit", matched: true, offset: 4, value: 2, hasValue: true, description: "64-bit"},
+		{line: "4\tbyte\t1\t32-bit", offset: 4, value: 2, hasValue: true},
+		{line: "4\tbyte\tx\tclass %d", matched: true, offset: 4, value: 2, hasValue: true, description: "class 2"},
+		{line: "8\tleshort\t-2\tminus two (%d, %#x)", matched: true, offset: 8, value: 0xfffe, hasValue: true, description: "minus two (-2, %#x)"},
+		{line: "8\tuleshort\t>0x8000\tbig %u", matched: true, offset: 8, value: 0xfffe, hasValue: true, description: "big 65534"},
+		{line: "8\tlelong\t0xfffe\t100%% %x", matched: true, offset: 8, value: 0xfffe, hasValue: true, description: "100% fffe"},
+		{line: "12\tstring\tv1.\tversion %s", matched: true, offset: 12, bytes: "v1.", description: "version v1."},
+		{line: "0\tsearch/32\tv1\tfound %s", matched: true, bytes: "v1", description: "found v1"},
+		{line: "18\toctal/8\t0755\tmode %o", matched: true, offset: 18, value: 0755, hasValue: true, description: "mode 755"},
+		{line: "18\toctal/8\t<0700\tnot that", offset: 18, value: 0755, hasValue: true},
+		// relative and page offsets start at the base offset
+		{line: "4\tbyte\t0\tpadding", base: 3, matched: true, offset: 7, value: 0, hasValue: true, description: "padding"},
+		{line: "&1\tbyte\t1\tversion", base: 5, matched: true, offset: 6, value: 1, hasValue: true, description: "version"},
+		// indirect offsets are relative to the base too
+		{line: "(2.b)\tbyte\t2\tpointer", base: 2, matched: true, offset: 4, value: 2, hasValue: true, description: "pointer"},
+	} {
+		t.Run(tc.line, func(t *testing.T) {
+			res, err := EvaluateRule(newBytesReader(target), parseRule(t, tc.line), tc.base)
+			assert.NoError(t, err)
+			assert.EqualValues(t, tc.matched, res.Matched)
+			assert.EqualValues(t, tc.offset, res.Offset)
+			assert.EqualValues(t, tc.value, res.Value)
+			assert.EqualValues(t, tc.hasValue, res.HasValue)
+			assert.EqualValues(t, tc.bytes, string(res.Bytes))
+			assert.EqualValues(t, tc.description, res.Description)
+		})
+	}
+}
+
+func Test_EvaluateRuleErrors(t *testing.T) {
+	sr := newBytesReader([]byte("tiny"))
+
+	_, err := EvaluateRule(nil, parseRule(t, "0\tbyte\t0"), 0)
+	assert.Equal(t, ErrNilReader, err)
+
+	res, err := EvaluateRule(sr, parseRule(t, "8\tbyte\t0"), 0)
+	assert.Error(t, err)
+	assert.False(t, res.Matched)
+	assert.EqualValues(t, 8, res.Offset)
+
+	_, err = EvaluateRule(sr, parseRule(t, "2\tlelong\t0"), 0)
+	assert.Error(t, err)
+
+	_, err = EvaluateRule(sr, parseRule(t, "0\tuse\tsomething"), 0)
+	assert.Equal(t, ErrRuleNeedsBook, err)
+}
+
+func Test_EvaluateRuleLikeIdentify(t *testing.T) {
+	book := parseBook(t, `
+0	string	MZ	DOS executable
+>2	uleshort	x	\b, %d bytes in last page
+`)
+	target := []byte("MZ\x90\x00")
+
+	ictx := &InterpretContext{Book: book}
+	matches, err := ictx.IdentifyMatches(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+
+	res, err := EvaluateRule(newBytesReader(target), book[""][1], 0)
+	assert.NoError(t, err)
+	assert.True(t, res.Matched)
+	assert.EqualValues(t, matches[1].Range, res.Range)
+	assert.EqualValues(t, matches[1].Description, res.Description)
+	assert.EqualValues(t, "\\b, 144 bytes in last page", res.Description)
+}
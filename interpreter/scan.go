@@ -0,0 +1,117 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// ScanResult is what the top-level rules found at one base offset
+type ScanResult struct {
+	// Offset is where the embedded content starts in the target, rule
+	// offsets were relative to it
+	Offset  int64
+	Matches []Match
+}
+
+// Descriptions returns the description of every match, like Identify
+func (r ScanResult) Descriptions() []string {
+	return descriptions(r.Matches)
+}
+
+// Scan looks for content embedded in sr, like files in a firmware blob or
+// a disk image, by running the top-level rules at each of the given base
+// offsets, as if the target started there. Only offsets where something
+// matched are part of the results. Offsets outside of sr are skipped.
+//
+// The whole scan shares one evaluation: pages used at the same absolute
+// offset are only evaluated once, and the budget set by MaxRulesEvaluated
+// and MaxBytesExamined covers all offsets. If it runs out, the scan stops.
+// Like with Identify, non-fatal errors are returned as a *MultiError along
+// with the results.
+func (ctx *InterpretContext) Scan(sr *utils.SliceReader, offsets []int64) ([]ScanResult, error) {
+	i := 0
+	return ctx.scan(sr, func() (int64, bool) {
+		if i >= len(offsets) {
+			return 0, false
+		}
+		offset := offsets[i]
+		i++
+		return offset, true
+	})
+}
+
+// ScanStride is like Scan, for base offsets that are regularly spaced:
+// start, start+stride, start+2*stride, and so on, up to (but excluding)
+// max. If max is 0 or less, the scan goes on until the end of sr.
+func (ctx *InterpretContext) ScanStride(sr *utils.SliceReader, start int64, stride int64, max int64) ([]ScanResult, error) {
+	if stride <= 0 {
+		return nil, ErrInvalidStride
+	}
+
+	offset := start
+	done := false
+	return ctx.scan(sr, func() (int64, bool) {
+		end := sr.Size()
+		if max > 0 && max < end {
+			end = max
+		}
+		if done || offset >= end {
+			return 0, false
+		}
+		current := offset
+		if offset > end-stride {
+			// the next offset is past the end, adding could overflow
+			done = true
+		} else {
+			offset += stride
+		}
+		return current, true
+	})
+}
+
+// scan runs the top-level rules at every offset returned by next, until it
+// returns false
+func (ctx *InterpretContext) scan(sr *utils.SliceReader, next func() (int64, bool)) ([]ScanResult, error) {
+	if ctx.Book == nil {
+		return nil, ErrNilBook
+	}
+
+	if sr == nil {
+		return nil, ErrNilReader
+	}
+
+	st := acquireIdentifyState()
+	defer st.release()
+	defer st.reset()
+	ctx.prepareState(st)
+	st.breadcrumbs = true
+
+	var results []ScanResult
+	for {
+		offset, ok := next()
+		if !ok {
+			break
+		}
+		if offset < 0 || offset >= sr.Size() {
+			continue
+		}
+
+		matches := ctx.identifyInternal(st, sr, offset, "", false)
+
+		if ctx.DeduplicateFragments {
+			matches = deduplicateMatches(matches)
+		}
+
+		if len(matches) > 0 {
+			results = append(results, ScanResult{
+				Offset:  offset,
+				Matches: matches,
+			})
+		}
+
+		if st.stopped {
+			break
+		}
+	}
+
+	return results, st.err()
+}
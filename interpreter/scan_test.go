@@ -0,0 +1,90 @@
+package interpreter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const embeddedMagic = `
+0	string	\x89PNG\x0d\x0a\x1a\x0a	PNG image data
+>16	belong	x	\b, %d x
+>20	belong	x	%d
+0	string	\x1f\x8b	gzip compressed data
+>2	byte	8	\b, deflated
+`
+
+func firmwareBlob(t *testing.T) []byte {
+	var pngBuf bytes.Buffer
+	err := png.Encode(&pngBuf, image.NewGray(image.Rect(0, 0, 32, 16)))
+	assert.NoError(t, err)
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	_, err = gw.Write([]byte("hello embedded world"))
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+
+	blob := make([]byte, 8192)
+	copy(blob, pngBuf.Bytes())
+	copy(blob[4096:], gzBuf.Bytes())
+	return blob
+}
+
+func Test_Scan(t *testing.T) {
+	ictx := &InterpretContext{
+		Book: parseBook(t, embeddedMagic),
+	}
+	sr := newBytesReader(firmwareBlob(t))
+
+	results, err := ictx.ScanStride(sr, 0, 512, 0)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.EqualValues(t, 0, results[0].Offset)
+	assert.EqualValues(t, []string{"PNG image data", "\\b, 32 x", "16"}, results[0].Descriptions())
+	assert.EqualValues(t, 4096, results[1].Offset)
+	assert.EqualValues(t, []string{"gzip compressed data", "\\b, deflated"}, results[1].Descriptions())
+
+	// match ranges are absolute, so callers can carve
+	assert.EqualValues(t, 4096+2, results[1].Matches[1].Offset)
+
+	// stopping before the gzip stream
+	results, err = ictx.ScanStride(sr, 0, 512, 4096)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	// explicit offsets, out of bounds ones are skipped
+	results, err = ictx.Scan(sr, []int64{-1, 4096, 1 << 20})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.EqualValues(t, 4096, results[0].Offset)
+
+	// strides that would overflow the offset stop the scan
+	results, err = ictx.ScanStride(sr, 4096, math.MaxInt64, 0)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.EqualValues(t, 4096, results[0].Offset)
+
+	_, err = ictx.ScanStride(sr, 0, 0, 0)
+	assert.Equal(t, ErrInvalidStride, err)
+}
+
+func Test_ScanBudget(t *testing.T) {
+	ictx := &InterpretContext{
+		Book:              parseBook(t, embeddedMagic),
+		MaxRulesEvaluated: 10,
+	}
+	sr := newBytesReader(firmwareBlob(t))
+
+	// two top-level rules per offset, the budget is shared by all offsets
+	results, err := ictx.ScanStride(sr, 0, 512, 0)
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.Len(t, results, 1)
+	assert.EqualValues(t, 0, results[0].Offset)
+}
@@ -0,0 +1,16 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// searchTest is utils.SearchTest for the pattern of sk, through its finder,
+// which is only prepared once. flags are those of sk, with what the target
+// looks like.
+func searchTest(sk *parser.SearchKind, sr *utils.SliceReader, targetIndex int64, maxLen int64, flags utils.StringTestFlags) (int64, int64) {
+	if utils.TargetExcluded(flags) {
+		return -1, 0
+	}
+	return sk.Finder().Find(sr, targetIndex, maxLen)
+}
@@ -0,0 +1,125 @@
+package interpreter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SearchTestCached(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := "aAbB \t\x00."
+	randomString := func(max int) string {
+		b := make([]byte, rng.Intn(max))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	// the same patterns and flags come back, with other targets, their
+	// kinds keep their finders
+	patterns := make([]string, 8)
+	for i := range patterns {
+		patterns[i] = randomString(3) + "a"
+	}
+	kinds := make(map[string]*parser.SearchKind)
+	kindOf := func(pattern string, flags utils.StringTestFlags) *parser.SearchKind {
+		flags &^= utils.TextTarget | utils.BinaryTarget
+		key := fmt.Sprintf("%q/%d", pattern, flags)
+		if kinds[key] == nil {
+			kinds[key] = &parser.SearchKind{Value: pattern, Flags: flags}
+		}
+		return kinds[key]
+	}
+	for i := 0; i < 5000; i++ {
+		target := utils.NewSliceReaderFromBytes([]byte(randomString(40)))
+		pattern := patterns[rng.Intn(len(patterns))]
+		index := int64(rng.Intn(int(target.Size()) + 2))
+		maxLen := int64(rng.Intn(int(target.Size())+4)) - 2
+		flags := utils.StringTestFlags(rng.Intn(int(utils.FullWord) * 2))
+		if flags&(utils.ForceText|utils.ForceBinary) > 0 {
+			flags |= []utils.StringTestFlags{0, utils.TextTarget, utils.BinaryTarget}[rng.Intn(3)]
+		}
+
+		expectedPos, expectedLen := utils.SearchTest(target, index, maxLen, pattern, flags)
+		pos, length := searchTest(kindOf(pattern, flags), target, index, maxLen, flags)
+		assert.EqualValues(t, expectedPos, pos, "%q, flags %d", pattern, flags)
+		assert.EqualValues(t, expectedLen, length, "%q, flags %d", pattern, flags)
+	}
+
+	// hints don't make other finders
+	sk := kindOf("text", utils.ForceText)
+	finder := sk.Finder()
+	sr := utils.NewSliceReaderFromBytes([]byte("some text"))
+	pos, _ := searchTest(sk, sr, 0, 16, utils.ForceText|utils.BinaryTarget)
+	assert.EqualValues(t, -1, pos)
+	pos, _ = searchTest(sk, sr, 0, 16, utils.ForceText|utils.TextTarget)
+	assert.EqualValues(t, 5, pos)
+	assert.Same(t, finder, sk.Finder())
+}
+
+// searchesMagic has many search rules, as magic for text formats does
+const searchesMagic = `
+0	search/4096	<!DOCTYPE\ html	HTML document
+0	search/4096/c	<html	HTML document
+0	search/1024	<?xml	XML document
+0	search/4096/W	#!\ /bin/sh	shell script
+0	search/4096/w	#!\ /usr/bin/env\ python	Python script
+0	search/8192	\\documentclass	LaTeX document
+0	search/8192/c	begin:vcard	vCard
+0	search/4096/f	import	source, with imports
+0	search/4096	-----BEGIN\ PGP	PGP armored data
+0	search/4096	diff\ --git	git diff
+`
+
+// BenchmarkIdentifySearches identifies a directory of text files with
+// searchesMagic, with finders prepared once or every time
+func BenchmarkIdentifySearches(b *testing.B) {
+	book := parseBook(b, searchesMagic)
+	dir := b.TempDir()
+	var paths []string
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("text-%d", i))
+		text := strings.Repeat(fmt.Sprintf("line %d of some text that matches nothing\n", i), 1+i*4)
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, bc := range []struct {
+		name       string
+		searchTest SearchTestFunc
+	}{
+		{"cached", nil},
+		{"uncached", utils.SearchTest},
+	} {
+		ictx := &InterpretContext{Book: book, SearchTest: bc.searchTest}
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, path := range paths {
+					f, err := os.Open(path)
+					if err != nil {
+						b.Fatal(err)
+					}
+					stat, err := f.Stat()
+					if err != nil {
+						b.Fatal(err)
+					}
+					ictx.IdentifyReaderAt(f, stat.Size())
+					f.Close()
+				}
+			}
+		})
+	}
+}
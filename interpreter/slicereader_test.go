@@ -0,0 +1,51 @@
+package interpreter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SliceReaderFromBytesIdentify(t *testing.T) {
+	ictx := &InterpretContext{Book: parseBook(t, samplesMagic)}
+	for _, sample := range identifySamples {
+		expected, err := ictx.Identify(newBytesReader(sample))
+		assert.NoError(t, err)
+		actual, err := ictx.Identify(utils.NewSliceReaderFromBytes(sample))
+		assert.NoError(t, err)
+		assert.EqualValues(t, expected, actual)
+	}
+}
+
+func Test_SliceReaderTailIdentify(t *testing.T) {
+	data := []byte("0123456789abcdef0123")
+	size := int64(len(data))
+	path := filepath.Join(t.TempDir(), "target")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	readers := map[string]*utils.SliceReader{
+		"bytes.Reader": newBytesReader(data),
+		"os.File":      utils.NewSliceReader(f, 0, size),
+		"from bytes":   utils.NewSliceReaderFromBytes(data),
+		"caching":      utils.NewCachingSliceReader(f, size, 8),
+		"window":       utils.NewSliceReader(bytes.NewReader(append([]byte("xx"), append(data, "yy"...)...)), 2, size),
+	}
+
+	// rules reading the last bytes, or past them, match the same whatever
+	// the reader
+	book := parseBook(t, "16\tlelong\tx\tlast %d\n>19\tbeshort\tx\tpast %d\n>19\tubyte\tx\tbyte %d\n")
+	ictx := &InterpretContext{Book: book}
+	for name, sr := range readers {
+		result, err := ictx.Identify(sr)
+		assert.NoError(t, err, name)
+		assert.EqualValues(t, "last 858927408 past %d byte 51", utils.MergeStrings(result), name)
+	}
+}
@@ -0,0 +1,162 @@
+package interpreter
+
+import "sync"
+
+// maxMemoEntries bounds how many page evaluations are remembered during a
+// single identification
+const maxMemoEntries = 1024
+
+// memoKey identifies one evaluation of a page
+type memoKey struct {
+	page       string
+	offset     int64
+	swapEndian bool
+}
+
+// memoEntry is a remembered page evaluation
+type memoEntry struct {
+	matches []Match
+	// crumbs is the breadcrumb of the page that used the remembered page
+	crumbs []string
+}
+
+// identifyState holds what lives for the duration of a single Identify call.
+// It's never shared between calls, so concurrent identifications don't
+// interfere with each other. States are pooled so that identifying many
+// files doesn't allocate a new one every time.
+type identifyState struct {
+	memo map[memoKey]memoEntry
+
+	// crumbs are the pages being evaluated, from the top-level page down
+	crumbs []string
+	// breadcrumbs is set when matches need a copy of crumbs, which callers
+	// that only want descriptions don't
+	breadcrumbs bool
+
+	// stats is nil unless the context collects stats
+	stats *statsCollector
+
+	// tracer is nil unless somebody listens to events
+	tracer Tracer
+	// depth is how many use rules deep the evaluation currently is
+	depth int
+
+	stringTest StringTestFunc
+	// searchTest is nil unless SearchTest replaces the finders of the rules
+	searchTest SearchTestFunc
+
+	// what the evaluation budget is checked against
+	rulesEvaluated int
+	bytesExamined  int64
+
+	// errs are the non-fatal errors encountered so far
+	errs []error
+	// stopped is set once the evaluation budget has run out
+	stopped bool
+}
+
+var identifyStatePool = sync.Pool{
+	New: func() interface{} {
+		return &identifyState{
+			memo: make(map[memoKey]memoEntry),
+		}
+	},
+}
+
+// acquireIdentifyState returns a blank state from the pool
+func acquireIdentifyState() *identifyState {
+	return identifyStatePool.Get().(*identifyState)
+}
+
+// release puts the state back into the pool
+func (st *identifyState) release() {
+	identifyStatePool.Put(st)
+}
+
+// reset prepares the state for another identification. Matches remembered
+// in the memo have already been copied into the results, so it's safe to
+// forget them.
+func (st *identifyState) reset() {
+	for key := range st.memo {
+		delete(st.memo, key)
+	}
+	st.crumbs = st.crumbs[:0]
+	st.breadcrumbs = false
+	st.stats = nil
+	st.tracer = nil
+	st.depth = 0
+	st.stringTest = nil
+	st.searchTest = nil
+	st.rulesEvaluated = 0
+	st.bytesExamined = 0
+	for i := range st.errs {
+		st.errs[i] = nil
+	}
+	st.errs = st.errs[:0]
+	st.stopped = false
+}
+
+// fail records a non-fatal error, evaluation goes on
+func (st *identifyState) fail(err error) {
+	st.errs = append(st.errs, err)
+}
+
+// err returns the non-fatal errors recorded so far as a *MultiError, or nil
+func (st *identifyState) err() error {
+	if len(st.errs) == 0 {
+		return nil
+	}
+	return &MultiError{Errors: append([]error(nil), st.errs...)}
+}
+
+// remember stores the result of evaluating a page, unless the memo is full
+func (st *identifyState) remember(key memoKey, matches []Match) {
+	if len(st.memo) >= maxMemoEntries {
+		return
+	}
+	entry := memoEntry{matches: matches}
+	if st.breadcrumbs {
+		entry.crumbs = st.breadcrumb()
+	}
+	st.memo[key] = entry
+}
+
+// recall returns the remembered result of evaluating a page. If it was
+// used from somewhere else, breadcrumbs are adjusted to the current path.
+func (st *identifyState) recall(key memoKey) ([]Match, bool) {
+	entry, ok := st.memo[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !st.breadcrumbs || equalCrumbs(entry.crumbs, st.crumbs) {
+		return entry.matches, true
+	}
+
+	matches := make([]Match, len(entry.matches))
+	for i, m := range entry.matches {
+		crumbs := st.breadcrumb()
+		m.Breadcrumb = append(crumbs, m.Breadcrumb[len(entry.crumbs):]...)
+		matches[i] = m
+	}
+	return matches, true
+}
+
+// breadcrumb returns a copy of the current page path, for results
+func (st *identifyState) breadcrumb() []string {
+	crumbs := make([]string, len(st.crumbs))
+	copy(crumbs, st.crumbs)
+	return crumbs
+}
+
+func equalCrumbs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package interpreter
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// Stats counts what the interpreter did since stats were last reset,
+// see InterpretContext.CollectStats
+type Stats struct {
+	// RulesEvaluated counts rules whose offset resolved and whose test was
+	// attempted, rules skipped because their parent didn't match are not
+	// included
+	RulesEvaluated int64
+	// RulesMatched counts rules whose test succeeded
+	RulesMatched int64
+	// ReadFailures counts rules that couldn't be tested because an offset
+	// was out of bounds, or a read came back short
+	ReadFailures int64
+
+	// Pages has counters for every page that was entered, including the
+	// top-level page ""
+	Pages map[string]PageStats
+	// Families has counters for every kind family that was evaluated
+	Families map[parser.KindFamily]FamilyStats
+}
+
+// PageStats counts what happened in a single page
+type PageStats struct {
+	// Entered counts how many times the page was evaluated, memoized
+	// evaluations are not included
+	Entered        int64
+	RulesEvaluated int64
+	RulesMatched   int64
+}
+
+// FamilyStats counts evaluations of rules of a single kind family
+type FamilyStats struct {
+	RulesEvaluated int64
+	RulesMatched   int64
+}
+
+// counters are updated atomically, so a context can be shared between
+// goroutines while collecting stats
+type counters struct {
+	entered   int64
+	evaluated int64
+	matched   int64
+}
+
+func (c *counters) reset() {
+	atomic.StoreInt64(&c.entered, 0)
+	atomic.StoreInt64(&c.evaluated, 0)
+	atomic.StoreInt64(&c.matched, 0)
+}
+
+type statsCollector struct {
+	total        counters
+	readFailures int64
+
+	pages    sync.Map // string -> *counters
+	families sync.Map // parser.KindFamily -> *counters
+}
+
+func (sc *statsCollector) page(page string) *counters {
+	if c, ok := sc.pages.Load(page); ok {
+		return c.(*counters)
+	}
+	c, _ := sc.pages.LoadOrStore(page, &counters{})
+	return c.(*counters)
+}
+
+func (sc *statsCollector) family(family parser.KindFamily) *counters {
+	if c, ok := sc.families.Load(family); ok {
+		return c.(*counters)
+	}
+	c, _ := sc.families.LoadOrStore(family, &counters{})
+	return c.(*counters)
+}
+
+func (sc *statsCollector) ruleEvaluated(pc *counters, family parser.KindFamily) {
+	atomic.AddInt64(&sc.total.evaluated, 1)
+	atomic.AddInt64(&pc.evaluated, 1)
+	atomic.AddInt64(&sc.family(family).evaluated, 1)
+}
+
+func (sc *statsCollector) ruleMatched(pc *counters, family parser.KindFamily) {
+	atomic.AddInt64(&sc.total.matched, 1)
+	atomic.AddInt64(&pc.matched, 1)
+	atomic.AddInt64(&sc.family(family).matched, 1)
+}
+
+func (sc *statsCollector) readFailed() {
+	atomic.AddInt64(&sc.readFailures, 1)
+}
+
+func (sc *statsCollector) snapshot() Stats {
+	s := Stats{
+		RulesEvaluated: atomic.LoadInt64(&sc.total.evaluated),
+		RulesMatched:   atomic.LoadInt64(&sc.total.matched),
+		ReadFailures:   atomic.LoadInt64(&sc.readFailures),
+		Pages:          make(map[string]PageStats),
+		Families:       make(map[parser.KindFamily]FamilyStats),
+	}
+
+	sc.pages.Range(func(key, value interface{}) bool {
+		c := value.(*counters)
+		s.Pages[key.(string)] = PageStats{
+			Entered:        atomic.LoadInt64(&c.entered),
+			RulesEvaluated: atomic.LoadInt64(&c.evaluated),
+			RulesMatched:   atomic.LoadInt64(&c.matched),
+		}
+		return true
+	})
+
+	sc.families.Range(func(key, value interface{}) bool {
+		c := value.(*counters)
+		s.Families[key.(parser.KindFamily)] = FamilyStats{
+			RulesEvaluated: atomic.LoadInt64(&c.evaluated),
+			RulesMatched:   atomic.LoadInt64(&c.matched),
+		}
+		return true
+	})
+
+	return s
+}
+
+func (sc *statsCollector) reset() {
+	sc.total.reset()
+	atomic.StoreInt64(&sc.readFailures, 0)
+
+	for _, m := range []*sync.Map{&sc.pages, &sc.families} {
+		m.Range(func(key, value interface{}) bool {
+			value.(*counters).reset()
+			return true
+		})
+	}
+}
+
+// collector returns the context's stats collector, creating it if needed
+func (ctx *InterpretContext) collector() *statsCollector {
+	if sc, ok := ctx.stats.Load().(*statsCollector); ok {
+		return sc
+	}
+	// only the first store wins, everybody uses its collector
+	ctx.stats.CompareAndSwap(nil, &statsCollector{})
+	return ctx.stats.Load().(*statsCollector)
+}
+
+// Stats returns the counters accumulated since CollectStats was turned on,
+// or since the last call to ResetStats
+func (ctx *InterpretContext) Stats() Stats {
+	return ctx.collector().snapshot()
+}
+
+// ResetStats sets all counters back to zero
+func (ctx *InterpretContext) ResetStats() {
+	ctx.collector().reset()
+}
@@ -0,0 +1,103 @@
+package interpreter
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+const statsMagic = `
+0	name	chunk
+>0	string	data	data chunk
+>0	string	list	list chunk
+0	string	RIFF	RIFF
+>4	use	chunk
+>8	use	chunk
+>0x100	ulong	0	never read
+>0	search/0x10	WAVE	WAVE
+`
+
+func doubled(s Stats) Stats {
+	d := Stats{
+		RulesEvaluated: s.RulesEvaluated * 2,
+		RulesMatched:   s.RulesMatched * 2,
+		ReadFailures:   s.ReadFailures * 2,
+		Pages:          make(map[string]PageStats),
+		Families:       make(map[parser.KindFamily]FamilyStats),
+	}
+	for page, ps := range s.Pages {
+		d.Pages[page] = PageStats{ps.Entered * 2, ps.RulesEvaluated * 2, ps.RulesMatched * 2}
+	}
+	for family, fs := range s.Families {
+		d.Families[family] = FamilyStats{fs.RulesEvaluated * 2, fs.RulesMatched * 2}
+	}
+	return d
+}
+
+func Test_Stats(t *testing.T) {
+	ictx := &InterpretContext{
+		Book:         parseBook(t, statsMagic),
+		CollectStats: true,
+	}
+	target := []byte("RIFFdatalistWAVE")
+
+	_, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+
+	once := ictx.Stats()
+	assert.EqualValues(t, 10, once.RulesEvaluated)
+	assert.EqualValues(t, 6, once.RulesMatched)
+	// the ulong at 0x100
+	assert.EqualValues(t, 1, once.ReadFailures)
+	// use rules are evaluated, but don't count as matches themselves
+	assert.EqualValues(t, PageStats{Entered: 1, RulesEvaluated: 4, RulesMatched: 2}, once.Pages[""])
+	// entered at 4 and 8, the name rule matches every time
+	assert.EqualValues(t, PageStats{Entered: 2, RulesEvaluated: 6, RulesMatched: 4}, once.Pages["chunk"])
+	assert.EqualValues(t, FamilyStats{RulesEvaluated: 5, RulesMatched: 3}, once.Families[parser.KindFamilyString])
+	assert.EqualValues(t, FamilyStats{RulesEvaluated: 1, RulesMatched: 1}, once.Families[parser.KindFamilySearch])
+
+	ictx.ResetStats()
+	for i := 0; i < 2; i++ {
+		_, err := ictx.Identify(newBytesReader(target))
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, doubled(once), ictx.Stats())
+
+	// stats are only collected when asked for
+	ictx.ResetStats()
+	ictx.CollectStats = false
+	_, err = ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, ictx.Stats().RulesEvaluated)
+}
+
+func Test_StatsConcurrent(t *testing.T) {
+	ictx := &InterpretContext{
+		Book:         parseBook(t, statsMagic),
+		CollectStats: true,
+	}
+	target := []byte("RIFFdatalistWAVE")
+
+	_, err := ictx.Identify(newBytesReader(target))
+	assert.NoError(t, err)
+	once := ictx.Stats()
+	ictx.ResetStats()
+
+	const numWorkers = 16
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ictx.Identify(newBytesReader(target))
+		}()
+	}
+	wg.Wait()
+
+	stats := ictx.Stats()
+	assert.EqualValues(t, once.RulesEvaluated*numWorkers, stats.RulesEvaluated)
+	assert.EqualValues(t, once.RulesMatched*numWorkers, stats.RulesMatched)
+	assert.EqualValues(t, once.Pages["chunk"].Entered*numWorkers, stats.Pages["chunk"].Entered)
+}
@@ -0,0 +1,28 @@
+package interpreter
+
+import (
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_String16Kind(t *testing.T) {
+	book := parseBook(t, `
+0	bestring16	MZ	big-endian MZ
+>&0	bestring16	x	\b, then "%s"
+0	lestring16	!MZ	not little-endian MZ
+`)
+
+	sk, ok := book[""][0].Kind.Data.(*parser.String16Kind)
+	assert.True(t, ok)
+	assert.EqualValues(t, parser.BigEndian, sk.Endianness)
+	assert.EqualValues(t, "MZ", sk.Value)
+	assert.True(t, book[""][1].Kind.Data.(*parser.String16Kind).MatchAny)
+
+	// strings stop at their NUL code unit
+	assert.EqualValues(t, `big-endian MZ, then "héllo"`, identify(t, book, []byte("\x00M\x00Z\x00h\x00\xe9\x00l\x00l\x00o\x00\x00\x00!")))
+	assert.EqualValues(t, `big-endian MZ, then ""`, identify(t, book, []byte("\x00M\x00Z\x00\x00")))
+	assert.EqualValues(t, `not little-endian MZ`, identify(t, book, []byte("MZ")))
+	assert.EqualValues(t, ``, identify(t, book, []byte("M\x00Z\x00")))
+}
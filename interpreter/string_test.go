@@ -0,0 +1,288 @@
+package interpreter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/9uanhuo/wizardry/parser"
+	"github.com/9uanhuo/wizardry/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StringTestWhitespace(t *testing.T) {
+	W := utils.StringTestFlags(utils.CompactWhitespace)
+	w := utils.StringTestFlags(utils.OptionalBlanks)
+
+	for _, c := range []struct {
+		pattern  string
+		flags    utils.StringTestFlags
+		target   string
+		expected int64
+	}{
+		// from file(5): with W, "a  b" needs at least two blanks
+		{"a  b", W, "a  b", 4},
+		{"a  b", W, "a     b", 7},
+		{"a  b", W, "a b", -1},
+		{"a  b", W, "ab", -1},
+		{"a b", W, "a \t b", 5},
+		{"a b", W, "ab", -1},
+		// the run is compacted up to what comes next
+		{"a b", W, "a bc", 3},
+		{"a ", W, "a  ", 3},
+		{"a ", W, "ab", -1},
+		// with w, "a b" also matches "ab"
+		{"a b", w, "ab", 2},
+		{"a b", w, "a b", 3},
+		// with both, there can be no blank, or any number of them
+		{"a b", W | w, "ab", 2},
+		{"a b", W | w, "a   b", 5},
+		{"a  b", W | w, "a b", 3},
+		{"a  b", W | w, "ab", 2},
+		// with neither, blanks match themselves
+		{"a b", 0, "a  b", -1},
+		{"a b", 0, "ab", -1},
+		// troff, as in file's magic
+		{".TH ", W, ".TH\tls 1", 4},
+		{".TH ", W, ".THls 1", -1},
+	} {
+		actual := utils.StringTestBytes([]byte(c.target), 0, c.pattern, c.flags)
+		assert.EqualValues(t, c.expected, actual, fmt.Sprintf("%q against %q, flags %d", c.pattern, c.target, c.flags))
+	}
+
+	book := parseBook(t, "0\tstring/W\t.TH\\ \ttroff or preprocessor input text\n")
+	assert.EqualValues(t, "troff or preprocessor input text", identify(t, book, []byte(".TH  LS 1")))
+	assert.EqualValues(t, "", identify(t, book, []byte(".THLS 1")))
+}
+
+func Test_StringTestOptionalBlanks(t *testing.T) {
+	w := utils.StringTestFlags(utils.OptionalBlanks)
+	W := utils.StringTestFlags(utils.CompactWhitespace)
+	c := utils.StringTestFlags(utils.LowerMatchesBoth)
+
+	for _, tc := range []struct {
+		pattern  string
+		flags    utils.StringTestFlags
+		target   string
+		expected int64
+	}{
+		// a blank matches itself, or nothing
+		{"x y", w, "x y", 3},
+		{"x y", w, "xy", 2},
+		{"x  y", w, "x y", 3},
+		{"x  y", w, "xy", 2},
+		// blanks in the target are only skipped with W
+		{"x y", w, "x  y", -1},
+		{"xy", w, "x y", -1},
+		{"x y", w | W, "x  y", 4},
+		// a blank doesn't match another one, it's skipped instead
+		{"x y", w, "x\ty", -1},
+		{"x \ty", w, "x\ty", 3},
+		{"x\t y", w, "x y", 3},
+		// at the end of the target too
+		{"x ", w, "x", 1},
+		{"x  ", w, "x ", 2},
+		{"x y", w, "x", -1},
+		{"x ", 0, "x", -1},
+		{"x ", w | W, "x", 1},
+		// along with other flags
+		{"x y", w | c, "XY", 2},
+		{"x y", w | c, "X Y", 3},
+	} {
+		actual := utils.StringTestBytes([]byte(tc.target), 0, tc.pattern, tc.flags)
+		assert.EqualValues(t, tc.expected, actual, fmt.Sprintf("%q against %q, flags %d", tc.pattern, tc.target, tc.flags))
+	}
+
+	book := parseBook(t, "0\tstring/w\t#!\\ /bin/sh\tshell script\n")
+	assert.EqualValues(t, "shell script", identify(t, book, []byte("#!/bin/sh")))
+	assert.EqualValues(t, "shell script", identify(t, book, []byte("#! /bin/sh\n")))
+	assert.EqualValues(t, "", identify(t, book, []byte("#!  /bin/sh\n")))
+}
+
+// targetsMagic has rules for text targets, binary ones, and full words
+const targetsMagic = `
+0	ubyte	x	target
+>0	string/t	hello	\b, text hello
+>0	string/b	hello	\b, binary hello
+>0	string/f	hel	\b, hel, the word
+>0	search/32/f	world	\b, world, the word
+>0	search/t/32	hello	\b, found in text
+>0	search/32/b	world	\b, found in binary
+`
+
+func Test_IdentifyTargets(t *testing.T) {
+	book := parseBook(t, targetsMagic)
+	flagsOf := func(i int) utils.StringTestFlags {
+		if sk, ok := book[""][i].Kind.Data.(*parser.SearchKind); ok {
+			return sk.Flags
+		}
+		return book[""][i].Kind.Data.(*parser.StringKind).Flags
+	}
+	assert.EqualValues(t, utils.FullWord, flagsOf(4))
+	assert.EqualValues(t, 32, book[""][4].Kind.Data.(*parser.SearchKind).MaxLen)
+	assert.EqualValues(t, utils.ForceText, flagsOf(5))
+	assert.EqualValues(t, 32, book[""][5].Kind.Data.(*parser.SearchKind).MaxLen)
+	assert.EqualValues(t, utils.ForceBinary, flagsOf(6))
+
+	for _, sample := range targetsSamples {
+		assert.EqualValues(t, sample.expected, identify(t, book, []byte(sample.data)))
+	}
+}
+
+// targetsSamples are text and binary targets for targetsMagic
+var targetsSamples = []struct {
+	data     string
+	expected string
+}{
+	{"hello there\n", "target, text hello, found in text"},
+	{"hello\x00world", "target, binary hello, world, the word, found in binary"},
+	{"hel world", "target, hel, the word, world, the word"},
+	{"helloworld world\n", "target, text hello, world, the word, found in text"},
+	{"helloworld\x00", "target, binary hello, found in binary"},
+}
+
+// searchPos returns where utils.SearchTest finds pattern
+func searchPos(sr *utils.SliceReader, targetIndex int64, maxLen int64, pattern string, flags utils.StringTestFlags) int64 {
+	pos, _ := utils.SearchTest(sr, targetIndex, maxLen, pattern, flags)
+	return pos
+}
+
+func Test_SearchTestCase(t *testing.T) {
+	c := utils.StringTestFlags(utils.LowerMatchesBoth)
+	C := utils.StringTestFlags(utils.UpperMatchesBoth)
+	sr := utils.NewSliceReaderFromBytes([]byte("<!DOCTYPE html>\n<HTML><hTmL>"))
+
+	assert.EqualValues(t, -1, searchPos(sr, 0, 64, "<html", 0))
+	assert.EqualValues(t, 16, searchPos(sr, 0, 64, "<html", c))
+	assert.EqualValues(t, 16, searchPos(sr, 0, 64, "<HTML", C))
+	// only lower case letters of the pattern match both with c
+	assert.EqualValues(t, 16, searchPos(sr, 0, 64, "<HTML", c))
+	assert.EqualValues(t, 22, searchPos(sr, 0, 64, "<hTmL", 0))
+	assert.EqualValues(t, 22, searchPos(sr, 0, 64, "<hTmL", C))
+	assert.EqualValues(t, 16, searchPos(sr, 0, 64, "<hTmL", c|C))
+	// starting within the range, from where it starts
+	assert.EqualValues(t, -1, searchPos(sr, 0, 16, "<html", c))
+	assert.EqualValues(t, 16, searchPos(sr, 0, 17, "<html", c))
+	assert.EqualValues(t, 0, searchPos(sr, 16, 5, "<html", c))
+	assert.EqualValues(t, 2, searchPos(sr, 3, 64, "type", c))
+	assert.EqualValues(t, 10, searchPos(sr, 0, 64, "HTML", C|utils.FullWord))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 64, "typ", c|utils.FullWord))
+
+	// matches end where file(1) continues from
+	book := parseBook(t, "0\tsearch/64/c\t<html\tHTML document\n>&0\tstring\t><\t\\b, tags\n")
+	assert.EqualValues(t, "HTML document, tags", identify(t, book, []byte("<!DOCTYPE html>\n<HTML><hTmL>")))
+	assert.EqualValues(t, "HTML document", identify(t, book, []byte("\n\n<Html>")))
+	assert.EqualValues(t, "", identify(t, book, []byte("<ht ml>")))
+}
+
+func Test_SearchTestWhitespace(t *testing.T) {
+	W := utils.StringTestFlags(utils.CompactWhitespace)
+	w := utils.StringTestFlags(utils.OptionalBlanks)
+	c := utils.StringTestFlags(utils.LowerMatchesBoth)
+
+	for _, tc := range []struct {
+		target  string
+		maxLen  int64
+		pattern string
+		flags   utils.StringTestFlags
+		pos     int64
+		length  int64
+	}{
+		// more blanks in the target
+		{"xxa   b!", 64, "a b", W, 2, 5},
+		{"xxa   b!", 64, "a b", 0, -1, 0},
+		{"xxa  b", 64, "a b", w, -1, 0},
+		{"xxa \t b", 64, "a b", W | w, 2, 5},
+		{"a   b", 1, "a b", W, 0, 5},
+		{"xa   b", 1, "a b", W, -1, 0},
+		// fewer
+		{"xxab", 64, "a b", W, -1, 0},
+		{"xxab", 64, "a b", w, 2, 2},
+		{"xxab a b", 64, "a b", W, 5, 3},
+		{"xxa b", 64, "a  b", w, 2, 3},
+		{"xxab", 64, "a b", W | w, 2, 2},
+		// found from the longest part without blanks
+		{"zz a  longword", 64, "a longword", W, 3, 11},
+		{"a longwor a  longword", 64, "a longword", W, 10, 11},
+		{"zz alongword", 64, "a longword", w, 3, 9},
+		{"ab\t\tx", 64, " x", W, 2, 3},
+		{"abx", 64, " x", w, 2, 1},
+		{"a   B", 64, "A b", W | c, -1, 0},
+		{"A   B", 64, "A b", W | c, 0, 5},
+		{"xx a  b", 64, "a b", W | utils.FullWord, 3, 4},
+		{"xxa  b", 64, "a b", W | utils.FullWord, -1, 0},
+	} {
+		sr := utils.NewSliceReaderFromBytes([]byte(tc.target))
+		pos, length := utils.SearchTest(sr, 0, tc.maxLen, tc.pattern, tc.flags)
+		msg := fmt.Sprintf("%q in %q, flags %d", tc.pattern, tc.target, tc.flags)
+		assert.EqualValues(t, tc.pos, pos, msg)
+		assert.EqualValues(t, tc.length, length, msg)
+	}
+
+	// what follows the match is right after it, however long it is
+	book := parseBook(t, "0\tsearch/32/W\ta\\ b\tfound\n>&0\tubyte\t0x21\t\\b, bang\n")
+	assert.EqualValues(t, "found, bang", identify(t, book, []byte("xx a    b!")))
+	assert.EqualValues(t, "found", identify(t, book, []byte("xx a  b !")))
+	assert.EqualValues(t, "", identify(t, book, []byte("xx ab!")))
+	book = parseBook(t, "0\tsearch/32/w\ta\\ b\tfound\n>&0\tubyte\t0x21\t\\b, bang\n")
+	assert.EqualValues(t, "found, bang", identify(t, book, []byte("xx ab!")))
+	assert.EqualValues(t, "found, bang", identify(t, book, []byte("xx a b!")))
+}
+
+func Test_SearchRange(t *testing.T) {
+	c := utils.StringTestFlags(utils.LowerMatchesBoth)
+	W := utils.StringTestFlags(utils.CompactWhitespace)
+	w := utils.StringTestFlags(utils.OptionalBlanks)
+	sr := utils.NewSliceReaderFromBytes([]byte("xxabxx"))
+
+	// the range is where matches start, they may run past it
+	assert.EqualValues(t, 2, searchPos(sr, 0, 3, "ab", 0))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 2, "ab", 0))
+	assert.EqualValues(t, 2, searchPos(sr, 0, 3, "AB", c|utils.UpperMatchesBoth))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 2, "AB", utils.UpperMatchesBoth))
+	assert.EqualValues(t, 2, searchPos(sr, 0, 3, "ab", utils.ForceBinary))
+	assert.EqualValues(t, 2, searchPos(sr, 0, 3, "a b", w))
+	assert.EqualValues(t, 1, searchPos(sr, 1, 2, "abxx", 0))
+	// but not past the target
+	assert.EqualValues(t, -1, searchPos(sr, 0, 3, "abxxx", 0))
+	// ranges beyond it are fine
+	assert.EqualValues(t, 2, searchPos(sr, 0, 1<<40, "ab", 0))
+	assert.EqualValues(t, 2, searchPos(sr, 0, 1<<40, "a b", W|w))
+	assert.EqualValues(t, -1, searchPos(sr, 6, 1<<40, "ab", 0))
+
+	blanks := utils.NewSliceReaderFromBytes([]byte("xxa      b"))
+	pos, length := utils.SearchTest(blanks, 0, 3, "a b", W)
+	assert.EqualValues(t, 2, pos)
+	assert.EqualValues(t, 8, length)
+	pos, _ = utils.SearchTest(blanks, 0, 3, " b", W)
+	assert.EqualValues(t, -1, pos)
+	pos, length = utils.SearchTest(blanks, 0, 4, " b", W)
+	assert.EqualValues(t, 3, pos)
+	assert.EqualValues(t, 7, length)
+
+	// zero is the default range
+	data := make([]byte, utils.DefaultSearchRange+16)
+	for _, at := range []int{0, 100, utils.DefaultSearchRange - 1, utils.DefaultSearchRange} {
+		for i := range data {
+			data[i] = 'x'
+		}
+		copy(data[at:], "ab")
+		expected := int64(at)
+		if at >= utils.DefaultSearchRange {
+			expected = -1
+		}
+		sr := utils.NewSliceReaderFromBytes(data)
+		assert.EqualValues(t, expected, searchPos(sr, 0, 0, "ab", 0), "ab at %d", at)
+		assert.EqualValues(t, expected, searchPos(sr, 0, 0, "AB", utils.UpperMatchesBoth), "ab at %d", at)
+	}
+
+	// file reports these
+	book := parseBook(t, "0\tsearch/3\tab\tshort range\n>&0\tstring\txx\t\\b, then xx\n"+
+		"0\tsearch/0\tab\tdefault range\n"+
+		"0\tsearch/1/W\tx\\ a\tblanks\n")
+	assert.EqualValues(t, "short range, then xx", identify(t, book, []byte("xxabxx")))
+	assert.EqualValues(t, "default range", identify(t, book, []byte("xxxabxx")))
+	assert.EqualValues(t, "blanks", identify(t, book, []byte("x   a")))
+	assert.EqualValues(t, "", identify(t, book, []byte("axx")))
+	assert.EqualValues(t, 0, book[""][2].Kind.Data.(*parser.SearchKind).MaxLen)
+	assert.EqualValues(t, utils.DefaultSearchRange, parseBook(t, "0\tsearch\tab\tab\n")[""][0].Kind.Data.(*parser.SearchKind).MaxLen)
+}
@@ -0,0 +1,154 @@
+package interpreter
+
+import (
+	"github.com/9uanhuo/wizardry/parser"
+)
+
+// Outcome is how the evaluation of a rule ended
+type Outcome int
+
+const (
+	// OutcomeMatched is for rules whose test succeeded
+	OutcomeMatched Outcome = iota
+	// OutcomeNotMatched is for rules whose test failed
+	OutcomeNotMatched
+	// OutcomeReadFailed is for rules that couldn't be tested because their
+	// offset couldn't be resolved or was out of bounds, or because the
+	// value to test couldn't be read
+	OutcomeReadFailed
+	// OutcomeExcluded is for rules excluded by ExcludeFamilies or
+	// ExcludeIndirect
+	OutcomeExcluded
+	// OutcomeUsed is for use rules, right before the page they use is
+	// evaluated
+	OutcomeUsed
+	// OutcomeReused is for use rules whose page had already been evaluated
+	// at the same offset, and whose results are reused
+	OutcomeReused
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeMatched:
+		return "matched"
+	case OutcomeNotMatched:
+		return "not matched"
+	case OutcomeReadFailed:
+		return "read failed"
+	case OutcomeExcluded:
+		return "excluded"
+	case OutcomeUsed:
+		return "used"
+	case OutcomeReused:
+		return "reused"
+	}
+	return "unknown outcome"
+}
+
+// PageEvent is emitted when the evaluation of a page starts or ends
+type PageEvent struct {
+	Page       string
+	Offset     int64
+	SwapEndian bool
+	// Depth is 0 for the top-level page, 1 for pages it uses, and so on
+	Depth    int
+	NumRules int
+}
+
+// RuleEvent is emitted when a rule has been evaluated. Rules skipped
+// because their parent didn't match don't produce events.
+type RuleEvent struct {
+	Page  string
+	Depth int
+	// Rule is the rule in the spellbook, its Line tells where it comes from
+	Rule *parser.Rule
+	// Offset is where the rule's test was performed, after resolving
+	// indirect and relative offsets
+	Offset int64
+	// Value is the value read by integer tests, if HasValue is true
+	Value    uint64
+	HasValue bool
+	Outcome  Outcome
+	// Err explains why a read failed, or why a use rule did nothing
+	Err error
+}
+
+// Tracer receives structured events in evaluation order, including from
+// inside pages that are used
+type Tracer interface {
+	PageEntered(ev PageEvent)
+	RuleEvaluated(ev RuleEvent)
+	PageLeft(ev PageEvent)
+}
+
+// NewLogTracer returns a Tracer that formats events with logf. It's what
+// InterpretContext.Logf uses.
+func NewLogTracer(logf LogFunc) Tracer {
+	return &logTracer{logf}
+}
+
+type logTracer struct {
+	logf LogFunc
+}
+
+func (lt *logTracer) PageEntered(ev PageEvent) {
+	lt.logf("|====> identifying at %d using page %s (%d rules)", ev.Offset, ev.Page, ev.NumRules)
+}
+
+func (lt *logTracer) RuleEvaluated(ev RuleEvent) {
+	lt.logf("| %s", *ev.Rule)
+
+	switch ev.Outcome {
+	case OutcomeMatched:
+		lt.logf("|==========> rule matched!")
+	case OutcomeReadFailed:
+		lt.logf("|====> %s - skipping rule", ev.Err.Error())
+	case OutcomeExcluded:
+		lt.logf("|====> excluded")
+	case OutcomeUsed, OutcomeReused:
+		uk, _ := ev.Rule.Kind.Data.(*parser.UseKind)
+		if ev.Outcome == OutcomeUsed {
+			lt.logf("|====> using %s", uk.Page)
+		} else {
+			lt.logf("|====> reusing %s at %d", uk.Page, ev.Offset)
+		}
+	}
+}
+
+func (lt *logTracer) PageLeft(ev PageEvent) {
+	lt.logf("|====> done identifying at %d using page %s (%d rules)", ev.Offset, ev.Page, ev.NumRules)
+}
+
+// multiTracer forwards events to several tracers
+type multiTracer []Tracer
+
+func (mt multiTracer) PageEntered(ev PageEvent) {
+	for _, t := range mt {
+		t.PageEntered(ev)
+	}
+}
+
+func (mt multiTracer) RuleEvaluated(ev RuleEvent) {
+	for _, t := range mt {
+		t.RuleEvaluated(ev)
+	}
+}
+
+func (mt multiTracer) PageLeft(ev PageEvent) {
+	for _, t := range mt {
+		t.PageLeft(ev)
+	}
+}
+
+// tracer returns where events should go, or nil if nobody's listening
+func (ctx *InterpretContext) tracer() Tracer {
+	switch {
+	case ctx.Tracer != nil && ctx.Logf != nil:
+		return multiTracer{ctx.Tracer, NewLogTracer(ctx.Logf)}
+	case ctx.Tracer != nil:
+		return ctx.Tracer
+	case ctx.Logf != nil:
+		return NewLogTracer(ctx.Logf)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package interpreter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTracer turns events into strings, to compare sequences easily
+type recordingTracer struct {
+	events []string
+	rules  []RuleEvent
+}
+
+func (rt *recordingTracer) PageEntered(ev PageEvent) {
+	rt.events = append(rt.events, fmt.Sprintf("enter %q at %d, depth %d", ev.Page, ev.Offset, ev.Depth))
+}
+
+func (rt *recordingTracer) RuleEvaluated(ev RuleEvent) {
+	rt.events = append(rt.events, fmt.Sprintf("%s: %s at %d", ev.Rule.Line, ev.Outcome, ev.Offset))
+	rt.rules = append(rt.rules, ev)
+}
+
+func (rt *recordingTracer) PageLeft(ev PageEvent) {
+	rt.events = append(rt.events, fmt.Sprintf("leave %q", ev.Page))
+}
+
+func Test_Tracer(t *testing.T) {
+	book := parseBook(t, `
+0	name	chunk
+>0	ubyte	0x2a	answer
+>0	ubyte	0x2b	not the answer
+0	string	RIFF	RIFF
+>(4.b)	use	chunk
+>(4.b)	use	chunk
+>0x100	byte	0	out of bounds
+`)
+
+	rt := &recordingTracer{}
+	ictx := &InterpretContext{
+		Book:   book,
+		Tracer: rt,
+	}
+
+	result, err := ictx.Identify(newBytesReader([]byte("RIFF\x06x\x2a")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"RIFF", "answer", "answer"}, result)
+
+	assert.EqualValues(t, []string{
+		`enter "" at 0, depth 0`,
+		"0\tstring\tRIFF\tRIFF: matched at 0",
+		">(4.b)\tuse\tchunk: used at 6",
+		`enter "chunk" at 6, depth 1`,
+		"0\tname\tchunk: matched at 6",
+		">0\tubyte\t0x2a\tanswer: matched at 6",
+		">0\tubyte\t0x2b\tnot the answer: not matched at 6",
+		`leave "chunk"`,
+		">(4.b)\tuse\tchunk: reused at 6",
+		">0x100\tbyte\t0\tout of bounds: read failed at 256",
+		`leave ""`,
+	}, rt.events)
+
+	// integer tests report what they read
+	answer := rt.rules[3]
+	assert.EqualValues(t, "chunk", answer.Page)
+	assert.EqualValues(t, 1, answer.Depth)
+	assert.True(t, answer.HasValue)
+	assert.EqualValues(t, 0x2a, answer.Value)
+	assert.NoError(t, answer.Err)
+
+	assert.Error(t, rt.rules[6].Err)
+}
+
+func Test_LogTracer(t *testing.T) {
+	book := parseBook(t, `
+0	string	RIFF	RIFF
+`)
+
+	var lines []string
+	ictx := &InterpretContext{
+		Book: book,
+		Logf: func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		},
+	}
+
+	_, err := ictx.Identify(newBytesReader([]byte("RIFF")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{
+		"|====> identifying at 0 using page  (1 rules)",
+		`| 0x0    string    "RIFF"    RIFF`,
+		"|==========> rule matched!",
+		"|====> done identifying at 0 using page  (1 rules)",
+	}, lines)
+}
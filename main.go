@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/9uanhuo/wizardry/compiler"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -23,25 +24,69 @@ var appArgs = struct {
 }
 
 var identifyArgs = struct {
-	magdir *string
-	target *string
+	magdir    *string
+	target    *string
+	keepGoing *bool
 }{
 	identifyCmd.Arg("magdir", "the folder of magic files to compile").Required().String(),
 	identifyCmd.Arg("target", "path of the the file to identify").Required().String(),
+	identifyCmd.Flag("keep-going", "don't stop at the first match").Short('k').Bool(),
 }
 
 var compileArgs = struct {
-	magdir       *string
-	output       *string
-	chatty       *bool
-	emitComments *bool
-	pkg          *string
+	magdir          *string
+	output          *string
+	trace           *bool
+	emitComments    *bool
+	pkg             *string
+	runtime         *string
+	selfContained   *bool
+	pagesPerFile    *int
+	noFormat        *bool
+	structured      *bool
+	parityCorpus    *string
+	lineDirs        *bool
+	sourceRoot      *string
+	only            *[]string
+	sliceReader     *bool
+	allowCycles     *bool
+	report          *bool
+	fuzzTest        *bool
+	maxInputSize    *int64
+	skipUnsupported *bool
+	filter          *bool
+	stringBlob      *int
+	singleDispatch  *bool
+	minimalImports  *bool
+	runtimeSwap     *bool
+	incremental     *bool
 }{
 	compileCmd.Arg("magdir", "the folder of magic files to compile").Required().String(),
-	compileCmd.Flag("output", "the go file to generate").Short('o').Required().String(),
-	compileCmd.Flag("chatty", "generate prints on every rule match").Bool(),
+	compileCmd.Flag("output", "the go file (or directory, with --pages-per-file) to generate").Short('o').Required().String(),
+	compileCmd.Flag("trace", "generate a Trace hook, called with every rule that matches").Bool(),
 	compileCmd.Flag("emit-comments", "generate comments in the code").Bool(),
 	compileCmd.Flag("package", "go package to generate").Default("main").String(),
+	compileCmd.Flag("runtime", "import path of the package generated code uses for SliceReader and string/search tests").Default(compiler.DefaultRuntimeImportPath).String(),
+	compileCmd.Flag("self-contained", "inline the runtime in the generated code, so it only imports the standard library").Bool(),
+	compileCmd.Flag("pages-per-file", "split the generated code into files of that many pages, output is then a directory").Int(),
+	compileCmd.Flag("no-format", "don't run go/format on the generated code, which is faster but doesn't check it parses").Bool(),
+	compileCmd.Flag("structured", "generate nested if blocks instead of gotos, which is easier to step through").Bool(),
+	compileCmd.Flag("parity-corpus", "also generate a test checking that the generated code identifies the files of that folder like the interpreter").String(),
+	compileCmd.Flag("line-directives", "generate //line directives, so stack traces and coverage point at the magic files").Bool(),
+	compileCmd.Flag("source-root", "what magic file paths are relative to in comments and //line directives, defaults to magdir").String(),
+	compileCmd.Flag("only", "only compile the top-level rules whose description starts with this, or the page of that name, and what they use (repeatable)").Strings(),
+	compileCmd.Flag("slice-reader-api", "generate exported functions taking a *SliceReader, as they used to, instead of an io.ReaderAt with a Size method").Bool(),
+	compileCmd.Flag("allow-cycles", "compile pages that use each other in a loop, generated code then gives up past a maximum depth of uses").Bool(),
+	compileCmd.Flag("report", "print the size and rule counts of every generated page, biggest first").Bool(),
+	compileCmd.Flag("fuzz-test", "also generate a fuzz test, checking that the generated code doesn't panic on arbitrary data").Bool(),
+	compileCmd.Flag("max-input-size", "leave out rules that only match inputs bigger than that many bytes").Int64(),
+	compileCmd.Flag("skip-unsupported", "leave out rules the compiler doesn't support, warning about each, they never match. With --no-skip-unsupported, fail instead").Default("true").Bool(),
+	compileCmd.Flag("filter", "also generate IdentifyFiltered, which only runs the top-level rules the first bytes of the target don't rule out").Bool(),
+	compileCmd.Flag("string-blob", "move strings longer than that many bytes into one constant the code slices").Int(),
+	compileCmd.Flag("single-dispatch", "generate one function for all pages, switching on the page to run, instead of one per page").Bool(),
+	compileCmd.Flag("minimal-imports", "generate code that only imports the runtime, encoding/binary and strconv, e.g. to build it with TinyGo").Bool(),
+	compileCmd.Flag("runtime-swap", "generate pages used in both byte orders once, picking the byte order at run time, instead of twice").Bool(),
+	compileCmd.Flag("incremental", "with --pages-per-file, leave the files whose code didn't change since the last run alone, instead of writing everything again").Bool(),
 }
 
 func main() {
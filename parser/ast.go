@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/9uanhuo/wizardry/utils"
 )
@@ -24,6 +25,13 @@ type Rule struct {
 	Offset      Offset
 	Kind        Kind
 	Description []byte
+	// MIME is the type set by a "!:mime" line after the rule, if any
+	MIME string
+	// SourceFile is the magic file the rule was read from, as passed to
+	// ParseSource, and SourceLine its line there, starting at 1. They're
+	// empty and 0 for rules the parser didn't read.
+	SourceFile string
+	SourceLine int
 }
 
 func (r Rule) String() string {
@@ -39,43 +47,59 @@ func (o Offset) String() string {
 	case OffsetTypeDirect:
 		s = fmt.Sprintf("0x%x", o.Direct)
 	case OffsetTypeIndirect:
-		s = "("
-		indirect := o.Indirect
-		if indirect.IsRelative {
-			s += "&"
-		}
+		s = o.Indirect.String()
+	}
 
-		s += fmt.Sprintf("0x%x", indirect.OffsetAddress)
-		s += "."
+	if o.IsRelative {
+		s = "&" + s
+	}
+	return s
+}
 
-		switch indirect.ByteWidth {
-		case 1:
-			s += "byte"
-		case 2:
-			s += "short"
-		case 4:
-			s += "long"
-		case 8:
-			s += "quad"
-		}
-		if indirect.Endianness == LittleEndian {
-			s += "le"
-		} else {
-			s += "be"
-		}
+func (indirect *IndirectOffset) String() string {
+	s := "("
+	if indirect.IsRelative {
+		s += "&"
+	}
 
-		switch indirect.OffsetAdjustmentType {
-		case AdjustmentAdd:
-			s += "+"
-		case AdjustmentSub:
-			s += "-"
-		case AdjustmentMul:
-			s += "*"
-		case AdjustmentDiv:
-			s += "/"
-		}
+	if indirect.AddressIndirect != nil {
+		s += indirect.AddressIndirect.String()
+	} else {
+		s += fmt.Sprintf("0x%x", indirect.OffsetAddress)
+	}
+	s += "."
+
+	switch indirect.ByteWidth {
+	case 1:
+		s += "byte"
+	case 2:
+		s += "short"
+	case 4:
+		s += "long"
+	case 8:
+		s += "quad"
+	}
+	if indirect.Endianness == LittleEndian {
+		s += "le"
+	} else {
+		s += "be"
+	}
+
+	switch indirect.OffsetAdjustmentType {
+	case AdjustmentAdd:
+		s += "+"
+	case AdjustmentSub:
+		s += "-"
+	case AdjustmentMul:
+		s += "*"
+	case AdjustmentDiv:
+		s += "/"
+	}
 
-		if indirect.OffsetAdjustmentType != AdjustmentNone {
+	if indirect.OffsetAdjustmentType != AdjustmentNone {
+		if indirect.OffsetAdjustmentIndirect != nil {
+			s += indirect.OffsetAdjustmentIndirect.String()
+		} else {
 			if indirect.OffsetAdjustmentIsRelative {
 				s += "("
 			}
@@ -84,13 +108,9 @@ func (o Offset) String() string {
 				s += ")"
 			}
 		}
-
-		s += ")"
 	}
 
-	if o.IsRelative {
-		s = "&" + s
-	}
+	s += ")"
 	return s
 }
 
@@ -110,13 +130,23 @@ func (o Offset) Equals(b Offset) bool {
 		return a.Direct == b.Direct
 	}
 
-	ai := a.Indirect
-	bi := b.Indirect
+	return a.Indirect.Equals(b.Indirect)
+}
+
+// Equals returns true if and only if a and b are read in exactly the same way
+func (ai *IndirectOffset) Equals(bi *IndirectOffset) bool {
+	if ai == nil || bi == nil {
+		return ai == bi
+	}
 
 	if ai.OffsetAddress != bi.OffsetAddress {
 		return false
 	}
 
+	if !ai.AddressIndirect.Equals(bi.AddressIndirect) {
+		return false
+	}
+
 	if ai.OffsetAdjustmentType != bi.OffsetAdjustmentType {
 		return false
 	}
@@ -129,6 +159,10 @@ func (o Offset) Equals(b Offset) bool {
 		return false
 	}
 
+	if !ai.OffsetAdjustmentIndirect.Equals(bi.OffsetAdjustmentIndirect) {
+		return false
+	}
+
 	if ai.Endianness != bi.Endianness {
 		return false
 	}
@@ -175,10 +209,10 @@ func (k Kind) String() string {
 		return s
 	case KindFamilyString:
 		sk, _ := k.Data.(*StringKind)
-		return fmt.Sprintf("string    %s", strconv.Quote(string(sk.Value)))
+		return fmt.Sprintf("string    %s", strconv.Quote(sk.Value))
 	case KindFamilySearch:
 		sk, _ := k.Data.(*SearchKind)
-		return fmt.Sprintf("search/0x%x    %s", sk.MaxLen, strconv.Quote(string(sk.Value)))
+		return fmt.Sprintf("search/0x%x    %s", sk.MaxLen, strconv.Quote(sk.Value))
 	case KindFamilyDefault:
 		return "default"
 	case KindFamilyClear:
@@ -191,9 +225,123 @@ func (k Kind) String() string {
 		}
 		s += uk.Page
 		return s
+	case KindFamilyDer:
+		dk, _ := k.Data.(*DerKind)
+		s := "der    " + DerTagName(dk.Tag)
+		if dk.Length >= 0 {
+			s += fmt.Sprintf("%d", dk.Length)
+		}
+		if dk.HasValue {
+			s += "=" + dk.Value
+		}
+		return s
+	case KindFamilyOctal:
+		octk, _ := k.Data.(*OctalKind)
+		s := fmt.Sprintf("octal/%d", octk.MaxLen)
+		if octk.DoAnd {
+			s += fmt.Sprintf("&0x%x", octk.AndValue)
+		}
+		s += "    "
+		if octk.MatchAny {
+			s += "x"
+		} else {
+			s += fmt.Sprintf("%o", octk.Value)
+		}
+		return s
+	case KindFamilyRegex:
+		rk, _ := k.Data.(*RegexKind)
+		s := "regex"
+		if rk.MaxLen > 0 {
+			s += fmt.Sprintf("/%d", rk.MaxLen)
+			if rk.Lines {
+				s += "l"
+			}
+		}
+		return fmt.Sprintf("%s    %s", s, strconv.Quote(rk.Pattern()))
+	case KindFamilyDate:
+		dk, _ := k.Data.(*DateKind)
+		s := fmt.Sprintf("date/%d", dk.ByteWidth)
+		if dk.Format != utils.DateFormatUnix {
+			s = fmt.Sprintf("msdos/%d", dk.ByteWidth)
+		}
+		if dk.Local {
+			s += " (local)"
+		}
+		if dk.DoAnd {
+			s += fmt.Sprintf("&0x%x", dk.AndValue)
+		}
+		s += "    "
+		if dk.MatchAny {
+			s += "x"
+		} else {
+			s += fmt.Sprintf("%x", dk.Value)
+		}
+		return s
+	case KindFamilyFloat:
+		fk, _ := k.Data.(*FloatKind)
+		s := "float"
+		if fk.ByteWidth == 8 {
+			s = "double"
+		}
+		if fk.Endianness == LittleEndian {
+			s += "le"
+		} else {
+			s += "be"
+		}
+		s += "    "
+		if fk.MatchAny {
+			s += "x"
+		} else {
+			s += fmt.Sprintf("%g", fk.Value)
+		}
+		return s
+	case KindFamilyPString:
+		pk, _ := k.Data.(*PStringKind)
+		s := fmt.Sprintf("pstring/%d", pk.LengthWidth)
+		if pk.LengthWidth > 1 {
+			if pk.LengthEndianness == LittleEndian {
+				s += "le"
+			} else {
+				s += "be"
+			}
+		}
+		if pk.LengthIncludesItself {
+			s += "J"
+		}
+		if pk.Negate {
+			s += "    !"
+		} else {
+			s += "    "
+		}
+		return s + strconv.Quote(pk.Value)
+	case KindFamilyString16:
+		sk, _ := k.Data.(*String16Kind)
+		s := "string16"
+		if sk.Endianness == LittleEndian {
+			s += "le"
+		} else {
+			s += "be"
+		}
+		switch {
+		case sk.MatchAny:
+			return s + "    x"
+		case sk.Negate:
+			return s + "    !" + strconv.Quote(sk.Value)
+		default:
+			return s + "    " + strconv.Quote(sk.Value)
+		}
+	case KindFamilyGuid:
+		gk, _ := k.Data.(*GuidKind)
+		if gk.MatchAny {
+			return "guid    x"
+		}
+		return "guid    " + utils.FormatGUID(gk.Value)
 	case KindFamilySwitch:
 		sk, _ := k.Data.(*SwitchKind)
 		return fmt.Sprintf("switch with %d cases", len(sk.Cases))
+	case KindFamilyStringSwitch:
+		sk, _ := k.Data.(*StringSwitchKind)
+		return fmt.Sprintf("string switch on %d bytes", sk.Length)
 	default:
 		return fmt.Sprintf("kind family %d", k.Family)
 	}
@@ -267,9 +415,18 @@ type SwitchKind struct {
 	Cases      []*SwitchCase
 }
 
+// StringSwitchKind stands for sibling string equality tests of the same
+// length at the same offset, which the compiler checks with a single read
+type StringSwitchKind struct {
+	Length int
+}
+
 type SwitchCase struct {
 	Value       int64
 	Description []byte
+	MIME        string
+	// Line is the source of the rule the case was merged from
+	Line string
 }
 
 // IntegerTest describes which comparison to perform on an integer
@@ -290,15 +447,45 @@ const (
 
 // StringKind describes how to match a string pattern
 type StringKind struct {
-	Value  []byte
+	Value  string
 	Negate bool
 	Flags  utils.StringTestFlags
 }
 
 // SearchKind describes how to look for a fixed pattern
 type SearchKind struct {
-	Value  []byte
+	Value string
+	// MaxLen is the range of the test: the match starts in the first
+	// MaxLen bytes, and may run past them. Zero means
+	// utils.DefaultSearchRange.
 	MaxLen int64
+	// Flags are the string test flags of the rule
+	Flags utils.StringTestFlags
+
+	finderOnce sync.Once
+	finder     *utils.Finder
+}
+
+// Finder returns the finder of Value with Flags. It's only prepared the
+// first time, the kind mustn't change afterwards. Like utils.MakeFinder,
+// it ignores ForceText and ForceBinary.
+func (sk *SearchKind) Finder() *utils.Finder {
+	sk.finderOnce.Do(func() {
+		sk.finder = utils.MakeFinder(sk.Value, sk.Flags)
+	})
+	return sk.finder
+}
+
+// DerKind describes how to match a DER-encoded (ASN.1) element
+type DerKind struct {
+	// Tag is the expected tag number, e.g. 16 for a sequence
+	Tag uint32
+	// Length is the expected content length, or -1 if any length will do
+	Length int64
+	// HasValue is true if the content itself is tested
+	HasValue bool
+	// Value is the expected content, formatted like file(1) does ("x" matches anything)
+	Value string
 }
 
 // KindFamily groups tests in families (all integer tests, for example)
@@ -319,11 +506,30 @@ const (
 	KindFamilyName
 	// KindFamilyUse acts like a subroutine call, to peruse another page of rules
 	KindFamilyUse
+	// KindFamilyDer walks a DER-encoded element and tests its tag, length and content
+	KindFamilyDer
+	// KindFamilyOctal reads a number written in ASCII octal digits and compares it
+	KindFamilyOctal
+	// KindFamilyRegex looks for a regular expression in a slice of the target
+	KindFamilyRegex
+	// KindFamilyDate compares a date like an integer, and prints it as a date
+	KindFamilyDate
+	// KindFamilyFloat compares an IEEE 754 float or double
+	KindFamilyFloat
+	// KindFamilyPString looks for a string after its length
+	KindFamilyPString
+	// KindFamilyString16 looks for a UTF-16 string
+	KindFamilyString16
+	// KindFamilyGuid compares a GUID
+	KindFamilyGuid
 
 	// Compiler additions begin
 
 	// KindFamilySwitch is a series of merged KindFamilyInteger
 	KindFamilySwitch
+	// KindFamilyStringSwitch is a series of merged KindFamilyString, the
+	// rules it stands for are its children
+	KindFamilyStringSwitch
 )
 
 // Offset describes where to look to compare something
@@ -331,7 +537,10 @@ type Offset struct {
 	OffsetType OffsetType
 	IsRelative bool
 	Direct     int64
-	Indirect   *IndirectOffset
+	// DirectIsHex is set when Direct was written in hexadecimal, which
+	// doesn't change what the offset is
+	DirectIsHex bool
+	Indirect    *IndirectOffset
 }
 
 // OffsetType describes whether an offset is direct or indirect
@@ -346,13 +555,29 @@ const (
 
 // IndirectOffset indicates where to look in a file to find the real offset
 type IndirectOffset struct {
-	IsRelative                 bool
-	ByteWidth                  int
-	Endianness                 Endianness
-	OffsetAddress              int64
+	IsRelative    bool
+	ByteWidth     int
+	Endianness    Endianness
+	OffsetAddress int64
+	// OffsetAddressIsHex and OffsetAdjustmentIsHex are set when the
+	// numbers were written in hexadecimal, they don't take part in Equals
+	OffsetAddressIsHex    bool
+	OffsetAdjustmentIsHex bool
+	// AddressIndirect, if set, is dereferenced to find the address to
+	// read from, instead of using OffsetAddress
+	AddressIndirect            *IndirectOffset
 	OffsetAdjustmentType       Adjustment
 	OffsetAdjustmentIsRelative bool
 	OffsetAdjustmentValue      int64
+	// OffsetAdjustmentIndirect, if set, is dereferenced (with its own
+	// format) to find the adjustment value
+	OffsetAdjustmentIndirect *IndirectOffset
+}
+
+// IsNested returns true if the address or the adjustment of this indirect
+// offset are indirect offsets themselves
+func (indirect *IndirectOffset) IsNested() bool {
+	return indirect.AddressIndirect != nil || indirect.OffsetAdjustmentIndirect != nil
 }
 
 // Adjustment describes which operation to apply to an offset
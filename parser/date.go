@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// DateKind describes a date test. The raw value is compared like an
+// integer, descriptions print it as a date.
+type DateKind struct {
+	// IntegerKind holds the width, endianness, mask and comparison. Dates
+	// are compared unsigned.
+	IntegerKind
+	// Format tells how the date is stored
+	Format utils.DateFormat
+	// Local is set for dates printed in the local time zone ("ldate")
+	Local bool
+}
+
+type dateKindName struct {
+	byteWidth int
+	format    utils.DateFormat
+	local     bool
+}
+
+// dateKindNames are the date kinds, without their endianness prefix
+var dateKindNames = map[string]dateKindName{
+	"date":      {4, utils.DateFormatUnix, false},
+	"ldate":     {4, utils.DateFormatUnix, true},
+	"qdate":     {8, utils.DateFormatUnix, false},
+	"qldate":    {8, utils.DateFormatUnix, true},
+	"msdosdate": {2, utils.DateFormatDOSDate, false},
+	"msdostime": {2, utils.DateFormatDOSTime, false},
+}
+
+// isDateKind tells whether name is a date kind, like "date", "beldate" or
+// "lemsdosdate"
+func isDateKind(name string) bool {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "be"), "le")
+	_, ok := dateKindNames[name]
+	return ok
+}
+
+// parseDateKind parses a date rule. The kind may carry a mask
+// ("ledate&0xffff"), the test is the same as for integers.
+func parseDateKind(name string, kind []byte, j int, test []byte) (*DateKind, error) {
+	endianness := LittleEndian
+	switch {
+	case strings.HasPrefix(name, "be"):
+		endianness = BigEndian
+		name = name[2:]
+	case strings.HasPrefix(name, "le"):
+		name = name[2:]
+	}
+
+	dkn, ok := dateKindNames[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown date kind %s", name)
+	}
+
+	dk := &DateKind{
+		IntegerKind: IntegerKind{
+			ByteWidth:   dkn.byteWidth,
+			Endianness:  endianness,
+			IntegerTest: IntegerTestEqual,
+		},
+		Format: dkn.format,
+		Local:  dkn.local,
+	}
+
+	if j < len(kind) && kind[j] == '&' {
+		j++
+		parsedAndValue, err := parseUint(kind, j)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse and value %s", kind[j:])
+		}
+		dk.DoAnd = true
+		dk.AndValue = parsedAndValue.Value
+	}
+
+	err := parseIntegerTest(&dk.IntegerKind, test)
+	if err != nil {
+		return nil, err
+	}
+
+	return dk, nil
+}
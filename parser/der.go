@@ -0,0 +1,81 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/9uanhuo/wizardry/utils"
+)
+
+// derTagNames maps universal DER tag numbers to the names file(1) uses in
+// magic rules, e.g. "seq" for a SEQUENCE (tag 16)
+var derTagNames = []string{
+	"eoc", "bool", "int", "bit_str", "octet_str",
+	"null", "obj_id", "obj_desc", "ext", "real",
+	"enum", "embed", "utf8_str", "rel_oid", "time",
+	"res2", "seq", "set", "num_str", "prt_str",
+	"t61_str", "vid_str", "ia5_str", "utc_time", "gen_time",
+	"gr_str", "vis_str", "gen_str", "univ_str", "char_str",
+	"bmp_str", "date", "tod", "datetime", "duration",
+	"oid-iri", "rel-oid-iri",
+}
+
+// DerTagName returns the name file(1) uses for a DER tag number
+func DerTagName(tag uint32) string {
+	if int(tag) < len(derTagNames) {
+		return derTagNames[tag]
+	}
+	return fmt.Sprintf("%#x", tag)
+}
+
+// parseDerTest parses the test part of a der rule, which looks like
+// "seq", "int1=02" or "obj_id9=2a864886f70d010101": a tag name, an optional
+// content length and an optional '=' followed by the expected content
+func parseDerTest(test []byte) (*DerKind, error) {
+	dk := &DerKind{
+		Length: -1,
+	}
+
+	j := 0
+	for j < len(test) && !utils.IsNumber(test[j]) && test[j] != '=' {
+		j++
+	}
+	name := string(test[:j])
+
+	found := false
+	for tag, tagName := range derTagNames {
+		if tagName == name {
+			dk.Tag = uint32(tag)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown der tag (%s)", name)
+	}
+
+	if j < len(test) && utils.IsNumber(test[j]) {
+		startJ := j
+		for j < len(test) && utils.IsNumber(test[j]) {
+			j++
+		}
+		length, err := strconv.ParseInt(string(test[startJ:j]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		dk.Length = length
+	}
+
+	if j < len(test) && test[j] == '=' {
+		j++
+		dk.HasValue = true
+		dk.Value = string(test[j:])
+		j = len(test)
+	}
+
+	if j < len(test) {
+		return nil, fmt.Errorf("trailing garbage in der test (%s)", test[j:])
+	}
+
+	return dk, nil
+}
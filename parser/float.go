@@ -0,0 +1,81 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FloatKind describes a test on an IEEE 754 float or double
+type FloatKind struct {
+	// ByteWidth is 4 for floats, 8 for doubles
+	ByteWidth  int
+	Endianness Endianness
+	// FloatTest is the comparison, IntegerTestAnd isn't allowed
+	FloatTest IntegerTest
+	Value     float64
+	MatchAny  bool
+}
+
+// isFloatKind tells whether name is a float kind, like "float" or
+// "bedouble"
+func isFloatKind(name string) bool {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "be"), "le")
+	return name == "float" || name == "double"
+}
+
+// parseFloatKind parses a float rule. Comparisons are the ones of integer
+// tests, except "&".
+func parseFloatKind(name string, test []byte) (*FloatKind, error) {
+	fk := &FloatKind{
+		Endianness: LittleEndian,
+		FloatTest:  IntegerTestEqual,
+	}
+
+	switch {
+	case strings.HasPrefix(name, "be"):
+		fk.Endianness = BigEndian
+		name = name[2:]
+	case strings.HasPrefix(name, "le"):
+		name = name[2:]
+	}
+
+	switch name {
+	case "float":
+		fk.ByteWidth = 4
+	case "double":
+		fk.ByteWidth = 8
+	default:
+		return nil, fmt.Errorf("unknown float kind %s", name)
+	}
+
+	if len(test) == 0 {
+		return nil, fmt.Errorf("missing magic value")
+	}
+
+	k := 0
+	switch test[k] {
+	case 'x':
+		fk.MatchAny = true
+		return fk, nil
+	case '=':
+		k++
+	case '!':
+		fk.FloatTest = IntegerTestNotEqual
+		k++
+	case '<':
+		fk.FloatTest = IntegerTestLessThan
+		k++
+	case '>':
+		fk.FloatTest = IntegerTestGreaterThan
+		k++
+	}
+
+	value, err := strconv.ParseFloat(string(test[k:]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse magic value %s", test[k:])
+	}
+	fk.Value = value
+
+	return fk, nil
+}
@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GuidKind describes a test on a GUID
+type GuidKind struct {
+	// Value is the GUID as stored in the target: its first three fields
+	// little-endian, the rest as written
+	Value []byte
+	// MatchAny is set for "x" tests
+	MatchAny bool
+}
+
+// parseGuidKind parses a guid rule, whose test is "x" or a GUID in its
+// canonical text form, optionally after a '='
+func parseGuidKind(test []byte) (*GuidKind, error) {
+	if len(test) == 1 && test[0] == 'x' {
+		return &GuidKind{MatchAny: true}, nil
+	}
+
+	s := strings.TrimPrefix(string(test), "=")
+	fields := strings.Split(s, "-")
+	if len(fields) != 5 || len(fields[0]) != 8 || len(fields[1]) != 4 || len(fields[2]) != 4 || len(fields[3]) != 4 || len(fields[4]) != 12 {
+		return nil, fmt.Errorf("invalid guid %s", s)
+	}
+
+	raw, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid guid %s: %s", s, err.Error())
+	}
+
+	// the first three fields are stored little-endian
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint32(value[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(value[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(value[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(value[8:], raw[8:])
+
+	return &GuidKind{Value: value}, nil
+}
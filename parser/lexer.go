@@ -10,6 +10,8 @@ import (
 type parsedInt struct {
 	Value    int64
 	NewIndex int
+	// IsHex is set when the number was written in hexadecimal
+	IsHex bool
 }
 
 type parsedUint struct {
@@ -21,7 +23,9 @@ func parseInt(input []byte, j int) (*parsedInt, error) {
 	inputSize := len(input)
 
 	startJ := j
+	sign := ""
 	if j < inputSize && input[j] == '-' {
+		sign = "-"
 		j++
 	}
 
@@ -50,7 +54,12 @@ func parseInt(input []byte, j int) (*parsedInt, error) {
 		}
 	}
 
-	value, err := strconv.ParseInt(string(input[startJ:j]), base, 64)
+	digits := string(input[startJ:j])
+	if base != 10 {
+		// the sign was skipped along with the prefix
+		digits = sign + digits
+	}
+	value, err := strconv.ParseInt(digits, base, 64)
 	if err != nil {
 		return nil, err
 	}
@@ -58,6 +67,7 @@ func parseInt(input []byte, j int) (*parsedInt, error) {
 	return &parsedInt{
 		Value:    value,
 		NewIndex: j,
+		IsHex:    base == 16,
 	}, nil
 }
 
@@ -100,6 +110,147 @@ func parseUint(input []byte, j int) (*parsedUint, error) {
 	}, nil
 }
 
+type parsedIndirectOffset struct {
+	Value    *IndirectOffset
+	NewIndex int
+}
+
+// parseIndirectOffset parses an indirect offset, starting right after its
+// opening parenthesis and up to (and including) the closing one. Both the
+// address and the adjustment may themselves be indirect offsets, as in
+// ((0x3c.l+4).s) or (0x3c.l+(0x40.s)).
+func parseIndirectOffset(input []byte, j int) (*parsedIndirectOffset, error) {
+	inputSize := len(input)
+	indirect := &IndirectOffset{}
+
+	if j < inputSize && input[j] == '&' {
+		indirect.IsRelative = true
+		j++
+	}
+
+	if j < inputSize && input[j] == '(' {
+		// the address is read from the file too
+		parsedAddress, err := parseIndirectOffset(input, j+1)
+		if err != nil {
+			return nil, err
+		}
+		indirect.AddressIndirect = parsedAddress.Value
+		j = parsedAddress.NewIndex
+	} else {
+		indirectAddr, err := parseInt(input, j)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse indirect offset in part \"%s\"", input[j:])
+		}
+		indirect.OffsetAddress = indirectAddr.Value
+		indirect.OffsetAddressIsHex = indirectAddr.IsHex
+		j = indirectAddr.NewIndex
+	}
+
+	if j+1 >= inputSize || (input[j] != '.' && input[j] != ',') {
+		return nil, fmt.Errorf("malformed indirect offset in %s, expected [.,] followed by a format", input)
+	}
+	j++
+
+	indirectAddrFormat := input[j]
+	j++
+
+	indirect.Endianness = LittleEndian
+
+	if utils.IsUpperLetter(indirectAddrFormat) {
+		indirect.Endianness = BigEndian
+		indirectAddrFormat = utils.ToLower(indirectAddrFormat)
+	}
+
+	switch indirectAddrFormat {
+	case 'b':
+		indirect.ByteWidth = 1
+	case 'i':
+		return nil, fmt.Errorf("id3 format not supported")
+	case 's':
+		indirect.ByteWidth = 2
+	case 'l':
+		indirect.ByteWidth = 4
+	case 'q':
+		indirect.ByteWidth = 8
+	case 'm':
+		return nil, fmt.Errorf("middle-endian format not supported")
+	default:
+		return nil, fmt.Errorf("unsupported indirect addr format %c", indirectAddrFormat)
+	}
+
+	if j < inputSize {
+		switch input[j] {
+		case '+':
+			indirect.OffsetAdjustmentType = AdjustmentAdd
+		case '-':
+			indirect.OffsetAdjustmentType = AdjustmentSub
+		case '*':
+			indirect.OffsetAdjustmentType = AdjustmentMul
+		case '/':
+			indirect.OffsetAdjustmentType = AdjustmentDiv
+		}
+	}
+
+	if indirect.OffsetAdjustmentType != AdjustmentNone {
+		j++
+		if j < inputSize && input[j] == '(' {
+			j++
+
+			k := j
+			if k < inputSize && input[k] == '-' {
+				k++
+			}
+			for k < inputSize && (utils.IsHexNumber(input[k]) || input[k] == 'x') {
+				k++
+			}
+
+			if k < inputSize && (input[k] == '.' || input[k] == ',') {
+				// the adjustment is a dereference with its own format
+				parsedAdjustment, err := parseIndirectOffset(input, j)
+				if err != nil {
+					return nil, err
+				}
+				indirect.OffsetAdjustmentIndirect = parsedAdjustment.Value
+				j = parsedAdjustment.NewIndex
+			} else {
+				// it's a relative pair, read with the same format at address+value
+				indirect.OffsetAdjustmentIsRelative = true
+
+				parsedRHS, err := parseInt(input, j)
+				if err != nil {
+					return nil, fmt.Errorf("malformed indirect offset rhs")
+				}
+				indirect.OffsetAdjustmentValue = parsedRHS.Value
+				indirect.OffsetAdjustmentIsHex = parsedRHS.IsHex
+				j = parsedRHS.NewIndex
+
+				if j >= inputSize || input[j] != ')' {
+					return nil, fmt.Errorf("malformed relative offset adjustment, missing closing ')'")
+				}
+				j++
+			}
+		} else {
+			parsedRHS, err := parseInt(input, j)
+			if err != nil {
+				return nil, fmt.Errorf("malformed indirect offset rhs")
+			}
+			indirect.OffsetAdjustmentValue = parsedRHS.Value
+			indirect.OffsetAdjustmentIsHex = parsedRHS.IsHex
+			j = parsedRHS.NewIndex
+		}
+	}
+
+	if j >= inputSize || input[j] != ')' {
+		return nil, fmt.Errorf("malformed indirect offset in %s, expected ')'", input)
+	}
+	j++
+
+	return &parsedIndirectOffset{
+		Value:    indirect,
+		NewIndex: j,
+	}, nil
+}
+
 type parsedKind struct {
 	Value    string
 	NewIndex int
@@ -236,11 +387,14 @@ func parseStringTestFlags(input []byte, j int) *parsedStringTestFlags {
 			result.Flags |= utils.ForceText
 		case 'b':
 			result.Flags |= utils.ForceBinary
+		case 'f':
+			result.Flags |= utils.FullWord
 		default:
 			break
 		}
 		j++
 	}
+	result.NewIndex = j
 
 	return result
 }
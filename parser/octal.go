@@ -0,0 +1,63 @@
+package parser
+
+import (
+	"fmt"
+)
+
+// DefaultOctalMaxLen is how many bytes an octal test looks at when the
+// magic doesn't give a field width: enough for any 64-bit value, plus padding
+const DefaultOctalMaxLen = 32
+
+// OctalKind describes how to test a number stored as ASCII octal digits,
+// like the size and mode fields of a tar header
+type OctalKind struct {
+	// IntegerKind holds the mask and comparison, it is always an unsigned
+	// 8-byte test
+	IntegerKind
+	// MaxLen is the width of the field, leading padding included
+	MaxLen int64
+}
+
+// parseOctalKind parses an octal rule. The kind may carry a field width
+// ("octal/12") and a mask ("octal&0777"), the test is the same as for
+// integers ("x", "=0644", ">0", etc.)
+func parseOctalKind(kind []byte, j int, test []byte) (*OctalKind, error) {
+	octk := &OctalKind{
+		IntegerKind: IntegerKind{
+			ByteWidth:   8,
+			Endianness:  BigEndian,
+			IntegerTest: IntegerTestEqual,
+		},
+		MaxLen: DefaultOctalMaxLen,
+	}
+
+	if j < len(kind) && kind[j] == '/' {
+		j++
+		parsedLen, err := parseUint(kind, j)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse field width in %s: %s", kind[j:], err.Error())
+		}
+		if parsedLen.Value == 0 {
+			return nil, fmt.Errorf("field width can't be zero")
+		}
+		octk.MaxLen = int64(parsedLen.Value)
+		j = parsedLen.NewIndex
+	}
+
+	if j < len(kind) && kind[j] == '&' {
+		j++
+		parsedAndValue, err := parseUint(kind, j)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse and value %s", kind[j:])
+		}
+		octk.DoAnd = true
+		octk.AndValue = parsedAndValue.Value
+	}
+
+	err := parseIntegerTest(&octk.IntegerKind, test)
+	if err != nil {
+		return nil, err
+	}
+
+	return octk, nil
+}
@@ -37,7 +37,7 @@ func (ctx *ParseContext) ParseAll(magdir string, book Spellbook) error {
 
 			defer f.Close()
 
-			err = ctx.Parse(f, book)
+			err = ctx.ParseSource(filepath.Join(magdir, magicFile.Name()), f, book)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -55,11 +55,21 @@ func (ctx *ParseContext) ParseAll(magdir string, book Spellbook) error {
 
 // Parse reads a magic rule file and puts it into a spell book
 func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
+	return ctx.ParseSource("", magicReader, book)
+}
+
+// ParseSource is like Parse, and records source as the file the rules come from
+func (ctx *ParseContext) ParseSource(source string, magicReader io.Reader, book Spellbook) error {
 	scanner := bufio.NewScanner(magicReader)
 
 	page := ""
+	// whether the last rule line was added to the book, and can get
+	// !:mime and such attached to it
+	lastAdded := false
+	lineNumber := 0
 
 	for scanner.Scan() {
+		lineNumber++
 		line := scanner.Text()
 		lineBytes := []byte(line)
 		numBytes := len(lineBytes)
@@ -77,12 +87,18 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 		}
 
 		if lineBytes[i] == '!' {
+			if lastAdded {
+				ctx.parseExtension(line, book[page])
+			}
 			continue
 		}
 
+		lastAdded = false
 		rule := Rule{}
 
 		rule.Line = line
+		rule.SourceFile = source
+		rule.SourceLine = lineNumber
 
 		// read level
 		for i < numBytes && lineBytes[i] == '>' {
@@ -160,99 +176,14 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				j++
 				rule.Offset.OffsetType = OffsetTypeIndirect
 
-				indirect := &IndirectOffset{}
-				rule.Offset.Indirect = indirect
-
-				if offsetBytes[j] == '&' {
-					indirect.IsRelative = true
-					j++
-				}
-
-				indirectAddr, err := parseInt(offsetBytes, j)
+				parsedIndirect, err := parseIndirectOffset(offsetBytes, j)
 				if err != nil {
-					ctx.Logf("error: couldn't parse indirect offset in part \"%s\" of rule %s", offsetBytes[j:], line)
-					continue
-				}
-
-				j = indirectAddr.NewIndex
-
-				indirect.OffsetAddress = indirectAddr.Value
-
-				if offsetBytes[j] != '.' && offsetBytes[j] != ',' {
-					ctx.Logf("malformed indirect offset in %s, expected [.,], got '%c'\n", string(offsetBytes), offsetBytes[j])
-					continue
-				}
-				j++
-
-				indirectAddrFormat := offsetBytes[j]
-				j++
-
-				indirect.Endianness = LittleEndian
-
-				if utils.IsUpperLetter(indirectAddrFormat) {
-					indirect.Endianness = BigEndian
-					indirectAddrFormat = utils.ToLower(indirectAddrFormat)
-				}
-
-				switch indirectAddrFormat {
-				case 'b':
-					indirect.ByteWidth = 1
-				case 'i':
-					ctx.Logf("id3 format not supported, skipping %s", line)
-					continue
-				case 's':
-					indirect.ByteWidth = 2
-				case 'l':
-					indirect.ByteWidth = 4
-				case 'm':
-					ctx.Logf("middle-endian format not supported, skipping %s", line)
-					continue
-				default:
-					ctx.Logf("unsupported indirect addr format %c, skipping %s", indirectAddrFormat, line)
+					ctx.Logf("%s, skipping %s", err.Error(), line)
 					continue
 				}
 
-				if offsetBytes[j] == '+' {
-					indirect.OffsetAdjustmentType = AdjustmentAdd
-				} else if offsetBytes[j] == '-' {
-					indirect.OffsetAdjustmentType = AdjustmentSub
-				} else if offsetBytes[j] == '*' {
-					indirect.OffsetAdjustmentType = AdjustmentMul
-				} else if offsetBytes[j] == '/' {
-					indirect.OffsetAdjustmentType = AdjustmentDiv
-				}
-
-				if indirect.OffsetAdjustmentType != AdjustmentNone {
-					j++
-					// it's a relative pair
-					if offsetBytes[j] == '(' {
-						indirect.OffsetAdjustmentIsRelative = true
-						j++
-					}
-
-					parsedRHS, err := parseInt(offsetBytes, j)
-					if err != nil {
-						ctx.Logf("malformed indirect offset rhs, skipping %s", line)
-						continue
-					}
-
-					indirect.OffsetAdjustmentValue = parsedRHS.Value
-					j = parsedRHS.NewIndex
-
-					if indirect.OffsetAdjustmentIsRelative {
-						if offsetBytes[j] != ')' {
-							ctx.Logf("malformed relative offset adjustment, missing closing ')' - in %s", line)
-							continue
-						}
-						j++
-					}
-				}
-
-				if offsetBytes[j] != ')' {
-					ctx.Logf("malformed indirect offset in %s, expected ')', got '%c', skipping", string(offsetBytes), offsetBytes[j])
-					continue
-				}
-				j++
+				rule.Offset.Indirect = parsedIndirect.Value
+				j = parsedIndirect.NewIndex
 			} else {
 				rule.Offset.OffsetType = OffsetTypeDirect
 
@@ -263,6 +194,7 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				}
 
 				rule.Offset.Direct = parsedAbsolute.Value
+				rule.Offset.DirectIsHex = parsedAbsolute.IsHex
 				j = parsedAbsolute.NewIndex
 			}
 		}
@@ -410,7 +342,7 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 					ctx.Logf("in string test, couldn't parse rhs: %s - skipping", err.Error())
 					continue
 				}
-				sk.Value = parsedRHS.Value
+				sk.Value = string(parsedRHS.Value)
 
 				if j < len(kind) && kind[j] == '/' {
 					j++
@@ -424,17 +356,33 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				rule.Kind.Family = KindFamilySearch
 				rule.Kind.Data = sk
 
-				sk.MaxLen = 8192
-				if j < len(kind) && kind[j] == '/' {
+				sk.MaxLen = utils.DefaultSearchRange
+				// the max len and flags may come in any order, e.g.
+				// search/256/f or search/f/256
+				validKind := true
+				for j < len(kind) && kind[j] == '/' {
 					j++
-					parsedLen, err := parseUint(kind, j)
-					if err != nil {
-						ctx.Logf("in search test, couldn't parse max len in %s: %s - skipping\n", kind[j:], err.Error())
-						continue
-					}
+					if j < len(kind) && utils.IsNumber(kind[j]) {
+						parsedLen, err := parseUint(kind, j)
+						if err != nil {
+							ctx.Logf("in search test, couldn't parse max len in %s: %s - skipping\n", kind[j:], err.Error())
+							validKind = false
+							break
+						}
 
-					j = parsedLen.NewIndex
-					sk.MaxLen = int64(parsedLen.Value)
+						j = parsedLen.NewIndex
+						sk.MaxLen = int64(parsedLen.Value)
+					} else {
+						end := j
+						for end < len(kind) && kind[end] != '/' {
+							end++
+						}
+						sk.Flags |= parseStringTestFlags(kind[j:end], 0).Flags
+						j = end
+					}
+				}
+				if !validKind {
+					continue
 				}
 
 				k := 0
@@ -445,7 +393,7 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 					continue
 				}
 				k = parsedRHS.NewIndex
-				sk.Value = parsedRHS.Value
+				sk.Value = string(parsedRHS.Value)
 
 			case "default":
 				rule.Kind.Family = KindFamilyDefault
@@ -469,15 +417,146 @@ func (ctx *ParseContext) Parse(magicReader io.Reader, book Spellbook) error {
 				}
 
 				uk.Page = string(test[k:])
+			case "der":
+				dk, err := parseDerTest(test)
+				if err != nil {
+					ctx.Logf("in der test, %s - skipping", err.Error())
+					continue
+				}
+				rule.Kind.Family = KindFamilyDer
+				rule.Kind.Data = dk
+			case "octal":
+				octk, err := parseOctalKind(kind, j, test)
+				if err != nil {
+					ctx.Logf("in octal test, %s - skipping", err.Error())
+					continue
+				}
+				rule.Kind.Family = KindFamilyOctal
+				rule.Kind.Data = octk
+			case "pstring":
+				pk, err := parsePStringKind(kind, j, test)
+				if err != nil {
+					ctx.Logf("in pstring test, %s - skipping", err.Error())
+					continue
+				}
+				rule.Kind.Family = KindFamilyPString
+				rule.Kind.Data = pk
+			case "lestring16", "bestring16":
+				sk, err := parseString16Kind(parsedKind.Value, test)
+				if err != nil {
+					ctx.Logf("in string16 test, %s - skipping", err.Error())
+					continue
+				}
+				rule.Kind.Family = KindFamilyString16
+				rule.Kind.Data = sk
+			case "guid":
+				gk, err := parseGuidKind(test)
+				if err != nil {
+					ctx.Logf("in guid test, %s - skipping", err.Error())
+					continue
+				}
+				rule.Kind.Family = KindFamilyGuid
+				rule.Kind.Data = gk
+			case "regex":
+				rk, err := parseRegexKind(kind, j, test)
+				if err != nil {
+					ctx.Logf("in regex test, %s - skipping", err.Error())
+					continue
+				}
+				rule.Kind.Family = KindFamilyRegex
+				rule.Kind.Data = rk
 			default:
+				if isDateKind(parsedKind.Value) {
+					dk, err := parseDateKind(parsedKind.Value, kind, j, test)
+					if err != nil {
+						ctx.Logf("in date test, %s - skipping", err.Error())
+						continue
+					}
+					rule.Kind.Family = KindFamilyDate
+					rule.Kind.Data = dk
+					break
+				}
+
+				if isFloatKind(parsedKind.Value) {
+					fk, err := parseFloatKind(parsedKind.Value, test)
+					if err != nil {
+						ctx.Logf("in float test, %s - skipping", err.Error())
+						continue
+					}
+					rule.Kind.Family = KindFamilyFloat
+					rule.Kind.Data = fk
+					break
+				}
+
 				ctx.Logf("unhandled kind (%s)\n", parsedKind.Value)
 				continue
 			}
 
 			rule.Description = descriptionBytes
 			book.AddRule(page, rule)
+			lastAdded = true
 		}
 	}
 
 	return nil
 }
+
+// parseExtension handles "!:" lines, which give more information about the
+// last rule of a page. Only "!:mime" is supported, others are ignored.
+func (ctx *ParseContext) parseExtension(line string, rules []Rule) {
+	if !strings.HasPrefix(line, "!:") {
+		return
+	}
+
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return
+	}
+
+	switch fields[0] {
+	case "mime":
+		if len(fields) < 2 {
+			ctx.Logf("missing type in %s, ignoring", line)
+			return
+		}
+		rules[len(rules)-1].MIME = fields[1]
+	}
+}
+
+// parseIntegerTest parses the test of kinds that compare a number like
+// integer tests do ("x", "=0644", ">0", "&0x80", etc.) into ik
+func parseIntegerTest(ik *IntegerKind, test []byte) error {
+	if len(test) == 0 {
+		return fmt.Errorf("missing test value")
+	}
+
+	k := 0
+	switch test[k] {
+	case 'x':
+		ik.MatchAny = true
+		k++
+	case '=':
+		k++
+	case '!':
+		ik.IntegerTest = IntegerTestNotEqual
+		k++
+	case '<':
+		ik.IntegerTest = IntegerTestLessThan
+		k++
+	case '>':
+		ik.IntegerTest = IntegerTestGreaterThan
+		k++
+	case '&':
+		ik.IntegerTest = IntegerTestAnd
+		k++
+	}
+
+	if !ik.MatchAny {
+		parsedMagicValue, err := parseInt(test, k)
+		if err != nil {
+			return fmt.Errorf("couldn't parse magic value %s", test[k:])
+		}
+		ik.Value = parsedMagicValue.Value
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package parser
+
+import (
+	"fmt"
+)
+
+// PStringKind describes a test on a Pascal-style string: a length, then
+// that many bytes
+type PStringKind struct {
+	// StringKind holds the pattern, which must match the start of the
+	// string, and the string test flags
+	StringKind
+	// LengthWidth is the size of the length in bytes: 1, 2 or 4
+	LengthWidth int
+	// LengthEndianness is the byte order of 2 and 4-byte lengths
+	LengthEndianness Endianness
+	// LengthIncludesItself is set with the "J" flag, when the length
+	// counts its own bytes
+	LengthIncludesItself bool
+}
+
+// parsePStringKind parses a pstring rule. After a '/', the kind may carry
+// the width of the length ("B", "H", "h", "L" or "l"), the "J" flag, and
+// string test flags.
+func parsePStringKind(kind []byte, j int, test []byte) (*PStringKind, error) {
+	pk := &PStringKind{
+		LengthWidth:      1,
+		LengthEndianness: BigEndian,
+	}
+
+	if j < len(kind) && kind[j] == '/' {
+		j++
+		for _, flag := range kind[j:] {
+			switch flag {
+			case 'B':
+				pk.LengthWidth = 1
+			case 'H':
+				pk.LengthWidth, pk.LengthEndianness = 2, BigEndian
+			case 'h':
+				pk.LengthWidth, pk.LengthEndianness = 2, LittleEndian
+			case 'L':
+				pk.LengthWidth, pk.LengthEndianness = 4, BigEndian
+			case 'l':
+				pk.LengthWidth, pk.LengthEndianness = 4, LittleEndian
+			case 'J':
+				pk.LengthIncludesItself = true
+			}
+		}
+		pk.Flags = parseStringTestFlags(kind, j).Flags
+	}
+
+	k := 0
+	if k < len(test) && test[k] == '!' {
+		pk.Negate = true
+		k++
+	}
+
+	parsedRHS, err := parseString(test, k)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse rhs: %s", err.Error())
+	}
+	pk.Value = string(parsedRHS.Value)
+	if pk.Value == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	return pk, nil
+}
@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RegexKind describes a regular expression test. Patterns are matched
+// line by line: "^" and "$" match at the start and end of lines.
+type RegexKind struct {
+	// Value is the pattern, in Go's regexp syntax
+	Value string
+	// MaxLen limits how much of the target is searched, in bytes, or in
+	// lines if Lines is set. 0 means as much as the target allows, up to
+	// utils.MaxRegexBytes.
+	MaxLen int64
+	// Lines ("l" flag) makes MaxLen a number of lines
+	Lines bool
+	// IgnoreCase ("c" flag) makes the pattern match both cases
+	IgnoreCase bool
+	// MatchStart ("s" flag) makes relative offsets start at the start of
+	// the match, rather than at its end
+	MatchStart bool
+
+	compileOnce sync.Once
+	re          *regexp.Regexp
+	err         error
+}
+
+// Pattern returns the pattern with its flags, ready for regexp.Compile
+func (rk *RegexKind) Pattern() string {
+	flags := "(?m)"
+	if rk.IgnoreCase {
+		flags = "(?mi)"
+	}
+	return flags + rk.Value
+}
+
+// Regexp returns the compiled Pattern. It's only compiled the first time,
+// the kind mustn't change afterwards. The parser compiles the patterns of
+// the rules it reads, and leaves out those that don't compile.
+func (rk *RegexKind) Regexp() (*regexp.Regexp, error) {
+	rk.compileOnce.Do(func() {
+		rk.re, rk.err = regexp.Compile(rk.Pattern())
+	})
+	return rk.re, rk.err
+}
+
+// parseRegexKind parses a regex rule. The kind may carry a limit and flags
+// ("regex/100", "regex/1l", "regex/cs"). Escaped blanks in the test are
+// unescaped, other escapes are left for the regexp package.
+func parseRegexKind(kind []byte, j int, test []byte) (*RegexKind, error) {
+	rk := &RegexKind{}
+
+	if j < len(kind) && kind[j] == '/' {
+		j++
+		if j < len(kind) && kind[j] >= '0' && kind[j] <= '9' {
+			parsedLen, err := parseUint(kind, j)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse limit in %s: %s", kind[j:], err.Error())
+			}
+			rk.MaxLen = int64(parsedLen.Value)
+			j = parsedLen.NewIndex
+		}
+
+		for ; j < len(kind); j++ {
+			switch kind[j] {
+			case 'c':
+				rk.IgnoreCase = true
+			case 's':
+				rk.MatchStart = true
+			case 'l':
+				rk.Lines = true
+			case 'b', 't':
+				// text and binary hints don't change the test
+			default:
+				return nil, fmt.Errorf("unknown flag %c", kind[j])
+			}
+		}
+	}
+
+	if len(test) == 0 {
+		return nil, fmt.Errorf("missing pattern")
+	}
+
+	var sb strings.Builder
+	for k := 0; k < len(test); k++ {
+		if test[k] == '\\' && k+1 < len(test) && (test[k+1] == ' ' || test[k+1] == '\t') {
+			k++
+		}
+		sb.WriteByte(test[k])
+	}
+	rk.Value = sb.String()
+
+	if _, err := rk.Regexp(); err != nil {
+		return nil, err
+	}
+	return rk, nil
+}
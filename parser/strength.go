@@ -0,0 +1,124 @@
+package parser
+
+import "github.com/9uanhuo/wizardry/utils"
+
+// strengthUnit is how much one byte of a test is worth, file(1) calls it MULT
+const strengthUnit = 10
+
+// Strength estimates how specific a rule is, the way file(1) does to decide
+// which top-level rules to try first: the more bytes a test looks at, the
+// stronger it is, and tests that match almost anything are the weakest.
+// Default rules have a strength of 0, any other rule at least 1.
+func (r Rule) Strength() int {
+	if r.Kind.Family == KindFamilyDefault {
+		return 0
+	}
+
+	val := 2 * strengthUnit
+	// whether the test matches any value (x) or all but one (!)
+	matchesMost := false
+	// what the test compares against, for integers and the like
+	var test *IntegerTest
+
+	switch kind := r.Kind.Data.(type) {
+	case *IntegerKind:
+		val += kind.ByteWidth * strengthUnit
+		matchesMost = kind.MatchAny
+		test = &kind.IntegerTest
+	case *DateKind:
+		val += kind.ByteWidth * strengthUnit
+		matchesMost = kind.MatchAny
+		test = &kind.IntegerTest
+	case *OctalKind:
+		// compared as a number, but read from text
+		val += 8 * strengthUnit
+		matchesMost = kind.MatchAny
+		test = &kind.IntegerTest
+	case *FloatKind:
+		val += kind.ByteWidth * strengthUnit
+		matchesMost = kind.MatchAny
+		test = &kind.FloatTest
+	case *StringKind:
+		val += len(kind.Value) * strengthUnit
+		matchesMost = kind.Negate
+	case *PStringKind:
+		val += len(kind.Value) * strengthUnit
+		matchesMost = kind.Negate
+	case *String16Kind:
+		val += len(kind.Value) * strengthUnit / 2
+		matchesMost = kind.Negate || kind.MatchAny
+	case *SearchKind:
+		if len(kind.Value) > 0 {
+			val += len(kind.Value) * maxInt(strengthUnit/len(kind.Value), 1)
+		}
+	case *RegexKind:
+		n := literalBytes(kind.Value)
+		val += n * maxInt(strengthUnit/n, 1)
+	case *DerKind:
+		val += strengthUnit
+	case *GuidKind:
+		val += utils.GUIDSize * strengthUnit
+		matchesMost = kind.MatchAny
+	}
+
+	switch {
+	case matchesMost:
+		val = 0
+	case test == nil:
+		// strings and such test for equality
+		val += strengthUnit
+	case *test == IntegerTestEqual:
+		val += strengthUnit
+	case *test == IntegerTestNotEqual:
+		val = 0
+	case *test == IntegerTestLessThan || *test == IntegerTestGreaterThan:
+		val -= 2 * strengthUnit
+	case *test == IntegerTestAnd:
+		val -= strengthUnit
+	}
+
+	if val <= 0 {
+		val = 1
+	}
+	// rules without a description need their children to print something
+	if len(r.Description) == 0 {
+		val++
+	}
+	return val
+}
+
+// literalBytes counts the bytes of a regular expression that aren't
+// operators, at least 1
+func literalBytes(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+			n++
+		case '?', '*', '.', '+', '^', '$', '(', ')', '|':
+		case '[', '{':
+			// a class or a repetition, skipped entirely
+			closing := byte(']')
+			if pattern[i] == '{' {
+				closing = '}'
+			}
+			for i < len(pattern) && pattern[i] != closing {
+				i++
+			}
+		default:
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"fmt"
+)
+
+// String16Kind describes a test on a UTF-16 string, like the names stored
+// in Windows formats
+type String16Kind struct {
+	// Value is the pattern, every byte of it must be a code unit of the
+	// target
+	Value      string
+	Endianness Endianness
+	Negate     bool
+	// MatchAny is set for "x" tests, which match any string, up to its
+	// NUL code unit
+	MatchAny bool
+}
+
+// parseString16Kind parses a lestring16 or bestring16 rule
+func parseString16Kind(name string, test []byte) (*String16Kind, error) {
+	sk := &String16Kind{
+		Endianness: LittleEndian,
+	}
+	if name == "bestring16" {
+		sk.Endianness = BigEndian
+	}
+
+	if len(test) == 1 && test[0] == 'x' {
+		sk.MatchAny = true
+		return sk, nil
+	}
+
+	k := 0
+	if k < len(test) && test[k] == '!' {
+		sk.Negate = true
+		k++
+	}
+
+	parsedRHS, err := parseString(test, k)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse rhs: %s", err.Error())
+	}
+	sk.Value = string(parsedRHS.Value)
+	if sk.Value == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	return sk, nil
+}
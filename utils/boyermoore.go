@@ -5,6 +5,7 @@
 package utils
 
 import (
+	"bytes"
 	"log"
 	"strings"
 )
@@ -48,6 +49,10 @@ type StringFinder struct {
 	// rightmost "abc" (at position 6) is a prefix of the whole pattern, so
 	// goodSuffixSkip[3] == shift+len(suffix) == 6+5 == 11.
 	goodSuffixSkip []int64
+
+	// fold lower-cases the text before comparing it with pattern, which is
+	// lower-cased already
+	fold bool
 }
 
 // MakeStringFinder prepares a finder for a given pattern
@@ -94,6 +99,19 @@ func MakeStringFinder(pattern string) *StringFinder {
 	return f
 }
 
+// makeFoldingStringFinder prepares a finder for pattern that ignores case:
+// it finds every occurrence, and others that the case flags of StringTest
+// may not accept
+func makeFoldingStringFinder(pattern string) *StringFinder {
+	folded := []byte(pattern)
+	for i, b := range folded {
+		folded[i] = ToLower(b)
+	}
+	f := MakeStringFinder(string(folded))
+	f.fold = true
+	return f
+}
+
 func longestCommonSuffix(a, b string) (i int) {
 	for ; i < len(a) && i < len(b); i++ {
 		if a[len(a)-1-i] != b[len(b)-1-i] {
@@ -104,14 +122,28 @@ func longestCommonSuffix(a, b string) (i int) {
 }
 
 // next returns the index in text of the first occurrence of the pattern. If
-// the pattern is not found, it returns -1.
+// the pattern is not found, it returns -1. Like bytes.Index, it finds empty
+// patterns at 0.
 func (f *StringFinder) next(sr *SliceReader) int64 {
+	switch {
+	case len(f.pattern) == 0:
+		return 0
+	case int64(len(f.pattern)) > sr.Size():
+		// nothing to read
+		return -1
+	case len(f.pattern) == 1 && !(f.fold && IsLowerLetter(f.pattern[0])):
+		// common in magic, and much faster
+		return indexByte(sr, f.pattern[0])
+	}
+
 	i := int64(len(f.pattern) - 1)
 
 	bv := &ByteView{
 		Input:    sr,
 		LookBack: int64(len(f.pattern)),
+		BufSize:  sr.Size(),
 	}
+	defer bv.Release()
 
 	for i < sr.Size() {
 		// Compare backwards from the end until the first unmatching character.
@@ -132,8 +164,13 @@ func (f *StringFinder) next(sr *SliceReader) int64 {
 			}
 
 			if byte(c) != f.pattern[j] {
-				// mismatch, must skip
-				break
+				if f.fold {
+					c = int(ToLower(byte(c)))
+				}
+				if byte(c) != f.pattern[j] {
+					// mismatch, must skip
+					break
+				}
 			}
 			i--
 			j--
@@ -143,3 +180,30 @@ func (f *StringFinder) next(sr *SliceReader) int64 {
 	}
 	return -1
 }
+
+// indexByte returns the index in sr of the first occurrence of b, or -1. It
+// reads sr a chunk at a time.
+func indexByte(sr *SliceReader, b byte) int64 {
+	bufp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bufp)
+	buf := *bufp
+
+	var pos int64
+	for pos < sr.Size() {
+		chunk := buf
+		if remaining := sr.Size() - pos; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, _ := sr.ReadAt(chunk, pos)
+		if i := bytes.IndexByte(chunk[:n], b); i >= 0 {
+			return pos + int64(i)
+		}
+		if n < len(chunk) {
+			// relay errors
+			log.Printf("Read error at %d", pos+int64(n))
+			return -1
+		}
+		pos += int64(n)
+	}
+	return -1
+}
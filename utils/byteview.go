@@ -1,13 +1,29 @@
 package utils
 
+import "sync"
+
 const maxBufLen = 128 * 1024 // 128KB buffer
 
+// bufPool recycles ByteView buffers, string and search tests would
+// otherwise allocate one every time they run
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxBufLen)
+		return &buf
+	},
+}
+
 // ByteView allows treating an io.ReaderAt as a byte
 // array.
 type ByteView struct {
 	Input    *SliceReader
 	LookBack int64
 
+	// BufSize is how many bytes are read at once. It defaults to (and can't
+	// exceed) 128KB, tests that only look at a few bytes should lower it.
+	BufSize int64
+
+	pooledBuf *[]byte
 	buf       []byte
 	bufOffset int64
 	bufLen    int64
@@ -22,7 +38,12 @@ func (bv *ByteView) Get(i int64) int {
 	}
 
 	if bv.buf == nil {
-		bv.buf = make([]byte, maxBufLen)
+		bufSize := bv.BufSize
+		if bufSize <= 0 || bufSize > maxBufLen {
+			bufSize = maxBufLen
+		}
+		bv.pooledBuf = bufPool.Get().(*[]byte)
+		bv.buf = (*bv.pooledBuf)[:bufSize]
 	}
 
 	// already got it in buf?
@@ -32,7 +53,7 @@ func (bv *ByteView) Get(i int64) int {
 	}
 
 	newOffset := max(0, i-bv.LookBack)
-	newEnd := min(newOffset+maxBufLen-1, bv.Input.Size()-1)
+	newEnd := min(newOffset+int64(len(bv.buf))-1, bv.Input.Size()-1)
 	newBufLen := (newEnd - newOffset) + 1
 	if newBufLen <= 0 {
 		// input isn't big enough
@@ -43,16 +64,30 @@ func (bv *ByteView) Get(i int64) int {
 	bv.bufLen = newBufLen
 
 	// don't got it in buf! must read.
-	_, err := bv.Input.ReadAt(bv.buf[:bv.bufLen], bv.bufOffset)
-	if err != nil {
-		// that's pretty bad
-		return -1
+	n, _ := bv.Input.ReadAt(bv.buf[:bv.bufLen], bv.bufOffset)
+	if int64(n) < bv.bufLen {
+		// short read, the bytes we did get are still good
+		bv.bufLen = int64(n)
 	}
 
 	posInBuffer = i - bv.bufOffset
+	if posInBuffer >= bv.bufLen {
+		// that's pretty bad
+		return -1
+	}
 	return int(bv.buf[posInBuffer])
 }
 
+// Release gives the view's buffer back to the pool. The view must not be
+// used afterwards.
+func (bv *ByteView) Release() {
+	if bv.pooledBuf != nil {
+		bufPool.Put(bv.pooledBuf)
+		bv.pooledBuf = nil
+		bv.buf = nil
+	}
+}
+
 func min(a, b int64) int64 {
 	if a < b {
 		return a
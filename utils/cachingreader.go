@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultBlockSize is the block size of a CachingReaderAt when none is given
+const DefaultBlockSize = 4096
+
+// CachedBlocks is how many blocks a CachingReaderAt keeps at most, the
+// least recently used one goes first
+const CachedBlocks = 64
+
+// CachingReaderAt reads blocks of an io.ReaderAt as they're needed and
+// keeps the last ones used, so identifying a large file only reads the
+// parts of it rules look at: the head, where pointers point, maybe the
+// tail. It reads like a bytes.Reader of the first size bytes, and is safe
+// for concurrent use.
+type CachingReaderAt struct {
+	reader    io.ReaderAt
+	size      int64
+	blockSize int64
+
+	mu        sync.Mutex
+	blocks    map[int64]*list.Element
+	lru       *list.List
+	bytesRead int64
+}
+
+var _ io.ReaderAt = (*CachingReaderAt)(nil)
+
+// cachedBlock is the data of block index, shorter than the block size for
+// the last one
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+// NewCachingReaderAt returns a reader of the first size bytes of r, which
+// reads blockSize bytes at a time, DefaultBlockSize if it's not positive
+func NewCachingReaderAt(r io.ReaderAt, size int64, blockSize int) *CachingReaderAt {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &CachingReaderAt{
+		reader:    r,
+		size:      size,
+		blockSize: int64(blockSize),
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// NewCachingSliceReader returns a SliceReader of the first size bytes of
+// r, through a CachingReaderAt
+func NewCachingSliceReader(r io.ReaderAt, size int64, blockSize int) *SliceReader {
+	return NewSliceReader(NewCachingReaderAt(r, size, blockSize), 0, size)
+}
+
+// Size returns how many bytes can be read
+func (cr *CachingReaderAt) Size() int64 {
+	return cr.size
+}
+
+// BytesRead returns how many bytes were read from the underlying reader
+func (cr *CachingReaderAt) BytesRead() int64 {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.bytesRead
+}
+
+// ReadAt reads like bytes.Reader does: it fails on negative offsets, and
+// returns io.EOF along with what it read if it couldn't fill buf
+func (cr *CachingReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("utils.CachingReaderAt.ReadAt: negative offset")
+	}
+	if off >= cr.size {
+		return 0, io.EOF
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	n := 0
+	for n < len(buf) && off < cr.size {
+		index := off / cr.blockSize
+		data, err := cr.block(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(buf[n:], data[off-index*cr.blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the data of block index, reading it if it's not cached.
+// cr.mu must be held.
+func (cr *CachingReaderAt) block(index int64) ([]byte, error) {
+	if el, ok := cr.blocks[index]; ok {
+		cr.lru.MoveToFront(el)
+		return el.Value.(*cachedBlock).data, nil
+	}
+
+	start := index * cr.blockSize
+	length := cr.blockSize
+	if start+length > cr.size {
+		length = cr.size - start
+	}
+
+	var data []byte
+	if cr.lru.Len() >= CachedBlocks {
+		// reuse the buffer of the block that goes
+		el := cr.lru.Back()
+		evicted := el.Value.(*cachedBlock)
+		cr.lru.Remove(el)
+		delete(cr.blocks, evicted.index)
+		data = evicted.data[:cap(evicted.data)]
+	}
+	if int64(len(data)) < length {
+		data = make([]byte, cr.blockSize)
+	}
+	data = data[:length]
+
+	n, err := cr.reader.ReadAt(data, start)
+	cr.bytesRead += int64(n)
+	if n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	cr.blocks[index] = cr.lru.PushFront(&cachedBlock{index: index, data: data})
+	return data, nil
+}
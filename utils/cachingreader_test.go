@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingReaderAt counts the bytes read through it
+type countingReaderAt struct {
+	reader io.ReaderAt
+	read   int64
+}
+
+func (c *countingReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := c.reader.ReadAt(buf, off)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func Test_CachingReaderAt(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 10000)
+	rng.Read(data)
+	br := bytes.NewReader(data)
+
+	for _, blockSize := range []int{0, 1, 7, 64, 4096, 20000} {
+		cr := NewCachingReaderAt(bytes.NewReader(data), int64(len(data)), blockSize)
+		assert.EqualValues(t, len(data), cr.Size())
+
+		for i := 0; i < 2000; i++ {
+			length := rng.Intn(300)
+			off := int64(rng.Intn(len(data) + 400))
+			if i%10 == 0 {
+				// right around the end
+				off = int64(len(data) - 5 + rng.Intn(10))
+			}
+
+			expected := make([]byte, length)
+			en, eerr := br.ReadAt(expected, off)
+			actual := make([]byte, length)
+			n, err := cr.ReadAt(actual, off)
+			assert.EqualValues(t, en, n, "reading %d at %d, blocks of %d", length, off, blockSize)
+			assert.Equal(t, eerr, err, "reading %d at %d, blocks of %d", length, off, blockSize)
+			assert.EqualValues(t, expected[:en], actual[:n])
+		}
+
+		_, err := cr.ReadAt(make([]byte, 4), -1)
+		assert.Error(t, err)
+
+		// through a SliceReader, like the interpreter reads it
+		sr := NewCachingSliceReader(bytes.NewReader(data), int64(len(data)), blockSize).Slice(9990)
+		buf := make([]byte, 16)
+		n, err := sr.ReadAt(buf, 2)
+		assert.EqualValues(t, 8, n)
+		assert.Equal(t, io.EOF, err)
+		assert.EqualValues(t, data[9992:], buf[:n])
+	}
+}
+
+func Test_CachingReaderAtBlocks(t *testing.T) {
+	data := make([]byte, 100*(CachedBlocks+2))
+	counter := &countingReaderAt{reader: bytes.NewReader(data)}
+	cr := NewCachingReaderAt(counter, int64(len(data)), 100)
+
+	buf := make([]byte, 10)
+	_, err := cr.ReadAt(buf, 95)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 200, cr.BytesRead())
+	assert.EqualValues(t, 200, counter.read)
+
+	// cached
+	_, err = cr.ReadAt(buf, 150)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 200, cr.BytesRead())
+
+	// the whole thing, the first blocks go
+	_, err = cr.ReadAt(make([]byte, len(data)), 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), cr.BytesRead())
+	_, err = cr.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data)+100, cr.BytesRead())
+
+	// failed reads are reported, with what was read before
+	failing := NewCachingReaderAt(bytes.NewReader(data[:150]), int64(len(data)), 100)
+	n, err := failing.ReadAt(make([]byte, 100), 50)
+	assert.EqualValues(t, 50, n)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateFormat tells how a date is stored
+type DateFormat int
+
+const (
+	// DateFormatUnix is a number of seconds since the epoch
+	DateFormatUnix DateFormat = iota
+	// DateFormatDOSDate is a day, month and year packed in 16 bits
+	DateFormatDOSDate
+	// DateFormatDOSTime is an hour, minute and second packed in 16 bits,
+	// with a 2-second resolution
+	DateFormatDOSTime
+)
+
+// FormatDate formats a date read by a date test like file(1) does. width is
+// how many bytes were read, 32-bit UNIX dates are signed. UNIX dates are
+// printed in UTC, or in the local time zone if local is set. DOS dates and
+// times are already local.
+func FormatDate(value uint64, width int, local bool, format DateFormat) string {
+	switch format {
+	case DateFormatDOSDate:
+		day := int(value & 0x1f)
+		month := time.Month((value >> 5) & 0xf)
+		year := int((value>>9)&0x7f) + 1980
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Format("Mon, Jan 02 2006")
+	case DateFormatDOSTime:
+		return fmt.Sprintf("%02d:%02d:%02d", (value>>11)&0x1f, (value>>5)&0x3f, (value&0x1f)*2)
+	}
+
+	seconds := int64(value)
+	if width == 4 {
+		seconds = int64(int32(value))
+	}
+	t := time.Unix(seconds, 0).UTC()
+	if local {
+		t = t.Local()
+	}
+	return t.Format("Mon Jan _2 15:04:05 2006")
+}
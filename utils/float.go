@@ -0,0 +1,15 @@
+package utils
+
+import "math"
+
+// Float32FromBits returns the float whose bits are the lower 32 of v, the
+// value a float test read
+func Float32FromBits(v uint64) float64 {
+	return float64(math.Float32frombits(uint32(v)))
+}
+
+// Float64FromBits returns the double whose bits are v, the value a double
+// test read
+func Float64FromBits(v uint64) float64 {
+	return math.Float64frombits(v)
+}
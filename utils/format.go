@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxFormattedString caps how many bytes of the target a %s conversion prints
+const MaxFormattedString = 96
+
+// IntegerArg tells what an integer is formatted as for a conversion
+type IntegerArg int
+
+const (
+	// IntegerArgSigned formats the value sign-extended, if its test is signed
+	IntegerArgSigned IntegerArg = iota
+	// IntegerArgUnsigned formats the value as read
+	IntegerArgUnsigned
+	// IntegerArgChar formats the lowest byte of the value as a character
+	IntegerArgChar
+)
+
+// Conversion is the printf-style conversion in a description, like the
+// "%d" in "version %d". file(1) only substitutes one value per description.
+type Conversion struct {
+	// Prefix and Suffix are the text around the conversion, with "%%"
+	// turned into "%"
+	Prefix string
+	Suffix string
+
+	// Spec has the flags, width and precision of the conversion in Go's
+	// syntax, without the verb, e.g. "%-5.5"
+	Spec string
+
+	// Verb is the C conversion character, one of "diouxXcseEfFgG"
+	Verb byte
+
+	// Raw is the conversion as written, e.g. "%llu"
+	Raw string
+}
+
+// ParseConversion finds the first conversion in a description. If there is
+// none, it returns false, and a Conversion whose Prefix is the whole
+// description.
+func ParseConversion(desc string) (Conversion, bool) {
+	var c Conversion
+	if strings.IndexByte(desc, '%') < 0 {
+		c.Prefix = desc
+		return c, false
+	}
+
+	var sb strings.Builder
+	found := false
+	i := 0
+	for i < len(desc) {
+		ch := desc[i]
+		if ch != '%' {
+			sb.WriteByte(ch)
+			i++
+			continue
+		}
+
+		if i+1 < len(desc) && desc[i+1] == '%' {
+			sb.WriteByte('%')
+			i += 2
+			continue
+		}
+
+		if found {
+			sb.WriteByte(ch)
+			i++
+			continue
+		}
+
+		spec, verb, end := parseConversionSpec(desc, i+1)
+		if end < 0 {
+			sb.WriteByte(ch)
+			i++
+			continue
+		}
+
+		c.Prefix = sb.String()
+		sb.Reset()
+		c.Spec = spec
+		c.Verb = verb
+		c.Raw = desc[i:end]
+		found = true
+		i = end
+	}
+
+	if found {
+		c.Suffix = sb.String()
+	} else {
+		c.Prefix = sb.String()
+	}
+	return c, found
+}
+
+// parseConversionSpec parses a C conversion specification (flags, width,
+// precision, length modifiers and conversion character) starting right
+// after a '%'. It returns the specification in Go's syntax, without the
+// verb, the C conversion character, and the index right after it, or -1
+// if it isn't a conversion we know.
+func parseConversionSpec(desc string, j int) (string, byte, int) {
+	start := j
+	for j < len(desc) && strings.IndexByte("-+ #0", desc[j]) >= 0 {
+		j++
+	}
+	for j < len(desc) && IsNumber(desc[j]) {
+		j++
+	}
+	if j < len(desc) && desc[j] == '.' {
+		j++
+		for j < len(desc) && IsNumber(desc[j]) {
+			j++
+		}
+	}
+	spec := "%" + desc[start:j]
+
+	// length modifiers don't matter, values are already 64-bit
+	for j < len(desc) && strings.IndexByte("hlqjzt", desc[j]) >= 0 {
+		j++
+	}
+
+	if j >= len(desc) || strings.IndexByte("diouxXcseEfFgG", desc[j]) < 0 {
+		return "", 0, -1
+	}
+	return spec, desc[j], j + 1
+}
+
+// IntegerFormat returns the Go format for an integer value, e.g. "%5d", and
+// what the value should be formatted as. Numbers printed as strings come
+// out in decimal.
+func (c Conversion) IntegerFormat() (string, IntegerArg) {
+	switch c.Verb {
+	case 'd', 'i', 's':
+		return c.Spec + "d", IntegerArgSigned
+	case 'u':
+		return c.Spec + "d", IntegerArgUnsigned
+	case 'c':
+		return c.Spec + "c", IntegerArgChar
+	default:
+		return c.Spec + string(c.Verb), IntegerArgUnsigned
+	}
+}
+
+// FormatInteger returns the description with an integer value in place of
+// the conversion. signed is the value, sign-extended if its test is signed.
+// Floating-point conversions are left as written.
+func (c Conversion) FormatInteger(value uint64, signed int64) string {
+	if c.IsFloat() {
+		return c.Unformatted()
+	}
+	format, arg := c.IntegerFormat()
+
+	var s string
+	switch arg {
+	case IntegerArgSigned:
+		s = fmt.Sprintf(format, signed)
+	case IntegerArgChar:
+		s = fmt.Sprintf(format, rune(byte(value)))
+	default:
+		s = fmt.Sprintf(format, value)
+	}
+	return c.Prefix + s + c.Suffix
+}
+
+// IsFloat tells whether the conversion prints a floating-point number
+func (c Conversion) IsFloat() bool {
+	return strings.IndexByte("eEfFgG", c.Verb) >= 0
+}
+
+// FloatFormat returns the Go format for a floating-point value. Like in C,
+// %g has a precision of 6 unless one is given.
+func (c Conversion) FloatFormat() string {
+	spec := c.Spec
+	if (c.Verb == 'g' || c.Verb == 'G') && !strings.Contains(spec, ".") {
+		spec += ".6"
+	}
+	return spec + string(c.Verb)
+}
+
+// FormatFloat returns the description with a floating-point value in place
+// of the conversion. Other conversions are left as written.
+func (c Conversion) FormatFloat(value float64) string {
+	if !c.IsFloat() {
+		return c.Unformatted()
+	}
+	return c.Prefix + fmt.Sprintf(c.FloatFormat(), value) + c.Suffix
+}
+
+// FormatBytes returns the description with bytes matched by a string test
+// in place of the conversion. Only "s" conversions print bytes, others are
+// left as written.
+func (c Conversion) FormatBytes(b []byte) string {
+	if c.Verb != 's' {
+		return c.Unformatted()
+	}
+	if len(b) > MaxFormattedString {
+		b = b[:MaxFormattedString]
+	}
+	return c.Prefix + fmt.Sprintf(c.Spec+"s", b) + c.Suffix
+}
+
+// FormatString returns the description with s in place of the conversion,
+// for values that are formatted as text before being printed, like dates
+func (c Conversion) FormatString(s string) string {
+	return c.Prefix + fmt.Sprintf(c.Spec+"s", s) + c.Suffix
+}
+
+// Unformatted returns the description with the conversion left as written,
+// for rules that have no value to show
+func (c Conversion) Unformatted() string {
+	return c.Prefix + c.Raw + c.Suffix
+}
+
+// GoFormat returns a format string for fmt.Sprintf that prints the whole
+// description, with format in place of the conversion
+func (c Conversion) GoFormat(format string) string {
+	return strings.ReplaceAll(c.Prefix, "%", "%%") + format + strings.ReplaceAll(c.Suffix, "%", "%%")
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// GUIDSize is how many bytes a GUID takes
+const GUIDSize = 16
+
+// FormatGUID formats a GUID stored like Windows does it, its first three
+// fields little-endian, in its canonical text form, e.g.
+// "00020906-0000-0000-C000-000000000046". b must hold GUIDSize bytes.
+func FormatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15])
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// TruncateUint keeps the lower byteWidth bytes of v
+func TruncateUint(v uint64, byteWidth int) uint64 {
+	if byteWidth >= 8 {
+		return v
+	}
+	return v & (1<<(uint(byteWidth)*8) - 1)
+}
+
+// SignExtend interprets the lower byteWidth bytes of v as a signed integer
+func SignExtend(v uint64, byteWidth int) uint64 {
+	switch byteWidth {
+	case 1:
+		return uint64(int64(int8(v)))
+	case 2:
+		return uint64(int64(int16(v)))
+	case 4:
+		return uint64(int64(int32(v)))
+	}
+	return v
+}
+
+// ErrNegativeOffset is what ReadUintErr returns for reads before the start
+// of the target
+var ErrNegativeOffset = errors.New("negative offset")
+
+// uintBufPool holds what ReadUintErr reads into when the target isn't in
+// memory, readers may keep buffers they're given, so they can't be on the
+// stack
+var uintBufPool = sync.Pool{
+	New: func() interface{} { return new([8]byte) },
+}
+
+// ReadUint reads an unsigned integer of width bytes, 1, 2, 4 or 8, at off
+// in sr, in byte order bo, which single bytes don't need, so it may be nil
+// for them. It fails for negative offsets, integers that don't fit before
+// the end of sr, other widths, and reads that fail.
+func ReadUint(sr *SliceReader, off int64, width int, bo binary.ByteOrder) (uint64, bool) {
+	v, err := ReadUintErr(sr, off, width, bo)
+	return v, err == nil
+}
+
+// ReadInt is ReadUint for signed integers, sign-extended from width bytes
+func ReadInt(sr *SliceReader, off int64, width int, bo binary.ByteOrder) (int64, bool) {
+	v, err := ReadUintErr(sr, off, width, bo)
+	return int64(SignExtend(v, width)), err == nil
+}
+
+// ReadUintErr is ReadUint telling why it failed: ErrNegativeOffset, io.EOF
+// if the integer doesn't fit before the end of sr, or what reading sr
+// returned. It doesn't allocate.
+func ReadUintErr(sr *SliceReader, off int64, width int, bo binary.ByteOrder) (uint64, error) {
+	switch width {
+	case 1, 2, 4, 8:
+	default:
+		return 0, fmt.Errorf("dunno how to read an uint of %d bytes", width)
+	}
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if off > sr.size-int64(width) {
+		return 0, io.EOF
+	}
+
+	if sr.reader == nil {
+		start := sr.offset + off
+		if start+int64(width) <= int64(len(sr.data)) {
+			return decodeUint(sr.data[start:start+int64(width)], bo), nil
+		}
+		return 0, io.EOF
+	}
+
+	buf := uintBufPool.Get().(*[8]byte)
+	defer uintBufPool.Put(buf)
+	n, err := sr.ReadAt(buf[:width], off)
+	if n < width {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	return decodeUint(buf[:width], bo), nil
+}
+
+// decodeUint decodes b, which is 1, 2, 4 or 8 bytes long
+func decodeUint(b []byte, bo binary.ByteOrder) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(bo.Uint16(b))
+	case 4:
+		return uint64(bo.Uint32(b))
+	}
+	return bo.Uint64(b)
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"runtime/debug"
+)
+
+// ErrMappedTruncated is returned when reading parts of a mapped file that
+// it doesn't have anymore, because it was truncated since it was mapped
+var ErrMappedTruncated = errors.New("utils: mapped file was truncated")
+
+// errNotMapped is returned by mapFile where files can't be mapped
+var errNotMapped = errors.New("utils: files can't be mapped on this platform")
+
+// mappedReaderAt reads a file mapped in memory
+type mappedReaderAt struct {
+	data []byte
+}
+
+var _ io.ReaderAt = (*mappedReaderAt)(nil)
+
+// ReadAt reads like bytes.Reader does. Where the file was truncated, the
+// fault is turned into an ErrMappedTruncated.
+func (mr *mappedReaderAt) ReadAt(buf []byte, off int64) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); !ok {
+				panic(r)
+			}
+			n, err = 0, ErrMappedTruncated
+		}
+	}()
+
+	return readBytesAt(mr.data, buf, off)
+}
+
+// NewMappedReader maps the file at path in memory, read-only, and returns
+// a SliceReader of it, along with a function that unmaps it, after which
+// the reader must not be used anymore. Where files can't be mapped, the
+// reader reads the file with ReadAt instead, and the function closes it.
+//
+// The reader covers the size the file had when it was mapped: what's
+// appended to it later isn't read, and reading what it doesn't have
+// anymore since it was truncated fails with ErrMappedTruncated. Empty
+// files aren't mapped, their readers read nothing.
+func NewMappedReader(path string) (*SliceReader, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	size := stat.Size()
+
+	if size == 0 {
+		return NewSliceReader(bytes.NewReader(nil), 0, 0), f.Close, nil
+	}
+
+	data, unmap, err := mapFile(f, size)
+	if err == errNotMapped {
+		return NewSliceReader(f, 0, size), f.Close, nil
+	}
+	// the mapping doesn't need the file to stay open
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mr := &mappedReaderAt{data: data}
+	closed := false
+	closer := func() error {
+		if closed {
+			return nil
+		}
+		closed = true
+		mr.data = nil
+		return unmap()
+	}
+	return NewSliceReader(mr, 0, size), closer, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package utils
+
+import "os"
+
+// mapFile doesn't map files here, NewMappedReader reads them instead
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errNotMapped
+}
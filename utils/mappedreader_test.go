@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MappedReader(t *testing.T) {
+	dir := t.TempDir()
+
+	for i, sample := range [][]byte{[]byte("abc"), []byte("\x7fELF\x02\x01\x01"), make([]byte, 5000)} {
+		path := filepath.Join(dir, fmt.Sprintf("sample-%d", i))
+		assert.NoError(t, ioutil.WriteFile(path, sample, 0644))
+
+		sr, closer, err := NewMappedReader(path)
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(sample), sr.Size())
+		buf := make([]byte, len(sample))
+		n, err := sr.ReadAt(buf, 0)
+		assert.EqualValues(t, len(sample), n)
+		assert.NoError(t, err)
+		assert.EqualValues(t, sample, buf)
+
+		// reads past the end stop there, like in memory
+		buf = make([]byte, 8)
+		n, err = sr.ReadAt(buf, sr.Size()-3)
+		assert.EqualValues(t, 3, n)
+		assert.Equal(t, io.EOF, err)
+		assert.EqualValues(t, sample[len(sample)-3:], buf[:n])
+		assert.NoError(t, closer())
+		assert.NoError(t, closer())
+	}
+
+	_, _, err := NewMappedReader(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_MappedReaderSizes(t *testing.T) {
+	dir := t.TempDir()
+
+	// empty files read nothing
+	empty := filepath.Join(dir, "empty")
+	assert.NoError(t, ioutil.WriteFile(empty, nil, 0644))
+	sr, closer, err := NewMappedReader(empty)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, sr.Size())
+	n, err := sr.ReadAt(make([]byte, 4), 0)
+	assert.EqualValues(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, closer())
+
+	path := filepath.Join(dir, "changing")
+	data := make([]byte, 3*os.Getpagesize())
+	for i := range data {
+		data[i] = byte(i)
+	}
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+	sr, closer, err = NewMappedReader(path)
+	assert.NoError(t, err)
+	defer closer()
+
+	// what's appended isn't read
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("more"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), sr.Size())
+	n, err = sr.ReadAt(make([]byte, 8), int64(len(data)))
+	assert.EqualValues(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	if runtime.GOOS == "windows" {
+		// mapped files can't be truncated there
+		f.Close()
+		return
+	}
+
+	// what was truncated fails to read, it doesn't crash
+	assert.NoError(t, f.Truncate(int64(os.Getpagesize())))
+	f.Close()
+	buf := make([]byte, 4)
+	n, err = sr.ReadAt(buf, 4)
+	assert.EqualValues(t, 4, n)
+	assert.NoError(t, err)
+	assert.EqualValues(t, data[4:8], buf)
+	_, err = sr.ReadAt(buf, int64(2*os.Getpagesize()))
+	assert.Equal(t, ErrMappedTruncated, err)
+}
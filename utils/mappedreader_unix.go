@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of f, read-only
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	if int64(int(size)) != size {
+		return nil, nil, errNotMapped
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("mmap", err)
+	}
+	unmap := func() error {
+		return os.NewSyscallError("munmap", syscall.Munmap(data))
+	}
+	return data, unmap, nil
+}
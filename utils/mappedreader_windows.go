@@ -0,0 +1,34 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mapFile maps the first size bytes of f, read-only
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	if int64(int(size)) != size {
+		return nil, nil, errNotMapped
+	}
+	mapping, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY,
+		uint32(size>>32), uint32(size), nil)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	addr, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_READ, 0, 0, uintptr(size))
+	// the view keeps the mapping alive
+	syscall.CloseHandle(mapping)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+
+	// addr isn't memory Go knows about, converting it directly upsets vet
+	data := unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), int(size))
+	unmap := func() error {
+		return os.NewSyscallError("UnmapViewOfFile", syscall.UnmapViewOfFile(addr))
+	}
+	return data, unmap, nil
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mergeCases are fragments, and how file(1) 5.44 prints them
+var mergeCases = []struct {
+	fragments []string
+	expected  string
+}{
+	{nil, ""},
+	{[]string{"Zip archive data"}, "Zip archive data"},
+	{[]string{"Zip archive data", `\b, at least v2.0`}, "Zip archive data, at least v2.0"},
+	{[]string{"ELF", "64-bit", "LSB"}, "ELF 64-bit LSB"},
+	// decoded, as a backspace
+	{[]string{"Zip archive data", "\b, at least v2.0"}, "Zip archive data, at least v2.0"},
+	// several are one, file(1) would print the second as written
+	{[]string{"version", `\b\b1`}, "version1"},
+	{[]string{"version", "\b" + `\b` + "\b.1"}, "version.1"},
+	// dropped from the first fragment
+	{[]string{`\b, first`, "second"}, ", first second"},
+	{[]string{"\b\b", `\bfirst`}, "first"},
+	// only at the start
+	{[]string{"a", `b\bc`}, `a b\bc`},
+	// empty ones add nothing
+	{[]string{"a", "", `\b`, "b"}, "a b"},
+	{[]string{"", "a", "", "", "b"}, "a b"},
+}
+
+func Test_MergeStrings(t *testing.T) {
+	for _, c := range mergeCases {
+		assert.EqualValues(t, c.expected, MergeStrings(c.fragments), "for %q", c.fragments)
+		// the zero value of MergeOptions is MergeStrings
+		assert.EqualValues(t, c.expected, MergeStringsOpts(c.fragments, MergeOptions{}), "for %q", c.fragments)
+	}
+}
+
+func Test_MergeStringsOpts(t *testing.T) {
+	// what the interpreter finds in the zip and PNG samples of its tests
+	zip := []string{"Zip archive data", `\b, at least v2.0 to extract`}
+	png := []string{"PNG image data", `\b, 256 x`, "256,", "8-bit"}
+
+	// several matches of a book with stray whitespace and repeats
+	repeated := []string{"ELF ", "64-bit", "64-bit", " LSB", "", `\b, x86-64`, `\b, x86-64`, "executable", "executable "}
+
+	cases := []struct {
+		fragments []string
+		opts      MergeOptions
+		expected  string
+	}{
+		{zip, MergeOptions{}, "Zip archive data, at least v2.0 to extract"},
+		{png, MergeOptions{}, "PNG image data, 256 x 256, 8-bit"},
+		{repeated, MergeOptions{}, "ELF  64-bit 64-bit  LSB, x86-64, x86-64 executable executable"},
+
+		// separators don't go before \b
+		{zip, MergeOptions{Separator: "; "}, "Zip archive data, at least v2.0 to extract"},
+		{png, MergeOptions{Separator: "\n"}, "PNG image data, 256 x\n256,\n8-bit"},
+		{repeated, MergeOptions{Separator: "|"}, "ELF |64-bit|64-bit| LSB, x86-64, x86-64|executable|executable"},
+
+		{png, MergeOptions{TrimSpace: true}, "PNG image data, 256 x 256, 8-bit"},
+		{repeated, MergeOptions{TrimSpace: true}, "ELF 64-bit 64-bit LSB, x86-64, x86-64 executable executable"},
+		{[]string{"a", `\b b`, `\b`, "c"}, MergeOptions{TrimSpace: true}, "ab c"},
+
+		{zip, MergeOptions{Dedupe: true}, "Zip archive data, at least v2.0 to extract"},
+		{repeated, MergeOptions{Dedupe: true}, "ELF  64-bit  LSB, x86-64 executable executable"},
+		// with \b removed
+		{[]string{"a", `\ba`, "\ba", "b"}, MergeOptions{Dedupe: true}, "a b"},
+
+		{repeated, MergeOptions{TrimSpace: true, Dedupe: true}, "ELF 64-bit LSB, x86-64 executable"},
+		{repeated, MergeOptions{Separator: ", ", TrimSpace: true, Dedupe: true}, "ELF, 64-bit, LSB, x86-64, executable"},
+		{repeated, MergeOptions{Separator: "\n", TrimSpace: true, Dedupe: true}, "ELF\n64-bit\nLSB, x86-64\nexecutable"},
+		{[]string{`\b, first`, "first", " ", "first "}, MergeOptions{Separator: " / ", TrimSpace: true, Dedupe: true}, ", first / first"},
+	}
+	for _, c := range cases {
+		assert.EqualValues(t, c.expected, MergeStringsOpts(c.fragments, c.opts), "for %q with %+v", c.fragments, c.opts)
+	}
+}
@@ -0,0 +1,62 @@
+package utils
+
+import "regexp"
+
+// MaxRegexBytes is how much of the target a regex test looks at, at most
+const MaxRegexBytes = 8192
+
+// regexLineBytes is how many bytes a line is assumed to take, to bound the
+// window of regex tests limited in lines
+const regexLineBytes = 80
+
+// RegexTest looks for re in the target, starting at targetIndex, within
+// maxLen bytes, or maxLen lines if lines is set. A maxLen of 0 searches as
+// far as the target goes, up to MaxRegexBytes. It returns the start and end
+// of the match relative to targetIndex, or -1, -1.
+func RegexTest(sr *SliceReader, targetIndex int64, maxLen int64, lines bool, re *regexp.Regexp) (int64, int64) {
+	windowLen := maxLen
+	if lines {
+		windowLen = maxLen * regexLineBytes
+	}
+	if remaining := sr.Size() - targetIndex; windowLen <= 0 || windowLen > remaining {
+		windowLen = remaining
+	}
+	if windowLen > MaxRegexBytes {
+		windowLen = MaxRegexBytes
+	}
+	if targetIndex < 0 || windowLen <= 0 {
+		return -1, -1
+	}
+
+	window := make([]byte, windowLen)
+	n, _ := sr.ReadAt(window, targetIndex)
+	if n <= 0 {
+		return -1, -1
+	}
+	window = window[:n]
+
+	if lines && maxLen > 0 {
+		seen := int64(0)
+		for i, b := range window {
+			if b == '\n' {
+				seen++
+				if seen == maxLen {
+					window = window[:i+1]
+					break
+				}
+			}
+		}
+	}
+
+	loc := re.FindIndex(window)
+	if loc == nil {
+		return -1, -1
+	}
+	return int64(loc[0]), int64(loc[1])
+}
+
+// MustCompileRegex compiles the pattern of a regex rule, it panics if it
+// can't. Generated code calls it so that it doesn't import regexp itself.
+func MustCompileRegex(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(pattern)
+}
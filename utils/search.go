@@ -1,9 +1,159 @@
 package utils
 
-// SearchTest looks for a fixed pattern at any position within a certain length
-func SearchTest(sr *SliceReader, targetIndex int64, maxLen int64, pattern string) int64 {
-	sf := MakeStringFinder(pattern)
+// DefaultSearchRange is the range of search tests that don't have one, or
+// have a zero one, as in file
+const DefaultSearchRange = 8192
 
-	sr = sr.Slice(targetIndex).Cap(maxLen)
-	return sf.next(sr)
+// SearchTest looks for a fixed pattern at any position within a certain
+// range. Like in file, the range bounds where the match starts, the match
+// itself may run past it, and a zero range is DefaultSearchRange. It
+// returns where the match starts relative to targetIndex, and how long it
+// is, or -1, 0. LowerMatchesBoth and UpperMatchesBoth make it ignore case,
+// and CompactWhitespace and OptionalBlanks make blanks variable, like they
+// do for StringTest, so the match may be longer or shorter than pattern.
+// FullWord only finds full words, and ForceText and ForceBinary fail for
+// the other kind of target.
+func SearchTest(sr *SliceReader, targetIndex int64, maxLen int64, pattern string, flags StringTestFlags) (int64, int64) {
+	if TargetExcluded(flags) {
+		return -1, 0
+	}
+	return MakeFinder(pattern, flags).Find(sr, targetIndex, maxLen)
+}
+
+// Finder is SearchTest for one pattern and its flags, with what finding it
+// takes prepared once. It's safe for concurrent use.
+type Finder struct {
+	pattern string
+	// compareFlags say how bytes are compared, see stringMatch
+	compareFlags StringTestFlags
+	fullWord     bool
+
+	// anchor is what sf finds, the match starts right there if
+	// anchorStarts is set, at it or before it otherwise
+	anchor       string
+	anchorStarts bool
+	sf           *StringFinder
+}
+
+// MakeFinder prepares a finder for pattern. It ignores ForceText and
+// ForceBinary, callers check TargetExcluded themselves.
+func MakeFinder(pattern string, flags StringTestFlags) *Finder {
+	f := &Finder{
+		pattern:      pattern,
+		compareFlags: flags & (LowerMatchesBoth | UpperMatchesBoth | CompactWhitespace | OptionalBlanks),
+		fullWord:     flags&FullWord > 0,
+		anchor:       pattern,
+		anchorStarts: true,
+	}
+
+	// With optional blanks, matches are no longer than the pattern, so the
+	// longest part of it without blanks is found, and the match starts at
+	// that part or before it. Compacted blanks make matches as long as
+	// they want, only the part of the pattern starting them can be found.
+	switch {
+	case flags&CompactWhitespace > 0:
+		f.anchor = leadingNonBlank(pattern)
+	case flags&OptionalBlanks > 0:
+		f.anchor, f.anchorStarts = longestNonBlank(pattern), false
+	}
+	if flags&(LowerMatchesBoth|UpperMatchesBoth) > 0 {
+		f.sf = makeFoldingStringFinder(f.anchor)
+	} else {
+		f.sf = MakeStringFinder(f.anchor)
+	}
+	return f
+}
+
+// Find is SearchTest with the pattern and flags of the finder
+func (f *Finder) Find(sr *SliceReader, targetIndex int64, maxLen int64) (int64, int64) {
+	if maxLen == 0 {
+		maxLen = DefaultSearchRange
+	}
+	window := sr.Slice(targetIndex)
+	// matches start before rangeEnd
+	rangeEnd := min(maxLen, window.Size())
+	if rangeEnd <= 0 {
+		return -1, 0
+	}
+
+	if f.compareFlags == 0 && !f.fullWord {
+		pos := f.sf.next(window.Cap(rangeEnd - 1 + int64(len(f.pattern))))
+		if pos < 0 {
+			return -1, 0
+		}
+		return pos, int64(len(f.pattern))
+	}
+
+	if targetIndex < 0 {
+		// where Slice starts the window
+		targetIndex = 0
+	}
+	// matchLength returns the length of the match at start, or -1
+	matchLength := func(start int64) int64 {
+		end := start + int64(len(f.pattern))
+		if f.compareFlags > 0 {
+			end = stringMatch(window, start, f.pattern, f.compareFlags)
+			if end < 0 {
+				return -1
+			}
+		}
+		if f.fullWord && !IsFullWord(sr, targetIndex+start, targetIndex+end) {
+			return -1
+		}
+		return end - start
+	}
+
+	// anchors are found where matches starting in the range have them
+	anchorWindow := window.Cap(rangeEnd - 1 + int64(len(f.pattern)))
+	if f.compareFlags&CompactWhitespace > 0 {
+		anchorWindow = window.Cap(rangeEnd - 1 + int64(len(f.anchor)))
+	}
+
+	// next is the first start that wasn't checked
+	var next int64
+	for next < rangeEnd {
+		last := rangeEnd - 1
+		if f.anchor != "" {
+			found := f.sf.next(anchorWindow.Slice(next))
+			if found < 0 {
+				return -1, 0
+			}
+			last = next + found
+			if f.anchorStarts {
+				next = last
+			}
+		}
+		for ; next <= last && next < rangeEnd; next++ {
+			if length := matchLength(next); length >= 0 {
+				return next, length
+			}
+		}
+	}
+	return -1, 0
+}
+
+// leadingNonBlank returns the part of pattern before its first blank
+func leadingNonBlank(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		if IsWhitespace(pattern[i]) {
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
+
+// longestNonBlank returns the longest part of pattern without blanks, the
+// first one if there are several
+func longestNonBlank(pattern string) string {
+	longest := ""
+	start := 0
+	for i := 0; i <= len(pattern); i++ {
+		if i == len(pattern) || IsWhitespace(pattern[i]) {
+			if i-start > len(longest) {
+				longest = pattern[start:i]
+			}
+			start = i + 1
+		}
+	}
+	return longest
 }
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// searchPos returns where SearchTest finds pattern
+func searchPos(sr *SliceReader, targetIndex int64, maxLen int64, pattern string, flags StringTestFlags) int64 {
+	pos, _ := SearchTest(sr, targetIndex, maxLen, pattern, flags)
+	return pos
+}
+
+func Test_SearchTestBounds(t *testing.T) {
+	sr := NewSliceReaderFromBytes([]byte("xxabxx"))
+	// found at targetIndex, plus what's returned
+	assert.EqualValues(t, 2, searchPos(sr, 0, math.MaxInt64, "ab", 0))
+	assert.EqualValues(t, 0, searchPos(sr, 2, math.MaxInt64, "ab", 0))
+	assert.EqualValues(t, 2, searchPos(sr, -5, 6, "ab", 0))
+	assert.EqualValues(t, -1, searchPos(sr, math.MaxInt64, math.MaxInt64, "ab", 0))
+	assert.EqualValues(t, -1, searchPos(sr, 1, math.MinInt64, "ab", 0))
+}
+
+func Test_SearchTestEdges(t *testing.T) {
+	sr := NewSliceReaderFromBytes([]byte("abc"))
+
+	// empty patterns are found right away, like bytes.Index does
+	pos, length := SearchTest(sr, 0, 3, "", 0)
+	assert.EqualValues(t, 0, pos)
+	assert.EqualValues(t, 0, length)
+	assert.EqualValues(t, 0, searchPos(sr, 2, 3, "", 0))
+
+	// patterns as long as the window, or longer
+	assert.EqualValues(t, 0, searchPos(sr, 0, 1, "abc", 0))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 1, "abd", 0))
+	assert.EqualValues(t, 0, searchPos(sr, 1, 1, "bc", 0))
+	assert.EqualValues(t, 2, searchPos(sr, 0, 3, "c", 0))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 2, "c", 0))
+	counter := &countingReaderAt{reader: bytes.NewReader([]byte("abc"))}
+	counted := NewSliceReader(counter, 0, 3)
+	assert.EqualValues(t, -1, searchPos(counted, 0, 3, "abcd", 0))
+	assert.EqualValues(t, -1, searchPos(counted, 1, 3, "abc", 0))
+	assert.EqualValues(t, 0, counter.read)
+
+	// around the chunks single bytes are read in, and the buffers of
+	// longer patterns
+	data := bytes.Repeat([]byte("x"), 3*128*1024)
+	for _, at := range []int{0, 1, 128*1024 - 1, 128 * 1024, 128*1024 + 1, len(data) - 3, len(data) - 1} {
+		copy(data[at:], "yes")
+		sr := NewSliceReaderFromBytes(data)
+		for _, pattern := range []string{"y", "yes"} {
+			expected := int64(at)
+			if at+len(pattern) > len(data) {
+				expected = -1
+			}
+			assert.EqualValues(t, expected, searchPos(sr, 0, int64(len(data)), pattern, 0), "%q at %d", pattern, at)
+			if at > 0 {
+				assert.EqualValues(t, -1, searchPos(sr, 0, int64(at), pattern, 0), "%q at %d", pattern, at)
+			}
+			if at > 1 && expected >= 0 {
+				assert.EqualValues(t, 1, searchPos(sr.Slice(1), int64(at-2), 2, pattern, 0), "%q at %d", pattern, at)
+			}
+		}
+		copy(data[at:], "xxx")
+	}
+
+	// against bytes.Index
+	rng := rand.New(rand.NewSource(1))
+	target := make([]byte, 64)
+	for i := 0; i < 5000; i++ {
+		for j := range target {
+			target[j] = "ab"[rng.Intn(2)]
+		}
+		pattern := make([]byte, rng.Intn(5))
+		for j := range pattern {
+			pattern[j] = "ab"[rng.Intn(2)]
+		}
+		index := rng.Intn(len(target) + 1)
+		maxLen := 1 + rng.Intn(len(target)+1)
+
+		expected := -1
+		if rangeEnd := len(target) - index; rangeEnd > 0 {
+			if maxLen < rangeEnd {
+				rangeEnd = maxLen
+			}
+			end := index + rangeEnd - 1 + len(pattern)
+			if end > len(target) {
+				end = len(target)
+			}
+			expected = bytes.Index(target[index:end], pattern)
+		}
+		sr := NewSliceReaderFromBytes(target)
+		assert.EqualValues(t, expected, searchPos(sr, int64(index), int64(maxLen), string(pattern), 0), "%q in %q at %d, range %d", pattern, target, index, maxLen)
+	}
+}
+
+// BenchmarkStringFinder looks for patterns of different lengths at the
+// end of 1MB windows
+func BenchmarkStringFinder(b *testing.B) {
+	data := bytes.Repeat([]byte("abcdefgh <>\n"), 1024*1024/12)
+	sr := NewSliceReaderFromBytes(data)
+
+	for _, pattern := range []string{"!", "<!--", "<!DOCTYPE html PUBLIC \"-//W3C//DTD"} {
+		copy(data[len(data)-len(pattern):], pattern)
+		b.Run(fmt.Sprintf("%d bytes", len(pattern)), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if pos, _ := SearchTest(sr, 0, int64(len(data)), pattern, 0); pos < 0 {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSearchTest looks for a pattern that's near the end of 64KB of
+// text, exactly, which must stay as fast as it was before search tests had
+// flags, and ignoring case
+func BenchmarkSearchTest(b *testing.B) {
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = "abcdefgh <>\n"[i%12]
+	}
+	copy(data[len(data)-16:], "<HTML>")
+	sr := NewSliceReaderFromBytes(data)
+
+	for _, bc := range []struct {
+		name    string
+		pattern string
+		flags   StringTestFlags
+	}{
+		{"exact", "<HTML>", 0},
+		{"ignoring case", "<html>", LowerMatchesBoth},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if pos, _ := SearchTest(sr, 0, int64(len(data)), bc.pattern, bc.flags); pos < 0 {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,20 @@
 package utils
 
-import "io"
+import (
+	"errors"
+	"io"
+)
 
 type SliceReader struct {
 	reader io.ReaderAt
 	offset int64
 	size   int64
+
+	// data is what's read when reader is nil, see NewSliceReaderFromBytes
+	data []byte
+
+	// textHint is what TextHint returns, once it's been worked out
+	textHint int32
 }
 
 var _ io.ReaderAt = (*SliceReader)(nil)
@@ -18,19 +27,36 @@ func NewSliceReader(reader io.ReaderAt, offset int64, size int64) *SliceReader {
 	}
 }
 
+// NewSliceReaderFromBytes returns a SliceReader of b, which reads from b
+// directly, without copying it
+func NewSliceReaderFromBytes(b []byte) *SliceReader {
+	return &SliceReader{
+		offset: 0,
+		size:   int64(len(b)),
+		data:   b,
+	}
+}
+
+// Slice returns a reader of what's after offset. Negative offsets count
+// as zero, and slices past the end are empty.
 func (sr *SliceReader) Slice(offset int64) *SliceReader {
+	offset = max(0, min(offset, sr.size))
 	return &SliceReader{
 		reader: sr.reader,
+		data:   sr.data,
 		offset: sr.offset + offset,
 		size:   sr.size - offset,
 	}
 }
 
+// Cap returns a reader of the first size bytes, or of all of them if
+// there are fewer. Negative sizes count as zero.
 func (sr *SliceReader) Cap(size int64) *SliceReader {
 	return &SliceReader{
 		reader: sr.reader,
+		data:   sr.data,
 		offset: sr.offset,
-		size:   min(sr.size, size),
+		size:   max(0, min(sr.size, size)),
 	}
 }
 
@@ -66,6 +92,52 @@ func (sr *SliceReader) Size() int64 {
 	return sr.size
 }
 
+// ReadAt reads at index like a bytes.Reader of the Size() bytes of sr
+// would, whatever the underlying reader does at its end: it fails for
+// negative indices, returns io.EOF along with what it read if it couldn't
+// fill buf, and nil if it could.
 func (sr *SliceReader) ReadAt(buf []byte, index int64) (int, error) {
-	return sr.reader.ReadAt(buf, index+sr.offset)
+	if index < 0 {
+		return 0, errSliceNegative
+	}
+	if index >= sr.size {
+		return 0, io.EOF
+	}
+	want := len(buf)
+	if remaining := sr.size - index; remaining < int64(len(buf)) {
+		buf = buf[:remaining]
+	}
+
+	var n int
+	var err error
+	if sr.reader == nil {
+		n, err = readBytesAt(sr.data, buf, index+sr.offset)
+	} else {
+		n, err = sr.reader.ReadAt(buf, index+sr.offset)
+	}
+	if n < want && err == nil {
+		err = io.EOF
+	} else if n == want && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// errSliceNegative is returned when reading a SliceReader at a negative
+// index
+var errSliceNegative = errors.New("utils.SliceReader.ReadAt: negative offset")
+
+// readBytesAt reads data at off into buf, like a bytes.Reader of data
+func readBytesAt(data []byte, buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("bytes.Reader.ReadAt: negative offset")
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, data[off:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
 }
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newBytesReader reads target through a bytes.Reader, the way SliceReaders
+// read anything else
+func newBytesReader(target []byte) *SliceReader {
+	return NewSliceReader(bytes.NewReader(target), 0, int64(len(target)))
+}
+
+func Test_SliceReaderFromBytes(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	data := make([]byte, 1000)
+	rng.Read(data)
+
+	for i := 0; i < 500; i++ {
+		expected := newBytesReader(data)
+		actual := NewSliceReaderFromBytes(data)
+		if i%2 == 0 {
+			off := int64(rng.Intn(1100))
+			expected, actual = expected.Slice(off), actual.Slice(off)
+		}
+		if i%3 == 0 {
+			size := int64(rng.Intn(1100))
+			expected, actual = expected.Cap(size), actual.Cap(size)
+		}
+		assert.EqualValues(t, expected.Size(), actual.Size())
+
+		length := rng.Intn(200)
+		off := int64(rng.Intn(1200)) - 100
+		ebuf := make([]byte, length)
+		en, eerr := expected.ReadAt(ebuf, off)
+		abuf := make([]byte, length)
+		n, err := actual.ReadAt(abuf, off)
+		assert.EqualValues(t, en, n, "reading %d at %d", length, off)
+		assert.Equal(t, eerr, err, "reading %d at %d", length, off)
+		assert.EqualValues(t, ebuf[:en], abuf[:n])
+	}
+
+	// no copy is made
+	sr := NewSliceReaderFromBytes(data)
+	data[0] = 'x'
+	buf := make([]byte, 1)
+	_, err := sr.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "x", string(buf))
+}
+
+// sliceArgument returns an argument for Slice or Cap, in range or not
+func sliceArgument(rng *rand.Rand, size int) int64 {
+	switch rng.Intn(6) {
+	case 0:
+		return -int64(rng.Intn(100)) - 1
+	case 1:
+		return math.MaxInt64 - int64(rng.Intn(100))
+	case 2:
+		return math.MinInt64 + int64(rng.Intn(100))
+	case 3:
+		return int64(size + rng.Intn(100))
+	default:
+		return int64(rng.Intn(size + 1))
+	}
+}
+
+func Test_SliceReaderSliceCap(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	data := make([]byte, 300)
+	rng.Read(data)
+
+	for i := 0; i < 5000; i++ {
+		readers := []*SliceReader{
+			newBytesReader(data),
+			NewSliceReaderFromBytes(data),
+			NewCachingSliceReader(bytes.NewReader(data), int64(len(data)), 16),
+		}
+		// the reference is what's left of data
+		start, end := 0, len(data)
+
+		var ops []string
+		for j := rng.Intn(5); j > 0; j-- {
+			arg := sliceArgument(rng, end-start)
+			if rng.Intn(2) == 0 {
+				ops = append(ops, fmt.Sprintf("Slice(%d)", arg))
+				for k := range readers {
+					readers[k] = readers[k].Slice(arg)
+				}
+				if arg < 0 {
+					arg = 0
+				}
+				if arg > int64(end-start) {
+					arg = int64(end - start)
+				}
+				start += int(arg)
+			} else {
+				ops = append(ops, fmt.Sprintf("Cap(%d)", arg))
+				for k := range readers {
+					readers[k] = readers[k].Cap(arg)
+				}
+				if arg < 0 {
+					arg = 0
+				}
+				if arg < int64(end-start) {
+					end = start + int(arg)
+				}
+			}
+		}
+		reference := bytes.NewReader(data[start:end])
+
+		length := rng.Intn(100)
+		off := sliceArgument(rng, end-start)
+		if rng.Intn(2) == 0 {
+			off = int64(rng.Intn(end - start + 1))
+		}
+		expected := make([]byte, length)
+		en, eerr := reference.ReadAt(expected, off)
+
+		for k, sr := range readers {
+			msg := fmt.Sprintf("reader %d, %v, reading %d at %d", k, ops, length, off)
+			assert.EqualValues(t, end-start, sr.Size(), msg)
+
+			actual := make([]byte, length)
+			n, err := sr.ReadAt(actual, off)
+			assert.EqualValues(t, en, n, msg)
+			assert.Equal(t, eerr == nil, err == nil, msg)
+			if eerr != nil && off >= 0 {
+				assert.Equal(t, eerr, err, msg)
+			}
+			assert.EqualValues(t, expected[:en], actual[:n], msg)
+		}
+	}
+}
+
+// quirkyReaderAt says nothing about short reads, and reports io.EOF along
+// with full reads of the last bytes, which io.ReaderAt allows
+type quirkyReaderAt struct {
+	data []byte
+}
+
+func (q *quirkyReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off >= int64(len(q.data)) {
+		return 0, nil
+	}
+	n := copy(buf, q.data[off:])
+	if off+int64(n) == int64(len(q.data)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func Test_SliceReaderTail(t *testing.T) {
+	data := []byte("0123456789abcdef0123")
+	size := int64(len(data))
+	path := filepath.Join(t.TempDir(), "target")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	readers := map[string]*SliceReader{
+		"bytes.Reader": newBytesReader(data),
+		"os.File":      NewSliceReader(f, 0, size),
+		"quirky":       NewSliceReader(&quirkyReaderAt{data: data}, 0, size),
+		"from bytes":   NewSliceReaderFromBytes(data),
+		"caching":      NewCachingSliceReader(f, size, 8),
+		// windows on something larger end where they say
+		"window": NewSliceReader(bytes.NewReader(append([]byte("xx"), append(data, "yy"...)...)), 2, size),
+	}
+
+	for name, sr := range readers {
+		for _, width := range []int{1, 2, 4, 8, 16} {
+			for _, off := range []int64{size - int64(width), size - 1, size, size + 10} {
+				buf := make([]byte, width)
+				n, err := sr.ReadAt(buf, off)
+				msg := fmt.Sprintf("%s, %d bytes at %d", name, width, off)
+				switch {
+				case off+int64(width) <= size:
+					assert.EqualValues(t, width, n, msg)
+					assert.NoError(t, err, msg)
+				case off < size:
+					assert.EqualValues(t, size-off, n, msg)
+					assert.Equal(t, io.EOF, err, msg)
+				default:
+					assert.EqualValues(t, 0, n, msg)
+					assert.Equal(t, io.EOF, err, msg)
+				}
+				if n > 0 {
+					assert.EqualValues(t, data[off:off+int64(n)], buf[:n], msg)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package utils
+
+import "sort"
+
+// Span is Len bytes of a target starting at Off, what a test matched for
+// example. Spans of no bytes are fine, they're where a match would start.
+type Span struct {
+	Off int64
+	Len int64
+}
+
+// End returns the offset right after the span
+func (s Span) End() int64 {
+	return s.Off + s.Len
+}
+
+// Empty tells whether the span has no bytes
+func (s Span) Empty() bool {
+	return s.Len <= 0
+}
+
+// Contains tells whether the byte at off is in the span, which it never is
+// for empty spans
+func (s Span) Contains(off int64) bool {
+	return s.Off <= off && off < s.End()
+}
+
+// Covers tells whether all of o is in the span. Empty spans are covered by
+// those they're in or at the end of.
+func (s Span) Covers(o Span) bool {
+	return s.Off <= o.Off && o.End() <= s.End()
+}
+
+// Intersect returns the bytes both spans have, and whether they have any.
+// Spans that only touch have none.
+func (s Span) Intersect(o Span) (Span, bool) {
+	start := max(s.Off, o.Off)
+	end := min(s.End(), o.End())
+	if start >= end {
+		return Span{}, false
+	}
+	return Span{Off: start, Len: end - start}, true
+}
+
+// Union returns the smallest span covering both, along with the bytes
+// between them if they don't touch. An empty span counts as a point.
+func (s Span) Union(o Span) Span {
+	start := min(s.Off, o.Off)
+	end := max(s.End(), o.End())
+	return Span{Off: start, Len: end - start}
+}
+
+// Clip returns the part of the span in a target of size bytes, empty and
+// at the end of the target if it's all past it, at its start if it's all
+// before it
+func (s Span) Clip(size int64) Span {
+	start := max(0, min(s.Off, size))
+	end := max(start, min(s.End(), size))
+	return Span{Off: start, Len: end - start}
+}
+
+// SortSpans sorts spans by where they start, then by length
+func SortSpans(spans []Span) {
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].Off != spans[j].Off {
+			return spans[i].Off < spans[j].Off
+		}
+		return spans[i].Len < spans[j].Len
+	})
+}
+
+// MergeSpans sorts spans, and merges those that overlap or touch. Empty
+// spans are dropped.
+func MergeSpans(spans []Span) []Span {
+	var merged []Span
+	sorted := append([]Span(nil), spans...)
+	SortSpans(sorted)
+	for _, s := range sorted {
+		if s.Empty() {
+			continue
+		}
+		if n := len(merged); n > 0 && s.Off <= merged[n-1].End() {
+			merged[n-1] = merged[n-1].Union(s)
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// StringTestSpan is StringTest, returning the bytes matched. An empty
+// pattern matches no bytes, anywhere in the target.
+func StringTestSpan(sr *SliceReader, targetIndex int64, pattern string, flags StringTestFlags) (Span, bool) {
+	if pattern == "" {
+		if TargetExcluded(flags) || targetIndex < 0 || targetIndex > sr.Size() {
+			return Span{}, false
+		}
+		return Span{Off: targetIndex}, true
+	}
+	end := StringTest(sr, targetIndex, pattern, flags)
+	if end < 0 {
+		return Span{}, false
+	}
+	return Span{Off: targetIndex, Len: end - targetIndex}, true
+}
+
+// SearchTestSpan is SearchTest, returning the bytes matched, which start
+// wherever the match was found rather than at targetIndex
+func SearchTestSpan(sr *SliceReader, targetIndex int64, maxLen int64, pattern string, flags StringTestFlags) (Span, bool) {
+	pos, length := SearchTest(sr, targetIndex, maxLen, pattern, flags)
+	if pos < 0 {
+		return Span{}, false
+	}
+	// where SearchTest starts looking
+	return Span{Off: max(0, targetIndex) + pos, Len: length}, true
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Span(t *testing.T) {
+	s := Span{Off: 4, Len: 4}
+	assert.EqualValues(t, 8, s.End())
+	assert.False(t, s.Empty())
+	assert.False(t, s.Contains(3))
+	assert.True(t, s.Contains(4))
+	assert.True(t, s.Contains(7))
+	assert.False(t, s.Contains(8))
+
+	assert.True(t, s.Covers(Span{Off: 5, Len: 2}))
+	assert.True(t, s.Covers(s))
+	assert.False(t, s.Covers(Span{Off: 6, Len: 4}))
+
+	// zero-length spans contain nothing, but are covered where they are
+	empty := Span{Off: 8}
+	assert.True(t, empty.Empty())
+	assert.False(t, empty.Contains(8))
+	assert.True(t, s.Covers(empty))
+	assert.False(t, s.Covers(Span{Off: 9}))
+	assert.True(t, Span{Off: 6, Len: -1}.Empty())
+
+	cases := []struct {
+		a, b         Span
+		intersection Span
+		intersects   bool
+		union        Span
+	}{
+		// overlapping
+		{s, Span{Off: 6, Len: 4}, Span{Off: 6, Len: 2}, true, Span{Off: 4, Len: 6}},
+		// one in the other
+		{s, Span{Off: 5, Len: 1}, Span{Off: 5, Len: 1}, true, s},
+		// touching
+		{s, Span{Off: 8, Len: 2}, Span{}, false, Span{Off: 4, Len: 6}},
+		// apart, the union covers the gap
+		{s, Span{Off: 10, Len: 2}, Span{}, false, Span{Off: 4, Len: 8}},
+		// zero-length, inside and outside
+		{s, Span{Off: 5}, Span{}, false, s},
+		{s, Span{Off: 1}, Span{}, false, Span{Off: 1, Len: 7}},
+	}
+	for _, c := range cases {
+		for _, pair := range [][2]Span{{c.a, c.b}, {c.b, c.a}} {
+			intersection, ok := pair[0].Intersect(pair[1])
+			assert.EqualValues(t, c.intersects, ok, "%v and %v", pair[0], pair[1])
+			assert.EqualValues(t, c.intersection, intersection, "%v and %v", pair[0], pair[1])
+			assert.EqualValues(t, c.union, pair[0].Union(pair[1]), "%v and %v", pair[0], pair[1])
+		}
+	}
+}
+
+func Test_SpanClip(t *testing.T) {
+	const size = 10
+	for _, c := range []struct {
+		span, clipped Span
+	}{
+		{Span{Off: 2, Len: 3}, Span{Off: 2, Len: 3}},
+		{Span{Off: 8, Len: 4}, Span{Off: 8, Len: 2}},
+		{Span{Off: 10, Len: 4}, Span{Off: 10}},
+		{Span{Off: 12, Len: 4}, Span{Off: 10}},
+		{Span{Off: -2, Len: 4}, Span{Off: 0, Len: 2}},
+		{Span{Off: -6, Len: 4}, Span{Off: 0}},
+		{Span{Off: 10}, Span{Off: 10}},
+	} {
+		assert.EqualValues(t, c.clipped, c.span.Clip(size), "%v", c.span)
+	}
+}
+
+func Test_SortSpans(t *testing.T) {
+	spans := []Span{{Off: 6, Len: 2}, {Off: 0, Len: 4}, {Off: 6}, {Off: 0, Len: 1}, {Off: 3, Len: 2}}
+	SortSpans(spans)
+	assert.EqualValues(t, []Span{{Off: 0, Len: 1}, {Off: 0, Len: 4}, {Off: 3, Len: 2}, {Off: 6}, {Off: 6, Len: 2}}, spans)
+
+	// overlapping and touching ones merge, empty ones go
+	merged := MergeSpans([]Span{{Off: 12}, {Off: 6, Len: 2}, {Off: 0, Len: 4}, {Off: 8, Len: 1}, {Off: 3, Len: 2}, {Off: 20, Len: 1}})
+	assert.EqualValues(t, []Span{{Off: 0, Len: 5}, {Off: 6, Len: 3}, {Off: 20, Len: 1}}, merged)
+	assert.Empty(t, MergeSpans(nil))
+}
+
+func Test_TestSpans(t *testing.T) {
+	sr := NewSliceReaderFromBytes([]byte("0123 hello  world"))
+
+	span, ok := StringTestSpan(sr, 5, "hello", 0)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 5, Len: 5}, span)
+	_, ok = StringTestSpan(sr, 4, "hello", 0)
+	assert.False(t, ok)
+
+	// compacted blanks make the span longer than the pattern
+	span, ok = StringTestSpan(sr, 5, "hello world", CompactWhitespace)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 5, Len: 12}, span)
+
+	// searches start where they found the match
+	span, ok = SearchTestSpan(sr, 2, 20, "hello", 0)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 5, Len: 5}, span)
+	span, ok = SearchTestSpan(sr, -3, 20, "0123", 0)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 0, Len: 4}, span)
+	_, ok = SearchTestSpan(sr, 6, 20, "hello", 0)
+	assert.False(t, ok)
+
+	// matches end at the end of the target at the latest
+	span, ok = SearchTestSpan(sr, 0, 0, "world", 0)
+	assert.True(t, ok)
+	assert.EqualValues(t, sr.Size(), span.End())
+	assert.EqualValues(t, span, span.Clip(sr.Size()))
+	span, ok = StringTestSpan(sr, 12, "world ", OptionalBlanks)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 12, Len: 5}, span)
+	_, ok = StringTestSpan(sr, 12, "worlds", 0)
+	assert.False(t, ok)
+
+	// empty patterns match zero-length spans
+	span, ok = StringTestSpan(sr, sr.Size(), "", 0)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: sr.Size()}, span)
+	_, ok = StringTestSpan(sr, sr.Size()+1, "", 0)
+	assert.False(t, ok)
+	span, ok = SearchTestSpan(sr, 3, 10, "", 0)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 3}, span)
+
+	// the flags still apply
+	_, ok = StringTestSpan(sr, 5, "hello", ForceBinary|TextTarget)
+	assert.False(t, ok)
+	span, ok = SearchTestSpan(sr, 0, 20, "HELLO", UpperMatchesBoth)
+	assert.True(t, ok)
+	assert.EqualValues(t, Span{Off: 5, Len: 5}, span)
+}
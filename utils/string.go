@@ -5,9 +5,12 @@ type StringTestFlags int64
 
 const (
 	// CompactWhitespace ("W" flag) compacts whitespace in the target,
-	// which must contain at least one whitespace character
+	// which must contain at least one whitespace character: n blanks in a
+	// row in the magic match at least n in the target
 	CompactWhitespace = 1 << iota
-	// OptionalBlanks ("w" flag) treats every blank in the magic as an optional blank
+	// OptionalBlanks ("w" flag) treats every blank in the magic as an optional blank:
+	// it matches the same blank in the target, or nothing. Blanks in the
+	// target are only skipped with CompactWhitespace.
 	OptionalBlanks
 	// LowerMatchesBoth ("c" flag) specifies case-insensitive matching: lower case
 	// characters in the magic match both lower and upper case characters
@@ -21,29 +24,107 @@ const (
 	ForceText
 	// ForceBinary ("b" flag) forces the test to be done for binary files
 	ForceBinary
+	// FullWord ("f" flag) requires the match to be a full word: the bytes
+	// right before and after it, if any, mustn't be letters or digits
+	FullWord
+	// TextTarget and BinaryTarget aren't flags of rules, callers add one of
+	// them to say what the target looks like, see SliceReader.TextHint.
+	// ForceText and ForceBinary tests fail for the other kind of target,
+	// and are done for both with neither.
+	TextTarget
+	BinaryTarget
 )
 
-// StringTest looks for a string pattern in target, at given index
+// TargetExcluded tells whether flags say the test is for another kind of
+// target than the one they hint at
+func TargetExcluded(flags StringTestFlags) bool {
+	return (flags&ForceText > 0 && flags&BinaryTarget > 0) || (flags&ForceBinary > 0 && flags&TextTarget > 0)
+}
+
+// IsFullWord tells whether the bytes from start to end are a full word, so
+// the bytes around them, if any, aren't letters or digits
+func IsFullWord(sr *SliceReader, start int64, end int64) bool {
+	var b [1]byte
+	if start > 0 {
+		if n, _ := sr.ReadAt(b[:], start-1); n == 1 && IsAlphanumeric(b[0]) {
+			return false
+		}
+	}
+	if n, _ := sr.ReadAt(b[:], end); n == 1 && IsAlphanumeric(b[0]) {
+		return false
+	}
+	return true
+}
+
+// StringTest looks for a string pattern in target, at given index. It
+// returns the index in the target right after the match, not the length of
+// the match, or -1 if there's none. The interpreter and generated code both
+// use it, and the self-contained runtime of the compiler is a copy of it.
 func StringTest(sr *SliceReader, targetIndex int64, patternString string, flags StringTestFlags) int64 {
+	if TargetExcluded(flags) {
+		return -1
+	}
+	end := stringMatch(sr, targetIndex, patternString, flags)
+	if end >= 0 && flags&FullWord > 0 && !IsFullWord(sr, targetIndex, end) {
+		return -1
+	}
+	return end
+}
+
+// stringMatch is StringTest, without the flags that don't say how bytes
+// are compared
+func stringMatch(sr *SliceReader, targetIndex int64, patternString string, flags StringTestFlags) int64 {
 	bv := &ByteView{
 		Input:    sr,
 		LookBack: 0,
+		// most string tests only look at a handful of bytes
+		BufSize: int64(len(patternString)),
 	}
+	defer bv.Release()
 
-	pattern := []byte(patternString)
-	patternSize := len(pattern)
+	patternSize := len(patternString)
 	patternIndex := 0
 
 	for {
-		patternByte := pattern[patternIndex]
+		patternByte := patternString[patternIndex]
 		targetInt := bv.Get(targetIndex)
 		if targetInt == -1 {
+			if flags&OptionalBlanks > 0 && IsWhitespace(patternByte) {
+				// blanks are optional past the end of the target too
+				patternIndex++
+				if patternIndex >= patternSize {
+					return targetIndex
+				}
+				continue
+			}
 			return -1
 		}
 		targetByte := byte(targetInt)
 
 		matches := patternByte == targetByte
-		if matches {
+		if flags&CompactWhitespace > 0 && IsWhitespace(patternByte) {
+			if IsWhitespace(targetByte) {
+				targetIndex++
+				patternIndex++
+				// the last blank of a run in the magic matches the rest
+				// of the run in the target
+				if patternIndex >= patternSize || !IsWhitespace(patternString[patternIndex]) {
+					for {
+						targetInt = bv.Get(targetIndex)
+						if targetInt == -1 || !IsWhitespace(byte(targetInt)) {
+							break
+						}
+						targetIndex++
+					}
+				}
+			} else if flags&OptionalBlanks > 0 {
+				// no blank at all is fine too
+				patternIndex++
+			} else {
+				// the target must have at least one blank there
+				return -1
+			}
+		} else if matches {
 			// perfect match, advance both
 			targetIndex++
 			patternIndex++
@@ -63,24 +144,14 @@ func StringTest(sr *SliceReader, targetIndex int64, patternString string, flags
 			return -1
 		}
 
-		if flags&CompactWhitespace > 0 && IsWhitespace(targetByte) {
-			// if we had whitespace, skip any whitespace coming after it
-			for {
-				targetIndex++
-				targetInt = bv.Get(targetIndex)
-				if targetInt == -1 {
-					return -1
-				}
-				targetByte = byte(targetInt)
-				if !IsWhitespace(targetByte) {
-					break
-				}
-			}
-		}
-
 		if patternIndex >= patternSize {
 			// hey it matched all the way!
 			return targetIndex
 		}
 	}
 }
+
+// StringTestBytes is StringTest on a byte slice
+func StringTestBytes(target []byte, targetIndex int64, patternString string, flags StringTestFlags) int64 {
+	return StringTest(NewSliceReaderFromBytes(target), targetIndex, patternString, flags)
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// MaxString16Units caps how many UTF-16 code units String16End looks at
+const MaxString16Units = 4096
+
+// readUnit16 reads the UTF-16 code unit at index, or returns -1
+func readUnit16(sr *SliceReader, index int64, bigEndian bool, buf []byte) int {
+	if index < 0 {
+		return -1
+	}
+	n, _ := sr.ReadAt(buf[:2], index)
+	if n < 2 {
+		return -1
+	}
+	if bigEndian {
+		return int(buf[0])<<8 | int(buf[1])
+	}
+	return int(buf[1])<<8 | int(buf[0])
+}
+
+// String16Test looks for a pattern stored as UTF-16 at targetIndex: every
+// byte of the pattern must be a code unit of the target. LowerMatchesBoth
+// and UpperMatchesBoth make letters match either case like they do for
+// StringTest, other flags are ignored. It returns the index right after
+// the match, or -1.
+func String16Test(sr *SliceReader, targetIndex int64, pattern string, bigEndian bool, flags StringTestFlags) int64 {
+	var buf [2]byte
+	for i := 0; i < len(pattern); i++ {
+		unit := readUnit16(sr, targetIndex, bigEndian, buf[:])
+		if unit != int(pattern[i]) && !foldedUnit16(unit, pattern[i], flags) {
+			return -1
+		}
+		targetIndex += 2
+	}
+	return targetIndex
+}
+
+// foldedUnit16 tells whether unit is b in the other case, and flags say
+// that b matches both
+func foldedUnit16(unit int, b byte, flags StringTestFlags) bool {
+	switch {
+	case flags&LowerMatchesBoth > 0 && IsLowerLetter(b):
+		return unit == int(ToUpper(b))
+	case flags&UpperMatchesBoth > 0 && IsUpperLetter(b):
+		return unit == int(ToLower(b))
+	}
+	return false
+}
+
+// String16End returns the index of the NUL code unit ending the UTF-16
+// string at targetIndex, or of the end of the target, looking at up to
+// MaxString16Units units. It returns -1 if there's no code unit to read at
+// targetIndex at all.
+func String16End(sr *SliceReader, targetIndex int64, bigEndian bool) int64 {
+	var buf [2]byte
+	if readUnit16(sr, targetIndex, bigEndian, buf[:]) < 0 {
+		return -1
+	}
+
+	end := targetIndex
+	for i := 0; i < MaxString16Units; i++ {
+		unit := readUnit16(sr, end, bigEndian, buf[:])
+		if unit <= 0 {
+			break
+		}
+		end += 2
+	}
+	return end
+}
+
+// DecodeUTF16 decodes up to maxUnits UTF-16 code units at off as UTF-8,
+// stopping at a NUL code unit, or at the end of the target, where a lone
+// byte isn't a unit. Surrogate pairs decode to the character they stand
+// for, a pair cut by maxUnits is left out, and unpaired surrogates decode
+// to U+FFFD.
+func DecodeUTF16(sr *SliceReader, off int64, maxUnits int64, bigEndian bool) string {
+	var buf [2]byte
+	var units []uint16
+	for int64(len(units)) < maxUnits {
+		unit := readUnit16(sr, off+2*int64(len(units)), bigEndian, buf[:])
+		if unit <= 0 {
+			break
+		}
+		units = append(units, uint16(unit))
+	}
+	if n := len(units); n > 0 && int64(n) == maxUnits && 0xd800 <= units[n-1] && units[n-1] < 0xdc00 {
+		// the low surrogate would be next
+		units = units[:n-1]
+	}
+	return string(utf16.Decode(units))
+}
+
+// DecodeString16 decodes the UTF-16 code units from start to end with
+// DecodeUTF16, and returns up to MaxFormattedString bytes of them, without
+// cutting characters
+func DecodeString16(sr *SliceReader, start int64, end int64, bigEndian bool) string {
+	units := (end - start) / 2
+	if units > MaxFormattedString {
+		units = MaxFormattedString
+	}
+	s := DecodeUTF16(sr, start, units, bigEndian)
+	if len(s) > MaxFormattedString {
+		cut := MaxFormattedString
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut]
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encode16 encodes s as UTF-16
+func encode16(s string, bigEndian bool) []byte {
+	var b []byte
+	for _, unit := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			b = append(b, byte(unit>>8), byte(unit))
+		} else {
+			b = append(b, byte(unit), byte(unit>>8))
+		}
+	}
+	return b
+}
+
+func Test_String16Test(t *testing.T) {
+	for _, bigEndian := range []bool{false, true} {
+		target := encode16("Hello, World\x00rest", bigEndian)
+		sr := NewSliceReaderFromBytes(target)
+
+		assert.EqualValues(t, 10, String16Test(sr, 0, "Hello", bigEndian, 0))
+		assert.EqualValues(t, 24, String16Test(sr, 14, "World", bigEndian, 0))
+		assert.EqualValues(t, 26, String16Test(sr, 14, "World\x00", bigEndian, 0))
+		assert.EqualValues(t, -1, String16Test(sr, 0, "Hello", !bigEndian, 0))
+		// units, not bytes
+		assert.EqualValues(t, -1, String16Test(sr, 1, "ello", bigEndian, 0))
+		assert.EqualValues(t, -1, String16Test(sr, -2, "Hello", bigEndian, 0))
+
+		// case folding, like string tests
+		assert.EqualValues(t, -1, String16Test(sr, 0, "hello", bigEndian, 0))
+		assert.EqualValues(t, 10, String16Test(sr, 0, "hello", bigEndian, LowerMatchesBoth))
+		assert.EqualValues(t, -1, String16Test(sr, 0, "hello", bigEndian, UpperMatchesBoth))
+		assert.EqualValues(t, 10, String16Test(sr, 0, "HELLO", bigEndian, UpperMatchesBoth))
+		assert.EqualValues(t, -1, String16Test(sr, 0, "HELLO", bigEndian, LowerMatchesBoth))
+		assert.EqualValues(t, 24, String16Test(sr, 14, "wORLD", bigEndian, LowerMatchesBoth|UpperMatchesBoth))
+		// only ASCII letters fold, the high byte of units counts
+		folded := NewSliceReaderFromBytes(encode16("\u0149", bigEndian))
+		assert.EqualValues(t, -1, String16Test(folded, 0, "i", bigEndian, LowerMatchesBoth))
+
+		// odd-length windows: the last unit is half there
+		odd := NewSliceReaderFromBytes(target).Cap(9)
+		assert.EqualValues(t, 8, String16Test(odd, 0, "Hell", bigEndian, 0))
+		assert.EqualValues(t, -1, String16Test(odd, 0, "Hello", bigEndian, 0))
+		assert.EqualValues(t, 9, String16Test(odd, 9, "", bigEndian, 0))
+	}
+}
+
+func Test_DecodeUTF16(t *testing.T) {
+	for _, bigEndian := range []bool{false, true} {
+		// U+1F600 is a surrogate pair
+		sr := NewSliceReaderFromBytes(encode16("h\u00e9\U0001F600!\x00after", bigEndian))
+
+		assert.EqualValues(t, "h\u00e9\U0001F600!", DecodeUTF16(sr, 0, 100, bigEndian))
+		assert.EqualValues(t, "h\u00e9", DecodeUTF16(sr, 0, 2, bigEndian))
+		assert.EqualValues(t, "", DecodeUTF16(sr, 0, 0, bigEndian))
+		// cut pairs are left out, whole ones kept
+		assert.EqualValues(t, "h\u00e9", DecodeUTF16(sr, 0, 3, bigEndian))
+		assert.EqualValues(t, "h\u00e9\U0001F600", DecodeUTF16(sr, 0, 4, bigEndian))
+		// a lone low surrogate
+		assert.EqualValues(t, "\ufffd!", DecodeUTF16(sr, 6, 100, bigEndian))
+		// after the NUL
+		assert.EqualValues(t, "after", DecodeUTF16(sr, 12, 100, bigEndian))
+		assert.EqualValues(t, "", DecodeUTF16(sr, 10, 100, bigEndian))
+		assert.EqualValues(t, "", DecodeUTF16(sr, -2, 100, bigEndian))
+
+		// a high surrogate at the end of the target is unpaired, a lone
+		// byte there isn't a unit
+		unpaired := NewSliceReaderFromBytes(encode16("a\U0001F600", bigEndian)[:4])
+		assert.EqualValues(t, "a\ufffd", DecodeUTF16(unpaired, 0, 100, bigEndian))
+		odd := NewSliceReaderFromBytes(encode16("abc", bigEndian)[:5])
+		assert.EqualValues(t, "ab", DecodeUTF16(odd, 0, 100, bigEndian))
+
+		// formatted strings are cut between characters
+		long := strings.Repeat("\u00e9", MaxFormattedString)
+		lr := NewSliceReaderFromBytes(encode16(long, bigEndian))
+		decoded := DecodeString16(lr, 0, lr.Size(), bigEndian)
+		assert.EqualValues(t, long[:MaxFormattedString], decoded)
+		assert.EqualValues(t, "h\u00e9\U0001F600", DecodeString16(sr, 0, 8, bigEndian))
+		assert.EqualValues(t, "h\u00e9", DecodeString16(sr, 0, 7, bigEndian))
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StringTestTargets(t *testing.T) {
+	text := []byte("hello world, hello\n")
+	binary := []byte("hello\x00world")
+	tf := StringTestFlags(ForceText)
+	bf := StringTestFlags(ForceBinary)
+	f := StringTestFlags(FullWord)
+
+	assert.EqualValues(t, TextTarget, NewSliceReaderFromBytes(text).TextHint())
+	assert.EqualValues(t, BinaryTarget, NewSliceReaderFromBytes(binary).TextHint())
+	assert.EqualValues(t, TextTarget, NewSliceReaderFromBytes([]byte("caf\xc3\xa9\n")).TextHint())
+	assert.EqualValues(t, BinaryTarget, NewSliceReaderFromBytes(nil).TextHint())
+
+	for _, c := range []struct {
+		target   []byte
+		index    int64
+		pattern  string
+		flags    StringTestFlags
+		expected int64
+	}{
+		// without a hint, t and b don't matter
+		{text, 0, "hello", tf, 5},
+		{text, 0, "hello", bf, 5},
+		{text, 0, "hello", tf | TextTarget, 5},
+		{text, 0, "hello", bf | TextTarget, -1},
+		{binary, 0, "hello", bf | BinaryTarget, 5},
+		{binary, 0, "hello", tf | BinaryTarget, -1},
+		// full words end where letters and digits do
+		{text, 0, "hello", f, 5},
+		{text, 0, "hell", f, -1},
+		{text, 6, "world", f, 11},
+		{text, 7, "orld", f, -1},
+		{text, 13, "hello", f, 18},
+		{binary, 6, "world", f, 11},
+		{[]byte("a1"), 0, "a", f, -1},
+		{[]byte("a_"), 0, "a", f, 1},
+	} {
+		actual := StringTestBytes(c.target, c.index, c.pattern, c.flags)
+		assert.EqualValues(t, c.expected, actual, fmt.Sprintf("%q at %d in %q, flags %d", c.pattern, c.index, c.target, c.flags))
+	}
+
+	sr := NewSliceReaderFromBytes([]byte("helloworld hello"))
+	assert.EqualValues(t, 0, searchPos(sr, 0, 16, "hello", 0))
+	assert.EqualValues(t, 11, searchPos(sr, 0, 16, "hello", f))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 11, "hello", f))
+	assert.EqualValues(t, -1, searchPos(sr, 0, 16, "world", f))
+	assert.EqualValues(t, 0, searchPos(sr, 11, 5, "hello", f))
+}
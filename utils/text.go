@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// TextSampleSize is how much of the target DetectText looks at
+const TextSampleSize = 64 * 1024
+
+// TextEncoding is the character encoding of a target that looks like text
+type TextEncoding int
+
+const (
+	// EncodingNone is for targets that don't look like text
+	EncodingNone TextEncoding = iota
+	// EncodingASCII is for printable 7-bit ASCII
+	EncodingASCII
+	// EncodingUTF8 is for valid UTF-8 with at least one non-ASCII character
+	EncodingUTF8
+	// EncodingUTF16LE is for little-endian UTF-16, which requires a BOM
+	EncodingUTF16LE
+	// EncodingUTF16BE is for big-endian UTF-16, which requires a BOM
+	EncodingUTF16BE
+	// EncodingISO8859 is for 8-bit text that isn't valid UTF-8
+	EncodingISO8859
+)
+
+func (enc TextEncoding) String() string {
+	switch enc {
+	case EncodingASCII:
+		return "ASCII"
+	case EncodingUTF8:
+		return "UTF-8 Unicode"
+	case EncodingUTF16LE, EncodingUTF16BE:
+		return "UTF-16 Unicode"
+	case EncodingISO8859:
+		return "ISO-8859"
+	}
+	return "data"
+}
+
+// LineTerminators is a set of the kinds of line terminators found in text
+type LineTerminators int
+
+const (
+	// LineTerminatorCRLF is "\r\n"
+	LineTerminatorCRLF LineTerminators = 1 << iota
+	// LineTerminatorCR is a "\r" not followed by "\n"
+	LineTerminatorCR
+	// LineTerminatorLF is a "\n" not preceded by "\r"
+	LineTerminatorLF
+	// LineTerminatorNEL is U+0085, the EBCDIC/ISO-8859 "next line"
+	LineTerminatorNEL
+)
+
+var lineTerminatorNames = []struct {
+	terminator LineTerminators
+	name       string
+}{
+	{LineTerminatorCRLF, "CRLF"},
+	{LineTerminatorCR, "CR"},
+	{LineTerminatorLF, "LF"},
+	{LineTerminatorNEL, "NEL"},
+}
+
+// TextInfo is what DetectText found out about a target
+type TextInfo struct {
+	Encoding        TextEncoding
+	BOM             bool
+	LineTerminators LineTerminators
+}
+
+// IsText returns true if the target looked like text in any encoding
+func (ti TextInfo) IsText() bool {
+	return ti.Encoding != EncodingNone
+}
+
+// String describes the text like file(1) does, e.g. "UTF-8 Unicode text,
+// with CRLF line terminators", or returns "data" if it's not text
+func (ti TextInfo) String() string {
+	if !ti.IsText() {
+		return "data"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(ti.Encoding.String())
+	if ti.BOM && ti.Encoding == EncodingUTF8 {
+		sb.WriteString(" (with BOM)")
+	}
+	sb.WriteString(" text")
+
+	switch ti.Encoding {
+	case EncodingUTF16LE:
+		sb.WriteString(", little-endian")
+	case EncodingUTF16BE:
+		sb.WriteString(", big-endian")
+	}
+
+	lt := ti.LineTerminators
+	switch {
+	case lt == 0:
+		sb.WriteString(", with no line terminators")
+	case lt == LineTerminatorLF:
+		// unix line endings are not worth mentioning
+	default:
+		sb.WriteString(", with")
+		first := true
+		for _, ltn := range lineTerminatorNames {
+			if lt&ltn.terminator == 0 {
+				continue
+			}
+			if !first {
+				sb.WriteString(",")
+			}
+			sb.WriteString(" ")
+			sb.WriteString(ltn.name)
+			first = false
+		}
+		sb.WriteString(" line terminators")
+	}
+
+	return sb.String()
+}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// DetectText looks at the start of the target to find out whether it's
+// text, in which encoding, and which line terminators it uses. Like
+// file(1), UTF-16 is only recognized with a BOM, and an 8-bit target
+// that isn't valid UTF-8 is ISO-8859 if it has no C1 control characters.
+func DetectText(sr *SliceReader) TextInfo {
+	sampleSize := sr.Size()
+	if sampleSize > TextSampleSize {
+		sampleSize = TextSampleSize
+	}
+	if sampleSize <= 0 {
+		return TextInfo{}
+	}
+
+	sample := make([]byte, sampleSize)
+	n, err := sr.ReadAt(sample, 0)
+	if n < len(sample) && err != nil && err != io.EOF {
+		return TextInfo{}
+	}
+	sample = sample[:n]
+	// the end of the sample may cut a character in half
+	truncated := int64(n) < sr.Size()
+
+	ti := TextInfo{}
+	var text []rune
+	var ok bool
+
+	switch {
+	case hasPrefix(sample, bomUTF16LE):
+		ti.Encoding, ti.BOM = EncodingUTF16LE, true
+		text, ok = decodeUTF16(sample[2:], false)
+	case hasPrefix(sample, bomUTF16BE):
+		ti.Encoding, ti.BOM = EncodingUTF16BE, true
+		text, ok = decodeUTF16(sample[2:], true)
+	case hasPrefix(sample, bomUTF8):
+		ti.Encoding, ti.BOM = EncodingUTF8, true
+		text, ok = decodeUTF8(sample[3:], truncated)
+	default:
+		if text, ok = decodeASCII(sample); ok {
+			ti.Encoding = EncodingASCII
+		} else if text, ok = decodeUTF8(sample, truncated); ok {
+			ti.Encoding = EncodingUTF8
+		} else if text, ok = decodeLatin1(sample); ok {
+			ti.Encoding = EncodingISO8859
+		}
+	}
+
+	if !ok {
+		return TextInfo{}
+	}
+
+	ti.LineTerminators = findLineTerminators(text)
+	return ti
+}
+
+func hasPrefix(sample []byte, prefix []byte) bool {
+	return len(sample) >= len(prefix) && string(sample[:len(prefix)]) == string(prefix)
+}
+
+// isTextByte tells whether b may appear in plain text, the same set of
+// characters file(1) accepts: printable ASCII, and the usual control
+// characters (bell, backspace, tab, newlines, form feed, escape)
+func isTextByte(b byte) bool {
+	return (b >= 0x20 && b < 0x7f) || (b >= 0x07 && b <= 0x0d) || b == 0x1b
+}
+
+// isTextRune extends isTextByte to decoded characters: anything past ASCII
+// is fine, except C1 control characters other than NEL
+func isTextRune(r rune) bool {
+	if r < 0x80 {
+		return isTextByte(byte(r))
+	}
+	if r < 0xa0 {
+		return r == 0x85
+	}
+	return true
+}
+
+func decodeASCII(sample []byte) ([]rune, bool) {
+	text := make([]rune, 0, len(sample))
+	for _, b := range sample {
+		if !isTextByte(b) {
+			return nil, false
+		}
+		text = append(text, rune(b))
+	}
+	return text, true
+}
+
+func decodeUTF8(sample []byte, truncated bool) ([]rune, bool) {
+	text := make([]rune, 0, len(sample))
+	for i := 0; i < len(sample); {
+		r, size := utf8.DecodeRune(sample[i:])
+		if r == utf8.RuneError && size <= 1 {
+			if truncated && !utf8.FullRune(sample[i:]) {
+				break
+			}
+			return nil, false
+		}
+		if !isTextRune(r) {
+			return nil, false
+		}
+		text = append(text, r)
+		i += size
+	}
+	return text, true
+}
+
+func decodeUTF16(sample []byte, bigEndian bool) ([]rune, bool) {
+	units := make([]uint16, 0, len(sample)/2)
+	for i := 0; i+1 < len(sample); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(sample[i])<<8|uint16(sample[i+1]))
+		} else {
+			units = append(units, uint16(sample[i+1])<<8|uint16(sample[i]))
+		}
+	}
+
+	text := utf16.Decode(units)
+	for _, r := range text {
+		if !isTextRune(r) {
+			return nil, false
+		}
+	}
+	return text, true
+}
+
+func decodeLatin1(sample []byte) ([]rune, bool) {
+	text := make([]rune, 0, len(sample))
+	for _, b := range sample {
+		r := rune(b)
+		if !isTextRune(r) {
+			return nil, false
+		}
+		text = append(text, r)
+	}
+	return text, true
+}
+
+func findLineTerminators(text []rune) LineTerminators {
+	var lt LineTerminators
+	for i, r := range text {
+		switch r {
+		case '\r':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				lt |= LineTerminatorCRLF
+			} else {
+				lt |= LineTerminatorCR
+			}
+		case '\n':
+			if i == 0 || text[i-1] != '\r' {
+				lt |= LineTerminatorLF
+			}
+		case 0x85:
+			lt |= LineTerminatorNEL
+		}
+	}
+	return lt
+}
+
+// LooksLikeText tells whether the start of the target is text in any of
+// the encodings DetectText knows about, for ForceText and ForceBinary
+// tests. Empty targets aren't text.
+func LooksLikeText(sr *SliceReader) bool {
+	return DetectText(sr).IsText()
+}
+
+// TextHint returns TextTarget if the target looks like text, BinaryTarget
+// otherwise, see LooksLikeText. It's only worked out once, the target
+// mustn't change afterwards.
+func (sr *SliceReader) TextHint() StringTestFlags {
+	hint := atomic.LoadInt32(&sr.textHint)
+	if hint == 0 {
+		hint = BinaryTarget
+		if LooksLikeText(sr) {
+			hint = TextTarget
+		}
+		atomic.StoreInt32(&sr.textHint, hint)
+	}
+	return StringTestFlags(hint)
+}
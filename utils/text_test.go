@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testdata/text/expected.txt lists what file(1) says about each sample
+func Test_DetectTextGolden(t *testing.T) {
+	dir := filepath.Join("testdata", "text")
+
+	f, err := os.Open(filepath.Join(dir, "expected.txt"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	numSamples := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tokens := strings.SplitN(scanner.Text(), ": ", 2)
+		assert.Len(t, tokens, 2)
+		name, expected := tokens[0], tokens[1]
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, expected, DetectText(newBytesReader(data)).String(), "for %s", name)
+		numSamples++
+	}
+	assert.NoError(t, scanner.Err())
+	assert.True(t, numSamples > 0)
+}
+
+func Test_DetectText(t *testing.T) {
+	ti := DetectText(newBytesReader([]byte("\xff\xfeh\x00i\x00\n\x00")))
+	assert.EqualValues(t, TextInfo{
+		Encoding:        EncodingUTF16LE,
+		BOM:             true,
+		LineTerminators: LineTerminatorLF,
+	}, ti)
+
+	// UTF-16 needs a BOM
+	assert.False(t, DetectText(newBytesReader([]byte("h\x00i\x00\n\x00"))).IsText())
+
+	// a character cut in half by the end of the sample is fine...
+	target := []byte(strings.Repeat("a", TextSampleSize-1) + "\xc3\xa9")
+	assert.EqualValues(t, EncodingUTF8, DetectText(newBytesReader(target)).Encoding)
+
+	// ...but not at the end of the target
+	assert.EqualValues(t, EncodingISO8859, DetectText(newBytesReader([]byte("caf\xc3"))).Encoding)
+
+	assert.False(t, DetectText(newBytesReader(nil)).IsText())
+}
+
+func Test_LooksLikeText(t *testing.T) {
+	assert.True(t, LooksLikeText(newBytesReader([]byte("#!/bin/sh\necho \x1b[1mhi\x1b[0m\n"))))
+	assert.True(t, LooksLikeText(newBytesReader([]byte("caf\xc3\xa9\n"))))
+	assert.False(t, LooksLikeText(newBytesReader([]byte("caf\x00\n"))))
+	assert.False(t, LooksLikeText(newBytesReader([]byte{})))
+
+	// the same as the fallback goes by
+	assert.True(t, LooksLikeText(newBytesReader([]byte("caf\xe9\n"))))
+	assert.True(t, LooksLikeText(newBytesReader([]byte("\xff\xfeh\x00i\x00\n\x00"))))
+	assert.False(t, LooksLikeText(newBytesReader([]byte("caf\xc2\x80\n"))))
+
+	// only the start of the target is looked at
+	target := make([]byte, TextSampleSize+1)
+	for i := range target {
+		target[i] = 'a'
+	}
+	target[TextSampleSize] = 0
+	assert.True(t, LooksLikeText(newBytesReader(target)))
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"regexp"
 	"strings"
 )
 
@@ -35,6 +34,11 @@ func IsUpperLetter(b byte) bool {
 	return 'A' <= b && b <= 'Z'
 }
 
+// IsAlphanumeric tests if a byte is in [0-9A-Za-z]
+func IsAlphanumeric(b byte) bool {
+	return IsNumber(b) || IsLowerLetter(b) || IsUpperLetter(b)
+}
+
 // ToLower transliterates from [A-Z] to [a-z], other bytes are unchanged
 func ToLower(b byte) byte {
 	if IsUpperLetter(b) {
@@ -51,14 +55,156 @@ func ToUpper(b byte) byte {
 	return b
 }
 
+// DescriptionJoin starts the description fragments that follow the previous
+// one without a space, as written in magic
+const DescriptionJoin = `\b`
+
 // MergeStrings concatenates a set of strings return by Identify into
-// a string that file(1) would print. For example, it handles \b.
+// a string that file(1) would print. Fragments are separated by a space,
+// except those starting with \b, as written in magic or decoded into a
+// backspace, which follow the previous one directly. Any number of them
+// counts as one, and they're dropped from the first fragment. Empty
+// fragments add nothing.
 func MergeStrings(outStrings []string) string {
-	outString := strings.Join(outStrings, " ")
+	return MergeStringsOpts(outStrings, MergeOptions{})
+}
 
-	re := regexp.MustCompile(`.\\b`)
-	outString = re.ReplaceAllString(outString, "")
-	outString = strings.TrimSpace(outString)
+// MergeOptions say how MergeStringsOpts joins fragments, the zero value
+// joins them like file(1) does
+type MergeOptions struct {
+	// Separator goes between fragments, except before those starting with
+	// \b. It's a space if empty.
+	Separator string
+
+	// TrimSpace trims the whitespace around every fragment, once \b is
+	// removed, and drops the fragments left empty. Fragments starting with
+	// \b and a space then follow the previous one directly.
+	TrimSpace bool
+
+	// Dedupe drops fragments that are the same as the one kept before them,
+	// once \b is removed
+	Dedupe bool
+}
 
-	return outString
+// MergeStringsOpts is MergeStrings, joining fragments as opts say. Whatever
+// they say, the result has no whitespace around it.
+func MergeStringsOpts(fragments []string, opts MergeOptions) string {
+	separator := opts.Separator
+	if separator == "" {
+		separator = " "
+	}
+
+	var sb strings.Builder
+	previous, kept := "", false
+	for _, s := range fragments {
+		s, join := trimJoin(s)
+		if opts.TrimSpace {
+			s = strings.TrimSpace(s)
+		}
+		// like in file(1), empty fragments don't get a separator
+		if s == "" {
+			continue
+		}
+		if opts.Dedupe && kept && s == previous {
+			continue
+		}
+		previous, kept = s, true
+
+		if !join && sb.Len() > 0 {
+			sb.WriteString(separator)
+		}
+		sb.WriteString(s)
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// trimJoin removes the \b starting s, and tells whether there were any
+func trimJoin(s string) (string, bool) {
+	join := false
+	for {
+		switch {
+		case strings.HasPrefix(s, DescriptionJoin):
+			s = s[len(DescriptionJoin):]
+		case strings.HasPrefix(s, "\b"):
+			s = s[1:]
+		default:
+			return s, join
+		}
+		join = true
+	}
+}
+
+// DecodeDescription decodes the escapes in a description read from magic.
+// A leading \b is removed, join tells whether there was one. Other escapes
+// (\\, \n, \t and the like, octal and \x hex) become the bytes they stand
+// for, unknown ones are kept as written.
+func DecodeDescription(desc string) (text string, join bool) {
+	if strings.HasPrefix(desc, DescriptionJoin) {
+		desc = desc[len(DescriptionJoin):]
+		join = true
+	}
+	if strings.IndexByte(desc, '\\') < 0 {
+		return desc, join
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(desc); i++ {
+		if desc[i] != '\\' || i+1 == len(desc) {
+			sb.WriteByte(desc[i])
+			continue
+		}
+
+		i++
+		switch ch := desc[i]; {
+		case ch == '\\':
+			sb.WriteByte('\\')
+		case ch == 'n':
+			sb.WriteByte('\n')
+		case ch == 't':
+			sb.WriteByte('\t')
+		case ch == 'r':
+			sb.WriteByte('\r')
+		case ch == 'a':
+			sb.WriteByte('\a')
+		case ch == 'v':
+			sb.WriteByte('\v')
+		case ch == 'f':
+			sb.WriteByte('\f')
+		case IsOctalNumber(ch):
+			// up to three digits
+			value := 0
+			j := i
+			for ; j < len(desc) && j < i+3 && IsOctalNumber(desc[j]); j++ {
+				value = value*8 + int(desc[j]-'0')
+			}
+			sb.WriteByte(byte(value))
+			i = j - 1
+		case ch == 'x' && i+1 < len(desc) && IsHexNumber(desc[i+1]):
+			// up to two digits
+			value := 0
+			j := i + 1
+			for ; j < len(desc) && j < i+3 && IsHexNumber(desc[j]); j++ {
+				value = value*16 + hexValue(desc[j])
+			}
+			sb.WriteByte(byte(value))
+			i = j - 1
+		default:
+			sb.WriteByte('\\')
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String(), join
+}
+
+// hexValue returns the value of a hex digit
+func hexValue(b byte) int {
+	switch {
+	case IsNumber(b):
+		return int(b - '0')
+	case 'a' <= b && b <= 'f':
+		return int(b-'a') + 10
+	default:
+		return int(b-'A') + 10
+	}
 }